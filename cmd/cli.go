@@ -0,0 +1,328 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"text/tabwriter"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/adapters"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/crypto"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/ports"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/config"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/database"
+)
+
+const usage = `usage: gocrypto <command> [arguments]
+
+commands:
+  serve                          runs the HTTP API, the default command
+  migrate up                     applies the pending schema migrations
+  migrate down [-to version]     rolls back the migrations newer than the version
+  migrate status                 lists the migrations and when they were applied
+  keys create -scope s [-expiration e] [-use u] [-type t]
+                                 creates a key, the expiration is a RFC3339 date or a duration
+  keys list -scope s             lists the keys of a scope
+  keys get [-version v] keyID    shows a key
+  keys disable keyID             disables a key
+  encrypt -key id -scope s [-in file] [-out file] [-alg a] [-enc e] [-compress]
+                                 encrypts a local file into a compact JWE
+  decrypt -key id -scope s [-in file] [-out file]
+                                 decrypts a local compact JWE
+  rewrap                         re-encrypts the stored private keys with the active KEK
+`
+
+// errUsage the command line does not match any command
+var errUsage = errors.New(usage)
+
+// cli runs the admin commands against the configured database, reusing the
+// services the HTTP API is built on
+type cli struct {
+	ctx context.Context
+	cfg config.Config
+	db  *sql.DB
+	in  io.Reader
+	out io.Writer
+}
+
+// knownCommand checks the command before the database connection is opened
+func knownCommand(name string) bool {
+	switch name {
+	case "migrate", "keys", "encrypt", "decrypt", "rewrap":
+		return true
+	}
+	return false
+}
+
+func (c cli) run(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+
+	switch args[0] {
+	case "migrate":
+		return c.migrate(args[1:])
+	case "keys":
+		return c.keys(args[1:])
+	case "encrypt":
+		return c.encrypt(args[1:])
+	case "decrypt":
+		return c.decrypt(args[1:])
+	case "rewrap":
+		return c.rewrap()
+	}
+	return errUsage
+}
+
+// services the CLI generates keys on demand instead of warming up a pool
+func (c cli) services() services {
+	return bootstrapServices(c.cfg, c.db, &adapters.SynchronousKeySource{})
+}
+
+func (c cli) migrate(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	if c.db == nil {
+		return errors.New("migrate: the storage backend has no schema to migrate")
+	}
+
+	switch args[0] {
+	case "up":
+		return database.MigrateUp(c.db)
+	case "down":
+		fs := flag.NewFlagSet("migrate down", flag.ContinueOnError)
+		to := fs.Int("to", 0, "version to roll back to, 0 rolls back every migration")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		return database.MigrateDownTo(c.db, *to)
+	case "status":
+		status, err := database.MigrationsStatus(c.db)
+		if err != nil {
+			return err
+		}
+
+		w := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(w, "VERSION\tNAME\tAPPLIED AT")
+		for _, s := range status {
+			applied := "pending"
+			if s.Applied() {
+				applied = s.AppliedAt.UTC().Format(time.RFC3339)
+			}
+			fmt.Fprintf(w, "%06d\t%s\t%s\n", s.Version, s.Name, applied)
+		}
+		return w.Flush()
+	}
+	return errUsage
+}
+
+func (c cli) keys(args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	s := c.services()
+	defer s.close()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("keys create", flag.ContinueOnError)
+		scope := fs.String("scope", "", "scope of the key")
+		expiration := fs.String("expiration", "8760h", "RFC3339 expiration date or duration from now")
+		use := fs.String("use", string(keys.UseEncryption), "use of the key, enc or sig")
+		keyType := fs.String("type", string(keys.DefaultKeyType), "type of the key")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *scope == "" {
+			return errors.New("keys create: -scope is required")
+		}
+		exp, err := parseExpiration(*expiration)
+		if err != nil {
+			return err
+		}
+		if !keys.KeyType(*keyType).Valid() {
+			return fmt.Errorf("keys create: unknown key type %s", *keyType)
+		}
+
+		k, err := s.keys.CreateKey(c.ctx, *scope, exp, keys.Use(*use), keys.KeyType(*keyType), keys.Policy{})
+		if err != nil {
+			return err
+		}
+		return c.printJSON(ports.NewHTTPCreateKey(k))
+	case "list":
+		fs := flag.NewFlagSet("keys list", flag.ContinueOnError)
+		scope := fs.String("scope", "", "scope of the keys")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if *scope == "" {
+			return errors.New("keys list: -scope is required")
+		}
+
+		ks, err := s.keys.FindKeysByScope(c.ctx, *scope)
+		if err != nil {
+			return err
+		}
+		return c.printJSON(ports.NewHTTPFindKeys(ks))
+	case "get":
+		fs := flag.NewFlagSet("keys get", flag.ContinueOnError)
+		version := fs.Int("version", 0, "version of the key, the newest one by default")
+		if err := fs.Parse(args[1:]); err != nil {
+			return err
+		}
+		if fs.NArg() != 1 {
+			return errUsage
+		}
+
+		var k keys.Key
+		var err error
+		if *version == 0 {
+			k, err = s.keys.FindKey(c.ctx, fs.Arg(0))
+		} else {
+			k, err = s.keys.FindKeyVersion(c.ctx, fs.Arg(0), *version)
+		}
+		if err != nil {
+			return err
+		}
+		return c.printJSON(ports.NewHTTPCreateKey(k))
+	case "disable":
+		if len(args) != 2 {
+			return errUsage
+		}
+
+		k, err := s.keys.ChangeKeyState(c.ctx, args[1], keys.StateDisabled)
+		if err != nil {
+			return err
+		}
+		return c.printJSON(ports.NewHTTPCreateKey(k))
+	}
+	return errUsage
+}
+
+type fileOpts struct {
+	keyID string
+	scope string
+	in    string
+	out   string
+}
+
+func (o *fileOpts) register(fs *flag.FlagSet) {
+	fs.StringVar(&o.keyID, "key", "", "ID of the key")
+	fs.StringVar(&o.scope, "scope", "", "scope of the key")
+	fs.StringVar(&o.in, "in", "-", "file to read, - reads the standard input")
+	fs.StringVar(&o.out, "out", "-", "file to write, - writes to the standard output")
+}
+
+func (o fileOpts) validate(cmd string) error {
+	if o.keyID == "" || o.scope == "" {
+		return fmt.Errorf("%s: -key and -scope are required", cmd)
+	}
+	return nil
+}
+
+func (c cli) encrypt(args []string) error {
+	var o fileOpts
+	var algs crypto.Algorithms
+	fs := flag.NewFlagSet("encrypt", flag.ContinueOnError)
+	o.register(fs)
+	fs.StringVar(&algs.Key, "alg", "", "key management algorithm, the first one of the key policy by default")
+	fs.StringVar(&algs.Content, "enc", "", "content encryption algorithm, the first one of the key policy by default")
+	fs.BoolVar(&algs.Compress, "compress", false, "compresses the content before encrypting it")
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.validate("encrypt"); err != nil {
+		return err
+	}
+
+	content, err := c.readInput(o.in)
+	if err != nil {
+		return err
+	}
+
+	s := c.services()
+	defer s.close()
+	encrypted, err := s.crypto.Encrypt(c.ctx, o.keyID, o.scope, content, algs)
+	if err != nil {
+		return err
+	}
+	return c.writeOutput(o.out, encrypted)
+}
+
+func (c cli) decrypt(args []string) error {
+	var o fileOpts
+	fs := flag.NewFlagSet("decrypt", flag.ContinueOnError)
+	o.register(fs)
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+	if err := o.validate("decrypt"); err != nil {
+		return err
+	}
+
+	content, err := c.readInput(o.in)
+	if err != nil {
+		return err
+	}
+
+	s := c.services()
+	defer s.close()
+	decrypted, err := s.crypto.Decrypt(c.ctx, o.keyID, o.scope, string(bytes.TrimSpace(content)))
+	if err != nil {
+		return err
+	}
+	return c.writeOutput(o.out, decrypted)
+}
+
+func (c cli) rewrap() error {
+	s := c.services()
+	defer s.close()
+	n, err := s.repo.RewrapKeys(c.ctx)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(c.out, "rewrapped %d stored keys\n", n)
+	return nil
+}
+
+func (c cli) readInput(path string) ([]byte, error) {
+	if path == "-" {
+		return ioutil.ReadAll(c.in)
+	}
+	return ioutil.ReadFile(path)
+}
+
+func (c cli) writeOutput(path string, content []byte) error {
+	if path == "-" {
+		_, err := c.out.Write(content)
+		return err
+	}
+	return ioutil.WriteFile(path, content, 0600)
+}
+
+func (c cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.out)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+// parseExpiration accepts both a RFC3339 date and a duration from now
+func parseExpiration(s string) (time.Time, error) {
+	if d, err := time.ParseDuration(s); err == nil {
+		return time.Now().Add(d), nil
+	}
+	exp, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		return time.Time{}, errors.New("expiration must be a RFC3339 date or a duration")
+	}
+	return exp, nil
+}
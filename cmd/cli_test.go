@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/ports"
+)
+
+func runCLI(t *testing.T, in string, args ...string) string {
+	t.Helper()
+	var out bytes.Buffer
+	c := cli{ctx: context.Background(), cfg: testCfg, db: testDB, in: strings.NewReader(in), out: &out}
+
+	if err := c.run(args); err != nil {
+		t.Fatalf("%v: want no error, got %v", args, err)
+	}
+	return out.String()
+}
+
+func TestCLIKeys(t *testing.T) {
+	var created ports.HTTPCreateKey
+	json.Unmarshal([]byte(runCLI(t, "", "keys", "create", "-scope", "cli", "-expiration", "24h")), &created)
+	if created.KeyID == "" {
+		t.Fatalf("want a created key, got %v", created)
+	}
+
+	t.Run("lists the keys of the scope", func(t *testing.T) {
+		var listed []ports.HTTPListedKeys
+		json.Unmarshal([]byte(runCLI(t, "", "keys", "list", "-scope", "cli")), &listed)
+
+		found := false
+		for _, k := range listed {
+			found = found || k.KeyID == created.KeyID
+		}
+		if !found {
+			t.Errorf("want %s in %v", created.KeyID, listed)
+		}
+	})
+	t.Run("gets the key", func(t *testing.T) {
+		var got ports.HTTPCreateKey
+		json.Unmarshal([]byte(runCLI(t, "", "keys", "get", created.KeyID)), &got)
+
+		if got.KeyID != created.KeyID || got.PublicKey != created.PublicKey {
+			t.Errorf("want %v, got %v", created, got)
+		}
+	})
+	t.Run("encrypts and decrypts local files", func(t *testing.T) {
+		dir := t.TempDir()
+		plain := filepath.Join(dir, "plain.txt")
+		encrypted := filepath.Join(dir, "plain.jwe")
+		decrypted := filepath.Join(dir, "decrypted.txt")
+		ioutil.WriteFile(plain, []byte("local secret"), 0600)
+
+		runCLI(t, "", "encrypt", "-key", created.KeyID, "-scope", "cli", "-in", plain, "-out", encrypted)
+		runCLI(t, "", "decrypt", "-key", created.KeyID, "-scope", "cli", "-in", encrypted, "-out", decrypted)
+
+		got, _ := ioutil.ReadFile(decrypted)
+		if string(got) != "local secret" {
+			t.Errorf("want %q, got %q", "local secret", got)
+		}
+	})
+	t.Run("encrypts and decrypts the standard streams", func(t *testing.T) {
+		encrypted := runCLI(t, "streamed secret", "encrypt", "-key", created.KeyID, "-scope", "cli")
+
+		got := runCLI(t, encrypted+"\n", "decrypt", "-key", created.KeyID, "-scope", "cli")
+
+		if got != "streamed secret" {
+			t.Errorf("want %q, got %q", "streamed secret", got)
+		}
+	})
+	t.Run("disables the key", func(t *testing.T) {
+		var got ports.HTTPCreateKey
+		json.Unmarshal([]byte(runCLI(t, "", "keys", "disable", created.KeyID)), &got)
+
+		if got.State != "disabled" {
+			t.Errorf("want disabled, got %s", got.State)
+		}
+	})
+}
+
+func TestCLIStdout(t *testing.T) {
+	t.Run("writes nothing but the command output", func(t *testing.T) {
+		r, w, _ := os.Pipe()
+		stdout := os.Stdout
+		os.Stdout = w
+		err := execute([]string{"keys", "list", "-scope", "test"})
+		os.Stdout = stdout
+		w.Close()
+		out, _ := ioutil.ReadAll(r)
+
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		var listed []ports.HTTPListedKeys
+		if err := json.Unmarshal(out, &listed); err != nil {
+			t.Errorf("want only the listed keys on stdout, got %q", out)
+		}
+	})
+}
+
+func TestCLIMigrate(t *testing.T) {
+	t.Run("lists every migration as applied", func(t *testing.T) {
+		status := runCLI(t, "", "migrate", "status")
+
+		if strings.Contains(status, "pending") || !strings.Contains(status, "000001") {
+			t.Errorf("want every migration applied, got\n%s", status)
+		}
+	})
+	t.Run("refuses unknown commands", func(t *testing.T) {
+		c := cli{ctx: context.Background(), cfg: testCfg, db: testDB, out: ioutil.Discard}
+
+		if err := c.run([]string{"migrate", "sideways"}); err != errUsage {
+			t.Errorf("want the usage, got %v", err)
+		}
+	})
+}
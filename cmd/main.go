@@ -3,41 +3,114 @@ package main
 import (
 	"context"
 	"database/sql"
+	"encoding/base64"
+	"fmt"
+	"io"
 	"log"
 	"net/http"
+	"os"
 	"time"
 
 	server "github.com/cesarFuhr/gocrypto/internal/app"
 	"github.com/cesarFuhr/gocrypto/internal/app/adapters"
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/crypto"
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/signing"
 	"github.com/cesarFuhr/gocrypto/internal/app/ports"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 	"github.com/cesarFuhr/gocrypto/internal/pkg/config"
 	"github.com/cesarFuhr/gocrypto/internal/pkg/database"
 	"github.com/cesarFuhr/gocrypto/internal/pkg/exit"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/health"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/kek"
 	"github.com/cesarFuhr/gocrypto/internal/pkg/logger"
 )
 
 func main() {
-	run()
+	if err := execute(os.Args[1:]); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
 }
 
-func run() {
+func execute(args []string) error {
+	if len(args) > 0 && (args[0] == "help" || args[0] == "-h" || args[0] == "--help") {
+		fmt.Print(usage)
+		return nil
+	}
+
 	cfg, err := config.LoadConfigs()
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	db := bootstrapSQLDatabase(cfg)
-	database.MigrateUp(db)
+	if len(args) == 0 || args[0] == "serve" {
+		serve(cfg)
+		return nil
+	}
+	if !knownCommand(args[0]) {
+		return errUsage
+	}
+
+	var db *sql.DB
+	if cfg.App.Storage.Backend == backendPostgres {
+		db = bootstrapSQLDatabase(cfg)
+		defer db.Close()
+	}
 
-	httpServer := bootstrapHTTPServer(cfg, db)
+	c := cli{ctx: context.Background(), cfg: cfg, db: db, in: os.Stdin, out: os.Stdout}
+	return c.run(args)
+}
+
+// serve listens right away, so the orchestrator can probe the process, and
+// only reports ready once the migrations are applied and the key pool is
+// warm
+func serve(cfg config.Config) {
+	readiness := health.NewReadiness()
+	migrated := readiness.Await("migrations")
+	warmedUp := readiness.Await("keyPool")
+
+	var db *sql.DB
+	if cfg.App.Storage.Backend == backendPostgres {
+		db = bootstrapSQLDatabase(cfg)
+		log.Println("connected to the postgres database")
+		readiness.Probe("database", db.PingContext)
+	}
+
+	keySource := bootstrapKeySource(cfg)
+	s := bootstrapServices(cfg, db, bootstrapFallbackKeySource(cfg, keySource))
+	httpServer := bootstrapHTTPServer(cfg, s, readiness)
+	metricsServer := bootstrapMetricsServer(cfg)
+
+	go func() {
+		if db != nil {
+			if err := database.MigrateUp(db); err != nil {
+				log.Fatalf("could not apply the migrations: %v", err)
+			}
+		}
+		migrated()
+
+		if cfg.App.KEK.RewrapOnStart {
+			go rewrapKeys(s.repo)
+		}
+		go destroyPendingKeys(s.keys, cfg.App.Keys.DestructionInterval)
+	}()
+	warm := keySource.WarmUp()
+	go func() {
+		<-warm
+		warmedUp()
+	}()
 
 	e := make(chan struct{}, 1)
 	exit.ListenToExit(e)
 
-	go gracefullShutdown(e, httpServer)
+	go gracefullShutdown(e, httpServer, metricsServer, keySource, readiness, cfg.Server.DrainPeriod)
 
+	go func() {
+		if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+			log.Fatalf("could not listen on the metrics port %v", err)
+		}
+	}()
 	if err := httpServer.ListenAndServe(); err != http.ErrServerClosed {
 		log.Fatalf("could not listen on port 5000 %v", err)
 	}
@@ -59,34 +132,219 @@ func bootstrapSQLDatabase(cfg config.Config) *sql.DB {
 	return sqlDB
 }
 
-func bootstrapHTTPServer(cfg config.Config, sqlDB *sql.DB) *http.Server {
-	keySource := adapters.NewPoolKeySource(cfg.App.KeySource.RSAKeySize, cfg.App.KeySource.PoolSize)
-	keySource.WarmUp()
+func bootstrapKeyring(cfg config.Config) kek.Keyring {
+	keks := make(map[string][]byte, len(cfg.App.KEK.Keys))
+	for id, encoded := range cfg.App.KEK.Keys {
+		k, err := base64.StdEncoding.DecodeString(encoded)
+		if err != nil {
+			panic(err)
+		}
+		keks[id] = k
+	}
+
+	keyring, err := kek.NewKeyring(cfg.App.KEK.ActiveID, keks)
+	if err != nil {
+		panic(err)
+	}
+	return keyring
+}
+
+func bootstrapKeySource(cfg config.Config) *adapters.PoolKeySource {
+	return adapters.NewPoolKeySource(adapters.PoolOptions{
+		Size:         cfg.App.KeySource.PoolSize,
+		LowWatermark: cfg.App.KeySource.PoolLowWatermark,
+		Workers:      cfg.App.KeySource.PoolWorkers,
+	}, bootstrapPoolTypes(cfg))
+}
+
+// key source fallbacks selected through APP_KEYSOURCE_FALLBACK
+const (
+	fallbackSynchronous = "synchronous"
+	fallbackNone        = "none"
+)
+
+// bootstrapFallbackKeySource keys failing to be taken from the pool are
+// generated synchronously, unless the fallback is disabled
+func bootstrapFallbackKeySource(cfg config.Config, pool keys.KeySource) keys.KeySource {
+	switch cfg.App.KeySource.Fallback {
+	case fallbackSynchronous:
+		return adapters.NewFallbackKeySource(pool, &adapters.SynchronousKeySource{})
+	case fallbackNone:
+		return pool
+	default:
+		panic("unknown key source fallback: " + cfg.App.KeySource.Fallback)
+	}
+}
+
+func bootstrapPoolTypes(cfg config.Config) []keys.KeyType {
+	types := make([]keys.KeyType, 0, len(cfg.App.KeySource.PoolTypes))
+	for _, name := range cfg.App.KeySource.PoolTypes {
+		t := keys.KeyType(name)
+		if !t.Valid() {
+			panic("unknown key type in the key source pools: " + name)
+		}
+		types = append(types, t)
+	}
+	return types
+}
+
+// bootstrapAuthenticator the API is only left open to every caller when it
+// is explicitly asked for, a missing key file is a misconfiguration
+func bootstrapAuthenticator(cfg config.Config) server.Authenticator {
+	if cfg.App.Auth.KeyFile == "" {
+		if !cfg.App.Auth.Disabled {
+			panic("APP_AUTH_KEY_FILE is not set, set APP_AUTH_DISABLED=true to open the API to every caller")
+		}
+		log.Println("APP_AUTH_DISABLED is set, the API is open to every caller")
+		return auth.Disabled{}
+	}
+
+	a, err := auth.LoadKeyFile(cfg.App.Auth.KeyFile)
+	if err != nil {
+		panic(err)
+	}
+	return a
+}
+
+// storage backends selected through APP_STORAGE_BACKEND
+const (
+	backendPostgres = "postgres"
+	backendMemory   = "memory"
+	backendBolt     = "bolt"
+)
 
-	sqlKeyRepo := adapters.NewSQLKeyRepository(sqlDB)
+// keyRepository the key repositories also rewrap what they persist when the
+// active KEK changes
+type keyRepository interface {
+	keys.KeyRepository
+	RewrapKeys(context.Context) (int, error)
+}
 
-	keyService := keys.NewKeyService(&keySource, &sqlKeyRepo)
-	keyHandler := ports.NewKeyHandler(keyService)
+// bootstrapKeyRepository sqlDB is nil unless the backend is postgres
+func bootstrapKeyRepository(cfg config.Config, sqlDB *sql.DB) keyRepository {
+	switch cfg.App.Storage.Backend {
+	case backendPostgres:
+		repo := adapters.NewSQLKeyRepository(sqlDB, bootstrapKeyring(cfg))
+		return &repo
+	case backendMemory:
+		if cfg.App.Storage.SnapshotFile == "" {
+			log.Println("APP_STORAGE_SNAPSHOT_FILE is not set, the keys are lost when the process exits")
+			return adapters.NewInMemoryKeyRepository()
+		}
+		repo, err := adapters.NewSnapshotKeyRepository(cfg.App.Storage.SnapshotFile, bootstrapKeyring(cfg))
+		if err != nil {
+			panic(err)
+		}
+		return repo
+	case backendBolt:
+		repo, err := adapters.NewBoltKeyRepository(cfg.App.Storage.BoltFile, bootstrapKeyring(cfg))
+		if err != nil {
+			panic(err)
+		}
+		return repo
+	}
+	panic("unknown storage backend: " + cfg.App.Storage.Backend)
+}
+
+// services the domain services and the repository they share
+type services struct {
+	repo    keyRepository
+	keys    *keys.KeyService
+	crypto  *crypto.CryptoService
+	signing *signing.SigningService
+}
+
+// close releases the repository of the file backends
+func (s services) close() {
+	if c, ok := s.repo.(io.Closer); ok {
+		c.Close()
+	}
+}
 
-	cryptoService := crypto.NewCryptoService(&sqlKeyRepo)
-	encryptHandler := ports.NewEncryptHandler(&cryptoService)
-	decryptHandler := ports.NewDecryptHandler(&cryptoService)
+func bootstrapServices(cfg config.Config, sqlDB *sql.DB, keySource keys.KeySource) services {
+	repo := bootstrapKeyRepository(cfg, sqlDB)
+	keyService := keys.NewKeyService(keySource, repo, cfg.App.Keys.DeletionWaitingPeriod)
+	cryptoService := crypto.NewCryptoService(keyService, cfg.App.Crypto.DecryptGracePeriod)
+	signingService := signing.NewSigningService(keyService)
+
+	return services{
+		repo:    repo,
+		keys:    keyService,
+		crypto:  &cryptoService,
+		signing: &signingService,
+	}
+}
+
+func bootstrapHTTPServer(cfg config.Config, s services, readiness *health.Readiness) *http.Server {
+	healthHandler := ports.NewHealthHandler(readiness)
+	keyHandler := ports.NewKeyHandler(s.keys)
+	encryptHandler := ports.NewEncryptHandler(s.crypto)
+	decryptHandler := ports.NewDecryptHandler(s.crypto)
+	signHandler := ports.NewSignHandler(s.signing)
+	verifyHandler := ports.NewVerifyHandler(s.signing)
 
 	logger := logger.NewLogger()
 
-	s := server.NewHTTPServer(logger, &keyHandler, &encryptHandler, &decryptHandler)
-	s.Addr = ":" + cfg.Server.Port
+	srv := server.NewHTTPServer(logger, bootstrapAuthenticator(cfg), cfg.Server.RequestTimeout, cfg.Server.StreamTimeout, &healthHandler, &keyHandler, &encryptHandler, &decryptHandler, &signHandler, &verifyHandler)
+	srv.Addr = ":" + cfg.Server.Port
+
+	return srv
+}
+
+func bootstrapMetricsServer(cfg config.Config) *http.Server {
+	srv := server.NewMetricsServer()
+	srv.Addr = ":" + cfg.Server.MetricsPort
+
+	return srv
+}
+
+func rewrapKeys(r keyRepository) {
+	n, err := r.RewrapKeys(context.Background())
+	if err != nil {
+		log.Printf("could not rewrap the stored keys: %v", err)
+		return
+	}
+	log.Printf("rewrapped %d stored keys", n)
+}
+
+// destroyPendingKeys a zero, or negative, interval disables the destruction,
+// the keys pending deletion are then only destroyed by another replica
+func destroyPendingKeys(s *keys.KeyService, interval time.Duration) {
+	if interval <= 0 {
+		log.Println("APP_KEYS_DESTRUCTION_INTERVAL is not positive, the keys pending deletion are not destroyed")
+		return
+	}
+
+	t := time.NewTicker(interval)
+	defer t.Stop()
 
-	return s
+	for range t.C {
+		n, err := s.DestroyPendingKeys(context.Background())
+		if err != nil {
+			log.Printf("could not destroy the keys pending deletion: %v", err)
+			continue
+		}
+		if n > 0 {
+			log.Printf("destroyed %d keys pending deletion", n)
+		}
+	}
 }
 
-func gracefullShutdown(e chan struct{}, s *http.Server) {
+// gracefullShutdown reports the service as not ready first and waits for the
+// drain period, so the load balancers stop sending traffic before the server
+// stops taking it
+func gracefullShutdown(e chan struct{}, s *http.Server, metricsServer *http.Server, keySource io.Closer, readiness *health.Readiness, drain time.Duration) {
 	<-e
+	readiness.Drain()
+	time.Sleep(drain)
+
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 
 	if err := s.Shutdown(ctx); err != nil {
 		log.Fatalf("could not shutdown properly...")
 	}
+	metricsServer.Shutdown(ctx)
+	keySource.Close()
 
 	cancel()
 }
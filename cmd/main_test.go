@@ -11,12 +11,18 @@ import (
 	"time"
 
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 	"github.com/cesarFuhr/gocrypto/internal/pkg/config"
 	"github.com/cesarFuhr/gocrypto/internal/pkg/database"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/health"
 	"github.com/google/uuid"
 )
 
-var httpServer *http.Server
+var (
+	httpServer *http.Server
+	testCfg    config.Config
+	testDB     *sql.DB
+)
 
 func TestMain(m *testing.M) {
 	os.Exit(deferable(m))
@@ -38,8 +44,9 @@ func deferable(m *testing.M) int {
 	}
 
 	setupDB(testdb)
+	testCfg, testDB = cfg, testdb
 
-	httpServer = bootstrapHTTPServer(cfg, testdb)
+	httpServer = bootstrapHTTPServer(cfg, bootstrapServices(cfg, testdb, bootstrapFallbackKeySource(cfg, bootstrapKeySource(cfg))), health.NewReadiness())
 
 	return m.Run()
 }
@@ -63,10 +70,51 @@ func setupDB(db *sql.DB) {
 		k.Scope,
 		k.Expiration,
 		time.Now(),
-		x509.MarshalPKCS1PrivateKey(k.Priv),
-		x509.MarshalPKCS1PublicKey(k.Pub),
+		x509.MarshalPKCS1PrivateKey(rsaKey),
+		x509.MarshalPKCS1PublicKey(&rsaKey.PublicKey),
 	)
 	if err != nil {
 		panic(err)
 	}
 }
+
+func TestBootstrapAuthenticator(t *testing.T) {
+	t.Run("refuses to start without a key file", func(t *testing.T) {
+		var cfg config.Config
+		defer func() {
+			if recover() == nil {
+				t.Errorf("want a panic without a key file")
+			}
+		}()
+
+		bootstrapAuthenticator(cfg)
+	})
+	t.Run("opens the API when authentication is disabled", func(t *testing.T) {
+		var cfg config.Config
+		cfg.App.Auth.Disabled = true
+
+		a := bootstrapAuthenticator(cfg)
+
+		if _, ok := a.(auth.Disabled); !ok {
+			t.Errorf("want auth.Disabled, got %T", a)
+		}
+	})
+}
+
+func TestDestroyPendingKeys(t *testing.T) {
+	t.Run("is disabled by a non positive interval", func(t *testing.T) {
+		for _, interval := range []time.Duration{0, -time.Second} {
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				destroyPendingKeys(nil, interval)
+			}()
+
+			select {
+			case <-done:
+			case <-time.After(time.Second):
+				t.Errorf("%v: want the destruction to be disabled", interval)
+			}
+		}
+	})
+}
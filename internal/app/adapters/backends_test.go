@@ -0,0 +1,72 @@
+package adapters
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys/keystest"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/config"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/database"
+)
+
+func TestInMemoryConformance(t *testing.T) {
+	keystest.RunConformance(t, func(t *testing.T) keys.KeyRepository {
+		return NewInMemoryKeyRepository()
+	})
+}
+
+func TestSnapshotConformance(t *testing.T) {
+	keystest.RunConformance(t, func(t *testing.T) keys.KeyRepository {
+		repo, err := NewSnapshotKeyRepository(filepath.Join(t.TempDir(), "keys.snapshot"), keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return repo
+	})
+}
+
+func TestBoltConformance(t *testing.T) {
+	keystest.RunConformance(t, func(t *testing.T) keys.KeyRepository {
+		repo, err := NewBoltKeyRepository(filepath.Join(t.TempDir(), "keys.db"), keyring)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { repo.Close() })
+		return repo
+	})
+}
+
+// TestSQLConformance runs against the postgres configured through the DB_*
+// variables, as the integration tests do, and is skipped without one. The
+// keys table is migrated and emptied, never point it to a live database
+func TestSQLConformance(t *testing.T) {
+	cfg, err := config.LoadConfigs()
+	if err != nil || cfg.Db.Driver == "" {
+		t.Skip("no postgres configured")
+	}
+	db, err := database.NewPGDatabase(database.PGConfigs{
+		Host:         cfg.Db.Host,
+		Port:         cfg.Db.Port,
+		User:         cfg.Db.User,
+		Password:     cfg.Db.Password,
+		Dbname:       cfg.Db.Dbname,
+		Driver:       cfg.Db.Driver,
+		MaxOpenConns: cfg.Db.MaxOpenConns,
+	})
+	if err != nil {
+		t.Skipf("postgres is not available: %v", err)
+	}
+	defer db.Close()
+	if err := database.MigrateUp(db); err != nil {
+		t.Fatal(err)
+	}
+
+	keystest.RunConformance(t, func(t *testing.T) keys.KeyRepository {
+		if _, err := db.Exec("DELETE FROM keys"); err != nil {
+			t.Fatal(err)
+		}
+		repo := NewSQLKeyRepository(db, keyring)
+		return &repo
+	})
+}
@@ -0,0 +1,370 @@
+package adapters
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	// keysBucket holds a bucket per key ID, its versions keyed big endian so
+	// the cursor walks them in ascending order
+	keysBucket = []byte("keys")
+	// scopesBucket holds a bucket per scope listing the IDs of its keys
+	scopesBucket = []byte("scopes")
+)
+
+// NewBoltKeyRepository opens, creating it if needed, the embedded database
+// file, private keys are wrapped by the keyWrapper before being persisted
+func NewBoltKeyRepository(path string, w keyWrapper) (*BoltKeyRepository, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, b := range [][]byte{keysBucket, scopesBucket} {
+			if _, err := tx.CreateBucketIfNotExists(b); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltKeyRepository{db: db, wrapper: w}, nil
+}
+
+// BoltKeyRepository embedded on disk persistency for single node deployments
+type BoltKeyRepository struct {
+	db      *bolt.DB
+	wrapper keyWrapper
+}
+
+// Close releases the database file
+func (r *BoltKeyRepository) Close() error {
+	return r.db.Close()
+}
+
+// FindKey finds and returns the newest version of the requested key
+func (r *BoltKeyRepository) FindKey(ctx context.Context, id string) (keys.Key, error) {
+	var k keys.Key
+	err := r.db.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(keysBucket).Bucket([]byte(id))
+		if versions == nil {
+			return keys.ErrKeyNotFound
+		}
+
+		_, v := versions.Cursor().Last()
+		if v == nil {
+			return keys.ErrKeyNotFound
+		}
+
+		var err error
+		k, err = r.decodeKey(v)
+		return err
+	})
+	return k, err
+}
+
+// FindKeyVersion finds and returns a specific version of the requested key
+func (r *BoltKeyRepository) FindKeyVersion(ctx context.Context, id string, version int) (keys.Key, error) {
+	var k keys.Key
+	err := r.db.View(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(keysBucket).Bucket([]byte(id))
+		if versions == nil {
+			return keys.ErrKeyNotFound
+		}
+
+		v := versions.Get(versionKey(version))
+		if v == nil {
+			return keys.ErrKeyNotFound
+		}
+
+		var err error
+		k, err = r.decodeKey(v)
+		return err
+	})
+	return k, err
+}
+
+// FindKeysByScope finds and returns the newest version of every key in the scope
+func (r *BoltKeyRepository) FindKeysByScope(ctx context.Context, scope string) ([]keys.Key, error) {
+	var ks []keys.Key
+	err := r.db.View(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(scopesBucket).Bucket([]byte(scope))
+		if ids == nil {
+			return nil
+		}
+
+		all := tx.Bucket(keysBucket)
+		return ids.ForEach(func(id, _ []byte) error {
+			versions := all.Bucket(id)
+			if versions == nil {
+				return nil
+			}
+
+			_, v := versions.Cursor().Last()
+			k, err := r.decodeKey(v)
+			if err != nil {
+				return err
+			}
+			if k.Scope == scope {
+				ks = append(ks, k)
+			}
+			return nil
+		})
+	})
+	return ks, err
+}
+
+// FindPublicKeysByScope finds the published versions of the keys in the
+// scope, the private keys are not even unwrapped
+func (r *BoltKeyRepository) FindPublicKeysByScope(ctx context.Context, scope string, at time.Time) ([]keys.Key, error) {
+	var ks []keys.Key
+	err := r.db.View(func(tx *bolt.Tx) error {
+		ids := tx.Bucket(scopesBucket).Bucket([]byte(scope))
+		if ids == nil {
+			return nil
+		}
+
+		all := tx.Bucket(keysBucket)
+		return ids.ForEach(func(id, _ []byte) error {
+			versions := all.Bucket(id)
+			if versions == nil {
+				return nil
+			}
+
+			var vs []keys.Key
+			err := versions.ForEach(func(_, v []byte) error {
+				k, err := decodePublicKey(v)
+				if err != nil {
+					return err
+				}
+				vs = append(vs, k)
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if len(vs) > 0 && vs[0].Scope == scope {
+				ks = append(ks, keys.PublishedVersions(vs, at)...)
+			}
+			return nil
+		})
+	})
+	return ks, err
+}
+
+// FindKeysPage finds and returns a page of the newest version of the keys
+// in the scope matching the query
+func (r *BoltKeyRepository) FindKeysPage(ctx context.Context, q keys.KeyQuery) (keys.KeyPage, error) {
+	ks, err := r.FindKeysByScope(ctx, q.Scope)
+	if err != nil {
+		return keys.KeyPage{}, err
+	}
+	return keys.PageOf(ks, q), nil
+}
+
+// InsertKey Inserts a key into the repository
+func (r *BoltKeyRepository) InsertKey(ctx context.Context, k keys.Key) error {
+	v, err := r.encodeKey(k)
+	if err != nil {
+		return err
+	}
+
+	return r.db.Update(func(tx *bolt.Tx) error {
+		versions, err := tx.Bucket(keysBucket).CreateBucketIfNotExists([]byte(k.ID))
+		if err != nil {
+			return err
+		}
+		if versions.Get(versionKey(k.Version)) != nil {
+			return keys.ErrKeyVersionExists
+		}
+		if err := versions.Put(versionKey(k.Version), v); err != nil {
+			return err
+		}
+
+		ids, err := tx.Bucket(scopesBucket).CreateBucketIfNotExists([]byte(k.Scope))
+		if err != nil {
+			return err
+		}
+		return ids.Put([]byte(k.ID), nil)
+	})
+}
+
+// UpdateKeyState moves the versions of the key in the from state to the
+// to state
+func (r *BoltKeyRepository) UpdateKeyState(ctx context.Context, id string, from keys.State, to keys.State, deletionDate time.Time) error {
+	return r.db.Update(func(tx *bolt.Tx) error {
+		versions := tx.Bucket(keysBucket).Bucket([]byte(id))
+		if versions == nil {
+			return keys.ErrKeyNotFound
+		}
+
+		moved := 0
+		err := updateStoredKeys(versions, func(sk *storedKey) (bool, error) {
+			if sk.State != from {
+				return false, nil
+			}
+			sk.State = to
+			sk.DeletionDate = deletionDate
+			moved++
+			return true, nil
+		})
+		if err != nil {
+			return err
+		}
+		if moved == 0 {
+			return keys.ErrInvalidStateTransition
+		}
+		return nil
+	})
+}
+
+// DestroyKeys wipes the private key of every key pending deletion whose
+// deletion date is not after the given instant
+func (r *BoltKeyRepository) DestroyKeys(ctx context.Context, before time.Time) (int, error) {
+	n := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		n = 0
+		all := tx.Bucket(keysBucket)
+		return all.ForEach(func(id, _ []byte) error {
+			return updateStoredKeys(all.Bucket(id), func(sk *storedKey) (bool, error) {
+				if sk.State != keys.StatePendingDeletion || sk.DeletionDate.After(before) {
+					return false, nil
+				}
+				sk.State = keys.StateDestroyed
+				sk.KEKID = ""
+				sk.Priv = nil
+				n++
+				return true, nil
+			})
+		})
+	})
+	return n, err
+}
+
+// RewrapKeys re-encrypts with the active KEK every private key wrapped by
+// another one, returns how many keys were rewrapped
+func (r *BoltKeyRepository) RewrapKeys(ctx context.Context) (int, error) {
+	n := 0
+	err := r.db.Update(func(tx *bolt.Tx) error {
+		n = 0
+		all := tx.Bucket(keysBucket)
+		return all.ForEach(func(id, _ []byte) error {
+			return updateStoredKeys(all.Bucket(id), func(sk *storedKey) (bool, error) {
+				if sk.Priv == nil || sk.KEKID == r.wrapper.ActiveID() {
+					return false, nil
+				}
+
+				plain, err := r.unwrap(*sk)
+				if err != nil {
+					return false, err
+				}
+				sk.KEKID, sk.Priv, err = r.wrapper.Wrap(plain, []byte(sk.ID))
+				if err != nil {
+					return false, err
+				}
+				n++
+				return true, nil
+			})
+		})
+	})
+	return n, err
+}
+
+// updateStoredKeys rewrites every version the update function changed
+func updateStoredKeys(versions *bolt.Bucket, update func(*storedKey) (bool, error)) error {
+	type change struct {
+		k []byte
+		v []byte
+	}
+	var changes []change
+
+	err := versions.ForEach(func(k, v []byte) error {
+		var sk storedKey
+		if err := json.Unmarshal(v, &sk); err != nil {
+			return err
+		}
+		changed, err := update(&sk)
+		if err != nil || !changed {
+			return err
+		}
+
+		updated, err := json.Marshal(sk)
+		if err != nil {
+			return err
+		}
+		changes = append(changes, change{k: append([]byte(nil), k...), v: updated})
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// buckets can not be modified while iterating over them
+	for _, c := range changes {
+		if err := versions.Put(c.k, c.v); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *BoltKeyRepository) encodeKey(k keys.Key) ([]byte, error) {
+	sk, err := toStoredKey(k)
+	if err != nil {
+		return nil, err
+	}
+	if sk.Priv != nil {
+		sk.KEKID, sk.Priv, err = r.wrapper.Wrap(sk.Priv, []byte(k.ID))
+		if err != nil {
+			return nil, err
+		}
+	}
+	return json.Marshal(sk)
+}
+
+func (r *BoltKeyRepository) decodeKey(v []byte) (keys.Key, error) {
+	var sk storedKey
+	if err := json.Unmarshal(v, &sk); err != nil {
+		return keys.Key{}, err
+	}
+
+	if sk.Priv != nil {
+		plain, err := r.unwrap(sk)
+		if err != nil {
+			return keys.Key{}, err
+		}
+		sk.Priv = plain
+	}
+	return fromStoredKey(sk)
+}
+
+// decodePublicKey decodes a stored key leaving its private key out
+func decodePublicKey(v []byte) (keys.Key, error) {
+	var sk storedKey
+	if err := json.Unmarshal(v, &sk); err != nil {
+		return keys.Key{}, err
+	}
+	sk.Priv = nil
+	return fromStoredKey(sk)
+}
+
+func (r *BoltKeyRepository) unwrap(sk storedKey) ([]byte, error) {
+	return r.wrapper.Unwrap(sk.KEKID, sk.Priv, []byte(sk.ID))
+}
+
+func versionKey(version int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(version))
+	return b
+}
@@ -0,0 +1,62 @@
+package adapters
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/cesarFuhr/gocrypto/internal/pkg/kek"
+)
+
+func TestBoltKeyRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.db")
+
+	t.Run("keeps the keys once the database is reopened", func(t *testing.T) {
+		repo, err := NewBoltKeyRepository(path, keyring)
+		assertValue(t, err, nil)
+		assertValue(t, repo.InsertKey(ctx, key), nil)
+		repo.Close()
+
+		reopened, err := NewBoltKeyRepository(path, keyring)
+		assertValue(t, err, nil)
+		defer reopened.Close()
+		got, err := reopened.FindKey(ctx, key.ID)
+
+		assertValue(t, err, nil)
+		if !mockKeys.Equal(got.Priv) {
+			t.Errorf("want the private key to round trip")
+		}
+	})
+	t.Run("does not store the private keys in plain text", func(t *testing.T) {
+		content, _ := os.ReadFile(path)
+
+		if bytes.Contains(content, privDER(key)) {
+			t.Errorf("want the private key to be wrapped")
+		}
+	})
+	t.Run("rewraps the keys wrapped by an old KEK", func(t *testing.T) {
+		old, _ := kek.NewKeyring("old", map[string][]byte{
+			"old": bytes.Repeat([]byte{1}, 32),
+			"kek": bytes.Repeat([]byte{2}, 32),
+		})
+		oldPath := filepath.Join(t.TempDir(), "keys.db")
+		repo, _ := NewBoltKeyRepository(oldPath, old)
+		repo.InsertKey(ctx, key)
+		repo.Close()
+
+		rotated, _ := NewBoltKeyRepository(oldPath, keyring)
+		defer rotated.Close()
+		n, err := rotated.RewrapKeys(ctx)
+
+		assertValue(t, err, nil)
+		assertValue(t, n, 1)
+		n, _ = rotated.RewrapKeys(ctx)
+		assertValue(t, n, 0)
+		got, err := rotated.FindKey(ctx, key.ID)
+		assertValue(t, err, nil)
+		if !mockKeys.Equal(got.Priv) {
+			t.Errorf("want the rewrapped private key to round trip")
+		}
+	})
+}
@@ -0,0 +1,421 @@
+package adapters
+
+import (
+	"context"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/keycodec"
+)
+
+// snapshotAD binds the wrapped snapshot to its purpose
+var snapshotAD = []byte("gocrypto-snapshot")
+
+// NewInMemoryKeyRepository returns an empty in memory repository, the keys
+// are lost when the process exits
+func NewInMemoryKeyRepository() *InMemoryKeyRepository {
+	return &InMemoryKeyRepository{store: map[string][]keys.Key{}}
+}
+
+// NewSnapshotKeyRepository returns an in memory repository persisted to an
+// encrypted snapshot file, loading the keys of an existing one. Every write
+// rewrites the whole snapshot, wrapped by the active KEK
+func NewSnapshotKeyRepository(path string, w keyWrapper) (*InMemoryKeyRepository, error) {
+	r := NewInMemoryKeyRepository()
+	r.snapshot = path
+	r.wrapper = w
+
+	if err := r.load(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// InMemoryKeyRepository in memory key repository, safe for concurrent use
+type InMemoryKeyRepository struct {
+	mu    sync.RWMutex
+	store map[string][]keys.Key
+
+	snapshot    string
+	snapshotKEK string
+	wrapper     keyWrapper
+}
+
+// FindKey finds and returns the newest version of the requested key
+func (r *InMemoryKeyRepository) FindKey(ctx context.Context, id string) (keys.Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	versions := r.store[id]
+	if len(versions) == 0 {
+		return keys.Key{}, keys.ErrKeyNotFound
+	}
+	return versions[len(versions)-1], nil
+}
+
+// FindKeyVersion finds and returns a specific version of the requested key
+func (r *InMemoryKeyRepository) FindKeyVersion(ctx context.Context, id string, version int) (keys.Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	for _, k := range r.store[id] {
+		if k.Version == version {
+			return k, nil
+		}
+	}
+	return keys.Key{}, keys.ErrKeyNotFound
+}
+
+// FindKeysByScope finds and returns the newest version of every key in the scope
+func (r *InMemoryKeyRepository) FindKeysByScope(ctx context.Context, scope string) ([]keys.Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	var ks []keys.Key
+	for _, versions := range r.store {
+		k := versions[len(versions)-1]
+		if k.Scope == scope {
+			ks = append(ks, k)
+		}
+	}
+	sort.Slice(ks, func(i, j int) bool { return ks[i].ID < ks[j].ID })
+	return ks, nil
+}
+
+// FindPublicKeysByScope finds the published versions of the keys in the
+// scope, without their private key
+func (r *InMemoryKeyRepository) FindPublicKeysByScope(ctx context.Context, scope string, at time.Time) ([]keys.Key, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+
+	ids := make([]string, 0, len(r.store))
+	for id, versions := range r.store {
+		if versions[0].Scope == scope {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+
+	var ks []keys.Key
+	for _, id := range ids {
+		for _, k := range keys.PublishedVersions(r.store[id], at) {
+			k.Priv = nil
+			ks = append(ks, k)
+		}
+	}
+	return ks, nil
+}
+
+// FindKeysPage finds and returns a page of the newest version of the keys
+// in the scope matching the query
+func (r *InMemoryKeyRepository) FindKeysPage(ctx context.Context, q keys.KeyQuery) (keys.KeyPage, error) {
+	ks, err := r.FindKeysByScope(ctx, q.Scope)
+	if err != nil {
+		return keys.KeyPage{}, err
+	}
+	return keys.PageOf(ks, q), nil
+}
+
+// InsertKey Inserts a key into the repository
+func (r *InMemoryKeyRepository) InsertKey(ctx context.Context, k keys.Key) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.store[k.ID]
+	for _, v := range previous {
+		if v.Version == k.Version {
+			return keys.ErrKeyVersionExists
+		}
+	}
+
+	versions := append(copyVersions(previous), k)
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	r.store[k.ID] = versions
+
+	return r.commit(map[string][]keys.Key{k.ID: previous})
+}
+
+// UpdateKeyState moves the versions of the key in the from state to the
+// to state
+func (r *InMemoryKeyRepository) UpdateKeyState(ctx context.Context, id string, from keys.State, to keys.State, deletionDate time.Time) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	previous := r.store[id]
+	if len(previous) == 0 {
+		return keys.ErrKeyNotFound
+	}
+	versions := copyVersions(previous)
+	moved := 0
+	for i := range versions {
+		if versions[i].State != from {
+			continue
+		}
+		versions[i].State = to
+		versions[i].DeletionDate = deletionDate
+		moved++
+	}
+	if moved == 0 {
+		return keys.ErrInvalidStateTransition
+	}
+	r.store[id] = versions
+
+	return r.commit(map[string][]keys.Key{id: previous})
+}
+
+// DestroyKeys wipes the private key of every key pending deletion whose
+// deletion date is not after the given instant
+func (r *InMemoryKeyRepository) DestroyKeys(ctx context.Context, before time.Time) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	n := 0
+	previous := map[string][]keys.Key{}
+	for id, versions := range r.store {
+		var destroyed []keys.Key
+		for i, k := range versions {
+			if k.State != keys.StatePendingDeletion || k.DeletionDate.After(before) {
+				continue
+			}
+			if destroyed == nil {
+				destroyed = copyVersions(versions)
+			}
+			destroyed[i].State = keys.StateDestroyed
+			destroyed[i].Priv = nil
+			n++
+		}
+		if destroyed != nil {
+			previous[id] = versions
+			r.store[id] = destroyed
+		}
+	}
+	if n == 0 {
+		return 0, nil
+	}
+
+	if err := r.commit(previous); err != nil {
+		return 0, err
+	}
+	return n, nil
+}
+
+// RewrapKeys the snapshot is wrapped as a whole, a snapshot wrapped by
+// another KEK is rewritten with the active one. Returns how many keys were
+// rewrapped
+func (r *InMemoryKeyRepository) RewrapKeys(ctx context.Context) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if r.snapshot == "" || r.snapshotKEK == r.wrapper.ActiveID() {
+		return 0, nil
+	}
+	if err := r.persist(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, versions := range r.store {
+		for _, k := range versions {
+			if k.Priv != nil {
+				n++
+			}
+		}
+	}
+	return n, nil
+}
+
+// commit persists the store, the keys are put back to their previous versions
+// when the snapshot could not be written so memory never holds what the
+// snapshot does not. Must be called holding the write lock
+func (r *InMemoryKeyRepository) commit(previous map[string][]keys.Key) error {
+	if err := r.persist(); err != nil {
+		for id, versions := range previous {
+			if versions == nil {
+				delete(r.store, id)
+				continue
+			}
+			r.store[id] = versions
+		}
+		return err
+	}
+	return nil
+}
+
+// copyVersions the versions are copied before being changed, so the previous
+// ones are kept intact for a rollback
+func copyVersions(versions []keys.Key) []keys.Key {
+	c := make([]keys.Key, len(versions), len(versions)+1)
+	copy(c, versions)
+	return c
+}
+
+type snapshotFile struct {
+	KEKID string `json:"kek_id"`
+	Keys  []byte `json:"keys"`
+}
+
+// storedKey a key as the file backends persist it, private keys are kept in
+// the PKCS #8 format and public keys in the PKIX one, as in the SQL repository
+type storedKey struct {
+	ID           string      `json:"id"`
+	Version      int         `json:"version"`
+	Scope        string      `json:"scope"`
+	Expiration   time.Time   `json:"expiration"`
+	Creation     time.Time   `json:"creation"`
+	Use          keys.Use    `json:"use"`
+	Policy       keys.Policy `json:"policy"`
+	State        keys.State  `json:"state"`
+	DeletionDate time.Time   `json:"deletion_date"`
+	KEKID        string      `json:"kek_id,omitempty"`
+	Priv         []byte      `json:"priv,omitempty"`
+	Pub          []byte      `json:"pub,omitempty"`
+}
+
+// persist must be called holding the write lock, the snapshot is written to
+// a temporary file first so a crash never leaves a truncated one behind
+func (r *InMemoryKeyRepository) persist() error {
+	if r.snapshot == "" {
+		return nil
+	}
+
+	var sks []storedKey
+	for _, versions := range r.store {
+		for _, k := range versions {
+			sk, err := toStoredKey(k)
+			if err != nil {
+				return err
+			}
+			sks = append(sks, sk)
+		}
+	}
+	plain, err := json.Marshal(sks)
+	if err != nil {
+		return err
+	}
+
+	kekID, wrapped, err := r.wrapper.Wrap(plain, snapshotAD)
+	if err != nil {
+		return err
+	}
+	content, err := json.Marshal(snapshotFile{KEKID: kekID, Keys: wrapped})
+	if err != nil {
+		return err
+	}
+
+	tmp, err := ioutil.TempFile(filepath.Dir(r.snapshot), filepath.Base(r.snapshot)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.Write(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.snapshot); err != nil {
+		return err
+	}
+
+	r.snapshotKEK = kekID
+	return nil
+}
+
+func (r *InMemoryKeyRepository) load() error {
+	content, err := ioutil.ReadFile(r.snapshot)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	var f snapshotFile
+	if err := json.Unmarshal(content, &f); err != nil {
+		return err
+	}
+	plain, err := r.wrapper.Unwrap(f.KEKID, f.Keys, snapshotAD)
+	if err != nil {
+		return err
+	}
+
+	var sks []storedKey
+	if err := json.Unmarshal(plain, &sks); err != nil {
+		return err
+	}
+	for _, sk := range sks {
+		k, err := fromStoredKey(sk)
+		if err != nil {
+			return err
+		}
+		r.store[k.ID] = append(r.store[k.ID], k)
+	}
+	for _, versions := range r.store {
+		sort.Slice(versions, func(i, j int) bool { return versions[i].Version < versions[j].Version })
+	}
+
+	r.snapshotKEK = f.KEKID
+	return nil
+}
+
+func toStoredKey(k keys.Key) (storedKey, error) {
+	sk := storedKey{
+		ID:           k.ID,
+		Version:      k.Version,
+		Scope:        k.Scope,
+		Expiration:   k.Expiration,
+		Creation:     k.Creation,
+		Use:          k.Use,
+		Policy:       k.Policy,
+		State:        k.State,
+		DeletionDate: k.DeletionDate,
+	}
+
+	var err error
+	if k.Priv != nil {
+		if sk.Priv, err = keycodec.MarshalPrivateKey(k.Priv); err != nil {
+			return storedKey{}, err
+		}
+	}
+	if k.Pub != nil {
+		if sk.Pub, err = keycodec.MarshalPublicKey(k.Pub); err != nil {
+			return storedKey{}, err
+		}
+	}
+	return sk, nil
+}
+
+func fromStoredKey(sk storedKey) (keys.Key, error) {
+	k := keys.Key{
+		ID:           sk.ID,
+		Version:      sk.Version,
+		Scope:        sk.Scope,
+		Expiration:   sk.Expiration,
+		Creation:     sk.Creation,
+		Use:          sk.Use,
+		Policy:       sk.Policy,
+		State:        sk.State,
+		DeletionDate: sk.DeletionDate,
+	}
+
+	var err error
+	if sk.Priv != nil {
+		if k.Priv, err = keycodec.ParsePrivateKey(sk.Priv); err != nil {
+			return keys.Key{}, err
+		}
+	}
+	if sk.Pub != nil {
+		if k.Pub, err = keycodec.ParsePublicKey(sk.Pub); err != nil {
+			return keys.Key{}, err
+		}
+	}
+	return k, nil
+}
@@ -0,0 +1,101 @@
+package adapters
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/kek"
+)
+
+func TestSnapshotKeyRepository(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "keys.snapshot")
+
+	t.Run("reloads the keys from the snapshot", func(t *testing.T) {
+		repo, err := NewSnapshotKeyRepository(path, keyring)
+		assertValue(t, err, nil)
+		assertValue(t, repo.InsertKey(ctx, key), nil)
+
+		reloaded, err := NewSnapshotKeyRepository(path, keyring)
+		assertValue(t, err, nil)
+		got, err := reloaded.FindKey(ctx, key.ID)
+
+		assertValue(t, err, nil)
+		assertValue(t, got.Scope, key.Scope)
+		assertValue(t, got.Expiration.Equal(key.Expiration), true)
+		if !reflect.DeepEqual(got.Policy, key.Policy) {
+			t.Errorf("got %v, want %v", got.Policy, key.Policy)
+		}
+		if !mockKeys.Equal(got.Priv) {
+			t.Errorf("want the private key to round trip")
+		}
+	})
+	t.Run("does not store the private keys in plain text", func(t *testing.T) {
+		content, _ := os.ReadFile(path)
+
+		if bytes.Contains(content, privDER(key)) || bytes.Contains(content, []byte(key.Scope)) {
+			t.Errorf("want the snapshot to be encrypted")
+		}
+	})
+	t.Run("refuses a snapshot wrapped by an unknown KEK", func(t *testing.T) {
+		other, _ := kek.NewKeyring("other", map[string][]byte{"other": bytes.Repeat([]byte{3}, 32)})
+
+		_, err := NewSnapshotKeyRepository(path, other)
+
+		if err == nil {
+			t.Errorf("want an error, got nil")
+		}
+	})
+	t.Run("rolls back the changes the snapshot could not be written for", func(t *testing.T) {
+		dir := t.TempDir()
+		repo, _ := NewSnapshotKeyRepository(filepath.Join(dir, "keys.snapshot"), keyring)
+		pending := key
+		pending.State, pending.DeletionDate = keys.StatePendingDeletion, time.Now().Add(-time.Hour)
+		assertValue(t, repo.InsertKey(ctx, pending), nil)
+		os.RemoveAll(dir)
+
+		rotated := pending
+		rotated.Version++
+		if err := repo.InsertKey(ctx, rotated); err == nil {
+			t.Errorf("want the insert to fail")
+		}
+		if err := repo.UpdateKeyState(ctx, key.ID, keys.StatePendingDeletion, keys.StateActive, time.Time{}); err == nil {
+			t.Errorf("want the state update to fail")
+		}
+		if _, err := repo.DestroyKeys(ctx, time.Now()); err == nil {
+			t.Errorf("want the destruction to fail")
+		}
+
+		got, err := repo.FindKey(ctx, key.ID)
+		assertValue(t, err, nil)
+		assertValue(t, got.Version, pending.Version)
+		assertValue(t, got.State, keys.StatePendingDeletion)
+		if got.Priv == nil {
+			t.Errorf("want the private key to be kept")
+		}
+		_, err = repo.FindKeyVersion(ctx, key.ID, rotated.Version)
+		assertValue(t, err, keys.ErrKeyNotFound)
+	})
+	t.Run("rewraps a snapshot wrapped by an old KEK", func(t *testing.T) {
+		old, _ := kek.NewKeyring("old", map[string][]byte{
+			"old": bytes.Repeat([]byte{1}, 32),
+			"kek": bytes.Repeat([]byte{2}, 32),
+		})
+		oldPath := filepath.Join(t.TempDir(), "keys.snapshot")
+		repo, _ := NewSnapshotKeyRepository(oldPath, old)
+		repo.InsertKey(ctx, key)
+
+		rotated, err := NewSnapshotKeyRepository(oldPath, keyring)
+		assertValue(t, err, nil)
+		n, err := rotated.RewrapKeys(ctx)
+
+		assertValue(t, err, nil)
+		assertValue(t, n, 1)
+		n, _ = rotated.RewrapKeys(ctx)
+		assertValue(t, n, 0)
+	})
+}
@@ -1,68 +1,66 @@
 package adapters
 
 import (
-	"crypto/x509"
+	"context"
+	"crypto"
 	"database/sql"
 	"log"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
-	// Is there any other way?
-	_ "github.com/lib/pq"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/keycodec"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/metrics"
+	"github.com/lib/pq"
 )
 
-// InMemoryKeyRepository simple in memory key repository
-type InMemoryKeyRepository struct {
-	Store map[string]keys.Key
+type keyWrapper interface {
+	ActiveID() string
+	Wrap([]byte, []byte) (string, []byte, error)
+	Unwrap(string, []byte, []byte) ([]byte, error)
 }
 
-// FindKey finds and returns the requested key
-func (r *InMemoryKeyRepository) FindKey(id string) (keys.Key, error) {
-	key, ok := r.Store[id]
-	if !ok {
-		return keys.Key{}, keys.ErrKeyNotFound
-	}
-	return key, nil
-}
-
-// InsertKey Inserts a key into the repository
-func (r *InMemoryKeyRepository) InsertKey(key keys.Key) error {
-	r.Store[key.ID] = key
-	return nil
-}
-
-// NewSQLKeyRepository returns a new sql repository instance
-func NewSQLKeyRepository(db *sql.DB) SQLKeyRepository {
-	return SQLKeyRepository{db: db}
+// NewSQLKeyRepository returns a new sql repository instance, private keys
+// are wrapped by the keyWrapper before being persisted
+func NewSQLKeyRepository(db *sql.DB, w keyWrapper) SQLKeyRepository {
+	return SQLKeyRepository{db: db, wrapper: w}
 }
 
 // SQLKeyRepository sql database persistency
 type SQLKeyRepository struct {
-	db *sql.DB
+	db      *sql.DB
+	wrapper keyWrapper
 }
 
 var findKeyStatement = `
-	SELECT id, scope, expiration, priv, pub 
+	SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub 
 		FROM keys 
-		WHERE id = $1`
+		WHERE id = $1
+		ORDER BY version DESC
+		LIMIT 1`
+
+// FindKey finds and returns the newest version of the requested key
+func (r *SQLKeyRepository) FindKey(ctx context.Context, id string) (keys.Key, error) {
+	defer metrics.ObserveQuery("find_key", time.Now())
+	return r.findKey(r.db.QueryRowContext(ctx, findKeyStatement, id))
+}
 
-// FindKey finds and returns the requested key
-func (r *SQLKeyRepository) FindKey(id string) (keys.Key, error) {
-	row := r.db.QueryRow(findKeyStatement, id)
+var findKeyVersionStatement = `
+	SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub 
+		FROM keys 
+		WHERE id = $1 AND version = $2`
 
-	var k keys.Key
-	var priv, pub []byte
+// FindKeyVersion finds and returns a specific version of the requested key
+func (r *SQLKeyRepository) FindKeyVersion(ctx context.Context, id string, version int) (keys.Key, error) {
+	defer metrics.ObserveQuery("find_key_version", time.Now())
+	return r.findKey(r.db.QueryRowContext(ctx, findKeyVersionStatement, id, version))
+}
 
-	switch err := row.Scan(&k.ID, &k.Scope, &k.Expiration, &priv, &pub); err {
+func (r *SQLKeyRepository) findKey(row *sql.Row) (keys.Key, error) {
+	k, err := r.scanKey(row)
+	switch err {
 	case nil:
-		k.Priv, err = x509.ParsePKCS1PrivateKey(priv)
-		if err != nil {
-			return keys.Key{}, err
-		}
-		k.Pub, err = x509.ParsePKCS1PublicKey(pub)
-		if err != nil {
-			return keys.Key{}, err
-		}
 	case sql.ErrNoRows:
 		return keys.Key{}, keys.ErrKeyNotFound
 	default:
@@ -72,13 +70,15 @@ func (r *SQLKeyRepository) FindKey(id string) (keys.Key, error) {
 }
 
 var findKeysByScopeStatement = `
-	SELECT id, scope, expiration, priv, pub 
+	SELECT DISTINCT ON (id) id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub 
 		FROM keys 
-		WHERE scope = $1`
+		WHERE scope = $1
+		ORDER BY id, version DESC`
 
-// FindKey finds and returns the requested key
-func (r *SQLKeyRepository) FindKeysByScope(scope string) ([]keys.Key, error) {
-	rows, err := r.db.Query(findKeysByScopeStatement, scope)
+// FindKeysByScope finds and returns the newest version of every key in the scope
+func (r *SQLKeyRepository) FindKeysByScope(ctx context.Context, scope string) ([]keys.Key, error) {
+	defer metrics.ObserveQuery("find_keys_by_scope", time.Now())
+	rows, err := r.db.QueryContext(ctx, findKeysByScopeStatement, scope)
 	if err != nil {
 		return nil, err
 	}
@@ -87,53 +87,417 @@ func (r *SQLKeyRepository) FindKeysByScope(scope string) ([]keys.Key, error) {
 	var ks []keys.Key
 
 	for rows.Next() {
-		var (
-			k    keys.Key
-			pub  []byte
-			priv []byte
-		)
-
-		err := rows.Scan(&k.ID, &k.Scope, &k.Expiration, &priv, &pub)
+		k, err := r.scanKey(rows)
 		if err != nil {
 			return nil, err
 		}
+		ks = append(ks, k)
+	}
+
+	if err := rows.Close(); err != nil {
+		log.Println(err)
+	}
 
-		k.Priv, err = x509.ParsePKCS1PrivateKey(priv)
+	if err := rows.Err(); err != nil {
+		log.Println(err)
+	}
+
+	return ks, nil
+}
+
+var findPublicKeysByScopeStatement = `
+	SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, pub
+		FROM keys k
+		WHERE scope = $1 AND expiration > $2
+			AND (key_use = $3 OR NOT EXISTS (SELECT 1 FROM keys n WHERE n.id = k.id AND n.version > k.version))
+		ORDER BY id, version DESC`
+
+// FindPublicKeysByScope finds the published versions of the keys in the
+// scope, the private keys are not even read
+func (r *SQLKeyRepository) FindPublicKeysByScope(ctx context.Context, scope string, at time.Time) ([]keys.Key, error) {
+	defer metrics.ObserveQuery("find_public_keys_by_scope", time.Now())
+	rows, err := r.db.QueryContext(ctx, findPublicKeysByScopeStatement, scope, at, keys.UseSigning)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var ks []keys.Key
+	for rows.Next() {
+		k, err := scanPublicKey(rows)
 		if err != nil {
 			return nil, err
 		}
-		k.Pub, err = x509.ParsePKCS1PublicKey(pub)
+		ks = append(ks, k)
+	}
+	return ks, rows.Err()
+}
+
+var findKeysPageStatement = `
+	SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+		FROM keys k
+		WHERE scope = $1 AND NOT EXISTS (SELECT 1 FROM keys n WHERE n.id = k.id AND n.version > k.version)`
+
+// FindKeysPage finds and returns a page of the newest version of the keys
+// in the scope matching the query, one more key than the limit is read to
+// know if there is a next page
+func (r *SQLKeyRepository) FindKeysPage(ctx context.Context, q keys.KeyQuery) (keys.KeyPage, error) {
+	defer metrics.ObserveQuery("find_keys_page", time.Now())
+	q = q.Normalized()
+	stmt, args := buildFindKeysPage(q)
+
+	rows, err := r.db.QueryContext(ctx, stmt, args...)
+	if err != nil {
+		return keys.KeyPage{}, err
+	}
+	defer rows.Close()
+
+	ks := []keys.Key{}
+	for rows.Next() {
+		k, err := r.scanKey(rows)
 		if err != nil {
-			return nil, err
+			return keys.KeyPage{}, err
 		}
 		ks = append(ks, k)
 	}
+	if err := rows.Err(); err != nil {
+		return keys.KeyPage{}, err
+	}
 
-	if err := rows.Close(); err != nil {
-		log.Println(err)
+	return keys.NewKeyPage(ks, q), nil
+}
+
+// buildFindKeysPage adds the filters, the cursor and the order of the query
+// to the page statement, the sort columns are backed by the scope indexes
+func buildFindKeysPage(q keys.KeyQuery) (string, []interface{}) {
+	var b strings.Builder
+	b.WriteString(findKeysPageStatement)
+	args := []interface{}{q.Scope}
+	arg := func(v interface{}) string {
+		args = append(args, v)
+		return "$" + strconv.Itoa(len(args))
 	}
 
-	if err := rows.Err(); err != nil {
-		log.Println(err)
+	if len(q.States) > 0 {
+		states := make([]string, len(q.States))
+		for i, s := range q.States {
+			states[i] = string(s)
+		}
+		b.WriteString(" AND state = ANY(" + arg(pq.Array(states)) + ")")
+	}
+	if len(q.Types) > 0 {
+		types := make([]string, len(q.Types))
+		for i, t := range q.Types {
+			types[i] = string(t)
+		}
+		b.WriteString(" AND key_type = ANY(" + arg(pq.Array(types)) + ")")
+	}
+	if !q.ExpiresAfter.IsZero() {
+		b.WriteString(" AND expiration > " + arg(q.ExpiresAfter))
+	}
+	if !q.ExpiresBefore.IsZero() {
+		b.WriteString(" AND expiration < " + arg(q.ExpiresBefore))
 	}
 
-	return ks, nil
+	column, cmp, dir := "creation", ">", "ASC"
+	if q.SortBy == keys.SortByExpiration {
+		column = "expiration"
+	}
+	if q.Descending {
+		cmp, dir = "<", "DESC"
+	}
+	if q.After != nil {
+		b.WriteString(" AND (" + column + ", id) " + cmp + " (" + arg(q.After.Value) + ", " + arg(q.After.ID) + ")")
+	}
+	b.WriteString("\n\t\tORDER BY " + column + " " + dir + ", id " + dir)
+	b.WriteString("\n\t\tLIMIT " + arg(q.Limit+1))
+
+	return b.String(), args
 }
 
+type rowScanner interface {
+	Scan(...interface{}) error
+}
+
+func (r *SQLKeyRepository) scanKey(row rowScanner) (keys.Key, error) {
+	var (
+		k            keys.Key
+		keyAlgs      sql.NullString
+		contentAlgs  sql.NullString
+		deletionDate sql.NullTime
+		kekID        sql.NullString
+		pub          []byte
+		priv         []byte
+	)
+
+	err := row.Scan(&k.ID, &k.Version, &k.Scope, &k.Expiration, &k.Creation, &k.Use, &keyAlgs, &contentAlgs, &k.Policy.Compression, &k.State, &deletionDate, &kekID, &priv, &pub)
+	if err != nil {
+		return keys.Key{}, err
+	}
+	k.Policy.KeyAlgorithms = splitList(keyAlgs)
+	k.Policy.ContentAlgorithms = splitList(contentAlgs)
+	k.DeletionDate = deletionDate.Time
+
+	if err := r.parseKeyPair(&k, kekID, priv, pub); err != nil {
+		return keys.Key{}, err
+	}
+	return k, nil
+}
+
+// scanPublicKey scans a key selected without its private key
+func scanPublicKey(row rowScanner) (keys.Key, error) {
+	var (
+		k            keys.Key
+		keyAlgs      sql.NullString
+		contentAlgs  sql.NullString
+		deletionDate sql.NullTime
+		pub          []byte
+	)
+
+	err := row.Scan(&k.ID, &k.Version, &k.Scope, &k.Expiration, &k.Creation, &k.Use, &keyAlgs, &contentAlgs, &k.Policy.Compression, &k.State, &deletionDate, &pub)
+	if err != nil {
+		return keys.Key{}, err
+	}
+	k.Policy.KeyAlgorithms = splitList(keyAlgs)
+	k.Policy.ContentAlgorithms = splitList(contentAlgs)
+	k.DeletionDate = deletionDate.Time
+
+	if k.Pub, err = keycodec.ParsePublicKey(pub); err != nil {
+		return keys.Key{}, err
+	}
+	return k, nil
+}
+
+// uniqueViolation postgres error code of a duplicated primary key
+const uniqueViolation = "23505"
+
 var insertKeyStatement = `
-	INSERT INTO keys (id, scope, expiration, creation, priv, pub)
-		VALUES ($1, $2, $3, $4, $5, $6)`
+	INSERT INTO keys (id, version, scope, expiration, creation, key_use, key_type, key_algorithms, content_algorithms, compression, state, kek_id, priv, pub)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, $12, $13, $14)`
+
+// InsertKey Inserts a key into the repository, private keys are stored in
+// the PKCS #8 format and public keys in the PKIX one
+func (r *SQLKeyRepository) InsertKey(ctx context.Context, k keys.Key) error {
+	plain, err := keycodec.MarshalPrivateKey(k.Priv)
+	if err != nil {
+		return err
+	}
+	pub, err := keycodec.MarshalPublicKey(k.Pub)
+	if err != nil {
+		return err
+	}
+
+	kekID, priv, err := r.wrapper.Wrap(plain, []byte(k.ID))
+	if err != nil {
+		return err
+	}
 
-// InsertKey Inserts a key into the repository
-func (r *SQLKeyRepository) InsertKey(k keys.Key) error {
-	_, err := r.db.Exec(
+	start := time.Now()
+	_, err = r.db.ExecContext(ctx,
 		insertKeyStatement,
 		k.ID,
+		k.Version,
 		k.Scope,
 		k.Expiration,
-		time.Now(),
-		x509.MarshalPKCS1PrivateKey(k.Priv),
-		x509.MarshalPKCS1PublicKey(k.Pub),
+		k.Creation,
+		k.Use,
+		k.Type(),
+		joinList(k.Policy.KeyAlgorithms),
+		joinList(k.Policy.ContentAlgorithms),
+		k.Policy.Compression,
+		k.State,
+		kekID,
+		priv,
+		pub,
 	)
+	metrics.ObserveQuery("insert_key", start)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == uniqueViolation {
+		return keys.ErrKeyVersionExists
+	}
 	return err
 }
+
+var updateKeyStateStatement = `
+	UPDATE keys SET state = $1, deletion_date = $2
+		WHERE id = $3 AND state = $4`
+
+var keyExistsStatement = `
+	SELECT EXISTS (SELECT 1 FROM keys WHERE id = $1)`
+
+// UpdateKeyState moves the versions of the key in the from state to the
+// to state, the state is checked by the update itself so a key destroyed
+// meanwhile is never brought back
+func (r *SQLKeyRepository) UpdateKeyState(ctx context.Context, id string, from keys.State, to keys.State, deletionDate time.Time) error {
+	defer metrics.ObserveQuery("update_key_state", time.Now())
+	res, err := r.db.ExecContext(ctx, updateKeyStateStatement, to, nullTime(deletionDate), id, from)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n > 0 {
+		return nil
+	}
+
+	var exists bool
+	if err := r.db.QueryRowContext(ctx, keyExistsStatement, id).Scan(&exists); err != nil {
+		return err
+	}
+	if !exists {
+		return keys.ErrKeyNotFound
+	}
+	return keys.ErrInvalidStateTransition
+}
+
+var destroyKeysStatement = `
+	UPDATE keys SET state = $1, priv = NULL, kek_id = NULL
+		WHERE state = $2 AND deletion_date <= $3`
+
+// DestroyKeys wipes the private key of every key pending deletion whose
+// deletion date is not after the given instant
+func (r *SQLKeyRepository) DestroyKeys(ctx context.Context, before time.Time) (int, error) {
+	defer metrics.ObserveQuery("destroy_keys", time.Now())
+	res, err := r.db.ExecContext(ctx, destroyKeysStatement, keys.StateDestroyed, keys.StatePendingDeletion, before)
+	if err != nil {
+		return 0, err
+	}
+
+	n, err := res.RowsAffected()
+	return int(n), err
+}
+
+func nullTime(t time.Time) sql.NullTime {
+	return sql.NullTime{Time: t, Valid: !t.IsZero()}
+}
+
+// joinList policy lists are stored comma separated, an empty one as NULL
+func joinList(l []string) sql.NullString {
+	return sql.NullString{String: strings.Join(l, ","), Valid: len(l) > 0}
+}
+
+func splitList(s sql.NullString) []string {
+	if !s.Valid || s.String == "" {
+		return nil
+	}
+	return strings.Split(s.String, ",")
+}
+
+var findKeysToRewrapStatement = `
+	SELECT id, version, kek_id, priv
+		FROM keys
+		WHERE kek_id IS DISTINCT FROM $1 AND priv IS NOT NULL`
+
+var updateWrappedKeyStatement = `
+	UPDATE keys SET kek_id = $1, priv = $2, key_type = COALESCE(key_type, $6)
+		WHERE id = $3 AND version = $4 AND kek_id IS NOT DISTINCT FROM $5`
+
+type wrappedKey struct {
+	id      string
+	version int
+	kekID   sql.NullString
+	priv    []byte
+}
+
+// RewrapKeys re-encrypts with the active KEK every private key wrapped by
+// another one, returns how many keys were rewrapped. The legacy keys the
+// migrations could not find the type of get it from their private key
+func (r *SQLKeyRepository) RewrapKeys(ctx context.Context) (int, error) {
+	start := time.Now()
+	rows, err := r.db.QueryContext(ctx, findKeysToRewrapStatement, r.wrapper.ActiveID())
+	metrics.ObserveQuery("find_keys_to_rewrap", start)
+	if err != nil {
+		return 0, err
+	}
+	defer rows.Close()
+
+	var wks []wrappedKey
+	for rows.Next() {
+		var wk wrappedKey
+		if err := rows.Scan(&wk.id, &wk.version, &wk.kekID, &wk.priv); err != nil {
+			return 0, err
+		}
+		wks = append(wks, wk)
+	}
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	rows.Close()
+
+	rewrapped := 0
+	for _, wk := range wks {
+		plain, err := r.unwrap(wk.id, wk.kekID, wk.priv)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		keyType, err := typeOfPrivateKey(plain)
+		if err != nil {
+			return rewrapped, err
+		}
+
+		kekID, priv, err := r.wrapper.Wrap(plain, []byte(wk.id))
+		if err != nil {
+			return rewrapped, err
+		}
+
+		start := time.Now()
+		res, err := r.db.ExecContext(ctx, updateWrappedKeyStatement, kekID, priv, wk.id, wk.version, wk.kekID, keyType)
+		metrics.ObserveQuery("update_wrapped_key", start)
+		if err != nil {
+			return rewrapped, err
+		}
+		if n, _ := res.RowsAffected(); n > 0 {
+			rewrapped++
+		}
+	}
+
+	return rewrapped, nil
+}
+
+// typeOfPrivateKey finds the type of a plain private key of any of the
+// formats it was ever stored in
+func typeOfPrivateKey(plain []byte) (keys.KeyType, error) {
+	priv, err := keycodec.ParsePrivateKey(plain)
+	if err != nil {
+		return "", err
+	}
+	signer, ok := priv.(interface{ Public() crypto.PublicKey })
+	if !ok {
+		return "", keycodec.ErrUnsupportedKey
+	}
+	return keys.TypeOf(signer.Public()), nil
+}
+
+// parseKeyPair destroyed keys have no private key, only the public one is parsed
+func (r *SQLKeyRepository) parseKeyPair(k *keys.Key, kekID sql.NullString, priv, pub []byte) error {
+	var err error
+	if priv != nil {
+		plain, err := r.unwrap(k.ID, kekID, priv)
+		if err != nil {
+			return err
+		}
+
+		k.Priv, err = keycodec.ParsePrivateKey(plain)
+		if err != nil {
+			return err
+		}
+	}
+
+	k.Pub, err = keycodec.ParsePublicKey(pub)
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// unwrap keys persisted before the envelope encryption have no KEK and are
+// stored in plain text, they stay readable until they are rewrapped
+func (r *SQLKeyRepository) unwrap(id string, kekID sql.NullString, priv []byte) ([]byte, error) {
+	if !kekID.Valid || kekID.String == "" {
+		return priv, nil
+	}
+	return r.wrapper.Unwrap(kekID.String, priv, []byte(id))
+}
@@ -1,9 +1,12 @@
 package adapters
 
 import (
+	"bytes"
+	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"crypto/x509"
+	"database/sql"
 	"database/sql/driver"
 	"errors"
 	"reflect"
@@ -12,81 +15,93 @@ import (
 
 	"github.com/DATA-DOG/go-sqlmock"
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/kek"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/keycodec"
 	"github.com/google/uuid"
+	"github.com/lib/pq"
 )
 
-var mockKeys, _ = rsa.GenerateKey(rand.Reader, 2048)
+// ctx the repositories are called without deadline
+var ctx = context.Background()
 
-func TestMemFindKey(t *testing.T) {
-	keyRepo := InMemoryKeyRepository{map[string]keys.Key{}}
-
-	t.Run("Should return a Key", func(t *testing.T) {
-		got, _ := keyRepo.FindKey("1")
-		want := keys.Key{}
-
-		assertType(t, got, want)
+var (
+	mockKeys, _ = rsa.GenerateKey(rand.Reader, 2048)
+	keyring, _  = kek.NewKeyring("kek", map[string][]byte{
+		"old": bytes.Repeat([]byte{1}, 32),
+		"kek": bytes.Repeat([]byte{2}, 32),
 	})
-	t.Run("Should return the right key", func(t *testing.T) {
-		iniKey := keys.Key{ID: "1"}
-		iniKeyRepo := InMemoryKeyRepository{map[string]keys.Key{"1": iniKey}}
-
-		got, _ := iniKeyRepo.FindKey("1")
-		want := iniKey
+)
 
-		assertType(t, got, want)
-		if !reflect.DeepEqual(got, want) {
-			t.Errorf("got %v, want %v", got, want)
-		}
-	})
+var key = keys.Key{
+	ID:         uuid.New().String(),
+	Version:    1,
+	Scope:      "scope",
+	Expiration: time.Now().AddDate(0, 0, 1),
+	Creation:   time.Now(),
+	Use:        keys.UseEncryption,
+	Policy: keys.Policy{
+		KeyAlgorithms:     []string{"RSA-OAEP-256", "RSA-OAEP"},
+		ContentAlgorithms: []string{"A256GCM"},
+		Compression:       true,
+	},
+	State: keys.StateActive,
+	Priv:  mockKeys,
+	Pub:   &mockKeys.PublicKey,
 }
 
-func TestMemInsertKey(t *testing.T) {
-	keyRepo := InMemoryKeyRepository{map[string]keys.Key{}}
-
-	t.Run("Should insert a Key", func(t *testing.T) {
-		key := keys.Key{ID: "1"}
-		keyRepo.InsertKey(key)
-
-		got, _ := keyRepo.FindKey(key.ID)
-		want := key
+type wrappedBy struct {
+	id    string
+	kekID string
+	plain []byte
+}
 
-		assertType(t, got, want)
-		if !reflect.DeepEqual(got, want) {
-			t.Errorf("got %v, want %v", got, want)
-		}
-	})
+func (a wrappedBy) Match(v driver.Value) bool {
+	b, ok := v.([]byte)
+	if !ok {
+		return false
+	}
+	plain, err := keyring.Unwrap(a.kekID, b, []byte(a.id))
+	return err == nil && bytes.Equal(plain, a.plain)
 }
 
-var key = keys.Key{
-	ID:         uuid.New().String(),
-	Scope:      "scope",
-	Expiration: time.Now().AddDate(0, 0, 1),
-	Priv:       mockKeys,
-	Pub:        &mockKeys.PublicKey,
+func privDER(k keys.Key) []byte {
+	der, _ := keycodec.MarshalPrivateKey(k.Priv)
+	return der
 }
 
-type anyTime struct{}
+func pubDER(k keys.Key) []byte {
+	der, _ := keycodec.MarshalPublicKey(k.Pub)
+	return der
+}
 
-func (a anyTime) Match(v driver.Value) bool {
-	_, ok := v.(time.Time)
-	return ok
+func wrap(k keys.Key) []byte {
+	_, wrapped, _ := keyring.Wrap(privDER(k), []byte(k.ID))
+	return wrapped
 }
 func TestSQLInsertKey(t *testing.T) {
 	db, mock, _ := sqlmock.New()
-	repo := SQLKeyRepository{db: db}
+	repo := NewSQLKeyRepository(db, keyring)
 	defer db.Close()
 
 	t.Run("calls db.Exec with the right params", func(t *testing.T) {
 		mock.ExpectExec("INSERT INTO keys").WithArgs(
 			key.ID,
+			key.Version,
 			key.Scope,
 			key.Expiration,
-			anyTime{},
-			x509.MarshalPKCS1PrivateKey(key.Priv),
-			x509.MarshalPKCS1PublicKey(key.Pub),
+			key.Creation,
+			key.Use,
+			keys.TypeRSA2048,
+			sql.NullString{String: "RSA-OAEP-256,RSA-OAEP", Valid: true},
+			sql.NullString{String: "A256GCM", Valid: true},
+			true,
+			key.State,
+			"kek",
+			wrappedBy{key.ID, "kek", privDER(key)},
+			pubDER(key),
 		)
 
-		repo.InsertKey(key)
+		repo.InsertKey(ctx, key)
 
 		if err := mock.ExpectationsWereMet(); err != nil {
 			t.Errorf("SQL expectations failed: %s", err)
@@ -97,31 +112,47 @@ func TestSQLInsertKey(t *testing.T) {
 		want := errors.New("an error")
 		mock.ExpectExec("INSERT INTO keys").WithArgs(
 			key.ID,
+			key.Version,
 			key.Scope,
 			key.Expiration,
-			anyTime{},
-			x509.MarshalPKCS1PrivateKey(key.Priv),
-			x509.MarshalPKCS1PublicKey(key.Pub),
+			key.Creation,
+			key.Use,
+			keys.TypeRSA2048,
+			sql.NullString{String: "RSA-OAEP-256,RSA-OAEP", Valid: true},
+			sql.NullString{String: "A256GCM", Valid: true},
+			true,
+			key.State,
+			"kek",
+			wrappedBy{key.ID, "kek", privDER(key)},
+			pubDER(key),
 		).WillReturnError(want)
 
-		got := repo.InsertKey(key)
+		got := repo.InsertKey(ctx, key)
 
 		assertValue(t, got, want)
 	})
+
+	t.Run("returns ErrKeyVersionExists on a duplicated primary key", func(t *testing.T) {
+		mock.ExpectExec("INSERT INTO keys").WillReturnError(&pq.Error{Code: uniqueViolation})
+
+		got := repo.InsertKey(ctx, key)
+
+		assertValue(t, got, keys.ErrKeyVersionExists)
+	})
 }
 
 func TestSQLFindKey(t *testing.T) {
 	db, mock, _ := sqlmock.New()
-	repo := SQLKeyRepository{db: db}
+	repo := NewSQLKeyRepository(db, keyring)
 	defer db.Close()
 
 	t.Run("calls db.QueryRow with the right params", func(t *testing.T) {
 		mock.ExpectQuery(`
-			SELECT id, scope, expiration, priv, pub
+			SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 				FROM keys
 				WHERE id`).WithArgs(key.ID)
 
-		repo.FindKey(key.ID)
+		repo.FindKey(ctx, key.ID)
 
 		if err := mock.ExpectationsWereMet(); err != nil {
 			t.Errorf("SQL expectations failed: %s", err)
@@ -130,19 +161,19 @@ func TestSQLFindKey(t *testing.T) {
 
 	t.Run("returns a complete Key object", func(t *testing.T) {
 		rows := sqlmock.
-			NewRows([]string{"id", "scope", "expiration", "priv", "pub"}).
-			AddRow(key.ID, key.Scope, key.Expiration,
-				x509.MarshalPKCS1PrivateKey(key.Priv),
-				x509.MarshalPKCS1PublicKey(key.Pub))
+			NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, key.State, nil, "kek",
+				wrap(key),
+				pubDER(key))
 		mock.
 			ExpectQuery(`
-				SELECT id, scope, expiration, priv, pub
+				SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 					FROM keys
 					WHERE id`).
 			WithArgs(key.ID).
 			WillReturnRows(rows)
 
-		returned, err := repo.FindKey(key.ID)
+		returned, err := repo.FindKey(ctx, key.ID)
 
 		assertValue(t, err, nil)
 		if !reflect.DeepEqual(key, returned) {
@@ -150,14 +181,111 @@ func TestSQLFindKey(t *testing.T) {
 		}
 	})
 
+	t.Run("reads keys of every type", func(t *testing.T) {
+		var g KeyGenerator
+		for _, kt := range []keys.KeyType{keys.TypeP384, keys.TypeEd25519, keys.TypeX25519} {
+			priv, _ := g.GenerateKey(kt)
+			k := key
+			k.Priv, k.Pub = priv, priv.Public()
+			rows := sqlmock.
+				NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}).
+				AddRow(k.ID, k.Version, k.Scope, k.Expiration, k.Creation, k.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, k.State, nil, "kek",
+					wrap(k),
+					pubDER(k))
+			mock.
+				ExpectQuery(`
+					SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+						FROM keys
+						WHERE id`).
+				WithArgs(k.ID).
+				WillReturnRows(rows)
+
+			returned, err := repo.FindKey(ctx, k.ID)
+
+			assertValue(t, err, nil)
+			assertValue(t, returned.Type(), kt)
+			if !reflect.DeepEqual(k.Priv, returned.Priv) {
+				t.Errorf("%s: want %v, got %v", kt, k.Priv, returned.Priv)
+			}
+		}
+	})
+
+	t.Run("reads keys persisted in plain text before the envelope encryption", func(t *testing.T) {
+		rows := sqlmock.
+			NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, key.State, nil, nil,
+				x509.MarshalPKCS1PrivateKey(mockKeys),
+				x509.MarshalPKCS1PublicKey(&mockKeys.PublicKey))
+		mock.
+			ExpectQuery(`
+				SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+					FROM keys
+					WHERE id`).
+			WithArgs(key.ID).
+			WillReturnRows(rows)
+
+		returned, err := repo.FindKey(ctx, key.ID)
+
+		assertValue(t, err, nil)
+		if !reflect.DeepEqual(key, returned) {
+			t.Errorf("want %v, got %v", key, returned)
+		}
+	})
+
+	t.Run("reads keys persisted before the policies with an empty one", func(t *testing.T) {
+		rows := sqlmock.
+			NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, nil, nil, false, key.State, nil, "kek",
+				wrap(key),
+				pubDER(key))
+		mock.
+			ExpectQuery(`
+				SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+					FROM keys
+					WHERE id`).
+			WithArgs(key.ID).
+			WillReturnRows(rows)
+
+		returned, err := repo.FindKey(ctx, key.ID)
+
+		assertValue(t, err, nil)
+		if !returned.Policy.Empty() {
+			t.Errorf("want an empty policy, got %v", returned.Policy)
+		}
+	})
+
+	t.Run("returns destroyed keys without the private key", func(t *testing.T) {
+		deletionDate := time.Now().Add(-time.Hour)
+		rows := sqlmock.
+			NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, keys.StateDestroyed, deletionDate, nil, nil,
+				pubDER(key))
+		mock.
+			ExpectQuery(`
+				SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+					FROM keys
+					WHERE id`).
+			WithArgs(key.ID).
+			WillReturnRows(rows)
+
+		returned, err := repo.FindKey(ctx, key.ID)
+
+		assertValue(t, err, nil)
+		assertValue(t, returned.State, keys.StateDestroyed)
+		assertValue(t, returned.DeletionDate, deletionDate)
+		if returned.Priv != nil {
+			t.Errorf("want no private key, got %v", returned.Priv)
+		}
+	})
+
 	t.Run("proxys the error from the sql db", func(t *testing.T) {
 		want := errors.New("an error")
 		mock.ExpectQuery(`
-			SELECT id, scope, expiration, priv, pub
+			SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 				FROM keys
 				WHERE id`).WithArgs(key.ID).WillReturnError(want)
 
-		_, got := repo.FindKey(key.ID)
+		_, got := repo.FindKey(ctx, key.ID)
 
 		assertValue(t, got, want)
 	})
@@ -165,28 +293,69 @@ func TestSQLFindKey(t *testing.T) {
 	t.Run("not founding the key, return a ErrKeyNotFound", func(t *testing.T) {
 		want := keys.ErrKeyNotFound
 		mock.ExpectQuery(`
-			SELECT id, scope, expiration, priv, pub
+			SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 				FROM keys
 				WHERE id`).WithArgs(key.ID).WillReturnRows(sqlmock.NewRows([]string{}))
 
-		_, got := repo.FindKey(key.ID)
+		_, got := repo.FindKey(ctx, key.ID)
 
 		assertValue(t, got, want)
 	})
 }
 
+func TestSQLFindKeyVersion(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	repo := NewSQLKeyRepository(db, keyring)
+	defer db.Close()
+
+	t.Run("returns the requested version of the Key", func(t *testing.T) {
+		rows := sqlmock.
+			NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, key.State, nil, "kek",
+				wrap(key),
+				pubDER(key))
+		mock.
+			ExpectQuery(`
+				SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+					FROM keys
+					WHERE id = \$1 AND version = \$2`).
+			WithArgs(key.ID, key.Version).
+			WillReturnRows(rows)
+
+		returned, err := repo.FindKeyVersion(ctx, key.ID, key.Version)
+
+		assertValue(t, err, nil)
+		if !reflect.DeepEqual(key, returned) {
+			t.Errorf("want %v, got %v", key, returned)
+		}
+	})
+
+	t.Run("not founding the version, return a ErrKeyNotFound", func(t *testing.T) {
+		mock.ExpectQuery(`
+			SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+				FROM keys
+				WHERE id = \$1 AND version = \$2`).
+			WithArgs(key.ID, 2).
+			WillReturnRows(sqlmock.NewRows([]string{}))
+
+		_, got := repo.FindKeyVersion(ctx, key.ID, 2)
+
+		assertValue(t, got, keys.ErrKeyNotFound)
+	})
+}
+
 func TestSQLFindKeysByScope(t *testing.T) {
 	db, mock, _ := sqlmock.New()
-	repo := SQLKeyRepository{db: db}
+	repo := NewSQLKeyRepository(db, keyring)
 	defer db.Close()
 
 	t.Run("calls db.QueryRow with the right params", func(t *testing.T) {
 		mock.ExpectQuery(`
-			SELECT id, scope, expiration, priv, pub
+			SELECT DISTINCT ON \(id\) id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 				FROM keys
 				WHERE scope`).WithArgs(key.Scope)
 
-		repo.FindKeysByScope(key.Scope)
+		repo.FindKeysByScope(ctx, key.Scope)
 
 		if err := mock.ExpectationsWereMet(); err != nil {
 			t.Errorf("SQL expectations failed: %s", err)
@@ -195,22 +364,22 @@ func TestSQLFindKeysByScope(t *testing.T) {
 
 	t.Run("returns a slice of Key objects", func(t *testing.T) {
 		rows := sqlmock.
-			NewRows([]string{"id", "scope", "expiration", "priv", "pub"}).
-			AddRow(key.ID, key.Scope, key.Expiration,
-				x509.MarshalPKCS1PrivateKey(key.Priv),
-				x509.MarshalPKCS1PublicKey(key.Pub)).
-			AddRow(key.ID, key.Scope, key.Expiration,
-				x509.MarshalPKCS1PrivateKey(key.Priv),
-				x509.MarshalPKCS1PublicKey(key.Pub))
+			NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, key.State, nil, "kek",
+				wrap(key),
+				pubDER(key)).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, key.State, nil, "kek",
+				wrap(key),
+				pubDER(key))
 		mock.
 			ExpectQuery(`
-				SELECT id, scope, expiration, priv, pub
+				SELECT DISTINCT ON \(id\) id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 					FROM keys
 					WHERE scope`).
 			WithArgs(key.Scope).
 			WillReturnRows(rows)
 
-		returnedSlice, err := repo.FindKeysByScope(key.Scope)
+		returnedSlice, err := repo.FindKeysByScope(ctx, key.Scope)
 
 		assertValue(t, err, nil)
 		assertValue(t, len(returnedSlice), 2)
@@ -224,27 +393,310 @@ func TestSQLFindKeysByScope(t *testing.T) {
 	t.Run("proxys the error from the sql db", func(t *testing.T) {
 		want := errors.New("an error")
 		mock.ExpectQuery(`
-			SELECT id, scope, expiration, priv, pub
+			SELECT DISTINCT ON \(id\) id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 				FROM keys
 				WHERE scope`).WithArgs(key.Scope).WillReturnError(want)
 
-		_, got := repo.FindKeysByScope(key.Scope)
+		_, got := repo.FindKeysByScope(ctx, key.Scope)
 
 		assertValue(t, got, want)
 	})
 
 	t.Run("not founding any key, return a empty slice", func(t *testing.T) {
 		mock.ExpectQuery(`
-			SELECT id, scope, expiration, priv, pub
+			SELECT DISTINCT ON \(id\) id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
 				FROM keys
 				WHERE scope`).WithArgs(key.Scope).WillReturnRows(sqlmock.NewRows([]string{}))
 
-		got, _ := repo.FindKeysByScope(key.Scope)
+		got, _ := repo.FindKeysByScope(ctx, key.Scope)
 
 		assertType(t, got, []keys.Key{})
 	})
 }
 
+func TestSQLFindPublicKeysByScope(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	repo := NewSQLKeyRepository(db, keyring)
+	defer db.Close()
+
+	at := time.Now()
+	query := `
+		SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, pub
+			FROM keys k
+			WHERE scope = \$1 AND expiration > \$2`
+
+	t.Run("returns the public keys without reading the private ones", func(t *testing.T) {
+		rows := sqlmock.
+			NewRows([]string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "pub"}).
+			AddRow(key.ID, key.Version, key.Scope, key.Expiration, key.Creation, key.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, key.State, nil, pubDER(key))
+		mock.ExpectQuery(query).WithArgs(key.Scope, at, keys.UseSigning).WillReturnRows(rows)
+
+		got, err := repo.FindPublicKeysByScope(ctx, key.Scope, at)
+
+		assertValue(t, err, nil)
+		if len(got) != 1 {
+			t.Fatalf("want 1 key, got %d", len(got))
+		}
+		want := key
+		want.Priv = nil
+		if !reflect.DeepEqual(want, got[0]) {
+			t.Errorf("want %v, got %v", want, got[0])
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+
+	t.Run("proxys the error from the sql db", func(t *testing.T) {
+		want := errors.New("an error")
+		mock.ExpectQuery(query).WithArgs(key.Scope, at, keys.UseSigning).WillReturnError(want)
+
+		_, got := repo.FindPublicKeysByScope(ctx, key.Scope, at)
+
+		assertValue(t, got, want)
+	})
+}
+
+func TestSQLFindKeysPage(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	repo := NewSQLKeyRepository(db, keyring)
+	defer db.Close()
+
+	columns := []string{"id", "version", "scope", "expiration", "creation", "key_use", "key_algorithms", "content_algorithms", "compression", "state", "deletion_date", "kek_id", "priv", "pub"}
+	row := func(k keys.Key) []driver.Value {
+		return []driver.Value{k.ID, k.Version, k.Scope, k.Expiration, k.Creation, k.Use, "RSA-OAEP-256,RSA-OAEP", "A256GCM", true, k.State, nil, "kek", wrap(k), pubDER(k)}
+	}
+
+	t.Run("reads one key more than the limit, sorted by creation", func(t *testing.T) {
+		mock.ExpectQuery(`
+			SELECT id, version, scope, expiration, creation, key_use, key_algorithms, content_algorithms, compression, state, deletion_date, kek_id, priv, pub
+				FROM keys k
+				WHERE scope = \$1 AND NOT EXISTS \(.*\)
+				ORDER BY creation ASC, id ASC
+				LIMIT \$2`).
+			WithArgs(key.Scope, 2).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(row(key)...))
+
+		page, err := repo.FindKeysPage(ctx, keys.KeyQuery{Scope: key.Scope, Limit: 1})
+
+		assertValue(t, err, nil)
+		assertValue(t, len(page.Keys), 1)
+		if page.Next != nil {
+			t.Errorf("want no next page, got %v", page.Next)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+
+	t.Run("returns the cursor of the last key when there are more", func(t *testing.T) {
+		next := key
+		next.ID = uuid.New().String()
+		mock.ExpectQuery(`SELECT .* FROM keys k`).
+			WillReturnRows(sqlmock.NewRows(columns).AddRow(row(key)...).AddRow(row(next)...))
+
+		page, err := repo.FindKeysPage(ctx, keys.KeyQuery{Scope: key.Scope, Limit: 1})
+
+		assertValue(t, err, nil)
+		assertValue(t, len(page.Keys), 1)
+		if page.Next == nil || page.Next.ID != key.ID || !page.Next.Value.Equal(key.Creation) {
+			t.Errorf("want the cursor of %s, got %v", key.ID, page.Next)
+		}
+	})
+
+	t.Run("adds the filters and the cursor to the statement", func(t *testing.T) {
+		after, before := time.Now(), time.Now().AddDate(0, 1, 0)
+		cursor := &keys.Cursor{SortBy: keys.SortByExpiration, Value: before, ID: key.ID}
+		mock.ExpectQuery(`
+			WHERE scope = \$1 AND NOT EXISTS \(.*\) AND state = ANY\(\$2\) AND key_type = ANY\(\$3\) AND expiration > \$4 AND expiration < \$5 AND \(expiration, id\) < \(\$6, \$7\)
+				ORDER BY expiration DESC, id DESC
+				LIMIT \$8`).
+			WithArgs(key.Scope, pq.Array([]string{"active", "disabled"}), pq.Array([]string{"P-256"}), after, before, before, key.ID, 11).
+			WillReturnRows(sqlmock.NewRows(columns))
+
+		page, err := repo.FindKeysPage(ctx, keys.KeyQuery{
+			Scope:         key.Scope,
+			States:        []keys.State{keys.StateActive, keys.StateDisabled},
+			Types:         []keys.KeyType{keys.TypeP256},
+			ExpiresAfter:  after,
+			ExpiresBefore: before,
+			SortBy:        keys.SortByExpiration,
+			Descending:    true,
+			Limit:         10,
+			After:         cursor,
+		})
+
+		assertValue(t, err, nil)
+		assertValue(t, len(page.Keys), 0)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+
+	t.Run("proxys the error from the sql db", func(t *testing.T) {
+		want := errors.New("an error")
+		mock.ExpectQuery(`SELECT .* FROM keys k`).WillReturnError(want)
+
+		_, got := repo.FindKeysPage(ctx, keys.KeyQuery{Scope: key.Scope})
+
+		assertValue(t, got, want)
+	})
+}
+
+func TestSQLUpdateKeyState(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	repo := NewSQLKeyRepository(db, keyring)
+	defer db.Close()
+
+	t.Run("updates the state of every version of the key", func(t *testing.T) {
+		deletionDate := time.Now().Add(time.Hour)
+		mock.ExpectExec("UPDATE keys SET state").
+			WithArgs(keys.StatePendingDeletion, deletionDate, key.ID, keys.StateActive).
+			WillReturnResult(sqlmock.NewResult(0, 2))
+
+		err := repo.UpdateKeyState(ctx, key.ID, keys.StateActive, keys.StatePendingDeletion, deletionDate)
+
+		assertValue(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+
+	t.Run("clears the deletion date when it is not set", func(t *testing.T) {
+		mock.ExpectExec("UPDATE keys SET state").
+			WithArgs(keys.StateActive, nil, key.ID, keys.StatePendingDeletion).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		err := repo.UpdateKeyState(ctx, key.ID, keys.StatePendingDeletion, keys.StateActive, time.Time{})
+
+		assertValue(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+
+	t.Run("not founding the key, return a ErrKeyNotFound", func(t *testing.T) {
+		mock.ExpectExec("UPDATE keys SET state").
+			WithArgs(keys.StateDisabled, nil, key.ID, keys.StateActive).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT EXISTS").
+			WithArgs(key.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(false))
+
+		got := repo.UpdateKeyState(ctx, key.ID, keys.StateActive, keys.StateDisabled, time.Time{})
+
+		assertValue(t, got, keys.ErrKeyNotFound)
+	})
+
+	t.Run("the key not being in the expected state, return a ErrInvalidStateTransition", func(t *testing.T) {
+		mock.ExpectExec("UPDATE keys SET state").
+			WithArgs(keys.StateActive, nil, key.ID, keys.StatePendingDeletion).
+			WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectQuery("SELECT EXISTS").
+			WithArgs(key.ID).
+			WillReturnRows(sqlmock.NewRows([]string{"exists"}).AddRow(true))
+
+		got := repo.UpdateKeyState(ctx, key.ID, keys.StatePendingDeletion, keys.StateActive, time.Time{})
+
+		assertValue(t, got, keys.ErrInvalidStateTransition)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+}
+
+func TestSQLDestroyKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	repo := NewSQLKeyRepository(db, keyring)
+	defer db.Close()
+
+	t.Run("wipes the private key of the keys pending deletion", func(t *testing.T) {
+		before := time.Now()
+		mock.ExpectExec(`UPDATE keys SET state = \$1, priv = NULL`).
+			WithArgs(keys.StateDestroyed, keys.StatePendingDeletion, before).
+			WillReturnResult(sqlmock.NewResult(0, 3))
+
+		got, err := repo.DestroyKeys(ctx, before)
+
+		assertValue(t, err, nil)
+		assertValue(t, got, 3)
+	})
+
+	t.Run("proxys the error from the sql db", func(t *testing.T) {
+		want := errors.New("an error")
+		mock.ExpectExec("UPDATE keys SET state").WillReturnError(want)
+
+		_, got := repo.DestroyKeys(ctx, time.Now())
+
+		assertValue(t, got, want)
+	})
+}
+
+func TestSQLRewrapKeys(t *testing.T) {
+	db, mock, _ := sqlmock.New()
+	repo := NewSQLKeyRepository(db, keyring)
+	defer db.Close()
+
+	t.Run("rewraps with the active KEK every key wrapped by another one", func(t *testing.T) {
+		oldKeyring, _ := kek.NewKeyring("old", map[string][]byte{"old": bytes.Repeat([]byte{1}, 32)})
+		plain := privDER(key)
+		_, oldWrapped, _ := oldKeyring.Wrap(plain, []byte(key.ID))
+
+		mock.ExpectQuery(`
+			SELECT id, version, kek_id, priv
+				FROM keys
+				WHERE kek_id IS DISTINCT FROM \$1 AND priv IS NOT NULL`).
+			WithArgs("kek").
+			WillReturnRows(sqlmock.
+				NewRows([]string{"id", "version", "kek_id", "priv"}).
+				AddRow(key.ID, key.Version, "old", oldWrapped).
+				AddRow("legacy", 1, nil, plain))
+		mock.ExpectExec("UPDATE keys SET kek_id").
+			WithArgs("kek", wrappedBy{key.ID, "kek", plain}, key.ID, key.Version, "old", keys.TypeRSA2048).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectExec("UPDATE keys SET kek_id").
+			WithArgs("kek", wrappedBy{"legacy", "kek", plain}, "legacy", 1, nil, keys.TypeRSA2048).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		got, err := repo.RewrapKeys(ctx)
+
+		assertValue(t, err, nil)
+		assertValue(t, got, 2)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+
+	t.Run("finds the type of the legacy PKCS #1 keys", func(t *testing.T) {
+		plain := x509.MarshalPKCS1PrivateKey(mockKeys)
+
+		mock.ExpectQuery("SELECT id, version, kek_id, priv").
+			WillReturnRows(sqlmock.
+				NewRows([]string{"id", "version", "kek_id", "priv"}).
+				AddRow("legacy", 1, nil, plain))
+		mock.ExpectExec(`UPDATE keys SET kek_id = \$1, priv = \$2, key_type = COALESCE\(key_type, \$6\)`).
+			WithArgs("kek", wrappedBy{"legacy", "kek", plain}, "legacy", 1, nil, keys.TypeRSA2048).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+
+		got, err := repo.RewrapKeys(ctx)
+
+		assertValue(t, err, nil)
+		assertValue(t, got, 1)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+
+	t.Run("proxys the error from the sql db", func(t *testing.T) {
+		want := errors.New("an error")
+		mock.ExpectQuery("SELECT id, version, kek_id, priv").WillReturnError(want)
+
+		_, got := repo.RewrapKeys(ctx)
+
+		assertValue(t, got, want)
+	})
+}
+
 func assertType(t *testing.T, got, want interface{}) {
 	t.Helper()
 	if reflect.TypeOf(got) != reflect.TypeOf(want) {
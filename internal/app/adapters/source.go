@@ -1,71 +1,308 @@
 package adapters
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
-	"io"
+	"errors"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/metrics"
+	"github.com/lestrrat-go/jwx/x25519"
 )
 
+// ErrUnknownKeyType the source can not generate keys of the requested type
+var ErrUnknownKeyType = errors.New("unknown key type")
+
 // SynchronousKeySource simple key source
 type SynchronousKeySource struct{}
 
-// Take Takes one key from the source
-func (s *SynchronousKeySource) Take() (*rsa.PrivateKey, error) {
-	return rsa.GenerateKey(rand.Reader, 2048)
+// Take Takes one key from the source, nothing is generated once the context
+// is done
+func (s *SynchronousKeySource) Take(ctx context.Context, t keys.KeyType) (keys.PrivateKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	var g KeyGenerator
+	return g.GenerateKey(t)
+}
+
+// FallbackKeySource takes the keys from the Fallback whenever the Primary
+// fails to provide one, unless the context is done
+type FallbackKeySource struct {
+	Primary  keys.KeySource
+	Fallback keys.KeySource
+}
+
+// NewFallbackKeySource creates a FallbackKeySource
+func NewFallbackKeySource(primary keys.KeySource, fallback keys.KeySource) *FallbackKeySource {
+	return &FallbackKeySource{Primary: primary, Fallback: fallback}
+}
+
+// Take Takes one key from the Primary, or from the Fallback if it fails
+func (s *FallbackKeySource) Take(ctx context.Context, t keys.KeyType) (keys.PrivateKey, error) {
+	k, err := s.Primary.Take(ctx, t)
+	if err == nil && k != nil {
+		return k, nil
+	}
+	if ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	log.Printf("could not take a %s key, falling back: %v", t, err)
+	return s.Fallback.Take(ctx, t)
 }
 
 type keyGenerator interface {
-	GenerateKey(io.Reader, int) (*rsa.PrivateKey, error)
+	GenerateKey(keys.KeyType) (keys.PrivateKey, error)
 }
 
-// KeyGenerator Type created to be a proxy of rsa key generator
+// KeyGenerator Type created to be a proxy of the key generators of each type
 type KeyGenerator struct{}
 
-// GenerateKey proxy generates RSA Keys
-func (g *KeyGenerator) GenerateKey(r io.Reader, s int) (*rsa.PrivateKey, error) {
-	return rsa.GenerateKey(r, s)
+// GenerateKey proxy generates keys of the requested type
+func (g *KeyGenerator) GenerateKey(t keys.KeyType) (keys.PrivateKey, error) {
+	switch t {
+	case keys.TypeRSA2048:
+		return rsa.GenerateKey(rand.Reader, 2048)
+	case keys.TypeRSA3072:
+		return rsa.GenerateKey(rand.Reader, 3072)
+	case keys.TypeRSA4096:
+		return rsa.GenerateKey(rand.Reader, 4096)
+	case keys.TypeP256:
+		return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	case keys.TypeP384:
+		return ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	case keys.TypeEd25519:
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		return k, err
+	case keys.TypeX25519:
+		_, k, err := x25519.GenerateKey(rand.Reader)
+		return k, err
+	}
+	return nil, ErrUnknownKeyType
 }
 
-// NewPoolKeySource creates initialized PoolKeySource
-func NewPoolKeySource(keySize int, keyPoolSize int) PoolKeySource {
-	var s PoolKeySource
-	s.keySize = keySize
-	s.Kgen = &KeyGenerator{}
-	s.Pool = make(chan *rsa.PrivateKey, keyPoolSize)
+// PoolOptions tunes a PoolKeySource, the zero values fall back to the
+// defaults
+type PoolOptions struct {
+	// Size keys kept in the pool of each type, the high watermark
+	Size int
+	// LowWatermark a pool is refilled once it holds this many keys or less,
+	// half of the Size by default
+	LowWatermark int
+	// Workers goroutines refilling the pools, a pool is only refilled by one
+	// of them at a time
+	Workers int
+	// MinBackoff and MaxBackoff bound the wait before generating again after
+	// a generation failed, doubled on every consecutive failure
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+const (
+	defaultPoolWorkers = 2
+	defaultMinBackoff  = 100 * time.Millisecond
+	defaultMaxBackoff  = 30 * time.Second
+)
+
+func (o PoolOptions) withDefaults() PoolOptions {
+	if o.LowWatermark <= 0 || o.LowWatermark >= o.Size {
+		o.LowWatermark = o.Size / 2
+	}
+	if o.Workers <= 0 {
+		o.Workers = defaultPoolWorkers
+	}
+	if o.MinBackoff <= 0 {
+		o.MinBackoff = defaultMinBackoff
+	}
+	if o.MaxBackoff < o.MinBackoff {
+		o.MaxBackoff = defaultMaxBackoff
+	}
+	return o
+}
+
+// keyPool keys of a type waiting to be taken, refilling is set while the
+// pool is queued or being refilled, so it is never refilled twice at a time
+type keyPool struct {
+	t         keys.KeyType
+	keys      chan keys.PrivateKey
+	refilling int32
+	warm      sync.Once
+}
+
+// NewPoolKeySource creates a PoolKeySource keeping a pool for each one of the
+// key types, no pool is kept when the size is not positive. Nothing is
+// generated in the background until WarmUp
+func NewPoolKeySource(o PoolOptions, types []keys.KeyType) *PoolKeySource {
+	o = o.withDefaults()
+	s := &PoolKeySource{
+		Kgen:  &KeyGenerator{},
+		opts:  o,
+		pools: make(map[keys.KeyType]*keyPool, len(types)),
+		done:  make(chan struct{}),
+		warm:  make(chan struct{}),
+	}
+	if o.Size > 0 {
+		for _, t := range types {
+			s.pools[t] = &keyPool{t: t, keys: make(chan keys.PrivateKey, o.Size)}
+		}
+	}
+	s.cold = int32(len(s.pools))
+	s.refills = make(chan *keyPool, len(s.pools))
 	return s
 }
 
-// PoolKeySource a key source based on a pool of keys
+// PoolKeySource a key source based on a pool of keys per key type, refilled
+// in the background by a fixed number of workers once they drop to the low
+// watermark. Types without a pool, and the types whose pool is empty, are
+// generated when taken
 type PoolKeySource struct {
-	Pool    chan *rsa.PrivateKey
-	Kgen    keyGenerator
-	keySize int
+	Kgen keyGenerator
+
+	opts    PoolOptions
+	pools   map[keys.KeyType]*keyPool
+	refills chan *keyPool
+	done    chan struct{}
+	closing sync.Once
+	started sync.Once
+	workers sync.WaitGroup
+	cold    int32
+	warm    chan struct{}
 }
 
-// Take Takes one key from the source
-func (s *PoolKeySource) Take() (*rsa.PrivateKey, error) {
-	defer func() { go s.addKeyToPoll() }()
-	if len(s.Pool) > 0 {
-		k := <-s.Pool
+// Take Takes one key of the type from the source
+func (s *PoolKeySource) Take(ctx context.Context, t keys.KeyType) (keys.PrivateKey, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	pool, ok := s.pools[t]
+	if !ok {
+		return s.generate(t)
+	}
+
+	select {
+	case k := <-pool.keys:
+		depth := len(pool.keys)
+		metrics.SetPoolDepth(string(t), depth)
+		if depth <= s.opts.LowWatermark {
+			s.refill(pool)
+		}
 		return k, nil
+	default:
+		metrics.CountPoolMiss(string(t))
+		s.refill(pool)
+		return s.generate(t)
 	}
-	return s.Kgen.GenerateKey(rand.Reader, s.keySize)
 }
 
-func (s *PoolKeySource) addKeyToPoll() {
-	if len(s.Pool) < cap(s.Pool) {
-		k, _ := s.Kgen.GenerateKey(rand.Reader, s.keySize)
-		s.Pool <- k
+// WarmUp starts the refill workers and queues every pool to be filled up,
+// without waiting for them. The returned channel is closed once every pool
+// was full for the first time
+func (s *PoolKeySource) WarmUp() <-chan struct{} {
+	s.started.Do(func() {
+		if s.cold == 0 {
+			close(s.warm)
+		}
+		s.workers.Add(s.opts.Workers)
+		for i := 0; i < s.opts.Workers; i++ {
+			go s.work()
+		}
+		for _, pool := range s.pools {
+			s.refill(pool)
+		}
+	})
+	return s.warm
+}
+
+// Close stops the refill workers, waiting for the generations in course.
+// Keys are still generated when taken
+func (s *PoolKeySource) Close() error {
+	s.closing.Do(func() { close(s.done) })
+	s.workers.Wait()
+	return nil
+}
+
+// refill queues the pool to a worker, unless it is already queued or being
+// refilled
+func (s *PoolKeySource) refill(pool *keyPool) {
+	if atomic.CompareAndSwapInt32(&pool.refilling, 0, 1) {
+		s.refills <- pool
 	}
 }
 
-// WarmUp fills the bufered channel with keys
-func (s *PoolKeySource) WarmUp() {
-	for len(s.Pool) < cap(s.Pool) {
-		k, err := s.Kgen.GenerateKey(rand.Reader, s.keySize)
+func (s *PoolKeySource) work() {
+	defer s.workers.Done()
+	for {
+		select {
+		case <-s.done:
+			return
+		case pool := <-s.refills:
+			s.fill(pool)
+			atomic.StoreInt32(&pool.refilling, 0)
+			// keys taken while the pool was being refilled, after it was full
+			if len(pool.keys) <= s.opts.LowWatermark {
+				s.refill(pool)
+			}
+		}
+	}
+}
+
+// fill generates keys until the pool is full, backing off after every
+// failed generation. Only one worker fills a pool at a time and Take only
+// removes keys from it, so the sends never block
+func (s *PoolKeySource) fill(pool *keyPool) {
+	backoff := s.opts.MinBackoff
+	for len(pool.keys) < cap(pool.keys) {
+		select {
+		case <-s.done:
+			return
+		default:
+		}
+
+		k, err := s.generate(pool.t)
 		if err != nil {
-			panic(err)
+			log.Printf("could not generate a %s key for the pool, retrying in %v: %v", pool.t, backoff, err)
+			select {
+			case <-s.done:
+				return
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > s.opts.MaxBackoff {
+				backoff = s.opts.MaxBackoff
+			}
+			continue
 		}
-		s.Pool <- k
+		backoff = s.opts.MinBackoff
+
+		select {
+		case pool.keys <- k:
+		default:
+		}
+		metrics.SetPoolDepth(string(pool.t), len(pool.keys))
+	}
+
+	pool.warm.Do(func() {
+		if atomic.AddInt32(&s.cold, -1) == 0 {
+			close(s.warm)
+		}
+	})
+}
+
+// generate generates a key of the type, timing the generation
+func (s *PoolKeySource) generate(t keys.KeyType) (keys.PrivateKey, error) {
+	defer metrics.ObserveKeyGeneration(string(t), time.Now())
+	k, err := s.Kgen.GenerateKey(t)
+	if err != nil {
+		metrics.CountKeyGenerationError(string(t))
+		return nil, err
 	}
+	return k, nil
 }
@@ -1,76 +1,328 @@
 package adapters
 
 import (
-	"crypto/rsa"
-	"io"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"errors"
 	"sync"
 	"testing"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/lestrrat-go/jwx/x25519"
 )
 
 type keyGeneratorStub struct {
 	called int
+	fails  int
 	mu     sync.Mutex
 }
 
-func (g *keyGeneratorStub) GenerateKey(r io.Reader, s int) (*rsa.PrivateKey, error) {
+var errGeneration = errors.New("generation failed")
+
+func (g *keyGeneratorStub) GenerateKey(t keys.KeyType) (keys.PrivateKey, error) {
 	g.mu.Lock()
 	g.called++
+	fail := g.fails > 0
+	if fail {
+		g.fails--
+	}
 	g.mu.Unlock()
 
-	return rsa.GenerateKey(r, s)
+	if fail {
+		return nil, errGeneration
+	}
+	var kg KeyGenerator
+	return kg.GenerateKey(t)
+}
+
+func (g *keyGeneratorStub) calls() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.called
 }
 
 func TestSyncTake(t *testing.T) {
 	keySource := SynchronousKeySource{}
 
 	t.Run("Should return a valid rsa PrivKey", func(t *testing.T) {
-		got, _ := keySource.Take()
+		got, _ := keySource.Take(ctx, keys.TypeRSA2048)
 		want := mockKeys
 
 		assertType(t, got, want)
 	})
+	t.Run("Should return a key of each requested type", func(t *testing.T) {
+		ec, _ := keySource.Take(ctx, keys.TypeP256)
+		ed, _ := keySource.Take(ctx, keys.TypeEd25519)
+		x, _ := keySource.Take(ctx, keys.TypeX25519)
+
+		assertType(t, ec, &ecdsa.PrivateKey{})
+		assertType(t, ed, ed25519.PrivateKey{})
+		assertType(t, x, x25519.PrivateKey{})
+	})
+	t.Run("Should refuse an unknown type", func(t *testing.T) {
+		_, err := keySource.Take(ctx, keys.KeyType("DSA"))
+
+		assertValue(t, err, ErrUnknownKeyType)
+	})
+	t.Run("Should not generate keys once the context is done", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := keySource.Take(cancelled, keys.TypeRSA2048)
+
+		assertValue(t, err, context.Canceled)
+	})
 }
 
 func TestPoolTake(t *testing.T) {
-	keyGenStub := keyGeneratorStub{}
-	keySource := PoolKeySource{make(chan *rsa.PrivateKey, 2), &keyGenStub, 2048}
+	newSource := func(g *keyGeneratorStub) *PoolKeySource {
+		s := NewPoolKeySource(PoolOptions{Size: 4, LowWatermark: 2}, []keys.KeyType{keys.TypeP256})
+		s.Kgen = g
+		return s
+	}
 
-	t.Run("returns a valid rsa PrivKey", func(t *testing.T) {
-		got, _ := keySource.Take()
-		want := mockKeys
+	t.Run("pops a key from the pool without generating one", func(t *testing.T) {
+		keyGenStub := keyGeneratorStub{}
+		keySource := newSource(&keyGenStub)
+		pool := keySource.pools[keys.TypeP256]
+		for i := 0; i < 4; i++ {
+			pool.keys <- &ecdsa.PrivateKey{}
+		}
 
-		<-keySource.Pool
-		assertType(t, got, want)
+		got, err := keySource.Take(ctx, keys.TypeP256)
+
+		assertValue(t, err, nil)
+		assertType(t, got, &ecdsa.PrivateKey{})
+		assertValue(t, keyGenStub.calls(), 0)
+		assertValue(t, len(pool.keys), 3)
 	})
-	t.Run("if there is no keys in the pool calls GenerateKey, and create one ascyncronouslly", func(t *testing.T) {
-		keyGenStub.called = 0
-		got, _ := keySource.Take()
-		want := mockKeys
+	t.Run("queues a refill once the pool drops to the low watermark", func(t *testing.T) {
+		keySource := newSource(&keyGeneratorStub{})
+		pool := keySource.pools[keys.TypeP256]
+		for i := 0; i < 3; i++ {
+			pool.keys <- &ecdsa.PrivateKey{}
+		}
 
-		<-keySource.Pool
-		assertType(t, got, want)
+		keySource.Take(ctx, keys.TypeP256)
+
+		assertValue(t, len(keySource.refills), 1)
+		keySource.Take(ctx, keys.TypeP256)
+		assertValue(t, len(keySource.refills), 1)
+	})
+	t.Run("generates the key when the pool is empty", func(t *testing.T) {
+		keyGenStub := keyGeneratorStub{}
+		keySource := newSource(&keyGenStub)
+
+		got, err := keySource.Take(ctx, keys.TypeP256)
+
+		assertValue(t, err, nil)
+		assertType(t, got, &ecdsa.PrivateKey{})
+		assertValue(t, keyGenStub.calls(), 1)
+		assertValue(t, len(keySource.refills), 1)
+	})
+	t.Run("returns the generation error when the pool is empty", func(t *testing.T) {
+		keySource := newSource(&keyGeneratorStub{fails: 1})
+
+		got, err := keySource.Take(ctx, keys.TypeP256)
+
+		assertValue(t, err, errGeneration)
+		assertValue(t, got, nil)
 	})
-	t.Run("if there is keys in the pool should not call GenerateKey, pop one key and create one ascyncronouslly", func(t *testing.T) {
-		keySource.Pool <- mockKeys
-		keyGenStub.called = 0
-		keySource.Take()
+	t.Run("generates the types without a pool when taken", func(t *testing.T) {
+		keyGenStub := keyGeneratorStub{}
+		keySource := newSource(&keyGenStub)
+
+		got, _ := keySource.Take(ctx, keys.TypeEd25519)
 
-		<-keySource.Pool
-		assertValue(t, keyGenStub.called, 1)
-		assertValue(t, len(keySource.Pool), 0)
+		assertType(t, got, ed25519.PrivateKey{})
+		assertValue(t, keyGenStub.calls(), 1)
+		assertValue(t, len(keySource.refills), 0)
+	})
+	t.Run("does not generate keys once the context is done", func(t *testing.T) {
+		keyGenStub := keyGeneratorStub{}
+		keySource := newSource(&keyGenStub)
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		_, err := keySource.Take(cancelled, keys.TypeP256)
+
+		assertValue(t, err, context.Canceled)
+		assertValue(t, keyGenStub.calls(), 0)
+	})
+	t.Run("keeps no pool when the size is not positive", func(t *testing.T) {
+		keySource := NewPoolKeySource(PoolOptions{}, []keys.KeyType{keys.TypeP256})
+
+		got, _ := keySource.Take(ctx, keys.TypeP256)
+
+		assertType(t, got, &ecdsa.PrivateKey{})
+		assertValue(t, len(keySource.pools), 0)
+		<-keySource.WarmUp()
+		keySource.Close()
 	})
 }
 
 func TestPoolWarmUp(t *testing.T) {
-	keyGenStub := keyGeneratorStub{}
-	keySource := PoolKeySource{make(chan *rsa.PrivateKey, 5), &keyGenStub, 2048}
-	t.Run("fills up the pool when called", func(t *testing.T) {
+	t.Run("fills up the pool of every type in the background", func(t *testing.T) {
+		keyGenStub := keyGeneratorStub{}
+		keySource := NewPoolKeySource(PoolOptions{Size: 5}, []keys.KeyType{keys.TypeP256, keys.TypeEd25519})
+		keySource.Kgen = &keyGenStub
+		defer keySource.Close()
+
+		waitFor(t, keySource.WarmUp())
+
+		for _, pool := range keySource.pools {
+			assertValue(t, len(pool.keys), cap(pool.keys))
+		}
+		assertValue(t, keyGenStub.calls(), 10)
+	})
+	t.Run("backs off and keeps no nil keys when the generation fails", func(t *testing.T) {
+		keyGenStub := keyGeneratorStub{fails: 3}
+		keySource := NewPoolKeySource(PoolOptions{Size: 3, MinBackoff: time.Millisecond, MaxBackoff: 2 * time.Millisecond}, []keys.KeyType{keys.TypeP256})
+		keySource.Kgen = &keyGenStub
+		defer keySource.Close()
+
+		waitFor(t, keySource.WarmUp())
+
+		pool := keySource.pools[keys.TypeP256]
+		assertValue(t, len(pool.keys), 3)
+		for i := 0; i < 3; i++ {
+			if k := <-pool.keys; k == nil {
+				t.Errorf("want a key, got nil")
+			}
+		}
+		assertValue(t, keyGenStub.calls(), 6)
+	})
+	t.Run("refills the pool back to the high watermark", func(t *testing.T) {
+		keySource := NewPoolKeySource(PoolOptions{Size: 4, LowWatermark: 1}, []keys.KeyType{keys.TypeP256})
+		keySource.Kgen = &keyGeneratorStub{}
+		defer keySource.Close()
+		waitFor(t, keySource.WarmUp())
+
+		for i := 0; i < 3; i++ {
+			keySource.Take(ctx, keys.TypeP256)
+		}
+
+		pool := keySource.pools[keys.TypeP256]
+		deadline := time.Now().Add(time.Second)
+		for len(pool.keys) < cap(pool.keys) && time.Now().Before(deadline) {
+			time.Sleep(time.Millisecond)
+		}
+		assertValue(t, len(pool.keys), 4)
+	})
+	t.Run("returns the same channel when called again", func(t *testing.T) {
+		keySource := NewPoolKeySource(PoolOptions{Size: 1}, []keys.KeyType{keys.TypeP256})
+		defer keySource.Close()
+
+		assertValue(t, keySource.WarmUp(), keySource.WarmUp())
+	})
+}
+
+func TestPoolClose(t *testing.T) {
+	t.Run("stops the workers while they back off", func(t *testing.T) {
+		keyGenStub := keyGeneratorStub{fails: 1000}
+		keySource := NewPoolKeySource(PoolOptions{Size: 2, MinBackoff: time.Hour, MaxBackoff: time.Hour}, []keys.KeyType{keys.TypeP256})
+		keySource.Kgen = &keyGenStub
+		warm := keySource.WarmUp()
+
+		closed := make(chan struct{})
+		go func() {
+			keySource.Close()
+			close(closed)
+		}()
+
+		waitFor(t, closed)
+		select {
+		case <-warm:
+			t.Errorf("want the pool not warm")
+		default:
+		}
+	})
+	t.Run("still generates the keys when taken", func(t *testing.T) {
+		keySource := NewPoolKeySource(PoolOptions{Size: 2}, []keys.KeyType{keys.TypeP256})
+		keySource.Kgen = &keyGeneratorStub{}
 		keySource.WarmUp()
-		wLen := len(keySource.Pool)
-		cap := cap(keySource.Pool)
+		keySource.Close()
+		keySource.Close()
+
+		for i := 0; i < 4; i++ {
+			got, err := keySource.Take(ctx, keys.TypeP256)
+			assertValue(t, err, nil)
+			assertType(t, got, &ecdsa.PrivateKey{})
+		}
+	})
+}
+
+type sourceStub struct {
+	key    keys.PrivateKey
+	err    error
+	called int
+}
+
+func (s *sourceStub) Take(ctx context.Context, t keys.KeyType) (keys.PrivateKey, error) {
+	s.called++
+	return s.key, s.err
+}
 
-		assertValue(t, wLen, cap)
+func TestFallbackTake(t *testing.T) {
+	t.Run("takes the key from the primary source", func(t *testing.T) {
+		primary, fallback := &sourceStub{key: mockKeys}, &sourceStub{}
+		keySource := NewFallbackKeySource(primary, fallback)
+
+		got, err := keySource.Take(ctx, keys.TypeRSA2048)
+
+		assertValue(t, err, nil)
+		assertType(t, got, mockKeys)
+		assertValue(t, fallback.called, 0)
+	})
+	t.Run("takes the key from the fallback when the primary fails", func(t *testing.T) {
+		primary, fallback := &sourceStub{err: errGeneration}, &sourceStub{key: mockKeys}
+		keySource := NewFallbackKeySource(primary, fallback)
+
+		got, err := keySource.Take(ctx, keys.TypeRSA2048)
+
+		assertValue(t, err, nil)
+		assertType(t, got, mockKeys)
+		assertValue(t, fallback.called, 1)
 	})
+	t.Run("takes the key from the fallback when the primary returns none", func(t *testing.T) {
+		primary, fallback := &sourceStub{}, &sourceStub{key: mockKeys}
+		keySource := NewFallbackKeySource(primary, fallback)
+
+		keySource.Take(ctx, keys.TypeRSA2048)
+
+		assertValue(t, fallback.called, 1)
+	})
+	t.Run("returns the fallback error when both fail", func(t *testing.T) {
+		fallbackErr := errors.New("fallback failed")
+		keySource := NewFallbackKeySource(&sourceStub{err: errGeneration}, &sourceStub{err: fallbackErr})
+
+		_, err := keySource.Take(ctx, keys.TypeRSA2048)
+
+		assertValue(t, err, fallbackErr)
+	})
+	t.Run("does not fall back once the context is done", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		fallback := &sourceStub{key: mockKeys}
+		keySource := NewFallbackKeySource(&sourceStub{err: context.Canceled}, fallback)
+
+		_, err := keySource.Take(cancelled, keys.TypeRSA2048)
+
+		assertValue(t, err, context.Canceled)
+		assertValue(t, fallback.called, 0)
+	})
+}
+
+func waitFor(t *testing.T, c <-chan struct{}) {
+	t.Helper()
+
+	select {
+	case <-c:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("timed out waiting")
+	}
 }
 
 func assertValue(t *testing.T, g, w interface{}) {
@@ -0,0 +1,23 @@
+package server
+
+import (
+	"net/http"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/ports"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
+)
+
+func newAuthMiddleware(a Authenticator) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			cred, err := a.Authenticate(r)
+			if err != nil {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="gocrypto"`)
+				ports.Unauthorized(w)
+				return
+			}
+
+			h.ServeHTTP(w, r.WithContext(auth.NewContext(r.Context(), cred)))
+		})
+	}
+}
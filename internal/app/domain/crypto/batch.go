@@ -0,0 +1,134 @@
+package crypto
+
+import (
+	"context"
+	"fmt"
+	"sync"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+)
+
+// batchWorkers most items of a batch processed at the same time
+const batchWorkers = 8
+
+// EncryptItem content to be encrypted by a key within the batch scope
+type EncryptItem struct {
+	KeyID string
+	Data  []byte
+}
+
+// DecryptItem JWE to be decrypted by a key within the batch scope
+type DecryptItem struct {
+	KeyID string
+	Data  string
+}
+
+// BatchResult outcome of a single item, in the position of the item
+type BatchResult struct {
+	Data []byte
+	Err  error
+}
+
+// EncryptBatch Encrypts every item as Encrypt would, each distinct key is
+// only looked up once for the whole batch. An item failing does not stop
+// the others, its error is returned in its own result
+func (s *CryptoService) EncryptBatch(ctx context.Context, scope string, algs Algorithms, items []EncryptItem) []BatchResult {
+	return s.batch(len(items), func(bs *CryptoService, i int) ([]byte, error) {
+		return bs.Encrypt(ctx, items[i].KeyID, scope, items[i].Data, algs)
+	})
+}
+
+// DecryptBatch Decrypts every item as Decrypt would, each distinct key
+// version is only looked up once for the whole batch. An item failing does
+// not stop the others, its error is returned in its own result
+func (s *CryptoService) DecryptBatch(ctx context.Context, scope string, items []DecryptItem) []BatchResult {
+	return s.batch(len(items), func(bs *CryptoService, i int) ([]byte, error) {
+		return bs.Decrypt(ctx, items[i].KeyID, scope, items[i].Data)
+	})
+}
+
+// batch runs the items on a bounded pool of workers, sharing a service that
+// remembers the keys found for the batch
+func (s *CryptoService) batch(n int, do func(*CryptoService, int) ([]byte, error)) []BatchResult {
+	bs := *s
+	bs.finder = newBatchFinder(s.finder)
+
+	workers := batchWorkers
+	if n < workers {
+		workers = n
+	}
+
+	results := make([]BatchResult, n)
+	items := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range items {
+				data, err := do(&bs, i)
+				results[i] = BatchResult{Data: data, Err: err}
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		items <- i
+	}
+	close(items)
+	wg.Wait()
+
+	return results
+}
+
+// batchFinder finds every key once, the workers asking for a key already
+// being looked up wait for that lookup instead of repeating it. Errors are
+// remembered too, so a missing key is not looked up again by every item
+type batchFinder struct {
+	finder KeyFinder
+	mu     sync.Mutex
+	finds  map[string]*batchFind
+}
+
+type batchFind struct {
+	done chan struct{}
+	key  keys.Key
+	err  error
+}
+
+func newBatchFinder(f KeyFinder) *batchFinder {
+	return &batchFinder{
+		finder: f,
+		finds:  map[string]*batchFind{},
+	}
+}
+
+func (f *batchFinder) FindScopedKey(ctx context.Context, id string, scope string) (keys.Key, error) {
+	return f.find(fmt.Sprintf("%s/%s", scope, id), func() (keys.Key, error) {
+		return f.finder.FindScopedKey(ctx, id, scope)
+	})
+}
+
+func (f *batchFinder) FindScopedKeyVersion(ctx context.Context, id string, version int, scope string) (keys.Key, error) {
+	return f.find(fmt.Sprintf("%s/%s/%d", scope, id, version), func() (keys.Key, error) {
+		return f.finder.FindScopedKeyVersion(ctx, id, version, scope)
+	})
+}
+
+func (f *batchFinder) find(name string, lookup func() (keys.Key, error)) (keys.Key, error) {
+	f.mu.Lock()
+	bf, found := f.finds[name]
+	if !found {
+		bf = &batchFind{done: make(chan struct{})}
+		f.finds[name] = bf
+	}
+	f.mu.Unlock()
+
+	if found {
+		<-bf.done
+		return bf.key, bf.err
+	}
+
+	bf.key, bf.err = lookup()
+	close(bf.done)
+	return bf.key, bf.err
+}
@@ -0,0 +1,13 @@
+package crypto
+
+import (
+	"context"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+)
+
+// KeyFinder Scoped key lookup interface to serve cryptoService
+type KeyFinder interface {
+	FindScopedKey(context.Context, string, string) (keys.Key, error)
+	FindScopedKeyVersion(context.Context, string, int, string) (keys.Key, error)
+}
@@ -1,45 +1,159 @@
 package crypto
 
 import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/metrics"
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwe"
 )
 
+var (
+	// ErrKIDMismatch the JWE kid header does not belong to the requested key
+	ErrKIDMismatch = errors.New("jwe kid does not match the requested key")
+	// ErrAlgorithmNotAllowed the JWE algorithms are outside of the key policy
+	ErrAlgorithmNotAllowed = errors.New("algorithm is not allowed by the key policy")
+	// ErrMalformedJWE the encrypted data is not a JWE
+	ErrMalformedJWE = errors.New("malformed jwe")
+	// ErrDecryptionFailed the JWE could not be decrypted by the key, it was
+	// tampered with or encrypted by another key
+	ErrDecryptionFailed = errors.New("jwe could not be decrypted")
+)
+
+// Algorithms JWE algorithms picked by the client, the empty ones follow the
+// first algorithm of the key policy
+type Algorithms struct {
+	Key      string
+	Content  string
+	Compress bool
+}
+
 type CryptoService struct {
-	repo Repository
+	finder       KeyFinder
+	decryptGrace time.Duration
 }
 
-// NewCryptoService creates a new crypto service
-func NewCryptoService(r Repository) CryptoService {
+// NewCryptoService creates a new crypto service, decryptGrace is the window
+// after expiration where a key can still be used to decrypt
+func NewCryptoService(f KeyFinder, decryptGrace time.Duration) CryptoService {
 	return CryptoService{
-		repo: r,
+		finder:       f,
+		decryptGrace: decryptGrace,
 	}
 }
 
-// Encrypt Encrypts the content in a JWE Wrapper
-func (s *CryptoService) Encrypt(keyID string, m string) ([]byte, error) {
-	key, err := s.repo.FindKey(keyID)
+// Encrypt Encrypts the content in a JWE Wrapper using the newest version of
+// a key within the scope, the version used is identified by the kid header
+// and the algorithms have to be allowed by the key policy. The content is
+// taken as is, binary content included
+func (s *CryptoService) Encrypt(ctx context.Context, keyID string, scope string, m []byte, algs Algorithms) ([]byte, error) {
+	encrypted, key, err := s.encrypt(ctx, keyID, scope, m, algs)
+	metrics.CountOperation("encrypt", key.Scope, err)
+	return encrypted, err
+}
+
+func (s *CryptoService) encrypt(ctx context.Context, keyID string, scope string, m []byte, algs Algorithms) ([]byte, keys.Key, error) {
+	key, err := s.finder.FindScopedKey(ctx, keyID, scope)
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, keys.Key{}, err
+	}
+
+	if err := key.UsableFor(keys.UseEncryption); err != nil {
+		return []byte{}, key, err
+	}
+
+	if key.ExpiredAt(time.Now()) {
+		return []byte{}, key, keys.ErrKeyExpired
+	}
+
+	policy := key.EncryptionPolicy()
+	if algs.Key == "" {
+		algs.Key = policy.KeyAlgorithms[0]
+	}
+	if algs.Content == "" {
+		algs.Content = policy.ContentAlgorithms[0]
+	}
+	if !policy.Allows(algs.Key, algs.Content, algs.Compress) {
+		return []byte{}, key, ErrAlgorithmNotAllowed
 	}
 
-	msg, err := jwe.Encrypt([]byte(m), jwa.RSA_OAEP_256, key.Pub, jwa.A256CBC_HS512, jwa.NoCompress)
+	compression := jwa.NoCompress
+	if algs.Compress {
+		compression = jwa.Deflate
+	}
+
+	h := jwe.NewHeaders()
+	if err := h.Set(jwe.KeyIDKey, key.KID()); err != nil {
+		return []byte{}, key, err
+	}
+
+	msg, err := jwe.Encrypt(m, jwa.KeyEncryptionAlgorithm(algs.Key), key.Pub, jwa.ContentEncryptionAlgorithm(algs.Content), compression, jwe.WithProtectedHeaders(h))
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, key, err
 	}
-	return msg, nil
+	return msg, key, nil
 }
 
-// Decrypt Decrypts the JWE and return de message
-func (s *CryptoService) Decrypt(keyID string, m string) ([]byte, error) {
-	key, err := s.repo.FindKey(keyID)
+// Decrypt Decrypts the JWE and return de message using the version of a key
+// within the scope pointed by the kid header, JWEs using algorithms outside of
+// the key policy are refused
+func (s *CryptoService) Decrypt(ctx context.Context, keyID string, scope string, m string) ([]byte, error) {
+	decrypted, key, err := s.decrypt(ctx, keyID, scope, []byte(m))
+	metrics.CountOperation("decrypt", key.Scope, err)
+	return decrypted, err
+}
+
+func (s *CryptoService) decrypt(ctx context.Context, keyID string, scope string, m []byte) ([]byte, keys.Key, error) {
+	msg, err := jwe.Parse(m)
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, keys.Key{}, ErrMalformedJWE
 	}
+	headers := msg.ProtectedHeaders()
 
-	msg, err := jwe.Decrypt([]byte(m), jwa.RSA_OAEP_256, key.Priv)
+	version, err := kidVersion(keyID, headers.KeyID())
 	if err != nil {
-		return []byte{}, err
+		return []byte{}, keys.Key{}, err
+	}
+
+	key, err := s.finder.FindScopedKeyVersion(ctx, keyID, version, scope)
+	if err != nil {
+		return []byte{}, keys.Key{}, err
+	}
+
+	if err := key.UsableFor(keys.UseEncryption); err != nil {
+		return []byte{}, key, err
+	}
+
+	if key.ExpiredAt(time.Now().Add(-s.decryptGrace)) {
+		return []byte{}, key, keys.ErrKeyExpired
+	}
+
+	compressed := headers.Compression() != jwa.NoCompress
+	if !key.EncryptionPolicy().Allows(headers.Algorithm().String(), headers.ContentEncryption().String(), compressed) {
+		return []byte{}, key, ErrAlgorithmNotAllowed
 	}
-	return msg, nil
+
+	decrypted, err := jwe.Decrypt(m, headers.Algorithm(), key.Priv)
+	if err != nil {
+		return []byte{}, key, ErrDecryptionFailed
+	}
+	return decrypted, key, nil
+}
+
+// kidVersion finds which version of the key was used to encrypt, JWEs
+// without a kid were created before the keys were versioned
+func kidVersion(keyID string, kid string) (int, error) {
+	if kid == "" {
+		return keys.FirstVersion, nil
+	}
+
+	id, version, err := keys.ParseKID(kid)
+	if err != nil || id != keyID {
+		return 0, ErrKIDMismatch
+	}
+
+	return version, nil
 }
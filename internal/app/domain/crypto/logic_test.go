@@ -1,37 +1,156 @@
 package crypto
 
 import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/metrics"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/stream"
 	"github.com/lestrrat-go/jwx/jwa"
 	"github.com/lestrrat-go/jwx/jwe"
+	"github.com/lestrrat-go/jwx/x25519"
 )
 
+// ctx the services are called without deadline
+var ctx = context.Background()
+
 var (
-	rsaKey, _ = rsa.GenerateKey(rand.Reader, 2048)
-	key       = keys.Key{
+	rsaKey, _    = rsa.GenerateKey(rand.Reader, 2048)
+	oldRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	oldKey       = keys.Key{
 		Scope:      "scope",
 		ID:         "id",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseEncryption,
+		Priv:       oldRSAKey,
+		Pub:        &oldRSAKey.PublicKey,
+	}
+	key = keys.Key{
+		Scope:      "scope",
+		ID:         "id",
+		Version:    2,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseEncryption,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}
+	expiredKey = keys.Key{
+		Scope:      "scope",
+		ID:         "expired",
+		Version:    1,
+		Expiration: time.Now().Add(-time.Hour),
+		Use:        keys.UseEncryption,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}
+	disabledKey = keys.Key{
+		Scope:      "scope",
+		ID:         "disabled",
+		Version:    1,
 		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseEncryption,
+		State:      keys.StateDisabled,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}
+	ecPriv, _ = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	ecKey     = keys.Key{
+		Scope:      "scope",
+		ID:         "ec",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseEncryption,
+		Priv:       ecPriv,
+		Pub:        &ecPriv.PublicKey,
+	}
+	xPub, xPriv, _ = x25519.GenerateKey(rand.Reader)
+	xKey           = keys.Key{
+		Scope:      "scope",
+		ID:         "x25519",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseEncryption,
+		Priv:       xPriv,
+		Pub:        xPub,
+	}
+	policyKey = keys.Key{
+		Scope:      "scope",
+		ID:         "policy",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseEncryption,
+		Policy: keys.Policy{
+			KeyAlgorithms:     []string{"RSA-OAEP", "RSA-OAEP-256"},
+			ContentAlgorithms: []string{"A256GCM", "A128GCM"},
+			Compression:       true,
+		},
+		Priv: rsaKey,
+		Pub:  &rsaKey.PublicKey,
+	}
+	signingKey = keys.Key{
+		Scope:      "scope",
+		ID:         "signing",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseSigning,
 		Priv:       rsaKey,
 		Pub:        &rsaKey.PublicKey,
 	}
 )
 
-type RepositoryStub struct{}
+type KeyFinderStub struct{}
 
-func (r *RepositoryStub) FindKey(id string) (keys.Key, error) {
-	return key, nil
+func (f *KeyFinderStub) FindScopedKey(ctx context.Context, id string, scope string) (keys.Key, error) {
+	k := key
+	if id == expiredKey.ID {
+		k = expiredKey
+	}
+	if id == disabledKey.ID {
+		k = disabledKey
+	}
+	for _, candidate := range []keys.Key{ecKey, xKey, policyKey, signingKey} {
+		if id == candidate.ID {
+			k = candidate
+		}
+	}
+	if k.Scope != scope {
+		return keys.Key{}, keys.ErrKeyOutOfScope
+	}
+	return k, nil
+}
+
+func (f *KeyFinderStub) FindScopedKeyVersion(ctx context.Context, id string, version int, scope string) (keys.Key, error) {
+	var k keys.Key
+	for _, candidate := range []keys.Key{oldKey, key, expiredKey, disabledKey, ecKey, xKey, policyKey, signingKey} {
+		if candidate.ID == id && candidate.Version == version {
+			k = candidate
+		}
+	}
+	if k.ID == "" {
+		return keys.Key{}, keys.ErrKeyNotFound
+	}
+	if k.Scope != scope {
+		return keys.Key{}, keys.ErrKeyOutOfScope
+	}
+	return k, nil
 }
 
 func TestCryptoEncrypt(t *testing.T) {
-	crypto := NewCryptoService(&RepositoryStub{})
+	crypto := NewCryptoService(&KeyFinderStub{}, 0)
 	t.Run("Should return a valid JWE", func(t *testing.T) {
-		got, _ := crypto.Encrypt("id", "testingOK")
+		got, _ := crypto.Encrypt(ctx, "id", "scope", []byte("testingOK"), Algorithms{})
 
 		if _, err := jwe.Decrypt(got, jwa.RSA_OAEP_256, key.Priv); err != nil {
 			t.Errorf("Invalid jwe: %v", err)
@@ -39,7 +158,7 @@ func TestCryptoEncrypt(t *testing.T) {
 	})
 	t.Run("Should be able to decrypt back", func(t *testing.T) {
 		want := "test"
-		encrypted, _ := crypto.Encrypt("id", want)
+		encrypted, _ := crypto.Encrypt(ctx, "id", "scope", []byte(want), Algorithms{})
 
 		decrypted, _ := jwe.Decrypt(encrypted, jwa.RSA_OAEP_256, key.Priv)
 		got := string(decrypted)
@@ -48,19 +167,493 @@ func TestCryptoEncrypt(t *testing.T) {
 			t.Errorf("want %v, got %v", want, string(got))
 		}
 	})
+	t.Run("Should use ECDH-ES for the curve keys", func(t *testing.T) {
+		encrypted, _ := crypto.Encrypt(ctx, "ec", "scope", []byte("test"), Algorithms{})
+
+		msg, _ := jwe.Parse(encrypted)
+		got := msg.ProtectedHeaders().Algorithm()
+
+		if got != jwa.ECDH_ES_A256KW {
+			t.Errorf("want %v, got %v", jwa.ECDH_ES_A256KW, got)
+		}
+	})
+	t.Run("Should use the first algorithms of the key policy by default", func(t *testing.T) {
+		encrypted, _ := crypto.Encrypt(ctx, "policy", "scope", []byte("test"), Algorithms{})
+
+		msg, _ := jwe.Parse(encrypted)
+		headers := msg.ProtectedHeaders()
+
+		if headers.Algorithm() != jwa.RSA_OAEP || headers.ContentEncryption() != jwa.A256GCM {
+			t.Errorf("want %v and %v, got %v and %v", jwa.RSA_OAEP, jwa.A256GCM, headers.Algorithm(), headers.ContentEncryption())
+		}
+	})
+	t.Run("Should use the requested algorithms within the key policy", func(t *testing.T) {
+		algs := Algorithms{Key: "RSA-OAEP-256", Content: "A128GCM", Compress: true}
+		encrypted, err := crypto.Encrypt(ctx, "policy", "scope", []byte("test"), algs)
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+
+		msg, _ := jwe.Parse(encrypted)
+		headers := msg.ProtectedHeaders()
+
+		if headers.Algorithm() != jwa.RSA_OAEP_256 || headers.ContentEncryption() != jwa.A128GCM || headers.Compression() != jwa.Deflate {
+			t.Errorf("want %v, got %v %v %v", algs, headers.Algorithm(), headers.ContentEncryption(), headers.Compression())
+		}
+	})
+	t.Run("Should refuse algorithms outside of the key policy", func(t *testing.T) {
+		tests := []struct {
+			keyID string
+			algs  Algorithms
+		}{
+			{"policy", Algorithms{Key: "RSA1_5"}},
+			{"policy", Algorithms{Content: "A256CBC-HS512"}},
+			{"id", Algorithms{Compress: true}},
+		}
+		for _, tt := range tests {
+			_, err := crypto.Encrypt(ctx, tt.keyID, "scope", []byte("test"), tt.algs)
+
+			if err != ErrAlgorithmNotAllowed {
+				t.Errorf("%v: want %v, got %v", tt.algs, ErrAlgorithmNotAllowed, err)
+			}
+		}
+	})
+	t.Run("Should identify the key version in the kid header", func(t *testing.T) {
+		encrypted, _ := crypto.Encrypt(ctx, "id", "scope", []byte("test"), Algorithms{})
+
+		msg, _ := jwe.Parse(encrypted)
+		got := msg.ProtectedHeaders().KeyID()
+
+		if got != key.KID() {
+			t.Errorf("want %v, got %v", key.KID(), got)
+		}
+	})
+	t.Run("Should refuse to encrypt with a key out of scope", func(t *testing.T) {
+		_, err := crypto.Encrypt(ctx, "id", "another scope", []byte("test"), Algorithms{})
+
+		if err != keys.ErrKeyOutOfScope {
+			t.Errorf("want %v, got %v", keys.ErrKeyOutOfScope, err)
+		}
+	})
+	t.Run("Should refuse to encrypt with a key that is not usable", func(t *testing.T) {
+		_, err := crypto.Encrypt(ctx, "disabled", "scope", []byte("test"), Algorithms{})
+
+		if err != keys.ErrKeyDisabled {
+			t.Errorf("want %v, got %v", keys.ErrKeyDisabled, err)
+		}
+	})
+	t.Run("Should refuse to encrypt with a signing key", func(t *testing.T) {
+		_, err := crypto.Encrypt(ctx, "signing", "scope", []byte("test"), Algorithms{})
+
+		if err != keys.ErrKeyWrongUse {
+			t.Errorf("want %v, got %v", keys.ErrKeyWrongUse, err)
+		}
+	})
+	t.Run("Should refuse to encrypt with an expired key", func(t *testing.T) {
+		_, err := crypto.Encrypt(ctx, "expired", "scope", []byte("test"), Algorithms{})
+
+		if err != keys.ErrKeyExpired {
+			t.Errorf("want %v, got %v", keys.ErrKeyExpired, err)
+		}
+	})
 }
 
 func TestCryptoDecrypt(t *testing.T) {
-	crypto := CryptoService{&RepositoryStub{}}
+	crypto := CryptoService{finder: &KeyFinderStub{}}
 	t.Run("Should be able to decrypt a encrypted message", func(t *testing.T) {
 		want := "test"
-		encrypted, _ := crypto.Encrypt("id", want)
+		encrypted, _ := crypto.Encrypt(ctx, "id", "scope", []byte(want), Algorithms{})
 
-		decrypted, _ := crypto.Decrypt("id", string(encrypted))
+		decrypted, _ := crypto.Decrypt(ctx, "id", "scope", string(encrypted))
 		got := string(decrypted)
 
 		if want != got {
 			t.Errorf("want %v, got %v", want, string(got))
 		}
 	})
+	t.Run("Should decrypt binary content back untouched", func(t *testing.T) {
+		want := []byte{0x89, 'P', 'N', 'G', 0x00, 0xff, 0xfe, 0x0a}
+		encrypted, _ := crypto.Encrypt(ctx, "id", "scope", want, Algorithms{})
+
+		decrypted, _ := crypto.Decrypt(ctx, "id", "scope", string(encrypted))
+
+		if !bytes.Equal(want, decrypted) {
+			t.Errorf("want %v, got %v", want, decrypted)
+		}
+	})
+	t.Run("Should decrypt back with every curve key type", func(t *testing.T) {
+		for _, id := range []string{"ec", "x25519"} {
+			want := "test"
+			encrypted, err := crypto.Encrypt(ctx, id, "scope", []byte(want), Algorithms{})
+			if err != nil {
+				t.Fatalf("%s: want no error, got %v", id, err)
+			}
+
+			decrypted, err := crypto.Decrypt(ctx, id, "scope", string(encrypted))
+			if err != nil {
+				t.Fatalf("%s: want no error, got %v", id, err)
+			}
+			if string(decrypted) != want {
+				t.Errorf("%s: want %v, got %v", id, want, string(decrypted))
+			}
+		}
+	})
+	t.Run("Should decrypt the algorithms allowed by the key policy", func(t *testing.T) {
+		algs := Algorithms{Key: "RSA-OAEP-256", Content: "A128GCM", Compress: true}
+		encrypted, _ := crypto.Encrypt(ctx, "policy", "scope", []byte("test"), algs)
+
+		decrypted, err := crypto.Decrypt(ctx, "policy", "scope", string(encrypted))
+
+		if err != nil || string(decrypted) != "test" {
+			t.Errorf("want %v, got %v and %v", "test", string(decrypted), err)
+		}
+	})
+	t.Run("Should refuse to decrypt algorithms outside of the key policy", func(t *testing.T) {
+		h := jwe.NewHeaders()
+		h.Set(jwe.KeyIDKey, key.KID())
+		encrypted, _ := jwe.Encrypt([]byte("test"), jwa.RSA_OAEP, key.Pub, jwa.A256CBC_HS512, jwa.NoCompress, jwe.WithProtectedHeaders(h))
+
+		_, err := crypto.Decrypt(ctx, "id", "scope", string(encrypted))
+
+		if err != ErrAlgorithmNotAllowed {
+			t.Errorf("want %v, got %v", ErrAlgorithmNotAllowed, err)
+		}
+	})
+	t.Run("Should decrypt with the older version pointed by the kid header", func(t *testing.T) {
+		want := "test"
+		h := jwe.NewHeaders()
+		h.Set(jwe.KeyIDKey, oldKey.KID())
+		encrypted, _ := jwe.Encrypt([]byte(want), jwa.RSA_OAEP_256, oldKey.Pub, jwa.A256CBC_HS512, jwa.NoCompress, jwe.WithProtectedHeaders(h))
+
+		decrypted, err := crypto.Decrypt(ctx, "id", "scope", string(encrypted))
+		got := string(decrypted)
+
+		if err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+		if want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+	t.Run("Should decrypt with the first version if there is no kid header", func(t *testing.T) {
+		want := "test"
+		encrypted, _ := jwe.Encrypt([]byte(want), jwa.RSA_OAEP_256, oldKey.Pub, jwa.A256CBC_HS512, jwa.NoCompress)
+
+		decrypted, _ := crypto.Decrypt(ctx, "id", "scope", string(encrypted))
+		got := string(decrypted)
+
+		if want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+	t.Run("Should refuse to decrypt if the kid belongs to another key", func(t *testing.T) {
+		encrypted, _ := crypto.Encrypt(ctx, "id", "scope", []byte("test"), Algorithms{})
+
+		_, err := crypto.Decrypt(ctx, "expired", "scope", string(encrypted))
+
+		if err != ErrKIDMismatch {
+			t.Errorf("want %v, got %v", ErrKIDMismatch, err)
+		}
+	})
+	t.Run("Should refuse to decrypt with a key out of scope", func(t *testing.T) {
+		encrypted, _ := crypto.Encrypt(ctx, "id", "scope", []byte("test"), Algorithms{})
+
+		_, err := crypto.Decrypt(ctx, "id", "another scope", string(encrypted))
+
+		if err != keys.ErrKeyOutOfScope {
+			t.Errorf("want %v, got %v", keys.ErrKeyOutOfScope, err)
+		}
+	})
+	t.Run("Should refuse to decrypt with a key that is not usable", func(t *testing.T) {
+		encrypted, _ := jwe.Encrypt([]byte("test"), jwa.RSA_OAEP_256, disabledKey.Pub, jwa.A256CBC_HS512, jwa.NoCompress)
+
+		_, err := crypto.Decrypt(ctx, "disabled", "scope", string(encrypted))
+
+		if err != keys.ErrKeyDisabled {
+			t.Errorf("want %v, got %v", keys.ErrKeyDisabled, err)
+		}
+	})
+	t.Run("Should refuse to decrypt with a signing key", func(t *testing.T) {
+		encrypted, _ := jwe.Encrypt([]byte("test"), jwa.RSA_OAEP_256, signingKey.Pub, jwa.A256CBC_HS512, jwa.NoCompress)
+
+		_, err := crypto.Decrypt(ctx, "signing", "scope", string(encrypted))
+
+		if err != keys.ErrKeyWrongUse {
+			t.Errorf("want %v, got %v", keys.ErrKeyWrongUse, err)
+		}
+	})
+	t.Run("Should refuse to decrypt with an expired key", func(t *testing.T) {
+		encrypted, _ := jwe.Encrypt([]byte("test"), jwa.RSA_OAEP_256, expiredKey.Pub, jwa.A256CBC_HS512, jwa.NoCompress)
+
+		_, err := crypto.Decrypt(ctx, "expired", "scope", string(encrypted))
+
+		if err != keys.ErrKeyExpired {
+			t.Errorf("want %v, got %v", keys.ErrKeyExpired, err)
+		}
+	})
+	t.Run("Should refuse to decrypt data that is not a JWE", func(t *testing.T) {
+		_, err := crypto.Decrypt(ctx, "id", "scope", "not a jwe")
+
+		if err != ErrMalformedJWE {
+			t.Errorf("want %v, got %v", ErrMalformedJWE, err)
+		}
+	})
+	t.Run("Should fail to decrypt a JWE encrypted by another key", func(t *testing.T) {
+		encrypted, _ := jwe.Encrypt([]byte("test"), jwa.RSA_OAEP_256, key.Pub, jwa.A256CBC_HS512, jwa.NoCompress)
+
+		_, err := crypto.Decrypt(ctx, "id", "scope", string(encrypted))
+
+		if err != ErrDecryptionFailed {
+			t.Errorf("want %v, got %v", ErrDecryptionFailed, err)
+		}
+	})
+	t.Run("Should decrypt with an expired key inside the grace window", func(t *testing.T) {
+		graceful := NewCryptoService(&KeyFinderStub{}, 2*time.Hour)
+		want := "test"
+		encrypted, _ := jwe.Encrypt([]byte(want), jwa.RSA_OAEP_256, expiredKey.Pub, jwa.A256CBC_HS512, jwa.NoCompress)
+
+		decrypted, err := graceful.Decrypt(ctx, "expired", "scope", string(encrypted))
+		got := string(decrypted)
+
+		if err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+		if want != got {
+			t.Errorf("want %v, got %v", want, got)
+		}
+	})
+}
+
+func TestCryptoStream(t *testing.T) {
+	crypto := NewCryptoService(&KeyFinderStub{}, 0)
+	payload := make([]byte, 3*stream.ChunkSize+100)
+	rand.Read(payload)
+
+	t.Run("Should decrypt back an encrypted stream", func(t *testing.T) {
+		for _, id := range []string{"id", "ec", "x25519"} {
+			var encrypted, decrypted bytes.Buffer
+			if err := crypto.EncryptStream(ctx, id, "scope", Algorithms{}, &encrypted, bytes.NewReader(payload)); err != nil {
+				t.Fatalf("%s: want no error, got %v", id, err)
+			}
+
+			err := crypto.DecryptStream(ctx, id, "scope", &decrypted, &encrypted)
+
+			if err != nil {
+				t.Fatalf("%s: want no error, got %v", id, err)
+			}
+			if !bytes.Equal(decrypted.Bytes(), payload) {
+				t.Errorf("%s: the payload did not round trip", id)
+			}
+		}
+	})
+	t.Run("Should wrap the data key with the newest version of the key", func(t *testing.T) {
+		var encrypted bytes.Buffer
+		crypto.EncryptStream(ctx, "id", "scope", Algorithms{}, &encrypted, bytes.NewReader(payload))
+
+		size := int(encrypted.Bytes()[7]) | int(encrypted.Bytes()[6])<<8
+		msg, err := jwe.Parse(encrypted.Bytes()[8 : 8+size])
+
+		if err != nil {
+			t.Fatalf("want a JWE header, got %v", err)
+		}
+		if kid := msg.ProtectedHeaders().KeyID(); kid != key.KID() {
+			t.Errorf("want %v, got %v", key.KID(), kid)
+		}
+	})
+	t.Run("Should not write anything when the key can not encrypt", func(t *testing.T) {
+		var encrypted bytes.Buffer
+
+		err := crypto.EncryptStream(ctx, "disabled", "scope", Algorithms{}, &encrypted, bytes.NewReader(payload))
+
+		if err != keys.ErrKeyDisabled {
+			t.Errorf("want %v, got %v", keys.ErrKeyDisabled, err)
+		}
+		if encrypted.Len() != 0 {
+			t.Errorf("want nothing written, got %d bytes", encrypted.Len())
+		}
+	})
+	t.Run("Should refuse streams without a valid header", func(t *testing.T) {
+		var encrypted bytes.Buffer
+		crypto.EncryptStream(ctx, "id", "scope", Algorithms{}, &encrypted, bytes.NewReader(payload))
+		tests := [][]byte{
+			[]byte("not a stream"),
+			append([]byte("GCS1\x00\x00\x00\x05"), "abcde"...),
+			append([]byte("GCS1\xff\xff\xff\xff"), encrypted.Bytes()[8:]...),
+		}
+		for _, tt := range tests {
+			err := crypto.DecryptStream(ctx, "id", "scope", &bytes.Buffer{}, bytes.NewReader(tt))
+
+			if err != ErrMalformedStream {
+				t.Errorf("want %v, got %v", ErrMalformedStream, err)
+			}
+		}
+	})
+	t.Run("Should refuse a stream cut short or tampered with", func(t *testing.T) {
+		var encrypted bytes.Buffer
+		crypto.EncryptStream(ctx, "id", "scope", Algorithms{}, &encrypted, bytes.NewReader(payload))
+		sealed := encrypted.Bytes()
+		tampered := append([]byte{}, sealed...)
+		tampered[len(tampered)-1] ^= 1
+
+		cut := crypto.DecryptStream(ctx, "id", "scope", &bytes.Buffer{}, bytes.NewReader(sealed[:len(sealed)-200]))
+		flipped := crypto.DecryptStream(ctx, "id", "scope", &bytes.Buffer{}, bytes.NewReader(tampered))
+
+		if cut != ErrCorruptedStream {
+			t.Errorf("want %v, got %v", ErrCorruptedStream, cut)
+		}
+		if flipped != ErrCorruptedStream {
+			t.Errorf("want %v, got %v", ErrCorruptedStream, flipped)
+		}
+	})
+	t.Run("Should refuse to decrypt with a key of another scope", func(t *testing.T) {
+		var encrypted bytes.Buffer
+		crypto.EncryptStream(ctx, "id", "scope", Algorithms{}, &encrypted, bytes.NewReader(payload))
+
+		err := crypto.DecryptStream(ctx, "id", "other", &bytes.Buffer{}, &encrypted)
+
+		if err != keys.ErrKeyOutOfScope {
+			t.Errorf("want %v, got %v", keys.ErrKeyOutOfScope, err)
+		}
+	})
+	t.Run("Should stop streaming once the context is done", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+
+		err := crypto.EncryptStream(cancelled, "id", "scope", Algorithms{}, &bytes.Buffer{}, bytes.NewReader(payload))
+
+		if err != context.Canceled {
+			t.Errorf("want %v, got %v", context.Canceled, err)
+		}
+	})
+}
+
+// countingFinder counts the lookups reaching the finder
+type countingFinder struct {
+	KeyFinderStub
+	mu      sync.Mutex
+	lookups int
+}
+
+func (f *countingFinder) FindScopedKey(ctx context.Context, id string, scope string) (keys.Key, error) {
+	f.mu.Lock()
+	f.lookups++
+	f.mu.Unlock()
+	return f.KeyFinderStub.FindScopedKey(ctx, id, scope)
+}
+
+func (f *countingFinder) FindScopedKeyVersion(ctx context.Context, id string, version int, scope string) (keys.Key, error) {
+	f.mu.Lock()
+	f.lookups++
+	f.mu.Unlock()
+	return f.KeyFinderStub.FindScopedKeyVersion(ctx, id, version, scope)
+}
+
+func TestCryptoBatch(t *testing.T) {
+	t.Run("Should decrypt back every item of an encrypted batch", func(t *testing.T) {
+		crypto := NewCryptoService(&KeyFinderStub{}, 0)
+		items := []EncryptItem{}
+		for i := 0; i < 50; i++ {
+			items = append(items, EncryptItem{KeyID: []string{"id", "ec", "x25519"}[i%3], Data: []byte{byte(i)}})
+		}
+
+		encrypted := crypto.EncryptBatch(ctx, "scope", Algorithms{}, items)
+		toDecrypt := []DecryptItem{}
+		for i, r := range encrypted {
+			if r.Err != nil {
+				t.Fatalf("item %d: want no error, got %v", i, r.Err)
+			}
+			toDecrypt = append(toDecrypt, DecryptItem{KeyID: items[i].KeyID, Data: string(r.Data)})
+		}
+		decrypted := crypto.DecryptBatch(ctx, "scope", toDecrypt)
+
+		for i, r := range decrypted {
+			if r.Err != nil || !bytes.Equal(r.Data, items[i].Data) {
+				t.Errorf("item %d: want %v, got %v and %v", i, items[i].Data, r.Data, r.Err)
+			}
+		}
+	})
+	t.Run("Should look each distinct key up only once", func(t *testing.T) {
+		finder := &countingFinder{}
+		crypto := NewCryptoService(finder, 0)
+		items := []EncryptItem{}
+		for i := 0; i < 30; i++ {
+			items = append(items, EncryptItem{KeyID: []string{"id", "ec", "missing"}[i%3], Data: []byte("test")})
+		}
+
+		crypto.EncryptBatch(ctx, "scope", Algorithms{}, items)
+
+		if finder.lookups != 3 {
+			t.Errorf("want 3 lookups, got %d", finder.lookups)
+		}
+	})
+	t.Run("Should look each distinct key version up only once when decrypting", func(t *testing.T) {
+		old, _ := jwe.Encrypt([]byte("old"), jwa.RSA_OAEP_256, &oldRSAKey.PublicKey, jwa.A256CBC_HS512, jwa.NoCompress)
+		crypto := NewCryptoService(&KeyFinderStub{}, 0)
+		current, _ := crypto.Encrypt(ctx, "id", "scope", []byte("current"), Algorithms{})
+		finder := &countingFinder{}
+		crypto = NewCryptoService(finder, 0)
+		items := []DecryptItem{}
+		for i := 0; i < 20; i++ {
+			items = append(items, DecryptItem{KeyID: "id", Data: []string{string(old), string(current)}[i%2]})
+		}
+
+		results := crypto.DecryptBatch(ctx, "scope", items)
+
+		if finder.lookups != 2 {
+			t.Errorf("want 2 lookups, got %d", finder.lookups)
+		}
+		if string(results[0].Data) != "old" || string(results[1].Data) != "current" {
+			t.Errorf("want old and current, got %s and %s", results[0].Data, results[1].Data)
+		}
+	})
+	t.Run("Should return the error of each item in its position", func(t *testing.T) {
+		crypto := NewCryptoService(&KeyFinderStub{}, 0)
+		items := []EncryptItem{
+			{KeyID: "id", Data: []byte("test")},
+			{KeyID: "disabled", Data: []byte("test")},
+			{KeyID: "signing", Data: []byte("test")},
+			{KeyID: "ec", Data: []byte("test")},
+		}
+
+		results := crypto.EncryptBatch(ctx, "scope", Algorithms{}, items)
+
+		for i, want := range []error{nil, keys.ErrKeyDisabled, keys.ErrKeyWrongUse, nil} {
+			if results[i].Err != want {
+				t.Errorf("item %d: want %v, got %v", i, want, results[i].Err)
+			}
+		}
+	})
+	t.Run("Should return no results for an empty batch", func(t *testing.T) {
+		crypto := NewCryptoService(&KeyFinderStub{}, 0)
+
+		results := crypto.DecryptBatch(ctx, "scope", nil)
+
+		if len(results) != 0 {
+			t.Errorf("want no results, got %v", results)
+		}
+	})
+}
+
+func TestCryptoOperationMetrics(t *testing.T) {
+	crypto := NewCryptoService(&KeyFinderStub{}, 0)
+	crypto.Encrypt(ctx, "id", "scope", []byte("test"), Algorithms{})
+	crypto.Encrypt(ctx, "id", "made-up-scope", []byte("test"), Algorithms{})
+	crypto.Decrypt(ctx, "id", "another-made-up-scope", "not a JWE")
+
+	response := httptest.NewRecorder()
+	metrics.Handler().ServeHTTP(response, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := response.Body.String()
+
+	for _, want := range []string{
+		`gocrypto_crypto_operations_total{operation="encrypt",outcome="success",scope="scope"}`,
+		`gocrypto_crypto_operations_total{operation="encrypt",outcome="failure",scope="unresolved"}`,
+		`gocrypto_crypto_operations_total{operation="decrypt",outcome="failure",scope="unresolved"}`,
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %s in the metrics", want)
+		}
+	}
+	if strings.Contains(body, "made-up-scope") {
+		t.Errorf("want the scopes of the failed lookups out of the labels")
+	}
 }
@@ -0,0 +1,128 @@
+package crypto
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/metrics"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/stream"
+	"github.com/lestrrat-go/jwx/jwe"
+)
+
+var (
+	// ErrMalformedStream the encrypted stream does not start with a valid header
+	ErrMalformedStream = errors.New("malformed encrypted stream")
+	// ErrCorruptedStream a chunk of the encrypted stream was tampered with, or
+	// the stream was cut short
+	ErrCorruptedStream = errors.New("corrupted encrypted stream")
+)
+
+// streamMagic identifies the encrypted streams and the version of their format
+var streamMagic = []byte("GCS1")
+
+// maxStreamHeader the header is the data key wrapped in a compact JWE, a few
+// hundred bytes long
+const maxStreamHeader = 16 * 1024
+
+// EncryptStream Encrypts src into dst with a random data key, the data key is
+// wrapped in a JWE by the newest version of a key within the scope, as
+// Encrypt would, and written as the header of the stream. The payload follows
+// as authenticated chunks, so memory use does not depend on its size
+//
+//	"GCS1" | header length (uint32) | JWE of the data key | chunks
+func (s *CryptoService) EncryptStream(ctx context.Context, keyID string, scope string, algs Algorithms, dst io.Writer, src io.Reader) error {
+	key, err := s.encryptStream(ctx, keyID, scope, algs, dst, src)
+	metrics.CountOperation("encrypt_stream", key.Scope, err)
+	return err
+}
+
+func (s *CryptoService) encryptStream(ctx context.Context, keyID string, scope string, algs Algorithms, dst io.Writer, src io.Reader) (keys.Key, error) {
+	dataKey := make([]byte, stream.KeySize)
+	if _, err := io.ReadFull(rand.Reader, dataKey); err != nil {
+		return keys.Key{}, err
+	}
+
+	header, key, err := s.encrypt(ctx, keyID, scope, dataKey, algs)
+	if err != nil {
+		return key, err
+	}
+
+	prefix := make([]byte, len(streamMagic)+4)
+	copy(prefix, streamMagic)
+	binary.BigEndian.PutUint32(prefix[len(streamMagic):], uint32(len(header)))
+	if _, err := dst.Write(append(prefix, header...)); err != nil {
+		return key, err
+	}
+
+	w, err := stream.NewWriter(dst, dataKey)
+	if err != nil {
+		return key, err
+	}
+	if _, err := io.Copy(w, contextReader{ctx, src}); err != nil {
+		return key, err
+	}
+	return key, w.Close()
+}
+
+// DecryptStream Decrypts a stream created by EncryptStream into dst, the data
+// key is unwrapped as Decrypt would, with the version of the key pointed by
+// the kid header. Chunks are written as soon as they are authenticated, a
+// stream that was tampered with or cut short fails after the chunks before it
+func (s *CryptoService) DecryptStream(ctx context.Context, keyID string, scope string, dst io.Writer, src io.Reader) error {
+	key, err := s.decryptStream(ctx, keyID, scope, dst, src)
+	metrics.CountOperation("decrypt_stream", key.Scope, err)
+	return err
+}
+
+func (s *CryptoService) decryptStream(ctx context.Context, keyID string, scope string, dst io.Writer, src io.Reader) (keys.Key, error) {
+	prefix := make([]byte, len(streamMagic)+4)
+	if _, err := io.ReadFull(src, prefix); err != nil || !bytes.Equal(prefix[:len(streamMagic)], streamMagic) {
+		return keys.Key{}, ErrMalformedStream
+	}
+	size := binary.BigEndian.Uint32(prefix[len(streamMagic):])
+	if size == 0 || size > maxStreamHeader {
+		return keys.Key{}, ErrMalformedStream
+	}
+
+	header := make([]byte, size)
+	if _, err := io.ReadFull(src, header); err != nil {
+		return keys.Key{}, ErrMalformedStream
+	}
+	if _, err := jwe.Parse(header); err != nil {
+		return keys.Key{}, ErrMalformedStream
+	}
+
+	dataKey, key, err := s.decrypt(ctx, keyID, scope, header)
+	if err != nil {
+		return key, err
+	}
+	r, err := stream.NewReader(contextReader{ctx, src}, dataKey)
+	if err != nil {
+		return key, ErrMalformedStream
+	}
+
+	_, err = io.Copy(dst, r)
+	if err == stream.ErrCorrupted || err == stream.ErrTruncated {
+		return key, ErrCorruptedStream
+	}
+	return key, err
+}
+
+// contextReader stops reading once the context is done, so a request that
+// ran out of time does not keep streaming
+type contextReader struct {
+	ctx context.Context
+	r   io.Reader
+}
+
+func (c contextReader) Read(p []byte) (int, error) {
+	if err := c.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return c.r.Read(p)
+}
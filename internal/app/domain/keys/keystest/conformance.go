@@ -0,0 +1,416 @@
+// Package keystest checks that a keys.KeyRepository implementation behaves
+// as the key service expects
+package keystest
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/google/uuid"
+)
+
+// NewRepository returns an empty repository, called once per test
+type NewRepository func(t *testing.T) keys.KeyRepository
+
+// ctx the repositories are called without deadline
+var ctx = context.Background()
+
+var (
+	pairOnce sync.Once
+	pair     *rsa.PrivateKey
+)
+
+// RunConformance runs the whole suite against the repositories built by
+// newRepo
+func RunConformance(t *testing.T, newRepo NewRepository) {
+	t.Run("FindKey", func(t *testing.T) { testFindKey(t, newRepo(t)) })
+	t.Run("InsertKey", func(t *testing.T) { testInsertKey(t, newRepo(t)) })
+	t.Run("FindKeysByScope", func(t *testing.T) { testFindKeysByScope(t, newRepo(t)) })
+	t.Run("FindKeysPage", func(t *testing.T) { testFindKeysPage(t, newRepo(t)) })
+	t.Run("FindPublicKeysByScope", func(t *testing.T) { testFindPublicKeysByScope(t, newRepo(t)) })
+	t.Run("UpdateKeyState", func(t *testing.T) { testUpdateKeyState(t, newRepo(t)) })
+	t.Run("DestroyKeys", func(t *testing.T) { testDestroyKeys(t, newRepo(t)) })
+	t.Run("ConcurrentAccess", func(t *testing.T) { testConcurrentAccess(t, newRepo(t)) })
+}
+
+// NewKey a complete key, as the key service would create it. Times are
+// truncated to the second and in UTC, so they survive every backend
+func NewKey(id string, version int, scope string) keys.Key {
+	pairOnce.Do(func() {
+		pair, _ = rsa.GenerateKey(rand.Reader, 2048)
+	})
+
+	return keys.Key{
+		ID:         id,
+		Version:    version,
+		Scope:      scope,
+		Expiration: time.Now().UTC().Truncate(time.Second).AddDate(0, 0, 1),
+		Creation:   time.Now().UTC().Truncate(time.Second),
+		Use:        keys.UseEncryption,
+		Policy: keys.Policy{
+			KeyAlgorithms:     []string{"RSA-OAEP-256", "RSA-OAEP"},
+			ContentAlgorithms: []string{"A256GCM"},
+			Compression:       true,
+		},
+		State: keys.StateActive,
+		Priv:  pair,
+		Pub:   &pair.PublicKey,
+	}
+}
+
+func testFindKey(t *testing.T, repo keys.KeyRepository) {
+	id := uuid.New().String()
+	v1 := NewKey(id, 1, "scope")
+	v2 := NewKey(id, 2, "scope")
+	mustInsert(t, repo, v2)
+	mustInsert(t, repo, v1)
+
+	t.Run("returns the newest version of the key", func(t *testing.T) {
+		got, err := repo.FindKey(ctx, id)
+
+		assertValue(t, err, nil)
+		assertSameKey(t, got, v2)
+	})
+	t.Run("returns the requested version of the key", func(t *testing.T) {
+		got, err := repo.FindKeyVersion(ctx, id, 1)
+
+		assertValue(t, err, nil)
+		assertSameKey(t, got, v1)
+	})
+	t.Run("returns ErrKeyNotFound for unknown keys", func(t *testing.T) {
+		_, err := repo.FindKey(ctx, uuid.New().String())
+
+		assertValue(t, err, keys.ErrKeyNotFound)
+	})
+	t.Run("returns ErrKeyNotFound for unknown versions", func(t *testing.T) {
+		_, err := repo.FindKeyVersion(ctx, id, 3)
+
+		assertValue(t, err, keys.ErrKeyNotFound)
+	})
+}
+
+func testInsertKey(t *testing.T, repo keys.KeyRepository) {
+	k := NewKey(uuid.New().String(), 1, "scope")
+
+	t.Run("round trips every field of the key", func(t *testing.T) {
+		assertValue(t, repo.InsertKey(ctx, k), nil)
+
+		got, err := repo.FindKey(ctx, k.ID)
+
+		assertValue(t, err, nil)
+		assertSameKey(t, got, k)
+	})
+	t.Run("refuses an existing version of the key with ErrKeyVersionExists", func(t *testing.T) {
+		duplicate := NewKey(k.ID, k.Version, "other")
+
+		err := repo.InsertKey(ctx, duplicate)
+
+		assertValue(t, err, keys.ErrKeyVersionExists)
+		got, _ := repo.FindKey(ctx, k.ID)
+		assertValue(t, got.Scope, k.Scope)
+	})
+	t.Run("accepts a new version of an existing key", func(t *testing.T) {
+		err := repo.InsertKey(ctx, NewKey(k.ID, k.Version+1, k.Scope))
+
+		assertValue(t, err, nil)
+	})
+}
+
+func testFindKeysByScope(t *testing.T, repo keys.KeyRepository) {
+	scope := uuid.New().String()[:8]
+	ids := []string{uuid.New().String(), uuid.New().String()}
+	sort.Strings(ids)
+	mustInsert(t, repo, NewKey(ids[1], 1, scope))
+	mustInsert(t, repo, NewKey(ids[1], 2, scope))
+	mustInsert(t, repo, NewKey(ids[0], 1, scope))
+	mustInsert(t, repo, NewKey(uuid.New().String(), 1, "other"))
+
+	t.Run("returns the newest version of every key in the scope, sorted by ID", func(t *testing.T) {
+		got, err := repo.FindKeysByScope(ctx, scope)
+
+		assertValue(t, err, nil)
+		if len(got) != 2 {
+			t.Fatalf("want 2 keys, got %d", len(got))
+		}
+		assertValue(t, got[0].ID, ids[0])
+		assertValue(t, got[1].ID, ids[1])
+		assertValue(t, got[1].Version, 2)
+	})
+	t.Run("returns nothing for an empty scope", func(t *testing.T) {
+		got, err := repo.FindKeysByScope(ctx, "empty")
+
+		assertValue(t, err, nil)
+		assertValue(t, len(got), 0)
+	})
+}
+
+func testFindPublicKeysByScope(t *testing.T, repo keys.KeyRepository) {
+	scope := uuid.New().String()[:8]
+	ids := []string{uuid.New().String(), uuid.New().String()}
+	sort.Strings(ids)
+	for v := 1; v <= 3; v++ {
+		k := NewKey(ids[0], v, scope)
+		k.Use = keys.UseSigning
+		if v == 1 {
+			k.Expiration = time.Now().UTC().Truncate(time.Second).Add(-time.Hour)
+		}
+		mustInsert(t, repo, k)
+	}
+	mustInsert(t, repo, NewKey(ids[1], 1, scope))
+	mustInsert(t, repo, NewKey(ids[1], 2, scope))
+	mustInsert(t, repo, NewKey(uuid.New().String(), 1, "other"))
+
+	t.Run("returns the unexpired signing versions and the newest encryption one, without the private key", func(t *testing.T) {
+		got, err := repo.FindPublicKeysByScope(ctx, scope, time.Now())
+
+		assertValue(t, err, nil)
+		want := []string{ids[0] + ":3", ids[0] + ":2", ids[1] + ":2"}
+		if len(got) != len(want) {
+			t.Fatalf("want %d keys, got %d", len(want), len(got))
+		}
+		for i, k := range got {
+			assertValue(t, k.KID(), want[i])
+			if k.Priv != nil || !pair.PublicKey.Equal(k.Pub) {
+				t.Errorf("want only the public key of %s", k.KID())
+			}
+		}
+	})
+	t.Run("returns nothing for an empty scope", func(t *testing.T) {
+		got, err := repo.FindPublicKeysByScope(ctx, "empty", time.Now())
+
+		assertValue(t, err, nil)
+		assertValue(t, len(got), 0)
+	})
+}
+
+func testFindKeysPage(t *testing.T, repo keys.KeyRepository) {
+	scope := uuid.New().String()[:8]
+	now := time.Now().UTC().Truncate(time.Second)
+	var ks []keys.Key
+	for i := 0; i < 5; i++ {
+		k := NewKey(uuid.New().String(), 1, scope)
+		k.Creation = now.Add(time.Duration(i) * time.Minute)
+		k.Expiration = now.Add(time.Duration(5-i) * time.Hour)
+		ks = append(ks, k)
+	}
+	ks[4].State = keys.StateDisabled
+	for _, k := range ks {
+		mustInsert(t, repo, k)
+	}
+	rotated := NewKey(ks[0].ID, 2, scope)
+	rotated.Creation = now.Add(10 * time.Minute)
+	mustInsert(t, repo, rotated)
+	mustInsert(t, repo, NewKey(uuid.New().String(), 1, "other"))
+
+	t.Run("walks the newest version of every key following the cursor", func(t *testing.T) {
+		q := keys.KeyQuery{Scope: scope, Limit: 2}
+		var got []keys.Key
+		for pages := 0; pages < 3; pages++ {
+			page, err := repo.FindKeysPage(ctx, q)
+			assertValue(t, err, nil)
+			got = append(got, page.Keys...)
+			if page.Next == nil {
+				break
+			}
+			q.After = page.Next
+		}
+
+		want := []keys.Key{ks[1], ks[2], ks[3], ks[4], rotated}
+		assertIDs(t, got, want)
+		assertValue(t, got[4].Version, 2)
+	})
+	t.Run("sorts by expiration, descending", func(t *testing.T) {
+		page, err := repo.FindKeysPage(ctx, keys.KeyQuery{Scope: scope, SortBy: keys.SortByExpiration, Descending: true, Limit: 3})
+
+		assertValue(t, err, nil)
+		assertIDs(t, page.Keys, []keys.Key{rotated, ks[1], ks[2]})
+		if page.Next == nil || page.Next.ID != ks[2].ID {
+			t.Errorf("want the cursor of %s, got %v", ks[2].ID, page.Next)
+		}
+	})
+	t.Run("filters by state, type and expiration", func(t *testing.T) {
+		tests := []struct {
+			q    keys.KeyQuery
+			want []keys.Key
+		}{
+			{keys.KeyQuery{States: []keys.State{keys.StateDisabled}}, []keys.Key{ks[4]}},
+			{keys.KeyQuery{Types: []keys.KeyType{keys.TypeRSA2048}}, []keys.Key{ks[1], ks[2], ks[3], ks[4], rotated}},
+			{keys.KeyQuery{Types: []keys.KeyType{keys.TypeP256}}, nil},
+			{keys.KeyQuery{ExpiresAfter: now.Add(3 * time.Hour)}, []keys.Key{ks[1], rotated}},
+			{keys.KeyQuery{ExpiresBefore: now.Add(3 * time.Hour)}, []keys.Key{ks[3], ks[4]}},
+		}
+		for _, tt := range tests {
+			tt.q.Scope = scope
+			page, err := repo.FindKeysPage(ctx, tt.q)
+
+			assertValue(t, err, nil)
+			assertIDs(t, page.Keys, tt.want)
+		}
+	})
+}
+
+func testUpdateKeyState(t *testing.T, repo keys.KeyRepository) {
+	id := uuid.New().String()
+	mustInsert(t, repo, NewKey(id, 1, "scope"))
+	mustInsert(t, repo, NewKey(id, 2, "scope"))
+
+	t.Run("moves every version of the key", func(t *testing.T) {
+		deletion := time.Now().UTC().Truncate(time.Second).Add(time.Hour)
+
+		err := repo.UpdateKeyState(ctx, id, keys.StateActive, keys.StatePendingDeletion, deletion)
+
+		assertValue(t, err, nil)
+		for _, v := range []int{1, 2} {
+			k, _ := repo.FindKeyVersion(ctx, id, v)
+			assertValue(t, k.State, keys.StatePendingDeletion)
+			assertValue(t, k.DeletionDate.Equal(deletion), true)
+		}
+	})
+	t.Run("clears the deletion date", func(t *testing.T) {
+		err := repo.UpdateKeyState(ctx, id, keys.StatePendingDeletion, keys.StateActive, time.Time{})
+
+		assertValue(t, err, nil)
+		k, _ := repo.FindKey(ctx, id)
+		assertValue(t, k.State, keys.StateActive)
+		assertValue(t, k.DeletionDate.IsZero(), true)
+	})
+	t.Run("returns ErrKeyNotFound for unknown keys", func(t *testing.T) {
+		err := repo.UpdateKeyState(ctx, uuid.New().String(), keys.StateActive, keys.StateDisabled, time.Time{})
+
+		assertValue(t, err, keys.ErrKeyNotFound)
+	})
+	t.Run("does not move a key that left the expected state", func(t *testing.T) {
+		destroyed := NewKey(uuid.New().String(), 1, "scope")
+		destroyed.State, destroyed.DeletionDate = keys.StatePendingDeletion, time.Now().Add(-time.Hour)
+		mustInsert(t, repo, destroyed)
+		if _, err := repo.DestroyKeys(ctx, time.Now()); err != nil {
+			t.Fatalf("could not destroy the key: %v", err)
+		}
+
+		err := repo.UpdateKeyState(ctx, destroyed.ID, keys.StatePendingDeletion, keys.StateActive, time.Time{})
+
+		assertValue(t, err, keys.ErrInvalidStateTransition)
+		k, _ := repo.FindKey(ctx, destroyed.ID)
+		assertValue(t, k.State, keys.StateDestroyed)
+		assertValue(t, k.Priv, nil)
+	})
+}
+
+func testDestroyKeys(t *testing.T, repo keys.KeyRepository) {
+	now := time.Now().UTC().Truncate(time.Second)
+	due, later, active := NewKey(uuid.New().String(), 1, "scope"), NewKey(uuid.New().String(), 1, "scope"), NewKey(uuid.New().String(), 1, "scope")
+	due.State, due.DeletionDate = keys.StatePendingDeletion, now.Add(-time.Hour)
+	later.State, later.DeletionDate = keys.StatePendingDeletion, now.Add(time.Hour)
+	for _, k := range []keys.Key{due, later, active} {
+		mustInsert(t, repo, k)
+	}
+
+	n, err := repo.DestroyKeys(ctx, now)
+
+	assertValue(t, err, nil)
+	assertValue(t, n, 1)
+	k, err := repo.FindKey(ctx, due.ID)
+	assertValue(t, err, nil)
+	assertValue(t, k.State, keys.StateDestroyed)
+	assertValue(t, k.Priv, nil)
+	if !pair.PublicKey.Equal(k.Pub) {
+		t.Errorf("want the public key to be kept")
+	}
+	for _, id := range []string{later.ID, active.ID} {
+		k, _ := repo.FindKey(ctx, id)
+		if k.Priv == nil {
+			t.Errorf("%s: want the private key to be kept", id)
+		}
+	}
+}
+
+func testConcurrentAccess(t *testing.T, repo keys.KeyRepository) {
+	scope := uuid.New().String()[:8]
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			id := uuid.New().String()
+			if err := repo.InsertKey(ctx, NewKey(id, 1, scope)); err != nil {
+				t.Errorf("insert: %v", err)
+				return
+			}
+			if _, err := repo.FindKey(ctx, id); err != nil {
+				t.Errorf("find: %v", err)
+			}
+			if _, err := repo.FindKeysByScope(ctx, scope); err != nil {
+				t.Errorf("find by scope: %v", err)
+			}
+			if err := repo.UpdateKeyState(ctx, id, keys.StateActive, keys.StateDisabled, time.Time{}); err != nil {
+				t.Errorf("update state: %v", err)
+			}
+			if _, err := repo.DestroyKeys(ctx, time.Now()); err != nil {
+				t.Errorf("destroy: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	ks, err := repo.FindKeysByScope(ctx, scope)
+	assertValue(t, err, nil)
+	assertValue(t, len(ks), 20)
+	for _, k := range ks {
+		assertValue(t, k.State, keys.StateDisabled)
+	}
+}
+
+func mustInsert(t *testing.T, repo keys.KeyRepository, k keys.Key) {
+	t.Helper()
+	if err := repo.InsertKey(ctx, k); err != nil {
+		t.Fatalf("could not insert the key %s: %v", k.ID, err)
+	}
+}
+
+func assertSameKey(t *testing.T, got, want keys.Key) {
+	t.Helper()
+	assertValue(t, got.ID, want.ID)
+	assertValue(t, got.Version, want.Version)
+	assertValue(t, got.Scope, want.Scope)
+	assertValue(t, got.Use, want.Use)
+	assertValue(t, got.State, want.State)
+	if !got.Expiration.Equal(want.Expiration) {
+		t.Errorf("want expiration %v, got %v", want.Expiration, got.Expiration)
+	}
+	if !got.Creation.Equal(want.Creation) {
+		t.Errorf("want creation %v, got %v", want.Creation, got.Creation)
+	}
+	if !reflect.DeepEqual(got.Policy, want.Policy) {
+		t.Errorf("want policy %v, got %v", want.Policy, got.Policy)
+	}
+	if !pair.Equal(got.Priv) || !pair.PublicKey.Equal(got.Pub) {
+		t.Errorf("want the key pair to round trip")
+	}
+}
+
+func assertIDs(t *testing.T, got, want []keys.Key) {
+	t.Helper()
+	if len(got) != len(want) {
+		t.Fatalf("want %d keys, got %d", len(want), len(got))
+	}
+	for i := range want {
+		if got[i].ID != want[i].ID {
+			t.Errorf("key %d: want %s, got %s", i, want[i].ID, got[i].ID)
+		}
+	}
+}
+
+func assertValue(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
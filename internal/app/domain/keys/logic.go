@@ -1,7 +1,9 @@
 package keys
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/google/uuid"
@@ -11,44 +13,172 @@ import (
 type KeyService struct {
 	Source KeySource
 	Repo   KeyRepository
+	// DeletionWaitingPeriod time a key stays pending deletion before being destroyed
+	DeletionWaitingPeriod time.Duration
 }
 
 // NewKeyService creates a new KeyService
-func NewKeyService(s KeySource, r KeyRepository) *KeyService {
+func NewKeyService(s KeySource, r KeyRepository, deletionWaitingPeriod time.Duration) *KeyService {
 	return &KeyService{
-		Source: s,
-		Repo:   r,
+		Source:                s,
+		Repo:                  r,
+		DeletionWaitingPeriod: deletionWaitingPeriod,
 	}
 }
 
-// CreateKey Creates a Key, scoping it and setting the expiration
-func (s *KeyService) CreateKey(scope string, expiration time.Time) (Key, error) {
-	newKey, _ := s.Source.Take()
+// CreateKey Creates a Key of the type, scoping it and setting the expiration,
+// its use and the algorithm policy of encryption keys
+func (s *KeyService) CreateKey(ctx context.Context, scope string, expiration time.Time, use Use, keyType KeyType, policy Policy) (Key, error) {
+	if !keyType.Supports(use) {
+		return Key{}, ErrUnsupportedKeyUse
+	}
+	if use == UseEncryption && policy.Empty() {
+		policy = DefaultPolicy(keyType)
+	}
+	if use == UseEncryption && policy.ValidFor(keyType) != nil {
+		return Key{}, ErrInvalidPolicy
+	}
+	if use != UseEncryption && !policy.Empty() {
+		return Key{}, ErrInvalidPolicy
+	}
+
+	newKey, err := s.take(ctx, keyType)
+	if err != nil {
+		return Key{}, err
+	}
 	key := Key{
 		Priv:       newKey,
-		Pub:        &newKey.PublicKey,
+		Pub:        newKey.Public(),
 		Scope:      scope,
 		Expiration: expiration,
+		Creation:   time.Now().UTC(),
 		ID:         uuid.New().String(),
+		Version:    FirstVersion,
+		Use:        use,
+		Policy:     policy,
+		State:      StateActive,
+	}
+
+	if err := s.Repo.InsertKey(ctx, key); err != nil {
+		return Key{}, err
+	}
+
+	return key, nil
+}
+
+// RotateKey Creates a new version of the Key, keeping its ID, scope, use,
+// type and policy
+func (s *KeyService) RotateKey(ctx context.Context, keyID string, expiration time.Time) (Key, error) {
+	current, err := s.FindKey(ctx, keyID)
+	if err != nil {
+		return Key{}, err
+	}
+	if err := current.Usable(); err != nil {
+		return Key{}, err
+	}
+
+	newKey, err := s.take(ctx, current.Type())
+	if err != nil {
+		return Key{}, err
+	}
+	key := Key{
+		Priv:       newKey,
+		Pub:        newKey.Public(),
+		Scope:      current.Scope,
+		Expiration: expiration,
+		Creation:   time.Now().UTC(),
+		ID:         current.ID,
+		Version:    current.Version + 1,
+		Use:        current.Use,
+		Policy:     current.Policy,
+		State:      StateActive,
 	}
 
-	if err := s.Repo.InsertKey(key); err != nil {
+	if err := s.Repo.InsertKey(ctx, key); err != nil {
 		return Key{}, err
 	}
 
 	return key, nil
 }
 
+// take Takes a key of the type from the Source, its failures are wrapped in
+// ErrKeyGeneration unless the context is done
+func (s *KeyService) take(ctx context.Context, t KeyType) (PrivateKey, error) {
+	k, err := s.Source.Take(ctx, t)
+	if err != nil {
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("%w: %v", ErrKeyGeneration, err)
+	}
+	if k == nil {
+		return nil, ErrKeyGeneration
+	}
+	return k, nil
+}
+
 var (
 	// ErrKeyNotFound the Key with the requested ID was not found in this store
 	ErrKeyNotFound = errors.New("requested key was not found")
+	// ErrKeyVersionExists the repository already holds this version of the Key
+	ErrKeyVersionExists = errors.New("key version already exists")
 	// ErrKeyOutOfScope the Key was found but is not within the requested scope
 	ErrKeyOutOfScope = errors.New("requested key is out of scope")
+	// ErrKeyExpired the Key was found but its expiration date has passed
+	ErrKeyExpired = errors.New("requested key is expired")
+	// ErrKeyDisabled the Key was found but it is disabled
+	ErrKeyDisabled = errors.New("requested key is disabled")
+	// ErrKeyPendingDeletion the Key was found but it is scheduled to be destroyed
+	ErrKeyPendingDeletion = errors.New("requested key is pending deletion")
+	// ErrKeyDestroyed the Key was found but its private key was destroyed
+	ErrKeyDestroyed = errors.New("requested key was destroyed")
+	// ErrKeyWrongUse the Key was found but it is meant for another use
+	ErrKeyWrongUse = errors.New("requested key can not be used for this operation")
+	// ErrUnsupportedKeyUse the Key type can not be used for the requested use
+	ErrUnsupportedKeyUse = errors.New("key type does not support the requested use")
+	// ErrInvalidStateTransition the Key can not be moved to the requested state
+	ErrInvalidStateTransition = errors.New("invalid key state transition")
+	// ErrKeyGeneration the key source could not provide a new key, it may
+	// succeed if retried later
+	ErrKeyGeneration = errors.New("key could not be generated")
 )
 
-// FindKey Finds a key by ID
-func (s *KeyService) FindKey(keyID string) (Key, error) {
-	key, err := s.Repo.FindKey(keyID)
+// ChangeKeyState Moves every version of a key to the requested state, keys
+// moved to pending deletion are destroyed after the deletion waiting period
+func (s *KeyService) ChangeKeyState(ctx context.Context, keyID string, state State) (Key, error) {
+	key, err := s.FindKey(ctx, keyID)
+	if err != nil {
+		return Key{}, err
+	}
+	if !key.State.CanMoveTo(state) {
+		return Key{}, ErrInvalidStateTransition
+	}
+
+	var deletionDate time.Time
+	if state == StatePendingDeletion {
+		deletionDate = time.Now().Add(s.DeletionWaitingPeriod)
+	}
+
+	// the key may have changed since it was read, like destroyed by the
+	// destruction ticker, so it is only moved if still in the state it was
+	if err := s.Repo.UpdateKeyState(ctx, keyID, key.State, state, deletionDate); err != nil {
+		return Key{}, err
+	}
+
+	key.State = state
+	key.DeletionDate = deletionDate
+	return key, nil
+}
+
+// DestroyPendingKeys Destroys every key whose deletion date has passed,
+// returns how many keys were destroyed
+func (s *KeyService) DestroyPendingKeys(ctx context.Context) (int, error) {
+	return s.Repo.DestroyKeys(ctx, time.Now())
+}
+
+// FindKey Finds the newest version of a key by ID
+func (s *KeyService) FindKey(ctx context.Context, keyID string) (Key, error) {
+	key, err := s.Repo.FindKey(ctx, keyID)
 	if err != nil {
 		if err == ErrKeyNotFound {
 			return Key{}, ErrKeyNotFound
@@ -58,9 +188,27 @@ func (s *KeyService) FindKey(keyID string) (Key, error) {
 	return key, nil
 }
 
-// FindScopedKey Find a key by ID within the scope
-func (s *KeyService) FindScopedKey(keyID string, scope string) (Key, error) {
-	key, err := s.FindKey(keyID)
+// FindKeyVersion Finds a specific version of a key by ID
+func (s *KeyService) FindKeyVersion(ctx context.Context, keyID string, version int) (Key, error) {
+	return s.Repo.FindKeyVersion(ctx, keyID, version)
+}
+
+// FindScopedKey Find the newest version of a key by ID within the scope
+func (s *KeyService) FindScopedKey(ctx context.Context, keyID string, scope string) (Key, error) {
+	key, err := s.FindKey(ctx, keyID)
+	if err != nil {
+		return Key{}, err
+	}
+	if key.Scope != scope {
+		return Key{}, ErrKeyOutOfScope
+	}
+
+	return key, nil
+}
+
+// FindScopedKeyVersion Find a specific version of a key by ID within the scope
+func (s *KeyService) FindScopedKeyVersion(ctx context.Context, keyID string, version int, scope string) (Key, error) {
+	key, err := s.FindKeyVersion(ctx, keyID, version)
 	if err != nil {
 		return Key{}, err
 	}
@@ -71,12 +219,36 @@ func (s *KeyService) FindScopedKey(keyID string, scope string) (Key, error) {
 	return key, nil
 }
 
-// FindKeysByScope Find a key by ID within the scope
-func (s *KeyService) FindKeysByScope(scope string) ([]Key, error) {
-	keys, err := s.Repo.FindKeysByScope(scope)
+// FindKeysByScope Find the newest version of every key within the scope
+func (s *KeyService) FindKeysByScope(ctx context.Context, scope string) ([]Key, error) {
+	keys, err := s.Repo.FindKeysByScope(ctx, scope)
 	if err != nil {
 		return nil, err
 	}
 
 	return keys, nil
 }
+
+// FindKeysPage Find a page of the newest version of the keys within the
+// scope matching the query
+func (s *KeyService) FindKeysPage(ctx context.Context, q KeyQuery) (KeyPage, error) {
+	return s.Repo.FindKeysPage(ctx, q.Normalized())
+}
+
+// FindActiveKeysByScope Find the published versions of the keys within the
+// scope that can still be used, only their public key is loaded
+func (s *KeyService) FindActiveKeysByScope(ctx context.Context, scope string) ([]Key, error) {
+	ks, err := s.Repo.FindPublicKeysByScope(ctx, scope, time.Now())
+	if err != nil {
+		return nil, err
+	}
+
+	active := []Key{}
+	for _, k := range ks {
+		if k.Usable() == nil {
+			active = append(active, k)
+		}
+	}
+
+	return active, nil
+}
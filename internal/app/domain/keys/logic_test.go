@@ -1,38 +1,130 @@
 package keys
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"errors"
 	"reflect"
+	"sort"
 	"testing"
 	"time"
+
+	"github.com/lestrrat-go/jwx/x25519"
 )
 
+// ctx the services are called without deadline
+var ctx = context.Background()
+
 type KeyRepositoryStub struct {
 	store map[string]Key
 }
 
-func (r *KeyRepositoryStub) FindKey(keyID string) (Key, error) {
-	key, ok := r.store[keyID]
+func (r *KeyRepositoryStub) FindKey(ctx context.Context, keyID string) (Key, error) {
+	var newest Key
+	for _, key := range r.store {
+		if key.ID == keyID && key.Version > newest.Version {
+			newest = key
+		}
+	}
+	if newest.ID == "" {
+		return Key{}, ErrKeyNotFound
+	}
+	return newest, nil
+}
+
+func (r *KeyRepositoryStub) FindKeyVersion(ctx context.Context, keyID string, version int) (Key, error) {
+	key, ok := r.store[Key{ID: keyID, Version: version}.KID()]
 	if ok == false {
 		return Key{}, ErrKeyNotFound
 	}
 	return key, nil
 }
 
-func (r *KeyRepositoryStub) FindKeysByScope(scope string) ([]Key, error) {
+func (r *KeyRepositoryStub) FindKeysByScope(ctx context.Context, scope string) ([]Key, error) {
 	if scope == "not found" {
 		return nil, nil
 	}
-
 	return []Key{keyStub, keyStub}, nil
 }
 
-func (r *KeyRepositoryStub) InsertKey(key Key) error {
-	r.store[key.ID] = key
+func (r *KeyRepositoryStub) FindPublicKeysByScope(ctx context.Context, scope string, at time.Time) ([]Key, error) {
+	if scope == "not found" {
+		return nil, nil
+	}
+	if scope == "mixed" {
+		disabled := keyStub
+		disabled.State = StateDisabled
+		return []Key{disabled, activeKeyStub}, nil
+	}
+
+	versions := map[string][]Key{}
+	for _, key := range r.store {
+		if key.Scope == scope {
+			versions[key.ID] = append(versions[key.ID], key)
+		}
+	}
+	var ks []Key
+	for _, vs := range versions {
+		sort.Slice(vs, func(i, j int) bool { return vs[i].Version < vs[j].Version })
+		ks = append(ks, PublishedVersions(vs, at)...)
+	}
+	return ks, nil
+}
+
+func (r *KeyRepositoryStub) FindKeysPage(ctx context.Context, q KeyQuery) (KeyPage, error) {
+	var ks []Key
+	for _, key := range r.store {
+		ks = append(ks, key)
+	}
+	return PageOf(ks, q), nil
+}
+
+func (r *KeyRepositoryStub) InsertKey(ctx context.Context, key Key) error {
+	r.store[key.KID()] = key
 	return nil
 }
 
+func (r *KeyRepositoryStub) UpdateKeyState(ctx context.Context, keyID string, from State, to State, deletionDate time.Time) error {
+	found, moved := false, false
+	for kid, key := range r.store {
+		if key.ID != keyID {
+			continue
+		}
+		found = true
+		if key.State != from {
+			continue
+		}
+		key.State = to
+		key.DeletionDate = deletionDate
+		r.store[kid] = key
+		moved = true
+	}
+	if !found {
+		return ErrKeyNotFound
+	}
+	if !moved {
+		return ErrInvalidStateTransition
+	}
+	return nil
+}
+
+func (r *KeyRepositoryStub) DestroyKeys(ctx context.Context, before time.Time) (int, error) {
+	destroyed := 0
+	for kid, key := range r.store {
+		if key.State == StatePendingDeletion && !key.DeletionDate.After(before) {
+			key.State = StateDestroyed
+			key.Priv = nil
+			r.store[kid] = key
+			destroyed++
+		}
+	}
+	return destroyed, nil
+}
+
 type KeySourceStub struct {
 }
 
@@ -47,38 +139,307 @@ var (
 	}
 )
 
-func (p *KeySourceStub) Take() (*rsa.PrivateKey, error) {
+var activeKeyStub = Key{
+	ID:         "active",
+	Scope:      "scope",
+	Expiration: time.Now().AddDate(0, 0, 1),
+	State:      StateActive,
+	Priv:       mockKeys,
+	Pub:        &mockKeys.PublicKey,
+}
+
+func (p *KeySourceStub) Take(ctx context.Context, t KeyType) (PrivateKey, error) {
+	if t == TypeEd25519 {
+		_, priv, err := ed25519.GenerateKey(rand.Reader)
+		return priv, err
+	}
 	return mockKeys, mockErr
 }
 
+type failingSourceStub struct {
+	err error
+}
+
+func (p *failingSourceStub) Take(ctx context.Context, t KeyType) (PrivateKey, error) {
+	return nil, p.err
+}
+
 func TestCreateKey(t *testing.T) {
 	keyStore := KeyService{
 		Source: &KeySourceStub{},
 		Repo:   &KeyRepositoryStub{map[string]Key{}},
 	}
 	t.Run("Should return a keypair", func(t *testing.T) {
-		got, _ := keyStore.CreateKey("scope", time.Now())
-		want := Key{}
-		want.Priv, _ = rsa.GenerateKey(rand.Reader, 2048)
-		want.Pub = &want.Priv.PublicKey
+		got, _ := keyStore.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeRSA2048, Policy{})
+		priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+		want := Key{Priv: priv, Pub: &priv.PublicKey}
 
 		assertType(t, got, want)
 		assertType(t, got.Priv, want.Priv)
 		assertType(t, got.Pub, want.Pub)
 	})
 	t.Run("Should return expiration date", func(t *testing.T) {
-		key, _ := keyStore.CreateKey("scope", time.Now().AddDate(0, 0, 1))
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
 		got := key.Expiration
 
 		assertTime(t, got, time.Now().AddDate(0, 0, 1))
 	})
 	t.Run("returned Keys should have the scope property", func(t *testing.T) {
-		key, _ := keyStore.CreateKey("scope", time.Now())
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeRSA2048, Policy{})
 		got := key.Scope
 		want := "scope"
 
 		assertString(t, got, want)
 	})
+	t.Run("returned Keys should have the use property", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now(), UseSigning, TypeRSA2048, Policy{})
+
+		assertString(t, string(key.Use), string(UseSigning))
+	})
+	t.Run("Should create a key of the requested type", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now(), UseSigning, TypeEd25519, Policy{})
+
+		assertString(t, string(key.Type()), string(TypeEd25519))
+	})
+	t.Run("Should give encryption keys the default policy of their type", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeRSA2048, Policy{})
+
+		if !reflect.DeepEqual(key.Policy, DefaultPolicy(TypeRSA2048)) {
+			t.Errorf("got %v want %v", key.Policy, DefaultPolicy(TypeRSA2048))
+		}
+	})
+	t.Run("Should keep the requested policy", func(t *testing.T) {
+		policy := Policy{
+			KeyAlgorithms:     []string{"RSA-OAEP"},
+			ContentAlgorithms: []string{"A256GCM", "A256CBC-HS512"},
+			Compression:       true,
+		}
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeRSA2048, policy)
+
+		if !reflect.DeepEqual(key.Policy, policy) {
+			t.Errorf("got %v want %v", key.Policy, policy)
+		}
+	})
+	t.Run("Should refuse a policy the key type can not follow", func(t *testing.T) {
+		policy := Policy{
+			KeyAlgorithms:     []string{"ECDH-ES"},
+			ContentAlgorithms: []string{"A256GCM"},
+		}
+		_, err := keyStore.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeRSA2048, policy)
+
+		if err != ErrInvalidPolicy {
+			t.Fatalf("was expecting a ErrInvalidPolicy and received %v", err)
+		}
+	})
+	t.Run("Should refuse a policy for signing keys", func(t *testing.T) {
+		_, err := keyStore.CreateKey(ctx, "scope", time.Now(), UseSigning, TypeRSA2048, DefaultPolicy(TypeRSA2048))
+
+		if err != ErrInvalidPolicy {
+			t.Fatalf("was expecting a ErrInvalidPolicy and received %v", err)
+		}
+	})
+	t.Run("Should refuse a type that does not support the use", func(t *testing.T) {
+		_, err := keyStore.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeEd25519, Policy{})
+
+		if err != ErrUnsupportedKeyUse {
+			t.Fatalf("was expecting a ErrUnsupportedKeyUse and received %v", err)
+		}
+	})
+	t.Run("Should return ErrKeyGeneration when the source fails", func(t *testing.T) {
+		repo := &KeyRepositoryStub{map[string]Key{}}
+		failing := KeyService{Source: &failingSourceStub{errors.New("entropy")}, Repo: repo}
+
+		_, err := failing.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeRSA2048, Policy{})
+
+		if !errors.Is(err, ErrKeyGeneration) {
+			t.Fatalf("was expecting a ErrKeyGeneration and received %v", err)
+		}
+		if len(repo.store) != 0 {
+			t.Errorf("was expecting no key stored and found %d", len(repo.store))
+		}
+	})
+	t.Run("Should return ErrKeyGeneration when the source returns no key", func(t *testing.T) {
+		failing := KeyService{Source: &failingSourceStub{}, Repo: &KeyRepositoryStub{map[string]Key{}}}
+
+		_, err := failing.CreateKey(ctx, "scope", time.Now(), UseEncryption, TypeRSA2048, Policy{})
+
+		if err != ErrKeyGeneration {
+			t.Fatalf("was expecting a ErrKeyGeneration and received %v", err)
+		}
+	})
+	t.Run("Should return the context error once it is done", func(t *testing.T) {
+		cancelled, cancel := context.WithCancel(ctx)
+		cancel()
+		failing := KeyService{Source: &failingSourceStub{context.Canceled}, Repo: &KeyRepositoryStub{map[string]Key{}}}
+
+		_, err := failing.CreateKey(cancelled, "scope", time.Now(), UseEncryption, TypeRSA2048, Policy{})
+
+		if err != context.Canceled {
+			t.Fatalf("was expecting a context.Canceled and received %v", err)
+		}
+	})
+}
+
+func TestRotateKey(t *testing.T) {
+	keyStore := KeyService{
+		Source: &KeySourceStub{},
+		Repo:   &KeyRepositoryStub{map[string]Key{}},
+	}
+	t.Run("Should create a new version of the key", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		rotated, _ := keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 2))
+
+		assertString(t, rotated.ID, key.ID)
+		assertString(t, rotated.Scope, key.Scope)
+		if rotated.Version != key.Version+1 {
+			t.Errorf("got version %d want %d", rotated.Version, key.Version+1)
+		}
+		assertTime(t, rotated.Expiration, time.Now().AddDate(0, 0, 2))
+	})
+	t.Run("Should keep the use and the type of the key", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseSigning, TypeEd25519, Policy{})
+		rotated, _ := keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 2))
+
+		assertString(t, string(rotated.Use), string(UseSigning))
+		assertString(t, string(rotated.Type()), string(TypeEd25519))
+	})
+	t.Run("Should keep the policy of the key", func(t *testing.T) {
+		policy := Policy{
+			KeyAlgorithms:     []string{"RSA-OAEP"},
+			ContentAlgorithms: []string{"A128GCM"},
+		}
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, policy)
+		rotated, _ := keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 2))
+
+		if !reflect.DeepEqual(rotated.Policy, policy) {
+			t.Errorf("got %v want %v", rotated.Policy, policy)
+		}
+	})
+	t.Run("Should make the new version the newest one", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		rotated, _ := keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 2))
+		found, _ := keyStore.FindKey(ctx, key.ID)
+
+		assertString(t, found.KID(), rotated.KID())
+	})
+	t.Run("Should keep the older versions", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 2))
+		found, err := keyStore.FindKeyVersion(ctx, key.ID, key.Version)
+
+		if err != nil {
+			t.Fatalf("was expecting no error and received %v", err)
+		}
+		assertString(t, found.KID(), key.KID())
+	})
+	t.Run("Should refuse to rotate a key that is not active", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		keyStore.ChangeKeyState(ctx, key.ID, StateDisabled)
+
+		_, err := keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 2))
+
+		if err != ErrKeyDisabled {
+			t.Fatalf("was expecting a ErrKeyDisabled and received %v", err)
+		}
+	})
+	t.Run("Should return an error if key was not found", func(t *testing.T) {
+		_, err := keyStore.RotateKey(ctx, "inexistent key.ID", time.Now())
+
+		if err != ErrKeyNotFound {
+			t.Fatalf("was expecting a ErrKeyNotFound and received %v", err)
+		}
+	})
+	t.Run("Should return ErrKeyGeneration when the source fails", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		failing := KeyService{Source: &failingSourceStub{errors.New("entropy")}, Repo: keyStore.Repo}
+
+		_, err := failing.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 2))
+
+		if !errors.Is(err, ErrKeyGeneration) {
+			t.Fatalf("was expecting a ErrKeyGeneration and received %v", err)
+		}
+	})
+}
+
+func TestChangeKeyState(t *testing.T) {
+	keyStore := KeyService{
+		Source:                &KeySourceStub{},
+		Repo:                  &KeyRepositoryStub{map[string]Key{}},
+		DeletionWaitingPeriod: time.Hour,
+	}
+	t.Run("Should create keys in the active state", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+
+		assertString(t, string(key.State), string(StateActive))
+	})
+	t.Run("Should move every version of the key to the requested state", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 1))
+
+		changed, _ := keyStore.ChangeKeyState(ctx, key.ID, StateDisabled)
+		first, _ := keyStore.FindKeyVersion(ctx, key.ID, FirstVersion)
+
+		assertString(t, string(changed.State), string(StateDisabled))
+		assertString(t, string(first.State), string(StateDisabled))
+	})
+	t.Run("Should schedule the deletion after the waiting period", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+
+		changed, _ := keyStore.ChangeKeyState(ctx, key.ID, StatePendingDeletion)
+
+		assertTime(t, changed.DeletionDate, time.Now().Add(time.Hour))
+	})
+	t.Run("Should cancel a scheduled deletion", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		keyStore.ChangeKeyState(ctx, key.ID, StatePendingDeletion)
+
+		changed, err := keyStore.ChangeKeyState(ctx, key.ID, StateActive)
+
+		if err != nil {
+			t.Fatalf("was expecting no error and received %v", err)
+		}
+		if !changed.DeletionDate.IsZero() {
+			t.Errorf("was expecting no deletion date and received %v", changed.DeletionDate)
+		}
+	})
+	t.Run("Should refuse invalid transitions", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+
+		for _, state := range []State{StateActive, StateDestroyed, State("unknown")} {
+			if _, err := keyStore.ChangeKeyState(ctx, key.ID, state); err != ErrInvalidStateTransition {
+				t.Errorf("was expecting a ErrInvalidStateTransition to %q and received %v", state, err)
+			}
+		}
+	})
+	t.Run("Should return an error if key was not found", func(t *testing.T) {
+		_, err := keyStore.ChangeKeyState(ctx, "inexistent key.ID", StateDisabled)
+
+		if err != ErrKeyNotFound {
+			t.Fatalf("was expecting a ErrKeyNotFound and received %v", err)
+		}
+	})
+}
+
+func TestDestroyPendingKeys(t *testing.T) {
+	keyStore := KeyService{
+		Source: &KeySourceStub{},
+		Repo:   &KeyRepositoryStub{map[string]Key{}},
+	}
+	t.Run("Should destroy keys whose deletion date has passed", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		keyStore.ChangeKeyState(ctx, key.ID, StatePendingDeletion)
+
+		destroyed, _ := keyStore.DestroyPendingKeys(ctx)
+		found, _ := keyStore.FindKey(ctx, key.ID)
+
+		if destroyed != 1 {
+			t.Errorf("got %d destroyed keys want %d", destroyed, 1)
+		}
+		assertString(t, string(found.State), string(StateDestroyed))
+		if found.Usable() != ErrKeyDestroyed {
+			t.Errorf("was expecting a ErrKeyDestroyed and received %v", found.Usable())
+		}
+	})
 }
 
 func TestFindKey(t *testing.T) {
@@ -87,19 +448,19 @@ func TestFindKey(t *testing.T) {
 		Repo:   &KeyRepositoryStub{map[string]Key{}},
 	}
 	t.Run("Should return a keypair", func(t *testing.T) {
-		got, _ := keyStore.FindKey("id")
-		want, _ := keyStore.CreateKey("scope", time.Now().AddDate(0, 0, 1))
+		got, _ := keyStore.FindKey(ctx, "id")
+		want, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
 
 		assertType(t, got, want)
 	})
 	t.Run("Should return the correct keypair", func(t *testing.T) {
-		key, _ := keyStore.CreateKey("scope", time.Now().AddDate(0, 0, 1))
-		found, _ := keyStore.FindKey(key.ID)
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		found, _ := keyStore.FindKey(ctx, key.ID)
 
 		assertString(t, found.ID, key.ID)
 	})
 	t.Run("Should return an error if key was not found", func(t *testing.T) {
-		_, err := keyStore.FindKey("inexistent key.ID")
+		_, err := keyStore.FindKey(ctx, "inexistent key.ID")
 
 		if err != ErrKeyNotFound {
 			t.Fatalf("was expecting a ErrKeyNotFound and didn't received")
@@ -113,21 +474,21 @@ func TestFindScopedKey(t *testing.T) {
 		Repo:   &KeyRepositoryStub{map[string]Key{}},
 	}
 	t.Run("Should return a keypair", func(t *testing.T) {
-		got, _ := keyStore.FindScopedKey("id", "scope")
-		want, _ := keyStore.CreateKey("scope", time.Now().AddDate(0, 0, 1))
+		got, _ := keyStore.FindScopedKey(ctx, "id", "scope")
+		want, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
 
 		assertType(t, got, want)
 	})
 	t.Run("Should return an error if Key is out of scope", func(t *testing.T) {
-		key, _ := keyStore.CreateKey("scope1", time.Now().AddDate(0, 0, 1))
-		_, err := keyStore.FindScopedKey(key.ID, "scope2")
+		key, _ := keyStore.CreateKey(ctx, "scope1", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		_, err := keyStore.FindScopedKey(ctx, key.ID, "scope2")
 
 		if err != ErrKeyOutOfScope {
 			t.Fatalf("was expecting a ErrKeyOutOfScope and received %v", err)
 		}
 	})
 	t.Run("Should return an error if key was not found", func(t *testing.T) {
-		_, err := keyStore.FindScopedKey("inexistent key.ID", "scope")
+		_, err := keyStore.FindScopedKey(ctx, "inexistent key.ID", "scope")
 
 		if err != ErrKeyNotFound {
 			t.Fatalf("was expecting a KeyNotFoundError and didn't received")
@@ -135,19 +496,149 @@ func TestFindScopedKey(t *testing.T) {
 	})
 }
 
+func TestFindScopedKeyVersion(t *testing.T) {
+	keyStore := KeyService{
+		Source: &KeySourceStub{},
+		Repo:   &KeyRepositoryStub{map[string]Key{}},
+	}
+	t.Run("Should return the requested version", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		keyStore.RotateKey(ctx, key.ID, time.Now().AddDate(0, 0, 1))
+
+		found, _ := keyStore.FindScopedKeyVersion(ctx, key.ID, FirstVersion, "scope")
+
+		assertString(t, found.KID(), key.KID())
+	})
+	t.Run("Should return an error if Key is out of scope", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope1", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		_, err := keyStore.FindScopedKeyVersion(ctx, key.ID, key.Version, "scope2")
+
+		if err != ErrKeyOutOfScope {
+			t.Fatalf("was expecting a ErrKeyOutOfScope and received %v", err)
+		}
+	})
+	t.Run("Should return an error if the version was not found", func(t *testing.T) {
+		key, _ := keyStore.CreateKey(ctx, "scope", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		_, err := keyStore.FindScopedKeyVersion(ctx, key.ID, key.Version+1, "scope")
+
+		if err != ErrKeyNotFound {
+			t.Fatalf("was expecting a ErrKeyNotFound and received %v", err)
+		}
+	})
+}
+
+func TestParseKID(t *testing.T) {
+	t.Run("Should parse back the ID and version of a key", func(t *testing.T) {
+		key := Key{ID: "f6a4633a-65f5-42f8-a984-38d87e3513ee", Version: 3}
+		id, version, err := ParseKID(key.KID())
+
+		if err != nil {
+			t.Fatalf("was expecting no error and received %v", err)
+		}
+		assertString(t, id, key.ID)
+		if version != key.Version {
+			t.Errorf("got version %d want %d", version, key.Version)
+		}
+	})
+	t.Run("Should return an error for a malformed kid", func(t *testing.T) {
+		for _, kid := range []string{"", "id", ":1", "id:", "id:x", "id:0"} {
+			if _, _, err := ParseKID(kid); err != ErrInvalidKID {
+				t.Errorf("was expecting a ErrInvalidKID for %q and received %v", kid, err)
+			}
+		}
+	})
+}
+
+func TestUsableFor(t *testing.T) {
+	t.Run("Should accept an active key for its own use", func(t *testing.T) {
+		key := Key{Use: UseSigning, State: StateActive}
+
+		if err := key.UsableFor(UseSigning); err != nil {
+			t.Fatalf("was expecting no error and received %v", err)
+		}
+	})
+	t.Run("Should refuse a key meant for another use", func(t *testing.T) {
+		key := Key{Use: UseEncryption, State: StateActive}
+
+		if err := key.UsableFor(UseSigning); err != ErrKeyWrongUse {
+			t.Fatalf("was expecting a ErrKeyWrongUse and received %v", err)
+		}
+	})
+	t.Run("Should refuse a key that is not active", func(t *testing.T) {
+		key := Key{Use: UseSigning, State: StateDisabled}
+
+		if err := key.UsableFor(UseSigning); err != ErrKeyDisabled {
+			t.Fatalf("was expecting a ErrKeyDisabled and received %v", err)
+		}
+	})
+}
+
+func TestKeyType(t *testing.T) {
+	t.Run("Should find the type of the public key", func(t *testing.T) {
+		ecKey, _ := ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+		edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+		xPub, _, _ := x25519.GenerateKey(rand.Reader)
+
+		assertString(t, string(TypeOf(&mockKeys.PublicKey)), string(TypeRSA2048))
+		assertString(t, string(TypeOf(&ecKey.PublicKey)), string(TypeP384))
+		assertString(t, string(TypeOf(edPub)), string(TypeEd25519))
+		assertString(t, string(TypeOf(xPub)), string(TypeX25519))
+	})
+	t.Run("Should only allow each curve for its use", func(t *testing.T) {
+		if TypeEd25519.Supports(UseEncryption) || TypeX25519.Supports(UseSigning) {
+			t.Errorf("Ed25519 keys only sign and X25519 keys only encrypt")
+		}
+		if !TypeP256.Supports(UseEncryption) || !TypeP256.Supports(UseSigning) {
+			t.Errorf("P-256 keys should encrypt and sign")
+		}
+		if KeyType("DSA").Supports(UseSigning) {
+			t.Errorf("unknown key types should not be supported")
+		}
+	})
+}
+
+func TestPolicy(t *testing.T) {
+	policy := Policy{
+		KeyAlgorithms:     []string{"RSA-OAEP-256"},
+		ContentAlgorithms: []string{"A256GCM"},
+	}
+	t.Run("Should allow the algorithms of the policy", func(t *testing.T) {
+		if !policy.Allows("RSA-OAEP-256", "A256GCM", false) {
+			t.Errorf("was expecting the algorithms to be allowed")
+		}
+	})
+	t.Run("Should refuse algorithms outside of the policy", func(t *testing.T) {
+		if policy.Allows("RSA-OAEP", "A256GCM", false) || policy.Allows("RSA-OAEP-256", "A128GCM", false) {
+			t.Errorf("was expecting the algorithms to be refused")
+		}
+	})
+	t.Run("Should refuse compression unless allowed", func(t *testing.T) {
+		if policy.Allows("RSA-OAEP-256", "A256GCM", true) {
+			t.Errorf("was expecting the compression to be refused")
+		}
+	})
+	t.Run("Should fall back to the default policy for keys without one", func(t *testing.T) {
+		key := Key{Pub: &mockKeys.PublicKey}
+
+		if !reflect.DeepEqual(key.EncryptionPolicy(), DefaultPolicy(TypeRSA2048)) {
+			t.Errorf("got %v want %v", key.EncryptionPolicy(), DefaultPolicy(TypeRSA2048))
+		}
+	})
+}
+
 func TestFindKeysByScope(t *testing.T) {
 	keyStore := KeyService{
 		Source: &KeySourceStub{},
 		Repo:   &KeyRepositoryStub{map[string]Key{}},
 	}
 	t.Run("Should return a slice of keypair", func(t *testing.T) {
-		got, _ := keyStore.FindKeysByScope("scope")
+		got, _ := keyStore.FindKeysByScope(ctx, "scope")
 		want := []Key{}
 
 		assertType(t, got, want)
 	})
 	t.Run("Should not return an error if no key was not found", func(t *testing.T) {
-		_, err := keyStore.FindKeysByScope("not found")
+		_, err := keyStore.FindKeysByScope(ctx, "not found")
 
 		if err != nil {
 			t.Fatalf("was expecting a nil and didn't received")
@@ -155,11 +646,198 @@ func TestFindKeysByScope(t *testing.T) {
 	})
 }
 
+func TestFindKeysPage(t *testing.T) {
+	keyStore := KeyService{
+		Source: &KeySourceStub{},
+		Repo:   &KeyRepositoryStub{map[string]Key{}},
+	}
+	t.Run("Should return a page of the created keys", func(t *testing.T) {
+		created, _ := keyStore.CreateKey(ctx, "paged", time.Now().AddDate(0, 0, 1), UseEncryption, DefaultKeyType, Policy{})
+
+		page, err := keyStore.FindKeysPage(ctx, KeyQuery{Scope: "paged"})
+
+		if err != nil {
+			t.Fatalf("was expecting a nil and received %v", err)
+		}
+		if len(page.Keys) != 1 {
+			t.Fatalf("got %d keys want %d", len(page.Keys), 1)
+		}
+		assertString(t, page.Keys[0].ID, created.ID)
+		if page.Keys[0].Creation.IsZero() {
+			t.Errorf("want the creation of the key to be set")
+		}
+	})
+	t.Run("Should fill the defaults of the query and cap its limit", func(t *testing.T) {
+		got := KeyQuery{}.Normalized()
+		capped := KeyQuery{Limit: MaxPageLimit + 1}.Normalized()
+
+		if got.SortBy != SortByCreation || got.Limit != DefaultPageLimit {
+			t.Errorf("got %+v want the default sort and limit", got)
+		}
+		if capped.Limit != MaxPageLimit {
+			t.Errorf("got %d want %d", capped.Limit, MaxPageLimit)
+		}
+	})
+}
+
+func TestPageOf(t *testing.T) {
+	now := time.Now().UTC()
+	ks := []Key{}
+	for i, id := range []string{"c", "a", "d", "b"} {
+		k := keyStub
+		k.ID = id
+		k.State = StateActive
+		k.Creation = now.Add(time.Duration(i) * time.Minute)
+		k.Expiration = now.Add(time.Duration(4-i) * time.Hour)
+		ks = append(ks, k)
+	}
+	ks[3].State = StateDisabled
+	other := keyStub
+	other.Scope = "other"
+	ks = append(ks, other)
+
+	ids := func(ks []Key) string {
+		s := ""
+		for _, k := range ks {
+			s += k.ID
+		}
+		return s
+	}
+
+	t.Run("Should sort the keys of the scope by creation", func(t *testing.T) {
+		page := PageOf(ks, KeyQuery{Scope: "scope"})
+
+		assertString(t, ids(page.Keys), "cadb")
+		if page.Next != nil {
+			t.Errorf("got %v want no next page", page.Next)
+		}
+	})
+	t.Run("Should sort the keys by expiration, descending", func(t *testing.T) {
+		page := PageOf(ks, KeyQuery{Scope: "scope", SortBy: SortByExpiration, Descending: true})
+
+		assertString(t, ids(page.Keys), "cadb")
+	})
+	t.Run("Should walk the pages following the cursor", func(t *testing.T) {
+		q := KeyQuery{Scope: "scope", SortBy: SortByExpiration, Limit: 3}
+		first := PageOf(ks, q)
+		q.After = first.Next
+		second := PageOf(ks, q)
+
+		assertString(t, ids(first.Keys), "bda")
+		assertString(t, ids(second.Keys), "c")
+		if second.Next != nil {
+			t.Errorf("got %v want no next page", second.Next)
+		}
+	})
+	t.Run("Should filter by state, type and expiration", func(t *testing.T) {
+		tests := []struct {
+			q    KeyQuery
+			want string
+		}{
+			{KeyQuery{States: []State{StateDisabled}}, "b"},
+			{KeyQuery{Types: []KeyType{TypeRSA2048}}, "cadb"},
+			{KeyQuery{Types: []KeyType{TypeP256}}, ""},
+			{KeyQuery{ExpiresAfter: now.Add(2 * time.Hour)}, "ca"},
+			{KeyQuery{ExpiresBefore: now.Add(3 * time.Hour)}, "db"},
+		}
+		for _, tt := range tests {
+			tt.q.Scope = "scope"
+			page := PageOf(ks, tt.q)
+
+			assertString(t, ids(page.Keys), tt.want)
+		}
+	})
+}
+
+func TestParseCursor(t *testing.T) {
+	c := Cursor{SortBy: SortByCreation, Value: time.Now().UTC(), ID: "0b5b8e29-4a32-4a5b-9e1c-0e7e3f0c3a10"}
+	t.Run("Should decode an encoded cursor", func(t *testing.T) {
+		got, err := ParseCursor(c.Encode(), SortByCreation)
+
+		if err != nil {
+			t.Fatalf("was expecting a nil and received %v", err)
+		}
+		assertString(t, got.ID, c.ID)
+		assertTime(t, got.Value, c.Value)
+	})
+	t.Run("Should refuse invalid cursors", func(t *testing.T) {
+		wrongID := c
+		wrongID.ID = "id"
+		tests := []struct {
+			cursor string
+			sortBy SortField
+		}{
+			{"not a cursor", SortByCreation},
+			{c.Encode(), SortByExpiration},
+			{wrongID.Encode(), SortByCreation},
+			{Cursor{SortBy: SortByCreation, ID: c.ID}.Encode(), SortByCreation},
+		}
+		for _, tt := range tests {
+			if _, err := ParseCursor(tt.cursor, tt.sortBy); err != ErrInvalidCursor {
+				t.Errorf("got %v want %v", err, ErrInvalidCursor)
+			}
+		}
+	})
+}
+
+func TestFindActiveKeysByScope(t *testing.T) {
+	keyStore := KeyService{
+		Source: &KeySourceStub{},
+		Repo:   &KeyRepositoryStub{map[string]Key{}},
+	}
+	t.Run("Should return only the usable keys", func(t *testing.T) {
+		got, _ := keyStore.FindActiveKeysByScope(ctx, "mixed")
+
+		if len(got) != 1 {
+			t.Fatalf("got %d keys want %d", len(got), 1)
+		}
+		assertString(t, got[0].ID, activeKeyStub.ID)
+	})
+	t.Run("Should return every unexpired version of the rotated signing keys", func(t *testing.T) {
+		signing, _ := keyStore.CreateKey(ctx, "rotated", time.Now().Add(time.Hour), UseSigning, TypeEd25519, Policy{})
+		rotated, _ := keyStore.RotateKey(ctx, signing.ID, time.Now().AddDate(0, 0, 1))
+		newest, _ := keyStore.RotateKey(ctx, signing.ID, time.Now().AddDate(0, 0, 2))
+		expired := signing
+		expired.Version, expired.Expiration = newest.Version+1, time.Now().Add(-time.Hour)
+		keyStore.Repo.InsertKey(ctx, expired)
+		encryption, _ := keyStore.CreateKey(ctx, "rotated", time.Now().AddDate(0, 0, 1), UseEncryption, TypeRSA2048, Policy{})
+		keyStore.RotateKey(ctx, encryption.ID, time.Now().AddDate(0, 0, 2))
+
+		got, _ := keyStore.FindActiveKeysByScope(ctx, "rotated")
+
+		kids := map[string]bool{}
+		for _, k := range got {
+			kids[k.KID()] = true
+		}
+		if len(got) != 4 {
+			t.Fatalf("got %d keys want %d", len(got), 4)
+		}
+		for _, k := range []Key{signing, rotated, newest} {
+			if !kids[k.KID()] {
+				t.Errorf("want %s to be published", k.KID())
+			}
+		}
+		if kids[encryption.KID()] {
+			t.Errorf("want only the newest version of the encryption keys")
+		}
+	})
+	t.Run("Should return an empty slice if no key was found", func(t *testing.T) {
+		got, err := keyStore.FindActiveKeysByScope(ctx, "not found")
+
+		if err != nil {
+			t.Fatalf("was expecting a nil and received %v", err)
+		}
+		if got == nil || len(got) != 0 {
+			t.Errorf("got %v want an empty slice", got)
+		}
+	})
+}
+
 func TestNewKeyService(t *testing.T) {
 	source := &KeySourceStub{}
 	repo := &KeyRepositoryStub{}
 	t.Run("Returns a valid KeyService", func(t *testing.T) {
-		got := NewKeyService(source, repo)
+		got := NewKeyService(source, repo, time.Hour)
 		want := &KeyService{}
 		assertType(t, got, want)
 	})
@@ -1,15 +1,208 @@
 package keys
 
 import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rsa"
+	"errors"
+	"strconv"
+	"strings"
 	"time"
+
+	"github.com/lestrrat-go/jwx/x25519"
+)
+
+// FirstVersion version of a newly created Key, rotations increment it
+const FirstVersion = 1
+
+// State lifecycle state of a Key
+type State string
+
+const (
+	// StateActive the key can be used
+	StateActive State = "active"
+	// StateDisabled the key was disabled and can not be used until enabled again
+	StateDisabled State = "disabled"
+	// StatePendingDeletion the key is waiting to be destroyed, it can not be
+	// used but the destruction can still be cancelled
+	StatePendingDeletion State = "pending-deletion"
+	// StateDestroyed the private key was wiped, this is a final state
+	StateDestroyed State = "destroyed"
+)
+
+// Use purpose of a Key, a key is either used to encrypt or to sign, never both
+type Use string
+
+const (
+	// UseEncryption the key encrypts and decrypts JWEs
+	UseEncryption Use = "enc"
+	// UseSigning the key signs and verifies JWSs
+	UseSigning Use = "sig"
+)
+
+// KeyType algorithm and size of the key pair
+type KeyType string
+
+const (
+	TypeRSA2048 KeyType = "RSA-2048"
+	TypeRSA3072 KeyType = "RSA-3072"
+	TypeRSA4096 KeyType = "RSA-4096"
+	TypeP256    KeyType = "P-256"
+	TypeP384    KeyType = "P-384"
+	// TypeEd25519 Edwards curve key, it can only sign
+	TypeEd25519 KeyType = "Ed25519"
+	// TypeX25519 Montgomery curve key, it can only encrypt
+	TypeX25519 KeyType = "X25519"
 )
 
-// Key Representation of a rsa key with scope, ID and expiration
+// DefaultKeyType type of the keys created without a requested type
+const DefaultKeyType = TypeRSA2048
+
+// KeyTypes every supported key type
+var KeyTypes = []KeyType{TypeRSA2048, TypeRSA3072, TypeRSA4096, TypeP256, TypeP384, TypeEd25519, TypeX25519}
+
+// Valid tells if the key type is supported
+func (t KeyType) Valid() bool {
+	for _, known := range KeyTypes {
+		if known == t {
+			return true
+		}
+	}
+	return false
+}
+
+// IsRSA tells if the key type is a RSA one, keys created before the key types
+// were introduced may have sizes that are not supported anymore
+func (t KeyType) IsRSA() bool {
+	return strings.HasPrefix(string(t), "RSA-")
+}
+
+// Supports tells if keys of this type can be created for the use
+func (t KeyType) Supports(use Use) bool {
+	switch t {
+	case TypeEd25519:
+		return use == UseSigning
+	case TypeX25519:
+		return use == UseEncryption
+	}
+	return t.Valid()
+}
+
+// TypeOf finds the type of a public key, it is empty for unsupported keys
+func TypeOf(pub crypto.PublicKey) KeyType {
+	switch k := pub.(type) {
+	case *rsa.PublicKey:
+		return KeyType("RSA-" + strconv.Itoa(k.N.BitLen()))
+	case *ecdsa.PublicKey:
+		switch k.Curve {
+		case elliptic.P256():
+			return TypeP256
+		case elliptic.P384():
+			return TypeP384
+		}
+	case ed25519.PublicKey:
+		return TypeEd25519
+	case x25519.PublicKey:
+		return TypeX25519
+	}
+	return ""
+}
+
+// transitions states each state can move to by request, destruction is only
+// reached by the scheduled destruction of pending keys
+var transitions = map[State][]State{
+	StateActive:          {StateDisabled, StatePendingDeletion},
+	StateDisabled:        {StateActive, StatePendingDeletion},
+	StatePendingDeletion: {StateActive, StateDisabled},
+}
+
+// CanMoveTo tells if a key in this state can be moved to the target state
+func (s State) CanMoveTo(target State) bool {
+	for _, allowed := range transitions[s] {
+		if allowed == target {
+			return true
+		}
+	}
+	return false
+}
+
+// Key Representation of a key pair with scope, ID, version and expiration
 type Key struct {
-	Scope      string
-	ID         string
-	Expiration time.Time
-	Priv       *rsa.PrivateKey
-	Pub        *rsa.PublicKey
+	Scope        string
+	ID           string
+	Version      int
+	Expiration   time.Time
+	Creation     time.Time
+	Use          Use
+	Policy       Policy
+	State        State
+	DeletionDate time.Time
+	Priv         crypto.PrivateKey
+	Pub          crypto.PublicKey
+}
+
+// EncryptionPolicy JWE algorithms the key accepts, keys without a policy
+// follow the default one of their type
+func (k Key) EncryptionPolicy() Policy {
+	if k.Policy.Empty() {
+		return DefaultPolicy(k.Type())
+	}
+	return k.Policy
+}
+
+// Type finds the type of the key from its public key
+func (k Key) Type() KeyType {
+	return TypeOf(k.Pub)
+}
+
+// Usable returns the error describing why the key can not be used, if any
+func (k Key) Usable() error {
+	switch k.State {
+	case StateDisabled:
+		return ErrKeyDisabled
+	case StatePendingDeletion:
+		return ErrKeyPendingDeletion
+	case StateDestroyed:
+		return ErrKeyDestroyed
+	}
+	return nil
+}
+
+// UsableFor returns the error describing why the key can not be used for the
+// purpose, if any
+func (k Key) UsableFor(use Use) error {
+	if k.Use != use {
+		return ErrKeyWrongUse
+	}
+	return k.Usable()
+}
+
+// ExpiredAt tells if the key was already expired at the given instant
+func (k Key) ExpiredAt(t time.Time) bool {
+	return !t.Before(k.Expiration)
+}
+
+// KID identifies a specific version of the Key, in the "<ID>:<version>" format
+func (k Key) KID() string {
+	return k.ID + ":" + strconv.Itoa(k.Version)
+}
+
+// ErrInvalidKID the kid is not in the "<ID>:<version>" format
+var ErrInvalidKID = errors.New("invalid kid format")
+
+// ParseKID extracts the ID and the version from a kid
+func ParseKID(kid string) (string, int, error) {
+	i := strings.LastIndex(kid, ":")
+	if i < 1 {
+		return "", 0, ErrInvalidKID
+	}
+
+	version, err := strconv.Atoi(kid[i+1:])
+	if err != nil || version < FirstVersion {
+		return "", 0, ErrInvalidKID
+	}
+
+	return kid[:i], version, nil
 }
@@ -0,0 +1,79 @@
+package keys
+
+import "errors"
+
+// ErrInvalidPolicy the policy has algorithms the key type can not use
+var ErrInvalidPolicy = errors.New("invalid key algorithm policy")
+
+// Policy JWE algorithms an encryption Key accepts, identified by their JOSE
+// names, the first ones are used when the client does not pick any
+type Policy struct {
+	KeyAlgorithms     []string
+	ContentAlgorithms []string
+	// Compression tells if the content can be DEFLATE compressed
+	Compression bool
+}
+
+var (
+	rsaKeyAlgorithms   = []string{"RSA-OAEP-256", "RSA-OAEP"}
+	curveKeyAlgorithms = []string{"ECDH-ES+A256KW", "ECDH-ES+A192KW", "ECDH-ES+A128KW", "ECDH-ES"}
+	contentAlgorithms  = []string{"A256CBC-HS512", "A192CBC-HS384", "A128CBC-HS256", "A256GCM", "A192GCM", "A128GCM"}
+)
+
+// DefaultPolicy policy of the keys created without one, and of the ones
+// created before the policies were introduced
+func DefaultPolicy(t KeyType) Policy {
+	keyAlgorithm := curveKeyAlgorithms[0]
+	if t.IsRSA() {
+		keyAlgorithm = rsaKeyAlgorithms[0]
+	}
+	return Policy{
+		KeyAlgorithms:     []string{keyAlgorithm},
+		ContentAlgorithms: []string{contentAlgorithms[0]},
+	}
+}
+
+// Empty tells if no algorithm was set in the policy
+func (p Policy) Empty() bool {
+	return len(p.KeyAlgorithms) == 0 && len(p.ContentAlgorithms) == 0 && !p.Compression
+}
+
+// ValidFor checks if keys of the type can use every algorithm of the policy
+func (p Policy) ValidFor(t KeyType) error {
+	keyAlgorithms := curveKeyAlgorithms
+	if t.IsRSA() {
+		keyAlgorithms = rsaKeyAlgorithms
+	}
+
+	if len(p.KeyAlgorithms) == 0 || len(p.ContentAlgorithms) == 0 {
+		return ErrInvalidPolicy
+	}
+	if !subsetOf(p.KeyAlgorithms, keyAlgorithms) || !subsetOf(p.ContentAlgorithms, contentAlgorithms) {
+		return ErrInvalidPolicy
+	}
+	return nil
+}
+
+// Allows tells if the policy accepts the combination of algorithms
+func (p Policy) Allows(keyAlgorithm, contentAlgorithm string, compressed bool) bool {
+	if compressed && !p.Compression {
+		return false
+	}
+	return subsetOf([]string{keyAlgorithm}, p.KeyAlgorithms) && subsetOf([]string{contentAlgorithm}, p.ContentAlgorithms)
+}
+
+func subsetOf(values, allowed []string) bool {
+	for _, v := range values {
+		found := false
+		for _, a := range allowed {
+			if v == a {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
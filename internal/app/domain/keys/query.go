@@ -0,0 +1,207 @@
+package keys
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"sort"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+const (
+	// DefaultPageLimit keys returned in a page when no limit is requested
+	DefaultPageLimit = 50
+	// MaxPageLimit most keys a single page can return
+	MaxPageLimit = 500
+)
+
+// SortField attribute the keys of a page are sorted by, ties are broken by ID
+type SortField string
+
+const (
+	// SortByCreation sorts by the creation of the listed version of the keys
+	SortByCreation SortField = "creation"
+	// SortByExpiration sorts by the expiration of the listed version of the keys
+	SortByExpiration SortField = "expiration"
+)
+
+// ErrInvalidCursor the cursor was not issued for this query
+var ErrInvalidCursor = errors.New("invalid page cursor")
+
+// KeyQuery lists the newest version of the keys of a scope a page at a time,
+// zero filters match every key
+type KeyQuery struct {
+	Scope  string
+	States []State
+	Types  []KeyType
+	// ExpiresAfter and ExpiresBefore bound the expiration, both exclusive
+	ExpiresAfter  time.Time
+	ExpiresBefore time.Time
+	SortBy        SortField
+	Descending    bool
+	Limit         int
+	// After continues the listing after the last key of the previous page
+	After *Cursor
+}
+
+// KeyPage a page of keys, Next is nil on the last page
+type KeyPage struct {
+	Keys []Key
+	Next *Cursor
+}
+
+// Cursor position of a key in a sorted listing
+type Cursor struct {
+	SortBy SortField `json:"s"`
+	Value  time.Time `json:"v"`
+	ID     string    `json:"id"`
+}
+
+// Normalized fills the defaults of the query
+func (q KeyQuery) Normalized() KeyQuery {
+	if q.SortBy == "" {
+		q.SortBy = SortByCreation
+	}
+	if q.Limit <= 0 {
+		q.Limit = DefaultPageLimit
+	}
+	if q.Limit > MaxPageLimit {
+		q.Limit = MaxPageLimit
+	}
+	return q
+}
+
+// Matches tells if the key passes the filters of the query, the scope and
+// the cursor are not checked
+func (q KeyQuery) Matches(k Key) bool {
+	if len(q.States) > 0 && !containsState(q.States, k.State) {
+		return false
+	}
+	if len(q.Types) > 0 && !containsType(q.Types, k.Type()) {
+		return false
+	}
+	if !q.ExpiresAfter.IsZero() && !k.Expiration.After(q.ExpiresAfter) {
+		return false
+	}
+	if !q.ExpiresBefore.IsZero() && !k.Expiration.Before(q.ExpiresBefore) {
+		return false
+	}
+	return true
+}
+
+// SortValue value of the key the query sorts by
+func (q KeyQuery) SortValue(k Key) time.Time {
+	if q.SortBy == SortByExpiration {
+		return k.Expiration
+	}
+	return k.Creation
+}
+
+// CursorOf position of the key in the listing of the query
+func (q KeyQuery) CursorOf(k Key) *Cursor {
+	return &Cursor{SortBy: q.SortBy, Value: q.SortValue(k), ID: k.ID}
+}
+
+// before tells if the position a is listed before the position b
+func (q KeyQuery) before(a, b *Cursor) bool {
+	if !a.Value.Equal(b.Value) {
+		return a.Value.Before(b.Value) != q.Descending
+	}
+	return a.ID < b.ID != q.Descending
+}
+
+// PublishedVersions the versions of a key, in ascending order, whose public
+// key is published: the ones unexpired at the instant of the signing keys,
+// so the signatures made before a rotation still verify, but only the newest
+// one of the encryption keys. Newest version first
+func PublishedVersions(versions []Key, at time.Time) []Key {
+	var published []Key
+	for i := len(versions) - 1; i >= 0; i-- {
+		k := versions[i]
+		if !k.ExpiredAt(at) {
+			published = append(published, k)
+		}
+		if k.Use != UseSigning {
+			break
+		}
+	}
+	return published
+}
+
+// PageOf builds the page of the query out of the newest version of every
+// key of the scope, for repositories that can not sort or filter on their own
+func PageOf(ks []Key, q KeyQuery) KeyPage {
+	q = q.Normalized()
+
+	matched := []Key{}
+	for _, k := range ks {
+		if k.Scope != q.Scope || !q.Matches(k) {
+			continue
+		}
+		if q.After != nil && !q.before(q.After, q.CursorOf(k)) {
+			continue
+		}
+		matched = append(matched, k)
+	}
+	sort.Slice(matched, func(i, j int) bool {
+		return q.before(q.CursorOf(matched[i]), q.CursorOf(matched[j]))
+	})
+
+	return NewKeyPage(matched, q)
+}
+
+// NewKeyPage builds the page out of the sorted keys following the cursor of
+// the query, at most one more than the limit is expected
+func NewKeyPage(ks []Key, q KeyQuery) KeyPage {
+	if len(ks) <= q.Limit {
+		return KeyPage{Keys: ks}
+	}
+	ks = ks[:q.Limit]
+	return KeyPage{Keys: ks, Next: q.CursorOf(ks[len(ks)-1])}
+}
+
+// Encode opaque representation of the cursor, safe to be used in URLs
+func (c Cursor) Encode() string {
+	b, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// ParseCursor decodes a cursor, it must have been issued for the sort field
+func ParseCursor(s string, sortBy SortField) (*Cursor, error) {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, ErrInvalidCursor
+	}
+
+	var c Cursor
+	if err := json.Unmarshal(b, &c); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	if c.SortBy != sortBy || c.Value.IsZero() {
+		return nil, ErrInvalidCursor
+	}
+	if _, err := uuid.Parse(c.ID); err != nil {
+		return nil, ErrInvalidCursor
+	}
+	return &c, nil
+}
+
+func containsState(states []State, s State) bool {
+	for _, state := range states {
+		if state == s {
+			return true
+		}
+	}
+	return false
+}
+
+func containsType(types []KeyType, t KeyType) bool {
+	for _, kt := range types {
+		if kt == t {
+			return true
+		}
+	}
+	return false
+}
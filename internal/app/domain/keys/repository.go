@@ -1,8 +1,23 @@
 package keys
 
+import (
+	"context"
+	"time"
+)
+
 // KeyRepository Persistency interface to serve the KeyStore
 type KeyRepository interface {
-	FindKey(string) (Key, error)
-	FindKeysByScope(string) ([]Key, error)
-	InsertKey(Key) error
+	FindKey(context.Context, string) (Key, error)
+	FindKeyVersion(context.Context, string, int) (Key, error)
+	FindKeysByScope(context.Context, string) ([]Key, error)
+	FindKeysPage(context.Context, KeyQuery) (KeyPage, error)
+	// FindPublicKeysByScope finds the versions of the keys within the scope
+	// that are published, see PublishedVersions, without their private key.
+	// Sorted by ID, newest version first
+	FindPublicKeysByScope(ctx context.Context, scope string, at time.Time) ([]Key, error)
+	InsertKey(context.Context, Key) error
+	// UpdateKeyState moves the versions of a key from one state to another,
+	// ErrInvalidStateTransition when none of them is in the expected state
+	UpdateKeyState(ctx context.Context, id string, from State, to State, deletionDate time.Time) error
+	DestroyKeys(context.Context, time.Time) (int, error)
 }
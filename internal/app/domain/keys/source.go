@@ -1,8 +1,16 @@
 package keys
 
-import "crypto/rsa"
+import (
+	"context"
+	"crypto"
+)
+
+// PrivateKey private key of any of the supported key types
+type PrivateKey interface {
+	Public() crypto.PublicKey
+}
 
 // KeySource Key provider of the KeyStore
 type KeySource interface {
-	Take() (*rsa.PrivateKey, error)
+	Take(context.Context, KeyType) (PrivateKey, error)
 }
@@ -0,0 +1,130 @@
+package signing
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jws"
+)
+
+var (
+	// ErrUnsupportedAlgorithm the signature algorithm can not be used with the key
+	ErrUnsupportedAlgorithm = errors.New("unsupported signature algorithm")
+	// ErrKIDMismatch the JWS kid header does not belong to the requested key
+	ErrKIDMismatch = errors.New("jws kid does not match the requested key")
+	// ErrInvalidSignature the JWS is malformed or its signature does not match
+	ErrInvalidSignature = errors.New("jws signature could not be verified")
+)
+
+// Algorithms signature algorithms each type of key can sign with, the first
+// one is used when the signer does not choose one
+func Algorithms(t keys.KeyType) []jwa.SignatureAlgorithm {
+	switch t {
+	case keys.TypeP256:
+		return []jwa.SignatureAlgorithm{jwa.ES256}
+	case keys.TypeP384:
+		return []jwa.SignatureAlgorithm{jwa.ES384}
+	case keys.TypeEd25519:
+		return []jwa.SignatureAlgorithm{jwa.EdDSA}
+	}
+	if t.IsRSA() {
+		return []jwa.SignatureAlgorithm{jwa.RS256, jwa.PS256}
+	}
+	return nil
+}
+
+// algorithmFor picks the requested algorithm if the key type can use it
+func algorithmFor(t keys.KeyType, alg jwa.SignatureAlgorithm) (jwa.SignatureAlgorithm, error) {
+	supported := Algorithms(t)
+	if alg == "" && len(supported) > 0 {
+		return supported[0], nil
+	}
+	for _, candidate := range supported {
+		if candidate == alg {
+			return alg, nil
+		}
+	}
+	return "", ErrUnsupportedAlgorithm
+}
+
+type SigningService struct {
+	finder KeyFinder
+}
+
+// NewSigningService creates a new signing service
+func NewSigningService(f KeyFinder) SigningService {
+	return SigningService{
+		finder: f,
+	}
+}
+
+// Sign Signs the payload in a compact JWS using the newest version of a key
+// within the scope, the version used is identified by the kid header
+func (s *SigningService) Sign(ctx context.Context, keyID string, scope string, alg string, payload string) ([]byte, error) {
+	key, err := s.finder.FindScopedKey(ctx, keyID, scope)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if err := key.UsableFor(keys.UseSigning); err != nil {
+		return []byte{}, err
+	}
+
+	signatureAlg, err := algorithmFor(key.Type(), jwa.SignatureAlgorithm(alg))
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if key.ExpiredAt(time.Now()) {
+		return []byte{}, keys.ErrKeyExpired
+	}
+
+	h := jws.NewHeaders()
+	if err := h.Set(jws.KeyIDKey, key.KID()); err != nil {
+		return []byte{}, err
+	}
+
+	signed, err := jws.Sign([]byte(payload), signatureAlg, key.Priv, jws.WithHeaders(h))
+	if err != nil {
+		return []byte{}, err
+	}
+	return signed, nil
+}
+
+// Verify Verifies the JWS and returns its payload using the version of a key
+// within the scope pointed by the kid header, signatures made before the key
+// expired can still be verified
+func (s *SigningService) Verify(ctx context.Context, keyID string, scope string, m string) ([]byte, error) {
+	msg, err := jws.Parse([]byte(m))
+	if err != nil || len(msg.Signatures()) != 1 {
+		return []byte{}, ErrInvalidSignature
+	}
+	headers := msg.Signatures()[0].ProtectedHeaders()
+
+	id, version, err := keys.ParseKID(headers.KeyID())
+	if err != nil || id != keyID {
+		return []byte{}, ErrKIDMismatch
+	}
+
+	key, err := s.finder.FindScopedKeyVersion(ctx, keyID, version, scope)
+	if err != nil {
+		return []byte{}, err
+	}
+
+	if err := key.UsableFor(keys.UseSigning); err != nil {
+		return []byte{}, err
+	}
+
+	if _, err := algorithmFor(key.Type(), headers.Algorithm()); err != nil || headers.Algorithm() == "" {
+		return []byte{}, ErrUnsupportedAlgorithm
+	}
+
+	payload, err := jws.Verify([]byte(m), headers.Algorithm(), key.Pub)
+	if err != nil {
+		return []byte{}, ErrInvalidSignature
+	}
+	return payload, nil
+}
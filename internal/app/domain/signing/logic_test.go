@@ -0,0 +1,325 @@
+package signing
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"testing"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jws"
+)
+
+// ctx the services are called without deadline
+var ctx = context.Background()
+
+var (
+	rsaKey, _    = rsa.GenerateKey(rand.Reader, 2048)
+	oldRSAKey, _ = rsa.GenerateKey(rand.Reader, 2048)
+	oldKey       = keys.Key{
+		Scope:      "scope",
+		ID:         "id",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseSigning,
+		Priv:       oldRSAKey,
+		Pub:        &oldRSAKey.PublicKey,
+	}
+	key = keys.Key{
+		Scope:      "scope",
+		ID:         "id",
+		Version:    2,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseSigning,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}
+	expiredKey = keys.Key{
+		Scope:      "scope",
+		ID:         "expired",
+		Version:    1,
+		Expiration: time.Now().Add(-time.Hour),
+		Use:        keys.UseSigning,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}
+	disabledKey = keys.Key{
+		Scope:      "scope",
+		ID:         "disabled",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseSigning,
+		State:      keys.StateDisabled,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}
+	ecPriv, _ = ecdsa.GenerateKey(elliptic.P384(), rand.Reader)
+	ecKey     = keys.Key{
+		Scope:      "scope",
+		ID:         "ec",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseSigning,
+		Priv:       ecPriv,
+		Pub:        &ecPriv.PublicKey,
+	}
+	edPub, edPriv, _ = ed25519.GenerateKey(rand.Reader)
+	edKey            = keys.Key{
+		Scope:      "scope",
+		ID:         "ed25519",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseSigning,
+		Priv:       edPriv,
+		Pub:        edPub,
+	}
+	encryptionKey = keys.Key{
+		Scope:      "scope",
+		ID:         "encryption",
+		Version:    1,
+		Expiration: time.Now().AddDate(0, 0, 1),
+		Use:        keys.UseEncryption,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}
+)
+
+type KeyFinderStub struct{}
+
+func (f *KeyFinderStub) FindScopedKey(ctx context.Context, id string, scope string) (keys.Key, error) {
+	k := key
+	for _, candidate := range []keys.Key{expiredKey, disabledKey, ecKey, edKey, encryptionKey} {
+		if candidate.ID == id {
+			k = candidate
+		}
+	}
+	if k.Scope != scope {
+		return keys.Key{}, keys.ErrKeyOutOfScope
+	}
+	return k, nil
+}
+
+func (f *KeyFinderStub) FindScopedKeyVersion(ctx context.Context, id string, version int, scope string) (keys.Key, error) {
+	var k keys.Key
+	for _, candidate := range []keys.Key{oldKey, key, expiredKey, disabledKey, ecKey, edKey, encryptionKey} {
+		if candidate.ID == id && candidate.Version == version {
+			k = candidate
+		}
+	}
+	if k.ID == "" {
+		return keys.Key{}, keys.ErrKeyNotFound
+	}
+	if k.Scope != scope {
+		return keys.Key{}, keys.ErrKeyOutOfScope
+	}
+	return k, nil
+}
+
+func signWith(k keys.Key, alg jwa.SignatureAlgorithm, payload string) string {
+	h := jws.NewHeaders()
+	h.Set(jws.KeyIDKey, k.KID())
+	signed, _ := jws.Sign([]byte(payload), alg, k.Priv, jws.WithHeaders(h))
+	return string(signed)
+}
+
+func TestSign(t *testing.T) {
+	signing := NewSigningService(&KeyFinderStub{})
+	t.Run("Should return a valid JWS signed with RS256 by default", func(t *testing.T) {
+		got, _ := signing.Sign(ctx, "id", "scope", "", "testingOK")
+
+		payload, err := jws.Verify(got, jwa.RS256, key.Pub)
+		if err != nil {
+			t.Fatalf("Invalid jws: %v", err)
+		}
+		if string(payload) != "testingOK" {
+			t.Errorf("want %v, got %v", "testingOK", string(payload))
+		}
+	})
+	t.Run("Should sign with PS256 when requested", func(t *testing.T) {
+		got, _ := signing.Sign(ctx, "id", "scope", "PS256", "test")
+
+		if _, err := jws.Verify(got, jwa.PS256, key.Pub); err != nil {
+			t.Errorf("Invalid jws: %v", err)
+		}
+	})
+	t.Run("Should identify the key version in the kid header", func(t *testing.T) {
+		signed, _ := signing.Sign(ctx, "id", "scope", "", "test")
+
+		msg, _ := jws.Parse(signed)
+		got := msg.Signatures()[0].ProtectedHeaders().KeyID()
+
+		if got != key.KID() {
+			t.Errorf("want %v, got %v", key.KID(), got)
+		}
+	})
+	t.Run("Should sign with the algorithm of the curve keys", func(t *testing.T) {
+		tests := []struct {
+			id  string
+			alg jwa.SignatureAlgorithm
+			pub interface{}
+		}{
+			{"ec", jwa.ES384, ecKey.Pub},
+			{"ed25519", jwa.EdDSA, edKey.Pub},
+		}
+		for _, tt := range tests {
+			got, err := signing.Sign(ctx, tt.id, "scope", "", "test")
+			if err != nil {
+				t.Fatalf("%s: want no error, got %v", tt.id, err)
+			}
+
+			if _, err := jws.Verify(got, tt.alg, tt.pub); err != nil {
+				t.Errorf("%s: invalid jws: %v", tt.id, err)
+			}
+		}
+	})
+	t.Run("Should refuse an algorithm of another key type", func(t *testing.T) {
+		_, err := signing.Sign(ctx, "ec", "scope", "RS256", "test")
+
+		if err != ErrUnsupportedAlgorithm {
+			t.Errorf("want %v, got %v", ErrUnsupportedAlgorithm, err)
+		}
+	})
+	t.Run("Should refuse an unsupported algorithm", func(t *testing.T) {
+		_, err := signing.Sign(ctx, "id", "scope", "HS256", "test")
+
+		if err != ErrUnsupportedAlgorithm {
+			t.Errorf("want %v, got %v", ErrUnsupportedAlgorithm, err)
+		}
+	})
+	t.Run("Should refuse to sign with a key out of scope", func(t *testing.T) {
+		_, err := signing.Sign(ctx, "id", "another scope", "", "test")
+
+		if err != keys.ErrKeyOutOfScope {
+			t.Errorf("want %v, got %v", keys.ErrKeyOutOfScope, err)
+		}
+	})
+	t.Run("Should refuse to sign with an encryption key", func(t *testing.T) {
+		_, err := signing.Sign(ctx, "encryption", "scope", "", "test")
+
+		if err != keys.ErrKeyWrongUse {
+			t.Errorf("want %v, got %v", keys.ErrKeyWrongUse, err)
+		}
+	})
+	t.Run("Should refuse to sign with a key that is not usable", func(t *testing.T) {
+		_, err := signing.Sign(ctx, "disabled", "scope", "", "test")
+
+		if err != keys.ErrKeyDisabled {
+			t.Errorf("want %v, got %v", keys.ErrKeyDisabled, err)
+		}
+	})
+	t.Run("Should refuse to sign with an expired key", func(t *testing.T) {
+		_, err := signing.Sign(ctx, "expired", "scope", "", "test")
+
+		if err != keys.ErrKeyExpired {
+			t.Errorf("want %v, got %v", keys.ErrKeyExpired, err)
+		}
+	})
+}
+
+func TestVerify(t *testing.T) {
+	signing := NewSigningService(&KeyFinderStub{})
+	t.Run("Should return the payload of a valid signature", func(t *testing.T) {
+		want := "test"
+		signed, _ := signing.Sign(ctx, "id", "scope", "PS256", want)
+
+		got, err := signing.Verify(ctx, "id", "scope", string(signed))
+
+		if err != nil {
+			t.Fatalf("want no error, got %v", err)
+		}
+		if string(got) != want {
+			t.Errorf("want %v, got %v", want, string(got))
+		}
+	})
+	t.Run("Should verify the signatures of the curve keys", func(t *testing.T) {
+		for _, id := range []string{"ec", "ed25519"} {
+			signed, _ := signing.Sign(ctx, id, "scope", "", "test")
+
+			if _, err := signing.Verify(ctx, id, "scope", string(signed)); err != nil {
+				t.Errorf("%s: want no error, got %v", id, err)
+			}
+		}
+	})
+	t.Run("Should verify with the older version pointed by the kid header", func(t *testing.T) {
+		signed := signWith(oldKey, jwa.RS256, "test")
+
+		if _, err := signing.Verify(ctx, "id", "scope", signed); err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+	})
+	t.Run("Should verify with an expired key", func(t *testing.T) {
+		signed := signWith(expiredKey, jwa.RS256, "test")
+
+		if _, err := signing.Verify(ctx, "expired", "scope", signed); err != nil {
+			t.Errorf("want no error, got %v", err)
+		}
+	})
+	t.Run("Should refuse a signature made by another key", func(t *testing.T) {
+		forged := oldKey
+		forged.Version = key.Version
+		signed := signWith(forged, jwa.RS256, "test")
+
+		_, err := signing.Verify(ctx, "id", "scope", signed)
+
+		if err != ErrInvalidSignature {
+			t.Errorf("want %v, got %v", ErrInvalidSignature, err)
+		}
+	})
+	t.Run("Should refuse a malformed JWS", func(t *testing.T) {
+		_, err := signing.Verify(ctx, "id", "scope", "not a jws")
+
+		if err != ErrInvalidSignature {
+			t.Errorf("want %v, got %v", ErrInvalidSignature, err)
+		}
+	})
+	t.Run("Should refuse to verify if the kid belongs to another key", func(t *testing.T) {
+		signed := signWith(key, jwa.RS256, "test")
+
+		_, err := signing.Verify(ctx, "another", "scope", signed)
+
+		if err != ErrKIDMismatch {
+			t.Errorf("want %v, got %v", ErrKIDMismatch, err)
+		}
+	})
+	t.Run("Should refuse an unsupported algorithm", func(t *testing.T) {
+		signed := signWith(key, jwa.RS512, "test")
+
+		_, err := signing.Verify(ctx, "id", "scope", signed)
+
+		if err != ErrUnsupportedAlgorithm {
+			t.Errorf("want %v, got %v", ErrUnsupportedAlgorithm, err)
+		}
+	})
+	t.Run("Should refuse to verify with a key out of scope", func(t *testing.T) {
+		signed := signWith(key, jwa.RS256, "test")
+
+		_, err := signing.Verify(ctx, "id", "another scope", signed)
+
+		if err != keys.ErrKeyOutOfScope {
+			t.Errorf("want %v, got %v", keys.ErrKeyOutOfScope, err)
+		}
+	})
+	t.Run("Should refuse to verify with an encryption key", func(t *testing.T) {
+		signed := signWith(encryptionKey, jwa.RS256, "test")
+
+		_, err := signing.Verify(ctx, "encryption", "scope", signed)
+
+		if err != keys.ErrKeyWrongUse {
+			t.Errorf("want %v, got %v", keys.ErrKeyWrongUse, err)
+		}
+	})
+	t.Run("Should refuse to verify with a key that is not usable", func(t *testing.T) {
+		signed := signWith(disabledKey, jwa.RS256, "test")
+
+		_, err := signing.Verify(ctx, "disabled", "scope", signed)
+
+		if err != keys.ErrKeyDisabled {
+			t.Errorf("want %v, got %v", keys.ErrKeyDisabled, err)
+		}
+	})
+}
@@ -2,7 +2,10 @@ package server
 
 import (
 	"net/http"
+	"time"
 
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/metrics"
 	"github.com/gorilla/mux"
 	"go.uber.org/zap"
 )
@@ -12,51 +15,149 @@ type HTTPLogger interface {
 	Info(string, ...zap.Field)
 }
 
-// NewHTTPServer creates a new http handler
+// Authenticator finds the credential of a request
+type Authenticator interface {
+	Authenticate(*http.Request) (auth.Credential, error)
+}
+
+// NewHTTPServer creates a new http handler, every route but the public JWKS
+// and the probes requires a credential accepted by the authenticator. Every request has to be served within the timeout, but the
+// streams, whose payloads take as long as they take to upload, have their
+// own timeout
 func NewHTTPServer(
 	l HTTPLogger,
+	a Authenticator,
+	timeout time.Duration,
+	streamTimeout time.Duration,
+	hH HealthHandler,
 	kH KeyHandler,
 	eH EncryptHandler,
 	dH DecryptHandler,
+	sH SignHandler,
+	vH VerifyHandler,
 ) *http.Server {
 	router := mux.NewRouter()
 	logger := newLoggerMiddleware(l)
 
 	router.Use(logger)
+	router.Use(newMetricsMiddleware())
 
-	router.
+	public := router.NewRoute().Subrouter()
+	public.Use(newTimeoutMiddleware(timeout))
+
+	public.
+		HandleFunc("/scopes/{scope}/.well-known/jwks.json", kH.JWKS).
+		Methods(http.MethodGet)
+	public.
+		HandleFunc("/healthz", hH.Live).
+		Methods(http.MethodGet)
+	public.
+		HandleFunc("/readyz", hH.Ready).
+		Methods(http.MethodGet)
+
+	authenticated := router.NewRoute().Subrouter()
+	authenticated.Use(newAuthMiddleware(a))
+
+	streams := authenticated.NewRoute().Subrouter()
+	streams.Use(newTimeoutMiddleware(streamTimeout))
+
+	streams.
+		HandleFunc("/encrypt/stream", eH.Stream).
+		Methods(http.MethodPost)
+	streams.
+		HandleFunc("/decrypt/stream", dH.Stream).
+		Methods(http.MethodPost)
+
+	api := authenticated.NewRoute().Subrouter()
+	api.Use(newTimeoutMiddleware(timeout))
+
+	api.
 		HandleFunc("/keys", kH.Post).
 		Methods(http.MethodPost)
-	router.
+	api.
 		HandleFunc("/keys/{keyID}", kH.Get).
 		Methods(http.MethodGet)
-	router.
+	api.
+		HandleFunc("/keys/{keyID}/rotate", kH.Rotate).
+		Methods(http.MethodPost)
+	api.
+		HandleFunc("/keys/{keyID}/state", kH.ChangeState).
+		Methods(http.MethodPut)
+	api.
 		HandleFunc("/keys", kH.Find).
 		Methods(http.MethodGet)
 
-	router.
+	api.
 		HandleFunc("/encrypt", eH.Post).
 		Methods(http.MethodPost)
+	api.
+		HandleFunc("/encrypt/batch", eH.Batch).
+		Methods(http.MethodPost)
 
-	router.
+	api.
 		HandleFunc("/decrypt", dH.Post).
 		Methods(http.MethodPost)
+	api.
+		HandleFunc("/decrypt/batch", dH.Batch).
+		Methods(http.MethodPost)
+
+	api.
+		HandleFunc("/sign", sH.Post).
+		Methods(http.MethodPost)
+
+	api.
+		HandleFunc("/verify", vH.Post).
+		Methods(http.MethodPost)
 
 	return &http.Server{
 		Handler: router,
 	}
 }
 
+// NewMetricsServer creates the http handler of the metrics, they name the
+// scopes of every tenant so they are served on their own listener, meant to
+// be reachable by the scrapers only
+func NewMetricsServer() *http.Server {
+	router := mux.NewRouter()
+	router.
+		Handle("/metrics", metrics.Handler()).
+		Methods(http.MethodGet)
+
+	return &http.Server{
+		Handler: router,
+	}
+}
+
+type HealthHandler interface {
+	Live(http.ResponseWriter, *http.Request)
+	Ready(http.ResponseWriter, *http.Request)
+}
+
 type KeyHandler interface {
 	Post(http.ResponseWriter, *http.Request)
+	Rotate(http.ResponseWriter, *http.Request)
+	ChangeState(http.ResponseWriter, *http.Request)
 	Get(http.ResponseWriter, *http.Request)
 	Find(http.ResponseWriter, *http.Request)
+	JWKS(http.ResponseWriter, *http.Request)
 }
 
 type EncryptHandler interface {
 	Post(http.ResponseWriter, *http.Request)
+	Batch(http.ResponseWriter, *http.Request)
+	Stream(http.ResponseWriter, *http.Request)
 }
 
 type DecryptHandler interface {
 	Post(http.ResponseWriter, *http.Request)
+	Batch(http.ResponseWriter, *http.Request)
+	Stream(http.ResponseWriter, *http.Request)
+}
+
+type SignHandler interface {
+	Post(http.ResponseWriter, *http.Request)
+}
+
+type VerifyHandler interface {
+	Post(http.ResponseWriter, *http.Request)
 }
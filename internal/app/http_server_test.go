@@ -1,10 +1,14 @@
 package server
 
 import (
+	"context"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 	"go.uber.org/zap"
 )
 
@@ -17,6 +21,18 @@ type keStub struct {
 		CalledWith []interface{}
 		Called     bool
 	}
+	R struct {
+		CalledWith []interface{}
+		Called     bool
+	}
+	S struct {
+		CalledWith []interface{}
+		Called     bool
+	}
+	J struct {
+		CalledWith []interface{}
+		Called     bool
+	}
 }
 
 func (h *keStub) Post(w http.ResponseWriter, r *http.Request) {
@@ -24,6 +40,16 @@ func (h *keStub) Post(w http.ResponseWriter, r *http.Request) {
 	h.P.Called = true
 }
 
+func (h *keStub) Rotate(w http.ResponseWriter, r *http.Request) {
+	h.R.CalledWith = []interface{}{w, r}
+	h.R.Called = true
+}
+
+func (h *keStub) ChangeState(w http.ResponseWriter, r *http.Request) {
+	h.S.CalledWith = []interface{}{w, r}
+	h.S.Called = true
+}
+
 func (h *keStub) Get(w http.ResponseWriter, r *http.Request) {
 	h.G.CalledWith = []interface{}{w, r}
 	h.G.Called = true
@@ -34,11 +60,41 @@ func (h *keStub) Find(w http.ResponseWriter, r *http.Request) {
 	h.G.Called = true
 }
 
+func (h *keStub) JWKS(w http.ResponseWriter, r *http.Request) {
+	h.J.CalledWith = []interface{}{w, r}
+	h.J.Called = true
+}
+
+type healthStub struct {
+	L struct {
+		Called bool
+	}
+	R struct {
+		Called bool
+	}
+}
+
+func (h *healthStub) Live(w http.ResponseWriter, r *http.Request) {
+	h.L.Called = true
+}
+
+func (h *healthStub) Ready(w http.ResponseWriter, r *http.Request) {
+	h.R.Called = true
+}
+
 type encrypStub struct {
 	P struct {
 		CalledWith []interface{}
 		Called     bool
 	}
+	B struct {
+		CalledWith []interface{}
+		Called     bool
+	}
+	S struct {
+		CalledWith []interface{}
+		Called     bool
+	}
 }
 
 func (h *encrypStub) Post(w http.ResponseWriter, r *http.Request) {
@@ -46,11 +102,42 @@ func (h *encrypStub) Post(w http.ResponseWriter, r *http.Request) {
 	h.P.Called = true
 }
 
+func (h *encrypStub) Batch(w http.ResponseWriter, r *http.Request) {
+	h.B.CalledWith = []interface{}{w, r}
+	h.B.Called = true
+}
+
+func (h *encrypStub) Stream(w http.ResponseWriter, r *http.Request) {
+	h.S.CalledWith = []interface{}{w, r}
+	h.S.Called = true
+}
+
+// slowStreamStub a stream taking longer than the wait to upload
+type slowStreamStub struct {
+	encrypStub
+	wait time.Duration
+	err  error
+}
+
+func (h *slowStreamStub) Stream(w http.ResponseWriter, r *http.Request) {
+	h.S.Called = true
+	time.Sleep(h.wait)
+	h.err = r.Context().Err()
+}
+
 type decrypStub struct {
 	P struct {
 		CalledWith []interface{}
 		Called     bool
 	}
+	B struct {
+		CalledWith []interface{}
+		Called     bool
+	}
+	S struct {
+		CalledWith []interface{}
+		Called     bool
+	}
 }
 
 func (h *decrypStub) Post(w http.ResponseWriter, r *http.Request) {
@@ -58,6 +145,40 @@ func (h *decrypStub) Post(w http.ResponseWriter, r *http.Request) {
 	h.P.Called = true
 }
 
+func (h *decrypStub) Batch(w http.ResponseWriter, r *http.Request) {
+	h.B.CalledWith = []interface{}{w, r}
+	h.B.Called = true
+}
+
+func (h *decrypStub) Stream(w http.ResponseWriter, r *http.Request) {
+	h.S.CalledWith = []interface{}{w, r}
+	h.S.Called = true
+}
+
+type signStub struct {
+	P struct {
+		CalledWith []interface{}
+		Called     bool
+	}
+}
+
+func (h *signStub) Post(w http.ResponseWriter, r *http.Request) {
+	h.P.CalledWith = []interface{}{w, r}
+	h.P.Called = true
+}
+
+type verifyStub struct {
+	P struct {
+		CalledWith []interface{}
+		Called     bool
+	}
+}
+
+func (h *verifyStub) Post(w http.ResponseWriter, r *http.Request) {
+	h.P.CalledWith = []interface{}{w, r}
+	h.P.Called = true
+}
+
 type loggerStub struct {
 	CalledWith []interface{}
 	Called     bool
@@ -71,12 +192,158 @@ func (l *loggerStub) Info(msg string, args ...zap.Field) {
 
 var (
 	log    = new(loggerStub)
+	hH     = new(healthStub)
 	kH     = new(keStub)
 	eH     = new(encrypStub)
 	dH     = new(decrypStub)
-	server = NewHTTPServer(log, kH, eH, dH).Handler
+	sH     = new(signStub)
+	vH     = new(verifyStub)
+	server = NewHTTPServer(log, auth.Disabled{}, 0, 0, hH, kH, eH, dH, sH, vH).Handler
 )
 
+type authStub struct{}
+
+func (authStub) Authenticate(r *http.Request) (auth.Credential, error) {
+	if r.Header.Get(auth.APIKeyHeader) != "valid" {
+		return auth.Credential{}, auth.ErrInvalidCredentials
+	}
+	return auth.Credential{ID: "valid"}, nil
+}
+
+func TestAuthentication(t *testing.T) {
+	kH := new(keStub)
+	eH := new(encrypStub)
+	server := NewHTTPServer(log, authStub{}, 0, 0, hH, kH, eH, dH, sH, vH).Handler
+
+	t.Run("returns unauthorized without a valid credential", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, response.Code, http.StatusUnauthorized)
+		assertValue(t, response.Header().Get("Content-Type"), "application/json")
+		assertValue(t, strings.Contains(response.Body.String(), `"code":"unauthorized"`), true)
+		assertValue(t, eH.P.Called, false)
+	})
+	t.Run("passes the credential to the handlers", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt", nil)
+		request.Header.Set(auth.APIKeyHeader, "valid")
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, eH.P.Called, true)
+		handled := eH.P.CalledWith[1].(*http.Request)
+		cred, _ := auth.FromContext(handled.Context())
+		assertValue(t, cred.ID, "valid")
+	})
+	t.Run("serves the JWKS without a credential", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, kH.J.Called, true)
+	})
+	t.Run("serves the probes without a credential", func(t *testing.T) {
+		for _, path := range []string{"/healthz", "/readyz"} {
+			request, _ := http.NewRequest(http.MethodGet, path, nil)
+			server.ServeHTTP(httptest.NewRecorder(), request)
+		}
+
+		assertValue(t, hH.L.Called, true)
+		assertValue(t, hH.R.Called, true)
+	})
+	t.Run("does not serve the metrics along the API", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/metrics", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, response.Code, http.StatusNotFound)
+	})
+}
+
+// duplexStreamStub a stream reading its body while replying
+type duplexStreamStub struct {
+	encrypStub
+	err error
+}
+
+func (h *duplexStreamStub) Stream(w http.ResponseWriter, r *http.Request) {
+	h.err = http.NewResponseController(w).EnableFullDuplex()
+}
+
+func TestStreams(t *testing.T) {
+	t.Run("lets the streams reply while reading the body", func(t *testing.T) {
+		eH := new(duplexStreamStub)
+		server := httptest.NewServer(NewHTTPServer(log, auth.Disabled{}, 0, 0, hH, kH, eH, dH, sH, vH).Handler)
+		defer server.Close()
+
+		response, err := http.Post(server.URL+"/encrypt/stream", "application/octet-stream", strings.NewReader("payload"))
+		if err != nil {
+			t.Fatalf("could not post the stream: %v", err)
+		}
+		response.Body.Close()
+
+		assertValue(t, eH.err, nil)
+	})
+}
+
+func TestRequestTimeout(t *testing.T) {
+	t.Run("sets the deadline on the request context", func(t *testing.T) {
+		eH := new(encrypStub)
+		server := NewHTTPServer(log, auth.Disabled{}, time.Minute, 0, hH, kH, eH, dH, sH, vH).Handler
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		handled := eH.P.CalledWith[1].(*http.Request)
+		deadline, ok := handled.Context().Deadline()
+		assertValue(t, ok, true)
+		if time.Until(deadline) > time.Minute {
+			t.Errorf("want the deadline within a minute, got %v", deadline)
+		}
+	})
+	t.Run("lets the streams outlive the request timeout", func(t *testing.T) {
+		timeout := 10 * time.Millisecond
+		eH := &slowStreamStub{wait: 3 * timeout}
+		server := NewHTTPServer(log, auth.Disabled{}, timeout, time.Minute, hH, kH, eH, dH, sH, vH).Handler
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt/stream", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, eH.S.Called, true)
+		assertValue(t, eH.err, nil)
+	})
+	t.Run("bounds the streams by their own timeout", func(t *testing.T) {
+		timeout := 10 * time.Millisecond
+		eH := &slowStreamStub{wait: 3 * timeout}
+		server := NewHTTPServer(log, auth.Disabled{}, time.Minute, timeout, hH, kH, eH, dH, sH, vH).Handler
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt/stream", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, eH.err, context.DeadlineExceeded)
+	})
+	t.Run("leaves the requests without a deadline when disabled", func(t *testing.T) {
+		eH := new(encrypStub)
+		server := NewHTTPServer(log, auth.Disabled{}, 0, 0, hH, kH, eH, dH, sH, vH).Handler
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		handled := eH.P.CalledWith[1].(*http.Request)
+		_, ok := handled.Context().Deadline()
+		assertValue(t, ok, false)
+	})
+}
+
 func TestKeysEndpoint(t *testing.T) {
 	t.Run("calls key.Post in a /keys http POST", func(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodPost, "/keys", nil)
@@ -96,6 +363,24 @@ func TestKeysEndpoint(t *testing.T) {
 		assertValue(t, kH.G.Called, true)
 		kH.G.Called = false
 	})
+	t.Run("calls key.Rotate in a /keys/{keyID}/rotate http POST", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/keys/100/rotate", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, kH.R.Called, true)
+		kH.R.Called = false
+	})
+	t.Run("calls key.ChangeState in a /keys/{keyID}/state http PUT", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPut, "/keys/100/state", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, kH.S.Called, true)
+		kH.S.Called = false
+	})
 	t.Run("returns method not allowed for any other method", func(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodPatch, "/keys", nil)
 		response := httptest.NewRecorder()
@@ -118,6 +403,26 @@ func TestKeysEndpoint(t *testing.T) {
 	})
 }
 
+func TestJWKSEndpoint(t *testing.T) {
+	t.Run("calls key.JWKS in a /scopes/{scope}/.well-known/jwks.json http GET", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, kH.J.Called, true)
+		kH.J.Called = false
+	})
+	t.Run("returns method not allowed for any other method", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, response.Code, http.StatusMethodNotAllowed)
+	})
+}
+
 func TestEncryptionEndpoint(t *testing.T) {
 	t.Run("calls encryp.Post in a /encrypt http POST", func(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodPost, "/encrypt", nil)
@@ -128,6 +433,24 @@ func TestEncryptionEndpoint(t *testing.T) {
 		assertValue(t, eH.P.Called, true)
 		eH.P.Called = false
 	})
+	t.Run("calls encryp.Batch in a /encrypt/batch http POST", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt/batch", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, eH.B.Called, true)
+		eH.B.Called = false
+	})
+	t.Run("calls encryp.Stream in a /encrypt/stream http POST", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/encrypt/stream", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, eH.S.Called, true)
+		eH.S.Called = false
+	})
 	t.Run("returns method not allowed for any other method", func(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodPatch, "/encrypt", nil)
 		response := httptest.NewRecorder()
@@ -160,6 +483,24 @@ func TestDecryptionEndpoint(t *testing.T) {
 		assertValue(t, dH.P.Called, true)
 		dH.P.Called = false
 	})
+	t.Run("calls decryp.Batch in a /decrypt/batch http POST", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/decrypt/batch", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, dH.B.Called, true)
+		dH.B.Called = false
+	})
+	t.Run("calls decryp.Stream in a /decrypt/stream http POST", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/decrypt/stream", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, dH.S.Called, true)
+		dH.S.Called = false
+	})
 	t.Run("returns method not allowed for any other method", func(t *testing.T) {
 		request, _ := http.NewRequest(http.MethodPatch, "/decrypt", nil)
 		response := httptest.NewRecorder()
@@ -182,9 +523,65 @@ func TestDecryptionEndpoint(t *testing.T) {
 	})
 }
 
+func TestMetrics(t *testing.T) {
+	t.Run("counts the requests per route template and status", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+		server.ServeHTTP(httptest.NewRecorder(), request)
+		request, _ = http.NewRequest(http.MethodGet, "/metrics", nil)
+		response := httptest.NewRecorder()
+
+		NewMetricsServer().Handler.ServeHTTP(response, request)
+
+		want := `gocrypto_http_requests_total{method="GET",route="/keys/{keyID}",status="200"}`
+		if !strings.Contains(response.Body.String(), want) {
+			t.Errorf("want %s in the metrics, got %s", want, response.Body.String())
+		}
+	})
+}
+
 func assertValue(t *testing.T, got, want interface{}) {
 	t.Helper()
 	if got != want {
 		t.Errorf("want %d, got %d", want, got)
 	}
 }
+
+func TestSignEndpoint(t *testing.T) {
+	t.Run("calls sign.Post in a /sign http POST", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/sign", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, sH.P.Called, true)
+		sH.P.Called = false
+	})
+	t.Run("returns method not allowed for any other method", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/sign", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, response.Code, http.StatusMethodNotAllowed)
+	})
+}
+
+func TestVerifyEndpoint(t *testing.T) {
+	t.Run("calls verify.Post in a /verify http POST", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodPost, "/verify", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, vH.P.Called, true)
+		vH.P.Called = false
+	})
+	t.Run("returns method not allowed for any other method", func(t *testing.T) {
+		request, _ := http.NewRequest(http.MethodGet, "/verify", nil)
+		response := httptest.NewRecorder()
+
+		server.ServeHTTP(response, request)
+
+		assertValue(t, response.Code, http.StatusMethodNotAllowed)
+	})
+}
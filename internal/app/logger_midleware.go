@@ -37,6 +37,12 @@ type responseWriter struct {
 	wroteHeader bool
 }
 
+// Unwrap lets the handlers reach the features of the underlying writer, like
+// full duplex streaming
+func (rw *responseWriter) Unwrap() http.ResponseWriter {
+	return rw.ResponseWriter
+}
+
 func (rw *responseWriter) Status() int {
 	return rw.status
 }
@@ -0,0 +1,39 @@
+package server
+
+import (
+	"net/http"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/pkg/metrics"
+	"github.com/gorilla/mux"
+)
+
+// newMetricsMiddleware counts the requests and their latency per route
+// template, method and status
+func newMetricsMiddleware() func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			startTime := time.Now()
+			wraped := wrapResponseWriter(w)
+			h.ServeHTTP(wraped, r)
+
+			status := wraped.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			metrics.ObserveRequest(routeOf(r), r.Method, status, time.Since(startTime))
+		})
+	}
+}
+
+func routeOf(r *http.Request) string {
+	route := mux.CurrentRoute(r)
+	if route == nil {
+		return "unknown"
+	}
+	template, err := route.GetPathTemplate()
+	if err != nil {
+		return "unknown"
+	}
+	return template
+}
@@ -1,14 +1,35 @@
 package ports
 
 import (
+	"context"
+	"io"
 	"net/http"
 
-	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/crypto"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 )
 
 type decryptReqBody struct {
 	KeyID         string `json:"keyID"`
+	Scope         string `json:"scope"`
 	EncryptedData string `json:"encryptedData"`
+	Encoding      string `json:"encoding"`
+}
+
+type decryptBatchReqBody struct {
+	Scope    string             `json:"scope"`
+	Encoding string             `json:"encoding"`
+	Items    []decryptBatchItem `json:"items"`
+}
+
+type decryptBatchItem struct {
+	KeyID         string `json:"keyID"`
+	EncryptedData string `json:"encryptedData"`
+}
+
+type decryptStreamOpts struct {
+	KeyID string
+	Scope string
 }
 
 type DecryptHandler struct {
@@ -17,7 +38,9 @@ type DecryptHandler struct {
 }
 
 type DecryptionService interface {
-	Decrypt(string, string) ([]byte, error)
+	Decrypt(context.Context, string, string, string) ([]byte, error)
+	DecryptBatch(context.Context, string, []crypto.DecryptItem) []crypto.BatchResult
+	DecryptStream(context.Context, string, string, io.Writer, io.Reader) error
 }
 
 // NewDecryptHandler creates a decrypt http handler
@@ -30,28 +53,121 @@ func NewDecryptHandler(s DecryptionService) DecryptHandler {
 
 func (s *DecryptHandler) Post(w http.ResponseWriter, r *http.Request) {
 	var o decryptReqBody
-	decodeJSONBody(r, &o)
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
 
 	if err := s.validator.PostValidator(o); err != nil {
-		replyJSON(w, http.StatusBadRequest, HTTPError{
-			Message: err.Error(),
-		})
+		invalidRequest(w, err)
 		return
 	}
 
-	decrypted, err := s.service.Decrypt(o.KeyID, o.EncryptedData)
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpDecrypt) {
+		forbidden(w)
+		return
+	}
+
+	decrypted, err := s.service.Decrypt(r.Context(), o.KeyID, o.Scope, o.EncryptedData)
 	if err != nil {
-		if err == keys.ErrKeyNotFound {
-			replyJSON(w, http.StatusPreconditionFailed, HTTPError{
-				Message: "Key was not found",
-			})
-			return
-		}
-		internalServerError(w)
+		serviceError(w, r, err)
+		return
+	}
+
+	data, err := encodePayload(o.Encoding, decrypted)
+	if err != nil {
+		replyError(w, errNotUTF8)
 		return
 	}
 
 	replyJSON(w, http.StatusOK, HTTPDecrypt{
-		Data: string(decrypted),
+		Data: data,
+	})
+}
+
+// Batch http translator, decrypts every item within the scope, the items
+// that can not be decrypted get their own error instead of failing the batch
+func (s *DecryptHandler) Batch(w http.ResponseWriter, r *http.Request) {
+	var o decryptBatchReqBody
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
+
+	if err := s.validator.BatchValidator(o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpDecrypt) {
+		forbidden(w)
+		return
+	}
+
+	replies := make([]HTTPDecryptBatchItem, len(o.Items))
+	items := []crypto.DecryptItem{}
+	positions := []int{}
+	for i, item := range o.Items {
+		if err := s.validator.BatchItemValidator(item); err != nil {
+			replies[i].Error = batchError(errInvalidRequest.withMessage(err.Error()))
+			continue
+		}
+		items = append(items, crypto.DecryptItem{KeyID: item.KeyID, Data: item.EncryptedData})
+		positions = append(positions, i)
+	}
+
+	for i, result := range s.service.DecryptBatch(r.Context(), o.Scope, items) {
+		if result.Err != nil {
+			replies[positions[i]].Error = batchError(failure(r, result.Err))
+			continue
+		}
+		data, err := encodePayload(o.Encoding, result.Data)
+		if err != nil {
+			replies[positions[i]].Error = batchError(errNotUTF8)
+			continue
+		}
+		replies[positions[i]].Data = data
+	}
+
+	replyJSON(w, http.StatusOK, HTTPDecryptBatch{
+		Items: replies,
 	})
 }
+
+// Stream http translator, decrypts the application/octet-stream body created
+// by the encryption stream as it is read, the keyID and scope are taken from
+// the query. The plaintext is released a chunk at a time, once authenticated,
+// so a stream found to be corrupted after the first chunk aborts the response
+func (s *DecryptHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o := decryptStreamOpts{
+		KeyID: q.Get("keyID"),
+		Scope: q.Get("scope"),
+	}
+
+	if !isOctetStream(r) {
+		unsupportedMediaType(w)
+		return
+	}
+
+	if err := s.validator.StreamValidator(o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpDecrypt) {
+		forbidden(w)
+		return
+	}
+
+	sw := newStreamWriter(w)
+	err := s.service.DecryptStream(r.Context(), o.KeyID, o.Scope, sw, r.Body)
+	if err != nil {
+		if sw.started {
+			abortStream()
+		}
+		serviceError(w, r, err)
+		return
+	}
+	sw.start()
+}
@@ -2,40 +2,124 @@ package ports
 
 import (
 	"bytes"
+	"context"
+	"crypto/rand"
 	"encoding/json"
 	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
+	"time"
 
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/crypto"
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 )
 
 type DecryptionServiceStub struct {
 	CalledWith []interface{}
 }
 
-func (s *DecryptionServiceStub) Decrypt(keyID string, m string) ([]byte, error) {
-	s.CalledWith = []interface{}{keyID, m}
+func (s *DecryptionServiceStub) Decrypt(ctx context.Context, keyID string, scope string, m string) ([]byte, error) {
+	s.CalledWith = []interface{}{keyID, scope, m}
 	if m == "error" {
 		return []byte{}, errors.New("some error")
 	}
 	if m == "notFound" {
 		return []byte{}, keys.ErrKeyNotFound
 	}
+	if m == "outOfScope" {
+		return []byte{}, keys.ErrKeyOutOfScope
+	}
+	if m == "kidMismatch" {
+		return []byte{}, crypto.ErrKIDMismatch
+	}
+	if m == "disabled" {
+		return []byte{}, keys.ErrKeyDisabled
+	}
+	if m == "pendingDeletion" {
+		return []byte{}, keys.ErrKeyPendingDeletion
+	}
+	if m == "destroyed" {
+		return []byte{}, keys.ErrKeyDestroyed
+	}
+	if m == "wrongUse" {
+		return []byte{}, keys.ErrKeyWrongUse
+	}
+	if m == "expired" {
+		return []byte{}, keys.ErrKeyExpired
+	}
+	if m == "notAllowed" {
+		return []byte{}, crypto.ErrAlgorithmNotAllowed
+	}
+	if m == "notJWE" {
+		return []byte{}, crypto.ErrMalformedJWE
+	}
+	if m == "undecryptable" {
+		return []byte{}, crypto.ErrDecryptionFailed
+	}
+	if m == "binary" {
+		return []byte{0xfb, 0xff, 0x00}, nil
+	}
 	return []byte{10, 10, 10}, nil
 }
 
+// DecryptBatch replies as Decrypt would for every item
+func (s *DecryptionServiceStub) DecryptBatch(ctx context.Context, scope string, items []crypto.DecryptItem) []crypto.BatchResult {
+	results := []crypto.BatchResult{}
+	for _, item := range items {
+		data, err := s.Decrypt(ctx, item.KeyID, scope, item.Data)
+		results = append(results, crypto.BatchResult{Data: data, Err: err})
+	}
+	s.CalledWith = []interface{}{scope, len(items)}
+	return results
+}
+
+// DecryptStream replies as Decrypt would for the body, a "late" body fails
+// after the output started
+func (s *DecryptionServiceStub) DecryptStream(ctx context.Context, keyID string, scope string, dst io.Writer, src io.Reader) error {
+	m, _ := ioutil.ReadAll(src)
+	if string(m) == "late" {
+		dst.Write([]byte{10})
+		return crypto.ErrCorruptedStream
+	}
+	if string(m) == "malformed" {
+		return crypto.ErrMalformedStream
+	}
+	if string(m) == "corrupted" {
+		return crypto.ErrCorruptedStream
+	}
+	decrypted, err := s.Decrypt(ctx, keyID, scope, string(m))
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(decrypted)
+	return err
+}
+
 func TestDecrypt(t *testing.T) {
 	cryptoStub := DecryptionServiceStub{}
 	h := NewDecryptHandler(&cryptoStub)
+	t.Run("Should return a BadRequest if the body is not valid JSON", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBufferString(`{"scope": "scope",`))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertHTTPError(t, response.Body, "invalid_body", "Request body contains badly-formed JSON")
+	})
 	t.Run("Should return a 200 if it was a success", func(t *testing.T) {
 		requestBody, _ := json.Marshal(decryptReqBody{
 			EncryptedData: "mensagem",
 			KeyID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			Scope:         "scope",
 		})
 
-		request, _ := http.NewRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 
 		want := http.StatusOK
@@ -48,9 +132,10 @@ func TestDecrypt(t *testing.T) {
 		requestBody, _ := json.Marshal(decryptReqBody{
 			EncryptedData: "mensagem",
 			KeyID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			Scope:         "scope",
 		})
 
-		request, _ := http.NewRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -66,36 +151,482 @@ func TestDecrypt(t *testing.T) {
 		requestBody, _ := json.Marshal(decryptReqBody{
 			EncryptedData: "message",
 			KeyID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			Scope:         "scope",
 		})
-		request, _ := http.NewRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 		h.Post(response, request)
 
 		assertInsideSlice(t, cryptoStub.CalledWith, "message")
 		assertInsideSlice(t, cryptoStub.CalledWith, "f6a4633a-65f5-42f8-a984-38d87e3513ee")
 	})
+	t.Run("Should render the data in the requested encoding", func(t *testing.T) {
+		tests := []struct {
+			encoding string
+			want     string
+		}{
+			{"", "\n\n\n"},
+			{"utf8", "\n\n\n"},
+			{"base64", "+/8A"},
+			{"base64url", "-_8A"},
+		}
+		for _, tt := range tests {
+			data := "binary"
+			if tt.encoding == "" || tt.encoding == "utf8" {
+				data = "message"
+			}
+			requestBody, _ := json.Marshal(decryptReqBody{
+				EncryptedData: data,
+				KeyID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+				Scope:         "scope",
+				Encoding:      tt.encoding,
+			})
+			request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, http.StatusOK)
+			assertInsideJSON(t, response.Body, "data", tt.want)
+		}
+	})
+	t.Run("Should return a unprocessable entity for binary data rendered as utf8", func(t *testing.T) {
+		requestBody, _ := json.Marshal(decryptReqBody{
+			EncryptedData: "binary",
+			KeyID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			Scope:         "scope",
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		assertInsideJSON(t, response.Body, "message", "Decrypted data is not valid utf8, it has to be requested as base64")
+	})
+	t.Run("Should return a BadRequest for an unknown encoding", func(t *testing.T) {
+		requestBody, _ := json.Marshal(decryptReqBody{
+			EncryptedData: "message",
+			KeyID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			Scope:         "scope",
+			Encoding:      "hex",
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "encoding")
+	})
 	t.Run("Should return a internal server error if there was a problem decrypting", func(t *testing.T) {
 		requestBody, _ := json.Marshal(decryptReqBody{
 			EncryptedData: "error",
 			KeyID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			Scope:         "scope",
 		})
-		request, _ := http.NewRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 		h.Post(response, request)
 
 		assertStatus(t, response.Code, http.StatusInternalServerError)
 		assertInsideJSON(t, response.Body, "message", "There was an unexpected error")
 	})
-	t.Run("Should return a precondition fail if the key does not exists", func(t *testing.T) {
+	t.Run("Should return a not found if the key does not exists", func(t *testing.T) {
 		requestBody, _ := json.Marshal(map[string]string{
 			"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			"scope":         "scope",
 			"encryptedData": "notFound",
 		})
-		request, _ := http.NewRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 		h.Post(response, request)
 
-		assertStatus(t, response.Code, http.StatusPreconditionFailed)
+		assertStatus(t, response.Code, http.StatusNotFound)
 		assertInsideJSON(t, response.Body, "message", "Key was not found")
 	})
+	t.Run("Should return a unprocessable entity if the key is expired", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			"scope":         "scope",
+			"encryptedData": "expired",
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		assertInsideJSON(t, response.Body, "message", "Key is expired")
+	})
+	t.Run("Should return a forbidden if the key is out of scope", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			"scope":         "scope",
+			"encryptedData": "outOfScope",
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", "Key is out of scope")
+	})
+	t.Run("Should return a BadRequest if the scope is missing", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			"encryptedData": "message",
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "scope")
+	})
+	t.Run("Should return a BadRequest if the kid does not match the key", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			"scope":         "scope",
+			"encryptedData": "kidMismatch",
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertInsideJSON(t, response.Body, "message", "Encrypted data does not belong to the key")
+	})
+	t.Run("Should return a specific error if the data can not be decrypted", func(t *testing.T) {
+		tests := []struct {
+			data    string
+			status  int
+			code    string
+			message string
+		}{
+			{"notJWE", http.StatusBadRequest, "malformed_encrypted_data", "Encrypted data is not a JWE"},
+			{"undecryptable", http.StatusUnprocessableEntity, "decryption_failed", "Encrypted data could not be decrypted by the key"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+				"scope":         "scope",
+				"encryptedData": tt.data,
+			})
+			request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, tt.status)
+			assertHTTPError(t, response.Body, tt.code, tt.message)
+		}
+	})
+	t.Run("Should return a specific error for each unusable key state", func(t *testing.T) {
+		tests := []struct {
+			data    string
+			status  int
+			code    string
+			message string
+		}{
+			{"disabled", http.StatusConflict, "key_disabled", "Key is disabled"},
+			{"pendingDeletion", http.StatusConflict, "key_pending_deletion", "Key is pending deletion"},
+			{"destroyed", http.StatusGone, "key_destroyed", "Key was destroyed"},
+			{"wrongUse", http.StatusConflict, "key_wrong_use", "Key is not meant for this operation"},
+			{"notAllowed", http.StatusUnprocessableEntity, "algorithm_not_allowed", "Algorithm is not allowed by the key policy"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+				"scope":         "scope",
+				"encryptedData": tt.data,
+			})
+			request, _ := newRequest(http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, tt.status)
+			assertHTTPError(t, response.Body, tt.code, tt.message)
+		}
+	})
+	t.Run("Should return a forbidden if the credential can not decrypt on the scope", func(t *testing.T) {
+		cryptoStub.CalledWith = nil
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+			"scope":         "scope",
+			"encryptedData": "mensagem",
+		})
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/decrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", "Credential is not allowed to run this operation on the scope")
+		if cryptoStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", cryptoStub.CalledWith)
+		}
+	})
+}
+
+func TestDecryptStream(t *testing.T) {
+	cryptoStub := DecryptionServiceStub{}
+	h := NewDecryptHandler(&cryptoStub)
+	query := "scope=scope&keyID=f6a4633a-65f5-42f8-a984-38d87e3513ee"
+	newStreamRequest := func(c auth.Credential, query string, body string) *http.Request {
+		request, _ := newRequestAs(c, http.MethodPost, "/decrypt/stream?"+query, bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/octet-stream")
+		return request
+	}
+	t.Run("Should stream the decrypted body", func(t *testing.T) {
+		request := newStreamRequest(allAccess, query, "message")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertString(t, response.Header().Get("Content-type"), "application/octet-stream")
+		assertString(t, response.Body.String(), string([]byte{10, 10, 10}))
+		assertInsideSlice(t, cryptoStub.CalledWith, "message")
+		assertInsideSlice(t, cryptoStub.CalledWith, "f6a4633a-65f5-42f8-a984-38d87e3513ee")
+	})
+	t.Run("Should return an unsupported media type for other content types", func(t *testing.T) {
+		request := newStreamRequest(allAccess, query, "message")
+		request.Header.Del("Content-Type")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnsupportedMediaType)
+		assertInsideJSON(t, response.Body, "message", "Content-Type must be application/octet-stream")
+	})
+	t.Run("Should return a BadRequest if the scope is missing", func(t *testing.T) {
+		request := newStreamRequest(allAccess, "keyID=f6a4633a-65f5-42f8-a984-38d87e3513ee", "message")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "scope")
+	})
+	t.Run("Should reply the errors found before streaming", func(t *testing.T) {
+		tests := []struct {
+			data    string
+			status  int
+			code    string
+			message string
+		}{
+			{"malformed", http.StatusBadRequest, "malformed_stream", "Encrypted stream is malformed"},
+			{"corrupted", http.StatusBadRequest, "corrupted_stream", "Encrypted stream was tampered with or cut short"},
+			{"kidMismatch", http.StatusBadRequest, "kid_mismatch", "Encrypted data does not belong to the key"},
+			{"notFound", http.StatusNotFound, "key_not_found", "Key was not found"},
+			{"destroyed", http.StatusGone, "key_destroyed", "Key was destroyed"},
+		}
+		for _, tt := range tests {
+			request := newStreamRequest(allAccess, query, tt.data)
+			response := httptest.NewRecorder()
+
+			h.Stream(response, request)
+
+			assertStatus(t, response.Code, tt.status)
+			assertHTTPError(t, response.Body, tt.code, tt.message)
+		}
+	})
+	t.Run("Should abort the response if the stream is corrupted after the first chunk", func(t *testing.T) {
+		request := newStreamRequest(allAccess, query, "late")
+		response := httptest.NewRecorder()
+
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("want %v, got %v", http.ErrAbortHandler, r)
+			}
+		}()
+		h.Stream(response, request)
+	})
+	t.Run("Should return a forbidden if the credential can not decrypt on the scope", func(t *testing.T) {
+		cryptoStub.CalledWith = nil
+		request := newStreamRequest(readOnly, query, "message")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		if cryptoStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", cryptoStub.CalledWith)
+		}
+	})
+}
+
+func TestDecryptBatch(t *testing.T) {
+	cryptoStub := DecryptionServiceStub{}
+	h := NewDecryptHandler(&cryptoStub)
+	keyID := "f6a4633a-65f5-42f8-a984-38d87e3513ee"
+	t.Run("Should return a BadRequest if the body is not valid JSON", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/decrypt/batch", bytes.NewBufferString(`{"scope": "scope",`))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertHTTPError(t, response.Body, "invalid_body", "Request body contains badly-formed JSON")
+	})
+	t.Run("Should return the result of every item in order", func(t *testing.T) {
+		requestBody, _ := json.Marshal(decryptBatchReqBody{
+			Scope: "scope",
+			Items: []decryptBatchItem{
+				{KeyID: keyID, EncryptedData: "message"},
+				{KeyID: keyID, EncryptedData: "kidMismatch"},
+				{KeyID: keyID, EncryptedData: ""},
+				{KeyID: keyID, EncryptedData: "binary"},
+				{KeyID: keyID, EncryptedData: "destroyed"},
+			},
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt/batch", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideSlice(t, cryptoStub.CalledWith, 4)
+		var got HTTPDecryptBatch
+		json.NewDecoder(response.Body).Decode(&got)
+		if len(got.Items) != 5 {
+			t.Fatalf("want 5 items, got %v", got.Items)
+		}
+		assertString(t, got.Items[0].Data, "\n\n\n")
+		want := []HTTPBatchError{
+			{http.StatusBadRequest, "kid_mismatch", "Encrypted data does not belong to the key"},
+			{http.StatusBadRequest, "invalid_request", "encryptedData is invalid: is required"},
+			{http.StatusUnprocessableEntity, "not_utf8", "Decrypted data is not valid utf8, it has to be requested as base64"},
+			{http.StatusGone, "key_destroyed", "Key was destroyed"},
+		}
+		for i, w := range want {
+			item := got.Items[i+1]
+			if item.Data != "" || item.Error == nil || *item.Error != w {
+				t.Errorf("item %d: want %v, got %v", i+1, w, item)
+			}
+		}
+	})
+	t.Run("Should render the data in the requested encoding", func(t *testing.T) {
+		requestBody, _ := json.Marshal(decryptBatchReqBody{
+			Scope:    "scope",
+			Encoding: "base64",
+			Items:    []decryptBatchItem{{KeyID: keyID, EncryptedData: "binary"}},
+		})
+		request, _ := newRequest(http.MethodPost, "/decrypt/batch", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		var got HTTPDecryptBatch
+		json.NewDecoder(response.Body).Decode(&got)
+		assertString(t, got.Items[0].Data, "+/8A")
+	})
+	t.Run("Should return a BadRequest for an invalid batch", func(t *testing.T) {
+		tests := []struct {
+			body    decryptBatchReqBody
+			message string
+		}{
+			{decryptBatchReqBody{Items: []decryptBatchItem{{KeyID: keyID, EncryptedData: "message"}}}, "scope"},
+			{decryptBatchReqBody{Scope: "scope"}, "items"},
+			{decryptBatchReqBody{Scope: "scope", Items: make([]decryptBatchItem, maxBatchItems+1)}, "items"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(tt.body)
+			request, _ := newRequest(http.MethodPost, "/decrypt/batch", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+
+			h.Batch(response, request)
+
+			assertStatus(t, response.Code, http.StatusBadRequest)
+			assertErrorMessage(t, response.Body, "message", tt.message)
+		}
+	})
+	t.Run("Should return a forbidden if the credential can not decrypt on the scope", func(t *testing.T) {
+		cryptoStub.CalledWith = nil
+		requestBody, _ := json.Marshal(decryptBatchReqBody{
+			Scope: "scope",
+			Items: []decryptBatchItem{{KeyID: keyID, EncryptedData: "message"}},
+		})
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/decrypt/batch", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		if cryptoStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", cryptoStub.CalledWith)
+		}
+	})
+}
+
+// streamKeyFinder finds the single key the streams are encrypted with
+type streamKeyFinder struct {
+	key keys.Key
+}
+
+func (f streamKeyFinder) FindScopedKey(ctx context.Context, id string, scope string) (keys.Key, error) {
+	return f.key, nil
+}
+
+func (f streamKeyFinder) FindScopedKeyVersion(ctx context.Context, id string, version int, scope string) (keys.Key, error) {
+	return f.key, nil
+}
+
+// onlyReader hides the length of the body, so the client sends it chunked
+type onlyReader struct {
+	io.Reader
+}
+
+func TestStreamRoundTrip(t *testing.T) {
+	service := crypto.NewCryptoService(streamKeyFinder{keys.Key{
+		ID:         "f6a4633a-65f5-42f8-a984-38d87e3513ee",
+		Version:    keys.FirstVersion,
+		Scope:      "scope",
+		Expiration: time.Now().Add(time.Hour),
+		Use:        keys.UseEncryption,
+		State:      keys.StateActive,
+		Priv:       rsaKey,
+		Pub:        &rsaKey.PublicKey,
+	}}, 0)
+	eH, dH := NewEncryptHandler(&service), NewDecryptHandler(&service)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r = r.WithContext(auth.NewContext(r.Context(), allAccess))
+		if r.URL.Path == "/encrypt/stream" {
+			eH.Stream(w, r)
+			return
+		}
+		dH.Stream(w, r)
+	}))
+	defer server.Close()
+
+	post := func(t *testing.T, path string, body []byte, chunked bool) []byte {
+		t.Helper()
+		var r io.Reader = bytes.NewReader(body)
+		if chunked {
+			r = onlyReader{r}
+		}
+		response, err := http.Post(server.URL+path+"?scope=scope&keyID=f6a4633a-65f5-42f8-a984-38d87e3513ee", octetStream, r)
+		if err != nil {
+			t.Fatalf("could not post to %s: %v", path, err)
+		}
+		defer response.Body.Close()
+
+		replied, err := ioutil.ReadAll(response.Body)
+		if err != nil {
+			t.Fatalf("could not read the reply of %s: %v", path, err)
+		}
+		assertStatus(t, response.StatusCode, http.StatusOK)
+		return replied
+	}
+
+	for _, size := range []int{200 << 10, 5 << 20} {
+		for _, chunked := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%d bytes, chunked %v", size, chunked), func(t *testing.T) {
+				payload := make([]byte, size)
+				rand.Read(payload)
+
+				encrypted := post(t, "/encrypt/stream", payload, chunked)
+				decrypted := post(t, "/decrypt/stream", encrypted, chunked)
+
+				if !bytes.Equal(decrypted, payload) {
+					t.Errorf("got %d bytes back, want the %d sent", len(decrypted), len(payload))
+				}
+			})
+		}
+	}
 }
@@ -1,18 +1,49 @@
 package ports
 
 import (
+	"context"
+	"io"
 	"net/http"
 
-	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/crypto"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 )
 
 type encryptReqBody struct {
+	KeyID      string `json:"keyID"`
+	Scope      string `json:"scope"`
+	Data       string `json:"data"`
+	Algorithm  string `json:"alg"`
+	Encryption string `json:"enc"`
+	Compress   bool   `json:"compress"`
+	Encoding   string `json:"encoding"`
+}
+
+type encryptBatchReqBody struct {
+	Scope      string             `json:"scope"`
+	Algorithm  string             `json:"alg"`
+	Encryption string             `json:"enc"`
+	Compress   bool               `json:"compress"`
+	Encoding   string             `json:"encoding"`
+	Items      []encryptBatchItem `json:"items"`
+}
+
+type encryptBatchItem struct {
 	KeyID string `json:"keyID"`
 	Data  string `json:"data"`
 }
 
+type encryptStreamOpts struct {
+	KeyID      string
+	Scope      string
+	Algorithm  string
+	Encryption string
+}
+
 type EncryptionService interface {
-	Encrypt(string, string) ([]byte, error)
+	Encrypt(context.Context, string, string, []byte, crypto.Algorithms) ([]byte, error)
+	EncryptBatch(context.Context, string, crypto.Algorithms, []crypto.EncryptItem) []crypto.BatchResult
+	EncryptStream(context.Context, string, string, crypto.Algorithms, io.Writer, io.Reader) error
 }
 
 type EncryptHandler struct {
@@ -30,24 +61,35 @@ func NewEncryptHandler(s EncryptionService) EncryptHandler {
 
 func (h *EncryptHandler) Post(w http.ResponseWriter, r *http.Request) {
 	var o encryptReqBody
-	decodeJSONBody(r, &o)
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
 
 	if err := h.validator.PostValidator(o); err != nil {
-		replyJSON(w, http.StatusBadRequest, HTTPError{
-			Message: err.Error(),
-		})
+		invalidRequest(w, err)
 		return
 	}
 
-	encrypted, err := h.service.Encrypt(o.KeyID, o.Data)
+	data, err := decodePayload(o.Encoding, o.Data)
 	if err != nil {
-		if err == keys.ErrKeyNotFound {
-			replyJSON(w, http.StatusPreconditionFailed, HTTPError{
-				Message: "Key was not found",
-			})
-			return
-		}
-		internalServerError(w)
+		replyError(w, errInvalidData.withMessage("Invalid: data is not valid "+o.Encoding))
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpEncrypt) {
+		forbidden(w)
+		return
+	}
+
+	algs := crypto.Algorithms{
+		Key:      o.Algorithm,
+		Content:  o.Encryption,
+		Compress: o.Compress,
+	}
+	encrypted, err := h.service.Encrypt(r.Context(), o.KeyID, o.Scope, data, algs)
+	if err != nil {
+		serviceError(w, r, err)
 		return
 	}
 
@@ -55,3 +97,99 @@ func (h *EncryptHandler) Post(w http.ResponseWriter, r *http.Request) {
 		EncryptedData: string(encrypted),
 	})
 }
+
+// Batch http translator, encrypts every item within the scope, the items
+// that can not be encrypted get their own error instead of failing the batch
+func (h *EncryptHandler) Batch(w http.ResponseWriter, r *http.Request) {
+	var o encryptBatchReqBody
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
+
+	if err := h.validator.BatchValidator(o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpEncrypt) {
+		forbidden(w)
+		return
+	}
+
+	replies := make([]HTTPEncryptBatchItem, len(o.Items))
+	items := []crypto.EncryptItem{}
+	positions := []int{}
+	for i, item := range o.Items {
+		if err := h.validator.BatchItemValidator(item); err != nil {
+			replies[i].Error = batchError(errInvalidRequest.withMessage(err.Error()))
+			continue
+		}
+		data, err := decodePayload(o.Encoding, item.Data)
+		if err != nil {
+			replies[i].Error = batchError(errInvalidData.withMessage("Invalid: data is not valid " + o.Encoding))
+			continue
+		}
+		items = append(items, crypto.EncryptItem{KeyID: item.KeyID, Data: data})
+		positions = append(positions, i)
+	}
+
+	algs := crypto.Algorithms{
+		Key:      o.Algorithm,
+		Content:  o.Encryption,
+		Compress: o.Compress,
+	}
+	for i, result := range h.service.EncryptBatch(r.Context(), o.Scope, algs, items) {
+		if result.Err != nil {
+			replies[positions[i]].Error = batchError(failure(r, result.Err))
+			continue
+		}
+		replies[positions[i]].EncryptedData = string(result.Data)
+	}
+
+	replyJSON(w, http.StatusOK, HTTPEncryptBatch{
+		Items: replies,
+	})
+}
+
+// Stream http translator, encrypts the application/octet-stream body as it is
+// read, the keyID, scope and algorithms are taken from the query
+func (h *EncryptHandler) Stream(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	o := encryptStreamOpts{
+		KeyID:      q.Get("keyID"),
+		Scope:      q.Get("scope"),
+		Algorithm:  q.Get("alg"),
+		Encryption: q.Get("enc"),
+	}
+
+	if !isOctetStream(r) {
+		unsupportedMediaType(w)
+		return
+	}
+
+	if err := h.validator.StreamValidator(o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpEncrypt) {
+		forbidden(w)
+		return
+	}
+
+	algs := crypto.Algorithms{
+		Key:     o.Algorithm,
+		Content: o.Encryption,
+	}
+	sw := newStreamWriter(w)
+	err := h.service.EncryptStream(r.Context(), o.KeyID, o.Scope, algs, sw, r.Body)
+	if err != nil {
+		if sw.started {
+			abortStream()
+		}
+		serviceError(w, r, err)
+		return
+	}
+	sw.start()
+}
@@ -2,13 +2,18 @@ package ports
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/crypto"
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 	"github.com/google/uuid"
 )
 
@@ -16,29 +21,91 @@ type EncryptionServiceStub struct {
 	CalledWith []interface{}
 }
 
-func (s *EncryptionServiceStub) Encrypt(keyID string, m string) ([]byte, error) {
-	s.CalledWith = []interface{}{keyID, m}
+func (s *EncryptionServiceStub) Encrypt(ctx context.Context, keyID string, scope string, b []byte, algs crypto.Algorithms) ([]byte, error) {
+	m := string(b)
+	s.CalledWith = []interface{}{keyID, scope, m, algs}
+	if err := ctx.Err(); err != nil {
+		return []byte{}, err
+	}
 	if m == "error" {
 		return []byte{}, errors.New("some error")
 	}
 	if m == "notFound" {
 		return []byte{}, keys.ErrKeyNotFound
 	}
+	if m == "outOfScope" {
+		return []byte{}, keys.ErrKeyOutOfScope
+	}
+	if m == "disabled" {
+		return []byte{}, keys.ErrKeyDisabled
+	}
+	if m == "pendingDeletion" {
+		return []byte{}, keys.ErrKeyPendingDeletion
+	}
+	if m == "destroyed" {
+		return []byte{}, keys.ErrKeyDestroyed
+	}
+	if m == "wrongUse" {
+		return []byte{}, keys.ErrKeyWrongUse
+	}
+	if m == "expired" {
+		return []byte{}, keys.ErrKeyExpired
+	}
+	if m == "notAllowed" {
+		return []byte{}, crypto.ErrAlgorithmNotAllowed
+	}
 	return []byte{10, 10, 10}, nil
 }
 
+// EncryptBatch replies as Encrypt would for every item
+func (s *EncryptionServiceStub) EncryptBatch(ctx context.Context, scope string, algs crypto.Algorithms, items []crypto.EncryptItem) []crypto.BatchResult {
+	results := []crypto.BatchResult{}
+	for _, item := range items {
+		data, err := s.Encrypt(ctx, item.KeyID, scope, item.Data, algs)
+		results = append(results, crypto.BatchResult{Data: data, Err: err})
+	}
+	s.CalledWith = []interface{}{scope, algs, len(items)}
+	return results
+}
+
+// EncryptStream replies as Encrypt would for the body, a "late" body fails
+// after the output started
+func (s *EncryptionServiceStub) EncryptStream(ctx context.Context, keyID string, scope string, algs crypto.Algorithms, dst io.Writer, src io.Reader) error {
+	m, _ := ioutil.ReadAll(src)
+	if string(m) == "late" {
+		dst.Write([]byte{10})
+		return errors.New("some error")
+	}
+	encrypted, err := s.Encrypt(ctx, keyID, scope, m, algs)
+	if err != nil {
+		return err
+	}
+	_, err = dst.Write(encrypted)
+	return err
+}
+
 func TestEncrypt(t *testing.T) {
 	cryptoStub := EncryptionServiceStub{}
 	h := NewEncryptHandler(&cryptoStub)
+	t.Run("Should return a BadRequest if the body is not valid JSON", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBufferString(`{"scope": "scope",`))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertHTTPError(t, response.Body, "invalid_body", "Request body contains badly-formed JSON")
+	})
 	t.Run("Should return a 200 if it was a success", func(t *testing.T) {
 		keyID := uuid.New().String()
 		data := "testing"
 		requestBody, _ := json.Marshal(map[string]string{
 			"keyID": keyID,
+			"scope": "scope",
 			"data":  data,
 		})
 
-		request, _ := http.NewRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 
 		want := http.StatusOK
@@ -52,10 +119,11 @@ func TestEncrypt(t *testing.T) {
 		data := "testing"
 		requestBody, _ := json.Marshal(map[string]string{
 			"keyID": keyID,
+			"scope": "scope",
 			"data":  data,
 		})
 
-		request, _ := http.NewRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -72,41 +140,456 @@ func TestEncrypt(t *testing.T) {
 		data := "testing"
 		requestBody, _ := json.Marshal(map[string]string{
 			"keyID": keyID,
+			"scope": "scope",
 			"data":  data,
 		})
 
-		request, _ := http.NewRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 		h.Post(response, request)
 
 		assertInsideSlice(t, cryptoStub.CalledWith, data)
 		assertInsideSlice(t, cryptoStub.CalledWith, keyID)
 	})
+	t.Run("Should call Encrypt with the requested algorithms", func(t *testing.T) {
+		requestBody, _ := json.Marshal(encryptReqBody{
+			KeyID:      uuid.New().String(),
+			Scope:      "scope",
+			Data:       "testing",
+			Algorithm:  "RSA-OAEP",
+			Encryption: "A256GCM",
+			Compress:   true,
+		})
+
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideSlice(t, cryptoStub.CalledWith, crypto.Algorithms{Key: "RSA-OAEP", Content: "A256GCM", Compress: true})
+	})
+	t.Run("Should return a BadRequest for an unknown algorithm", func(t *testing.T) {
+		tests := []struct {
+			field string
+			value string
+		}{
+			{"alg", "RSA1_5"},
+			{"enc", "A256KW"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID":  uuid.New().String(),
+				"scope":  "scope",
+				"data":   "testing",
+				tt.field: tt.value,
+			})
+			request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, http.StatusBadRequest)
+			assertErrorMessage(t, response.Body, "message", tt.field+" is invalid")
+		}
+	})
+	t.Run("Should call Encrypt with the data decoded from its encoding", func(t *testing.T) {
+		tests := []struct {
+			encoding string
+			data     string
+		}{
+			{"utf8", "testing"},
+			{"base64", "dGVzdGluZw=="},
+			{"base64url", "dGVzdGluZw"},
+			{"base64url", "dGVzdGluZw=="},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID":    uuid.New().String(),
+				"scope":    "scope",
+				"data":     tt.data,
+				"encoding": tt.encoding,
+			})
+			request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, http.StatusOK)
+			assertInsideSlice(t, cryptoStub.CalledWith, "testing")
+		}
+	})
+	t.Run("Should return a BadRequest if the data does not match its encoding", func(t *testing.T) {
+		tests := []struct {
+			encoding string
+			data     string
+			message  string
+		}{
+			{"hex", "74657374", "encoding is invalid"},
+			{"base64", "not base64!", "Invalid: data is not valid base64"},
+			{"base64url", "dGVz+GluZw", "Invalid: data is not valid base64url"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID":    uuid.New().String(),
+				"scope":    "scope",
+				"data":     tt.data,
+				"encoding": tt.encoding,
+			})
+			request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, http.StatusBadRequest)
+			assertErrorMessage(t, response.Body, "message", tt.message)
+		}
+	})
 	t.Run("Should return a internal server error if there was a problem encrypting", func(t *testing.T) {
 		keyID := uuid.New().String()
 		data := "error"
 		requestBody, _ := json.Marshal(map[string]string{
 			"keyID": keyID,
+			"scope": "scope",
 			"data":  data,
 		})
 
-		request, _ := http.NewRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 		h.Post(response, request)
 
 		assertStatus(t, response.Code, http.StatusInternalServerError)
 		assertInsideJSON(t, response.Body, "message", "There was an unexpected error")
 	})
-	t.Run("Should return a precondition fail if the key does not exists", func(t *testing.T) {
+	t.Run("Should return a gateway timeout if the request ran out of time", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID": uuid.New().String(),
+			"scope": "scope",
+			"data":  "testing",
+		})
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		ctx, cancel := context.WithTimeout(request.Context(), 0)
+		defer cancel()
+		response := httptest.NewRecorder()
+		h.Post(response, request.WithContext(ctx))
+
+		assertStatus(t, response.Code, http.StatusGatewayTimeout)
+		assertInsideJSON(t, response.Body, "message", "The request timed out")
+	})
+	t.Run("Should return a not found if the key does not exists", func(t *testing.T) {
 		requestBody, _ := json.Marshal(map[string]string{
 			"keyID": uuid.New().String(),
+			"scope": "scope",
 			"data":  "notFound",
 		})
-		request, _ := http.NewRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 		h.Post(response, request)
 
-		assertStatus(t, response.Code, http.StatusPreconditionFailed)
+		assertStatus(t, response.Code, http.StatusNotFound)
 		assertInsideJSON(t, response.Body, "message", "Key was not found")
 	})
+	t.Run("Should return a unprocessable entity if the key is expired", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID": uuid.New().String(),
+			"scope": "scope",
+			"data":  "expired",
+		})
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		assertInsideJSON(t, response.Body, "message", "Key is expired")
+	})
+	t.Run("Should return a forbidden if the key is out of scope", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID": uuid.New().String(),
+			"scope": "scope",
+			"data":  "outOfScope",
+		})
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", "Key is out of scope")
+	})
+	t.Run("Should return a BadRequest if the scope is missing", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID": uuid.New().String(),
+			"data":  "message",
+		})
+		request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "scope")
+	})
+	t.Run("Should return a specific error for each unusable key state", func(t *testing.T) {
+		tests := []struct {
+			data    string
+			status  int
+			code    string
+			message string
+		}{
+			{"disabled", http.StatusConflict, "key_disabled", "Key is disabled"},
+			{"pendingDeletion", http.StatusConflict, "key_pending_deletion", "Key is pending deletion"},
+			{"destroyed", http.StatusGone, "key_destroyed", "Key was destroyed"},
+			{"wrongUse", http.StatusConflict, "key_wrong_use", "Key is not meant for this operation"},
+			{"notAllowed", http.StatusUnprocessableEntity, "algorithm_not_allowed", "Algorithm is not allowed by the key policy"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID": uuid.New().String(),
+				"scope": "scope",
+				"data":  tt.data,
+			})
+			request, _ := newRequest(http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, tt.status)
+			assertHTTPError(t, response.Body, tt.code, tt.message)
+		}
+	})
+	t.Run("Should return a forbidden if the credential can not encrypt on the scope", func(t *testing.T) {
+		cryptoStub.CalledWith = nil
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID": uuid.New().String(),
+			"scope": "scope",
+			"data":  "testing",
+		})
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/encrypt", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", "Credential is not allowed to run this operation on the scope")
+		if cryptoStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", cryptoStub.CalledWith)
+		}
+	})
+}
+
+func TestEncryptStream(t *testing.T) {
+	cryptoStub := EncryptionServiceStub{}
+	h := NewEncryptHandler(&cryptoStub)
+	keyID := uuid.New().String()
+	newStreamRequest := func(c auth.Credential, query string, body string) *http.Request {
+		request, _ := newRequestAs(c, http.MethodPost, "/encrypt/stream?"+query, bytes.NewBufferString(body))
+		request.Header.Set("Content-Type", "application/octet-stream")
+		return request
+	}
+	t.Run("Should stream the encrypted body", func(t *testing.T) {
+		request := newStreamRequest(allAccess, "scope=scope&keyID="+keyID, "testing")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertString(t, response.Header().Get("Content-type"), "application/octet-stream")
+		assertString(t, response.Body.String(), string([]byte{10, 10, 10}))
+		assertInsideSlice(t, cryptoStub.CalledWith, keyID)
+		assertInsideSlice(t, cryptoStub.CalledWith, "testing")
+	})
+	t.Run("Should call EncryptStream with the requested algorithms", func(t *testing.T) {
+		request := newStreamRequest(allAccess, "scope=scope&alg=RSA-OAEP&enc=A256GCM&keyID="+keyID, "testing")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideSlice(t, cryptoStub.CalledWith, crypto.Algorithms{Key: "RSA-OAEP", Content: "A256GCM"})
+	})
+	t.Run("Should return an unsupported media type for other content types", func(t *testing.T) {
+		request := newStreamRequest(allAccess, "scope=scope&keyID="+keyID, "testing")
+		request.Header.Set("Content-Type", "application/json")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusUnsupportedMediaType)
+		assertInsideJSON(t, response.Body, "message", "Content-Type must be application/octet-stream")
+	})
+	t.Run("Should return a BadRequest for invalid query params", func(t *testing.T) {
+		tests := []struct {
+			query string
+			field string
+		}{
+			{"scope=scope", "keyID"},
+			{"keyID=" + keyID, "scope"},
+			{"scope=scope&alg=RSA1_5&keyID=" + keyID, "alg"},
+			{"scope=scope&enc=A256KW&keyID=" + keyID, "enc"},
+		}
+		for _, tt := range tests {
+			request := newStreamRequest(allAccess, tt.query, "testing")
+			response := httptest.NewRecorder()
+
+			h.Stream(response, request)
+
+			assertStatus(t, response.Code, http.StatusBadRequest)
+			assertErrorMessage(t, response.Body, "message", tt.field)
+		}
+	})
+	t.Run("Should reply the key errors found before streaming", func(t *testing.T) {
+		tests := []struct {
+			data    string
+			status  int
+			code    string
+			message string
+		}{
+			{"notFound", http.StatusNotFound, "key_not_found", "Key was not found"},
+			{"outOfScope", http.StatusForbidden, "key_out_of_scope", "Key is out of scope"},
+			{"disabled", http.StatusConflict, "key_disabled", "Key is disabled"},
+			{"expired", http.StatusUnprocessableEntity, "key_expired", "Key is expired"},
+			{"error", http.StatusInternalServerError, "internal_error", "There was an unexpected error"},
+		}
+		for _, tt := range tests {
+			request := newStreamRequest(allAccess, "scope=scope&keyID="+keyID, tt.data)
+			response := httptest.NewRecorder()
+
+			h.Stream(response, request)
+
+			assertStatus(t, response.Code, tt.status)
+			assertHTTPError(t, response.Body, tt.code, tt.message)
+		}
+	})
+	t.Run("Should abort the response if it fails after streaming", func(t *testing.T) {
+		request := newStreamRequest(allAccess, "scope=scope&keyID="+keyID, "late")
+		response := httptest.NewRecorder()
+
+		defer func() {
+			if r := recover(); r != http.ErrAbortHandler {
+				t.Errorf("want %v, got %v", http.ErrAbortHandler, r)
+			}
+		}()
+		h.Stream(response, request)
+	})
+	t.Run("Should return a forbidden if the credential can not encrypt on the scope", func(t *testing.T) {
+		cryptoStub.CalledWith = nil
+		request := newStreamRequest(readOnly, "scope=scope&keyID="+keyID, "testing")
+		response := httptest.NewRecorder()
+
+		h.Stream(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		if cryptoStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", cryptoStub.CalledWith)
+		}
+	})
+}
+
+func TestEncryptBatch(t *testing.T) {
+	cryptoStub := EncryptionServiceStub{}
+	h := NewEncryptHandler(&cryptoStub)
+	keyID := uuid.New().String()
+	t.Run("Should return a BadRequest if the body is not valid JSON", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/encrypt/batch", bytes.NewBufferString(`{"scope": "scope",`))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertHTTPError(t, response.Body, "invalid_body", "Request body contains badly-formed JSON")
+	})
+	t.Run("Should return the result of every item in order", func(t *testing.T) {
+		requestBody, _ := json.Marshal(encryptBatchReqBody{
+			Scope: "scope",
+			Items: []encryptBatchItem{
+				{KeyID: keyID, Data: "testing"},
+				{KeyID: keyID, Data: "notFound"},
+				{KeyID: "", Data: "testing"},
+				{KeyID: keyID, Data: "disabled"},
+				{KeyID: keyID, Data: "error"},
+			},
+		})
+		request, _ := newRequest(http.MethodPost, "/encrypt/batch", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		var got HTTPEncryptBatch
+		json.NewDecoder(response.Body).Decode(&got)
+		if len(got.Items) != 5 {
+			t.Fatalf("want 5 items, got %v", got.Items)
+		}
+		if got.Items[0].EncryptedData == "" || got.Items[0].Error != nil {
+			t.Errorf("want the first item encrypted, got %v", got.Items[0])
+		}
+		want := []HTTPBatchError{
+			{http.StatusNotFound, "key_not_found", "Key was not found"},
+			{http.StatusBadRequest, "invalid_request", "keyID is invalid: is required"},
+			{http.StatusConflict, "key_disabled", "Key is disabled"},
+			{http.StatusInternalServerError, "internal_error", "There was an unexpected error"},
+		}
+		for i, w := range want {
+			item := got.Items[i+1]
+			if item.EncryptedData != "" || item.Error == nil || *item.Error != w {
+				t.Errorf("item %d: want %v, got %v", i+1, w, item)
+			}
+		}
+	})
+	t.Run("Should only hand the valid items to the service", func(t *testing.T) {
+		requestBody, _ := json.Marshal(encryptBatchReqBody{
+			Scope:      "scope",
+			Algorithm:  "RSA-OAEP",
+			Encryption: "A256GCM",
+			Encoding:   "base64",
+			Items: []encryptBatchItem{
+				{KeyID: keyID, Data: "dGVzdGluZw=="},
+				{KeyID: keyID, Data: "not base64!"},
+				{KeyID: keyID, Data: ""},
+			},
+		})
+		request, _ := newRequest(http.MethodPost, "/encrypt/batch", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideSlice(t, cryptoStub.CalledWith, crypto.Algorithms{Key: "RSA-OAEP", Content: "A256GCM"})
+		assertInsideSlice(t, cryptoStub.CalledWith, 1)
+		var got HTTPEncryptBatch
+		json.NewDecoder(response.Body).Decode(&got)
+		assertString(t, got.Items[1].Error.Message, "Invalid: data is not valid base64")
+		assertString(t, got.Items[2].Error.Message, "data is invalid: is required")
+	})
+	t.Run("Should return a BadRequest for an invalid batch", func(t *testing.T) {
+		tooMany := make([]encryptBatchItem, maxBatchItems+1)
+		tests := []struct {
+			body    encryptBatchReqBody
+			message string
+		}{
+			{encryptBatchReqBody{Items: []encryptBatchItem{{KeyID: keyID, Data: "testing"}}}, "scope"},
+			{encryptBatchReqBody{Scope: "scope"}, "items"},
+			{encryptBatchReqBody{Scope: "scope", Items: tooMany}, "items"},
+			{encryptBatchReqBody{Scope: "scope", Algorithm: "RSA1_5", Items: []encryptBatchItem{{KeyID: keyID, Data: "testing"}}}, "alg"},
+			{encryptBatchReqBody{Scope: "scope", Encoding: "hex", Items: []encryptBatchItem{{KeyID: keyID, Data: "testing"}}}, "encoding"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(tt.body)
+			request, _ := newRequest(http.MethodPost, "/encrypt/batch", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+
+			h.Batch(response, request)
+
+			assertStatus(t, response.Code, http.StatusBadRequest)
+			assertErrorMessage(t, response.Body, "message", tt.message)
+		}
+	})
+	t.Run("Should return a forbidden if the credential can not encrypt on the scope", func(t *testing.T) {
+		cryptoStub.CalledWith = nil
+		requestBody, _ := json.Marshal(encryptBatchReqBody{
+			Scope: "scope",
+			Items: []encryptBatchItem{{KeyID: keyID, Data: "testing"}},
+		})
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/encrypt/batch", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Batch(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		if cryptoStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", cryptoStub.CalledWith)
+		}
+	})
 }
@@ -0,0 +1,153 @@
+package ports
+
+import (
+	"context"
+	"errors"
+	"net/http"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/crypto"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/signing"
+)
+
+// apiError entry of the error catalogue, a code is always replied with the
+// same status whatever the endpoint
+type apiError struct {
+	status  int
+	code    string
+	message string
+	// retryAfter seconds the client should wait before retrying, if any
+	retryAfter string
+}
+
+// withMessage the same error with a message about the request at hand, like
+// the field failing the validation
+func (e apiError) withMessage(message string) apiError {
+	e.message = message
+	return e
+}
+
+// Error catalogue of the API
+var (
+	errInvalidBody            = apiError{status: http.StatusBadRequest, code: "invalid_body", message: "Invalid: Empty body"}
+	errInvalidRequest         = apiError{status: http.StatusBadRequest, code: "invalid_request", message: "Invalid: request"}
+	errInvalidData            = apiError{status: http.StatusBadRequest, code: "invalid_data", message: "Invalid: data does not match its encoding"}
+	errInvalidCursor          = apiError{status: http.StatusBadRequest, code: "invalid_cursor", message: "Invalid: cursor does not belong to this listing"}
+	errUnsupportedMediaType   = apiError{status: http.StatusUnsupportedMediaType, code: "unsupported_media_type", message: "Content-Type must be " + octetStream}
+	errUnauthorized           = apiError{status: http.StatusUnauthorized, code: "unauthorized", message: "Missing or invalid credentials"}
+	errForbidden              = apiError{status: http.StatusForbidden, code: "forbidden", message: "Credential is not allowed to run this operation on the scope"}
+	errKeyNotFound            = apiError{status: http.StatusNotFound, code: "key_not_found", message: "Key was not found"}
+	errKeyOutOfScope          = apiError{status: http.StatusForbidden, code: "key_out_of_scope", message: "Key is out of scope"}
+	errKeyDisabled            = apiError{status: http.StatusConflict, code: "key_disabled", message: "Key is disabled"}
+	errKeyPendingDeletion     = apiError{status: http.StatusConflict, code: "key_pending_deletion", message: "Key is pending deletion"}
+	errKeyDestroyed           = apiError{status: http.StatusGone, code: "key_destroyed", message: "Key was destroyed"}
+	errKeyWrongUse            = apiError{status: http.StatusConflict, code: "key_wrong_use", message: "Key is not meant for this operation"}
+	errKeyExpired             = apiError{status: http.StatusUnprocessableEntity, code: "key_expired", message: "Key is expired"}
+	errKeyVersionExists       = apiError{status: http.StatusConflict, code: "key_version_exists", message: "Key version already exists"}
+	errUnsupportedKeyUse      = apiError{status: http.StatusBadRequest, code: "unsupported_key_use", message: "Key type does not support the requested use"}
+	errInvalidPolicy          = apiError{status: http.StatusBadRequest, code: "invalid_policy", message: "Policy is not valid for the key type"}
+	errInvalidStateTransition = apiError{status: http.StatusConflict, code: "invalid_state_transition", message: "Key can not be moved to the requested state"}
+	errKeyGeneration          = apiError{status: http.StatusServiceUnavailable, code: "key_generation_failed", message: "Key could not be generated, try again later", retryAfter: "1"}
+	errAlgorithmNotAllowed    = apiError{status: http.StatusUnprocessableEntity, code: "algorithm_not_allowed", message: "Algorithm is not allowed by the key policy"}
+	errEncryptionKIDMismatch  = apiError{status: http.StatusBadRequest, code: "kid_mismatch", message: "Encrypted data does not belong to the key"}
+	errMalformedJWE           = apiError{status: http.StatusBadRequest, code: "malformed_encrypted_data", message: "Encrypted data is not a JWE"}
+	errDecryptionFailed       = apiError{status: http.StatusUnprocessableEntity, code: "decryption_failed", message: "Encrypted data could not be decrypted by the key"}
+	errNotUTF8                = apiError{status: http.StatusUnprocessableEntity, code: "not_utf8", message: "Decrypted data is not valid utf8, it has to be requested as base64"}
+	errMalformedStream        = apiError{status: http.StatusBadRequest, code: "malformed_stream", message: "Encrypted stream is malformed"}
+	errCorruptedStream        = apiError{status: http.StatusBadRequest, code: "corrupted_stream", message: "Encrypted stream was tampered with or cut short"}
+	errSignatureKIDMismatch   = apiError{status: http.StatusBadRequest, code: "kid_mismatch", message: "Signature does not belong to the key"}
+	errUnsupportedAlgorithm   = apiError{status: http.StatusBadRequest, code: "unsupported_algorithm", message: "Signature algorithm is not supported"}
+	errInvalidSignature       = apiError{status: http.StatusUnprocessableEntity, code: "invalid_signature", message: "Signature is invalid"}
+	errTimeout                = apiError{status: http.StatusGatewayTimeout, code: "timeout", message: "The request timed out"}
+	errInternal               = apiError{status: http.StatusInternalServerError, code: "internal_error", message: "There was an unexpected error"}
+)
+
+// domainErrors catalogue entry of each error of the services
+var domainErrors = []struct {
+	err   error
+	reply apiError
+}{
+	{keys.ErrKeyNotFound, errKeyNotFound},
+	{keys.ErrKeyOutOfScope, errKeyOutOfScope},
+	{keys.ErrKeyDisabled, errKeyDisabled},
+	{keys.ErrKeyPendingDeletion, errKeyPendingDeletion},
+	{keys.ErrKeyDestroyed, errKeyDestroyed},
+	{keys.ErrKeyWrongUse, errKeyWrongUse},
+	{keys.ErrKeyExpired, errKeyExpired},
+	{keys.ErrKeyVersionExists, errKeyVersionExists},
+	{keys.ErrUnsupportedKeyUse, errUnsupportedKeyUse},
+	{keys.ErrInvalidPolicy, errInvalidPolicy},
+	{keys.ErrInvalidStateTransition, errInvalidStateTransition},
+	{keys.ErrInvalidCursor, errInvalidCursor},
+	{keys.ErrKeyGeneration, errKeyGeneration},
+	{crypto.ErrAlgorithmNotAllowed, errAlgorithmNotAllowed},
+	{crypto.ErrKIDMismatch, errEncryptionKIDMismatch},
+	{crypto.ErrMalformedJWE, errMalformedJWE},
+	{crypto.ErrDecryptionFailed, errDecryptionFailed},
+	{crypto.ErrMalformedStream, errMalformedStream},
+	{crypto.ErrCorruptedStream, errCorruptedStream},
+	{signing.ErrKIDMismatch, errSignatureKIDMismatch},
+	{signing.ErrUnsupportedAlgorithm, errUnsupportedAlgorithm},
+	{signing.ErrInvalidSignature, errInvalidSignature},
+}
+
+// failure catalogue entry of an error of the services, the errors out of the
+// catalogue are unexpected, unless the request ran out of time
+func failure(r *http.Request, err error) apiError {
+	for _, d := range domainErrors {
+		if errors.Is(err, d.err) {
+			return d.reply
+		}
+	}
+	if r.Context().Err() == context.DeadlineExceeded {
+		return errTimeout
+	}
+	return errInternal
+}
+
+// replyError replies the error as an HTTPError
+func replyError(w http.ResponseWriter, e apiError) {
+	if e.retryAfter != "" {
+		w.Header().Set("Retry-After", e.retryAfter)
+	}
+	replyJSON(w, e.status, HTTPError{
+		Code:    e.code,
+		Message: e.message,
+	})
+}
+
+// Unauthorized replies the error of a request without a valid credential,
+// for the authentication running before the handlers
+func Unauthorized(w http.ResponseWriter) {
+	replyError(w, errUnauthorized)
+}
+
+// serviceError replies the catalogue entry of an error of the services
+func serviceError(w http.ResponseWriter, r *http.Request, err error) {
+	replyError(w, failure(r, err))
+}
+
+// bodyError replies the error of decoding the request body, the bodies that
+// could not be read are unexpected
+func bodyError(w http.ResponseWriter, r *http.Request, err error) {
+	var mr *malformedRequest
+	if errors.As(err, &mr) {
+		replyError(w, errInvalidBody.withMessage(mr.msg))
+		return
+	}
+	serviceError(w, r, err)
+}
+
+// invalidRequest replies the error of a request failing its validation
+func invalidRequest(w http.ResponseWriter, err error) {
+	replyError(w, errInvalidRequest.withMessage(err.Error()))
+}
+
+// batchError the error of a single item of a batch
+func batchError(e apiError) *HTTPBatchError {
+	return &HTTPBatchError{
+		Status:  e.status,
+		Code:    e.code,
+		Message: e.message,
+	}
+}
@@ -0,0 +1,74 @@
+package ports
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+)
+
+func TestFailure(t *testing.T) {
+	request := httptest.NewRequest(http.MethodPost, "/keys", nil)
+
+	t.Run("Should find the catalogue entry of a domain error", func(t *testing.T) {
+		got := failure(request, keys.ErrKeyNotFound)
+
+		assertString(t, got.code, "key_not_found")
+		assertStatus(t, got.status, http.StatusNotFound)
+	})
+	t.Run("Should find the catalogue entry of a wrapped domain error", func(t *testing.T) {
+		got := failure(request, fmt.Errorf("%w: pool failed", keys.ErrKeyGeneration))
+
+		assertString(t, got.code, "key_generation_failed")
+		assertString(t, got.retryAfter, "1")
+	})
+	t.Run("Should report the errors out of the catalogue as unexpected", func(t *testing.T) {
+		got := failure(request, errors.New("some error"))
+
+		assertString(t, got.code, "internal_error")
+		assertStatus(t, got.status, http.StatusInternalServerError)
+	})
+	t.Run("Should report a request out of time as a timeout", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Nanosecond)
+		defer cancel()
+		<-ctx.Done()
+
+		got := failure(request.WithContext(ctx), ctx.Err())
+
+		assertString(t, got.code, "timeout")
+		assertStatus(t, got.status, http.StatusGatewayTimeout)
+	})
+	t.Run("Should reply every code with a single status", func(t *testing.T) {
+		statuses := map[string]int{}
+		for _, d := range domainErrors {
+			if status, found := statuses[d.reply.code]; found && status != d.reply.status {
+				t.Errorf("%s replied with %d and %d", d.reply.code, status, d.reply.status)
+			}
+			statuses[d.reply.code] = d.reply.status
+		}
+	})
+}
+
+func TestReplyError(t *testing.T) {
+	t.Run("Should reply the code and the message", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		replyError(response, errKeyExpired)
+
+		assertStatus(t, response.Code, http.StatusUnprocessableEntity)
+		assertHTTPError(t, response.Body, "key_expired", "Key is expired")
+	})
+	t.Run("Should hint when to retry", func(t *testing.T) {
+		response := httptest.NewRecorder()
+
+		replyError(response, errKeyGeneration)
+
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+		assertString(t, response.Header().Get("Retry-After"), "1")
+	})
+}
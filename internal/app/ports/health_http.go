@@ -0,0 +1,45 @@
+package ports
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cesarFuhr/gocrypto/internal/pkg/health"
+)
+
+type ReadinessChecker interface {
+	Check(context.Context) health.Report
+}
+
+type HealthHandler struct {
+	readiness ReadinessChecker
+}
+
+// NewHealthHandler creates a liveness and readiness http handler
+func NewHealthHandler(r ReadinessChecker) HealthHandler {
+	return HealthHandler{
+		readiness: r,
+	}
+}
+
+// Live the process is alive as long as it answers
+func (h *HealthHandler) Live(w http.ResponseWriter, r *http.Request) {
+	replyJSON(w, http.StatusOK, HTTPHealth{
+		Status: "alive",
+	})
+}
+
+// Ready replies 503 while a startup step is pending, a dependency fails or
+// the service is draining for a shutdown
+func (h *HealthHandler) Ready(w http.ResponseWriter, r *http.Request) {
+	report := h.readiness.Check(r.Context())
+
+	status, code := "ready", http.StatusOK
+	if !report.Ready {
+		status, code = "not ready", http.StatusServiceUnavailable
+	}
+	replyJSON(w, code, HTTPHealth{
+		Status:       status,
+		Dependencies: report.Dependencies,
+	})
+}
@@ -0,0 +1,65 @@
+package ports
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cesarFuhr/gocrypto/internal/pkg/health"
+)
+
+type ReadinessCheckerStub struct {
+	report health.Report
+}
+
+func (s *ReadinessCheckerStub) Check(ctx context.Context) health.Report {
+	return s.report
+}
+
+func TestHealth(t *testing.T) {
+	t.Run("Should always reply alive", func(t *testing.T) {
+		h := NewHealthHandler(&ReadinessCheckerStub{})
+		request, _ := http.NewRequest(http.MethodGet, "/healthz", nil)
+		response := httptest.NewRecorder()
+
+		h.Live(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideJSON(t, response.Body, "status", "alive")
+	})
+	t.Run("Should reply ready with the status of each dependency", func(t *testing.T) {
+		h := NewHealthHandler(&ReadinessCheckerStub{health.Report{
+			Ready:        true,
+			Dependencies: map[string]string{"database": health.StatusOK, "keyPool": health.StatusOK},
+		}})
+		request, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		response := httptest.NewRecorder()
+
+		h.Ready(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		var got HTTPHealth
+		json.NewDecoder(response.Body).Decode(&got)
+		assertString(t, got.Status, "ready")
+		assertString(t, got.Dependencies["database"], health.StatusOK)
+	})
+	t.Run("Should reply service unavailable when not ready", func(t *testing.T) {
+		h := NewHealthHandler(&ReadinessCheckerStub{health.Report{
+			Ready:        false,
+			Dependencies: map[string]string{"database": health.StatusFailing, "keyPool": health.StatusPending},
+		}})
+		request, _ := http.NewRequest(http.MethodGet, "/readyz", nil)
+		response := httptest.NewRecorder()
+
+		h.Ready(response, request)
+
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+		var got HTTPHealth
+		json.NewDecoder(response.Body).Decode(&got)
+		assertString(t, got.Status, "not ready")
+		assertString(t, got.Dependencies["database"], health.StatusFailing)
+		assertString(t, got.Dependencies["keyPool"], health.StatusPending)
+	})
+}
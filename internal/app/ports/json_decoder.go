@@ -34,6 +34,9 @@ func decodeJSONBody(r *http.Request, dst interface{}) error {
 		case errors.Is(err, io.EOF):
 			msg := "Invalid: Empty body"
 			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
+		case errors.Is(err, io.ErrUnexpectedEOF):
+			msg := "Request body contains badly-formed JSON"
+			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
 		case errors.As(err, &syntaxError):
 			msg := fmt.Sprintf("Request body contains invalid JSON (at position %d)", syntaxError.Offset)
 			return &malformedRequest{status: http.StatusBadRequest, msg: msg}
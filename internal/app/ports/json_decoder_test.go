@@ -47,6 +47,17 @@ func TestDecodeJSONBody(t *testing.T) {
 
 		assertStringPrefix(t, got.Error(), wantedMsgPrefix)
 	})
+	t.Run("Should return a malformed request for a cut short json body", func(t *testing.T) {
+		r, _ := http.NewRequest(http.MethodPost, "whatever", strings.NewReader("{\"test\": "))
+
+		dst := testStruct{}
+		got := decodeJSONBody(r, &dst)
+
+		if _, ok := got.(*malformedRequest); !ok {
+			t.Fatalf("want a malformedRequest, got %v", got)
+		}
+		assertStringPrefix(t, got.Error(), "Request body contains badly-formed JSON")
+	})
 }
 
 func assertStringPrefix(t *testing.T, got, wantedPrefix string) {
@@ -1,29 +1,121 @@
 package ports
 
 import (
-	"errors"
+	"context"
 	"net/http"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 	"github.com/gorilla/mux"
 )
 
 type keyOpts struct {
-	Scope      string `json:"scope" validate:"required,gt=0,lte=50"`
-	Expiration string `json:"expiration" validate:"required,datetime"`
+	Scope      string         `json:"scope" validate:"required,gt=0,lte=50"`
+	Expiration string         `json:"expiration" validate:"required,datetime"`
+	Use        string         `json:"use"`
+	KeyType    string         `json:"keyType"`
+	Policy     *keyPolicyOpts `json:"policy"`
+}
+
+type keyPolicyOpts struct {
+	KeyAlgorithms     []string `json:"keyAlgorithms"`
+	ContentAlgorithms []string `json:"contentAlgorithms"`
+	Compression       bool     `json:"compression"`
+}
+
+type rotateKeyOpts struct {
+	Expiration string `json:"expiration"`
+}
+
+type keyStateOpts struct {
+	State string `json:"state"`
+}
+
+// keyPageOpts query parameters of a key listing, state and keyType take comma
+// separated lists
+type keyPageOpts struct {
+	Scope         string
+	Limit         string
+	Cursor        string
+	State         string
+	KeyType       string
+	ExpiresAfter  string
+	ExpiresBefore string
+	Sort          string
+	Order         string
+}
+
+func newKeyPageOpts(r *http.Request) keyPageOpts {
+	q := r.URL.Query()
+	return keyPageOpts{
+		Scope:         q.Get("scope"),
+		Limit:         q.Get("limit"),
+		Cursor:        q.Get("cursor"),
+		State:         q.Get("state"),
+		KeyType:       q.Get("keyType"),
+		ExpiresAfter:  q.Get("expiresAfter"),
+		ExpiresBefore: q.Get("expiresBefore"),
+		Sort:          q.Get("sort"),
+		Order:         q.Get("order"),
+	}
+}
+
+// query builds the key query out of validated options
+func (o keyPageOpts) query() (keys.KeyQuery, error) {
+	q := keys.KeyQuery{
+		Scope:      o.Scope,
+		SortBy:     keys.SortByCreation,
+		Descending: o.Order == "desc",
+	}
+	if o.Sort != "" {
+		q.SortBy = keys.SortField(o.Sort)
+	}
+	if o.Limit != "" {
+		q.Limit, _ = strconv.Atoi(o.Limit)
+	}
+	if o.State != "" {
+		for _, s := range strings.Split(o.State, ",") {
+			q.States = append(q.States, keys.State(s))
+		}
+	}
+	if o.KeyType != "" {
+		for _, t := range strings.Split(o.KeyType, ",") {
+			q.Types = append(q.Types, keys.KeyType(t))
+		}
+	}
+	if o.ExpiresAfter != "" {
+		q.ExpiresAfter, _ = time.Parse(time.RFC3339, o.ExpiresAfter)
+	}
+	if o.ExpiresBefore != "" {
+		q.ExpiresBefore, _ = time.Parse(time.RFC3339, o.ExpiresBefore)
+	}
+	if o.Cursor != "" {
+		c, err := keys.ParseCursor(o.Cursor, q.SortBy)
+		if err != nil {
+			return keys.KeyQuery{}, err
+		}
+		q.After = c
+	}
+	return q, nil
 }
 
-//
 type KeyHandler struct {
 	service   KeyService
 	validator keysValidator
 }
 
 type KeyService interface {
-	CreateKey(string, time.Time) (keys.Key, error)
-	FindKey(string) (keys.Key, error)
-	FindKeysByScope(string) ([]keys.Key, error)
+	CreateKey(context.Context, string, time.Time, keys.Use, keys.KeyType, keys.Policy) (keys.Key, error)
+	RotateKey(context.Context, string, time.Time) (keys.Key, error)
+	FindKey(context.Context, string) (keys.Key, error)
+	FindKeyVersion(context.Context, string, int) (keys.Key, error)
+	ChangeKeyState(context.Context, string, keys.State) (keys.Key, error)
+	FindKeysByScope(context.Context, string) ([]keys.Key, error)
+	FindKeysPage(context.Context, keys.KeyQuery) (keys.KeyPage, error)
+	FindActiveKeysByScope(context.Context, string) ([]keys.Key, error)
 }
 
 // NewKeyHandler creates a new http key handler
@@ -38,84 +130,225 @@ func NewKeyHandler(s KeyService) KeyHandler {
 func (h *KeyHandler) Post(w http.ResponseWriter, r *http.Request) {
 	var o keyOpts
 	if err := decodeJSONBody(r, &o); err != nil {
-		var mr *malformedRequest
-		if errors.As(err, &mr) {
-			replyJSON(w, mr.status, HTTPError{
-				Message: mr.msg,
-			})
-			return
-		}
-		replyJSON(w, http.StatusInternalServerError, HTTPError{
-			Message: err.Error(),
-		})
+		bodyError(w, r, err)
 		return
 	}
 
 	if err := h.validator.PostValidator(o); err != nil {
-		replyJSON(w, http.StatusBadRequest, HTTPError{
-			Message: err.Error(),
-		})
+		invalidRequest(w, err)
+		return
+	}
+
+	exp, err := time.Parse(time.RFC3339, o.Expiration)
+	if err != nil {
+		replyError(w, errInvalidRequest.withMessage("Invalid: expiration property format"))
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpCreate) {
+		forbidden(w)
+		return
+	}
+
+	use := keys.UseEncryption
+	if o.Use != "" {
+		use = keys.Use(o.Use)
+	}
+	keyType := keys.DefaultKeyType
+	if o.KeyType != "" {
+		keyType = keys.KeyType(o.KeyType)
+	}
+	var policy keys.Policy
+	if o.Policy != nil {
+		policy = keys.Policy{
+			KeyAlgorithms:     o.Policy.KeyAlgorithms,
+			ContentAlgorithms: o.Policy.ContentAlgorithms,
+			Compression:       o.Policy.Compression,
+		}
+	}
+
+	key, err := h.service.CreateKey(r.Context(), o.Scope, exp, use, keyType, policy)
+	if err != nil {
+		serviceError(w, r, err)
+		return
+	}
+
+	replyJSON(w, http.StatusCreated, NewHTTPCreateKey(key))
+}
+
+// Rotate http translator
+func (h *KeyHandler) Rotate(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["keyID"]
+
+	var o rotateKeyOpts
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
+
+	if err := h.validator.RotateValidator(id, o); err != nil {
+		invalidRequest(w, err)
 		return
 	}
 
 	exp, err := time.Parse(time.RFC3339, o.Expiration)
 	if err != nil {
-		replyJSON(w, http.StatusBadRequest, HTTPError{
-			Message: "Invalid: expiration property format",
-		})
+		replyError(w, errInvalidRequest.withMessage("Invalid: expiration property format"))
+		return
+	}
+
+	if !h.allowedOnKey(w, r, id, auth.OpCreate) {
 		return
 	}
 
-	key, err := h.service.CreateKey(o.Scope, exp)
+	key, err := h.service.RotateKey(r.Context(), id, exp)
 	if err != nil {
-		internalServerError(w)
+		serviceError(w, r, err)
 		return
 	}
 
 	replyJSON(w, http.StatusCreated, NewHTTPCreateKey(key))
 }
 
+// ChangeState http translator
+func (h *KeyHandler) ChangeState(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	id := params["keyID"]
+
+	var o keyStateOpts
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
+
+	if err := h.validator.StateValidator(id, o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	if !h.allowedOnKey(w, r, id, auth.OpCreate) {
+		return
+	}
+
+	key, err := h.service.ChangeKeyState(r.Context(), id, keys.State(o.State))
+	if err != nil {
+		serviceError(w, r, err)
+		return
+	}
+
+	replyJSON(w, http.StatusOK, NewHTTPCreateKey(key))
+}
+
 func (h *KeyHandler) Get(w http.ResponseWriter, r *http.Request) {
 	params := mux.Vars(r)
 	id := params["keyID"]
+	version := r.URL.Query().Get("version")
+
+	if err := h.validator.GetValidator(id, version); err != nil {
+		invalidRequest(w, err)
+		return
+	}
 
-	if err := h.validator.GetValidator(id); err != nil {
-		replyJSON(w, http.StatusBadRequest, HTTPError{
-			Message: err.Error(),
-		})
+	if !auth.AllowedOperation(r.Context(), auth.OpRead) {
+		forbidden(w)
 		return
 	}
 
-	key, err := h.service.FindKey(id)
+	var key keys.Key
+	var err error
+	if version == "" {
+		key, err = h.service.FindKey(r.Context(), id)
+	} else {
+		v, _ := strconv.Atoi(version)
+		key, err = h.service.FindKeyVersion(r.Context(), id, v)
+	}
 	if err != nil {
-		if err == keys.ErrKeyNotFound {
-			replyJSON(w, http.StatusNotFound, HTTPError{
-				Message: "Key was not found",
-			})
-			return
-		}
-		internalServerError(w)
+		serviceError(w, r, err)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), key.Scope, auth.OpRead) {
+		replyError(w, errKeyNotFound)
 		return
 	}
 
 	replyJSON(w, http.StatusOK, NewHTTPCreateKey(key))
 }
 
+// Find http translator, lists a page of the keys of a scope
 func (h *KeyHandler) Find(w http.ResponseWriter, r *http.Request) {
-	scope := r.URL.Query().Get("scope")
+	o := newKeyPageOpts(r)
+
+	if err := h.validator.PageValidator(o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	q, err := o.query()
+	if err != nil {
+		replyError(w, errInvalidCursor)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpRead) {
+		forbidden(w)
+		return
+	}
+
+	page, err := h.service.FindKeysPage(r.Context(), q)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+
+	replyJSON(w, http.StatusOK, NewHTTPKeysPage(page))
+}
+
+// JWKS http translator, serves the public keys of a scope as a JSON Web Key Set
+func (h *KeyHandler) JWKS(w http.ResponseWriter, r *http.Request) {
+	params := mux.Vars(r)
+	scope := params["scope"]
 
 	if err := h.validator.FindValidator(scope); err != nil {
-		replyJSON(w, http.StatusBadRequest, HTTPError{
-			Message: err.Error(),
-		})
+		invalidRequest(w, err)
 		return
 	}
 
-	key, err := h.service.FindKeysByScope(scope)
+	ks, err := h.service.FindActiveKeysByScope(r.Context(), scope)
 	if err != nil {
-		internalServerError(w)
+		internalServerError(w, r)
 		return
 	}
 
-	replyJSON(w, http.StatusOK, NewHTTPFindKeys(key))
+	set, err := NewHTTPJWKS(ks)
+	if err != nil {
+		internalServerError(w, r)
+		return
+	}
+
+	replyJSON(w, http.StatusOK, set)
+}
+
+// allowedOnKey the scope is on the key, so it is found before running the
+// operation, replies on its own when the operation is not allowed. The keys
+// out of the scopes of the credential are not found, their IDs can not be
+// probed
+func (h *KeyHandler) allowedOnKey(w http.ResponseWriter, r *http.Request, id string, op auth.Operation) bool {
+	if !auth.AllowedOperation(r.Context(), op) {
+		forbidden(w)
+		return false
+	}
+
+	key, err := h.service.FindKey(r.Context(), id)
+	if err != nil {
+		serviceError(w, r, err)
+		return false
+	}
+
+	if !auth.Allowed(r.Context(), key.Scope, op) {
+		replyError(w, errKeyNotFound)
+		return false
+	}
+	return true
 }
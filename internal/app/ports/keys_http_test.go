@@ -2,11 +2,16 @@ package ports
 
 import (
 	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"net/http/httptest"
@@ -16,34 +21,102 @@ import (
 	"time"
 
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
 	"github.com/google/uuid"
 	"github.com/gorilla/mux"
+	"github.com/lestrrat-go/jwx/jwk"
 )
 
 type KeyServiceStub struct {
 	CalledWith       []interface{}
 	LastDeliveredKey keys.Key
 	nextError        error
+	nextChangeError  error
 	nextFindResult   []keys.Key
 }
 
 var rsaKey, _ = rsa.GenerateKey(rand.Reader, 4098)
 
-func (s *KeyServiceStub) CreateKey(scope string, exp time.Time) (keys.Key, error) {
-	s.CalledWith = []interface{}{scope, exp}
+func (s *KeyServiceStub) CreateKey(ctx context.Context, scope string, exp time.Time, use keys.Use, keyType keys.KeyType, policy keys.Policy) (keys.Key, error) {
+	s.CalledWith = []interface{}{scope, exp, use, keyType, policy}
 	if scope == "ERROR" {
 		return keys.Key{}, errors.New("A ERROR")
 	}
+	if scope == "GENERATION" {
+		return keys.Key{}, fmt.Errorf("%w: pool failed", keys.ErrKeyGeneration)
+	}
+	if !keyType.Supports(use) {
+		return keys.Key{}, keys.ErrUnsupportedKeyUse
+	}
+	if !policy.Empty() && policy.ValidFor(keyType) != nil {
+		return keys.Key{}, keys.ErrInvalidPolicy
+	}
 	return keys.Key{
 		Scope:      scope,
 		Expiration: time.Now().AddDate(0, 0, 1),
 		ID:         uuid.New().String(),
+		Use:        use,
+		Policy:     policy,
+		Pub:        &rsaKey.PublicKey,
+		Priv:       rsaKey,
+	}, nil
+}
+
+func (s *KeyServiceStub) RotateKey(ctx context.Context, id string, exp time.Time) (keys.Key, error) {
+	s.CalledWith = []interface{}{id, exp}
+	if s.nextChangeError != nil {
+		return keys.Key{}, s.nextChangeError
+	}
+	if s.nextError != nil {
+		return keys.Key{}, s.nextError
+	}
+	return keys.Key{
+		Scope:      "scope",
+		Expiration: exp,
+		ID:         id,
+		Version:    2,
+		Pub:        &rsaKey.PublicKey,
+		Priv:       rsaKey,
+	}, nil
+}
+
+func (s *KeyServiceStub) FindKeyVersion(ctx context.Context, id string, version int) (keys.Key, error) {
+	s.CalledWith = []interface{}{id, version}
+	if s.nextError != nil {
+		return keys.Key{}, s.nextError
+	}
+
+	s.LastDeliveredKey = keys.Key{
+		Scope:      "scope",
+		Expiration: time.Now().AddDate(0, 0, 1),
+		ID:         id,
+		Version:    version,
+		Pub:        &rsaKey.PublicKey,
+		Priv:       rsaKey,
+	}
+	return s.LastDeliveredKey, nil
+}
+
+func (s *KeyServiceStub) ChangeKeyState(ctx context.Context, id string, state keys.State) (keys.Key, error) {
+	s.CalledWith = []interface{}{id, state}
+	if s.nextChangeError != nil {
+		return keys.Key{}, s.nextChangeError
+	}
+	if s.nextError != nil {
+		return keys.Key{}, s.nextError
+	}
+	return keys.Key{
+		Scope:      "scope",
+		Expiration: time.Now().AddDate(0, 0, 1),
+		ID:         id,
+		Version:    1,
+		State:      state,
 		Pub:        &rsaKey.PublicKey,
 		Priv:       rsaKey,
 	}, nil
 }
 
-func (s *KeyServiceStub) FindKey(id string) (keys.Key, error) {
+func (s *KeyServiceStub) FindKey(ctx context.Context, id string) (keys.Key, error) {
 	s.CalledWith = []interface{}{id}
 	if s.nextError != nil {
 		return keys.Key{}, s.nextError
@@ -67,7 +140,7 @@ func (s *KeyServiceStub) SetErrorFindKeyByScope(err error) {
 	s.nextError = err
 }
 
-func (s *KeyServiceStub) FindScopedKey(id string, scope string) (keys.Key, error) {
+func (s *KeyServiceStub) FindScopedKey(ctx context.Context, id string, scope string) (keys.Key, error) {
 	s.CalledWith = []interface{}{id, scope}
 	if id == "notFound" {
 		return keys.Key{}, keys.ErrKeyNotFound
@@ -86,7 +159,7 @@ func (s *KeyServiceStub) FindScopedKey(id string, scope string) (keys.Key, error
 	return s.LastDeliveredKey, nil
 }
 
-func (s *KeyServiceStub) FindKeysByScope(scope string) ([]keys.Key, error) {
+func (s *KeyServiceStub) FindKeysByScope(ctx context.Context, scope string) ([]keys.Key, error) {
 	s.CalledWith = []interface{}{scope}
 	if s.nextError != nil {
 		return nil, s.nextError
@@ -99,19 +172,38 @@ func (s *KeyServiceStub) FindKeysByScope(scope string) ([]keys.Key, error) {
 		Scope:      "scope",
 		Expiration: time.Now().AddDate(0, 0, 1),
 		ID:         uuid.NewString(),
+		Use:        keys.UseEncryption,
 		Pub:        &rsaKey.PublicKey,
 		Priv:       rsaKey,
 	}
 	return []keys.Key{s.LastDeliveredKey}, nil
 }
 
-var validReqBody, _ = json.Marshal(keyOpts{"scope", time.Now().UTC().Format(time.RFC3339)})
+func (s *KeyServiceStub) FindKeysPage(ctx context.Context, q keys.KeyQuery) (keys.KeyPage, error) {
+	ks, err := s.FindKeysByScope(ctx, q.Scope)
+	s.CalledWith = []interface{}{q.Scope, q}
+	if err != nil {
+		return keys.KeyPage{}, err
+	}
+
+	page := keys.KeyPage{Keys: ks}
+	if len(ks) > 0 && q.Limit == len(ks) {
+		page.Next = &keys.Cursor{SortBy: q.SortBy, Value: time.Now().UTC(), ID: ks[len(ks)-1].ID}
+	}
+	return page, nil
+}
+
+func (s *KeyServiceStub) FindActiveKeysByScope(ctx context.Context, scope string) ([]keys.Key, error) {
+	return s.FindKeysByScope(ctx, scope)
+}
+
+var validReqBody, _ = json.Marshal(keyOpts{"scope", time.Now().UTC().Format(time.RFC3339), "", "", nil})
 
 func TestPOSTKeys(t *testing.T) {
 	keyServiceStub := KeyServiceStub{}
 	h := NewKeyHandler(&keyServiceStub)
 	t.Run("Should return 201 on /keys", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -119,7 +211,7 @@ func TestPOSTKeys(t *testing.T) {
 		assertStatus(t, response.Code, http.StatusCreated)
 	})
 	t.Run("Should return valid json on /keys", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -131,10 +223,10 @@ func TestPOSTKeys(t *testing.T) {
 		}
 	})
 	t.Run("Should return all properties on /keys response", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
 		response := httptest.NewRecorder()
 
-		wants := []string{"publicKey", "keyID", "expiration"}
+		wants := []string{"publicKey", "keyID", "version", "expiration", "use", "keyType"}
 
 		h.Post(response, request)
 		respMap := map[string]interface{}{}
@@ -153,7 +245,7 @@ func TestPOSTKeys(t *testing.T) {
 			"scope":      scope,
 			"expiration": expiration,
 		})
-		request, _ := http.NewRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -162,6 +254,136 @@ func TestPOSTKeys(t *testing.T) {
 		assertInsideSlice(t, keyServiceStub.CalledWith, wantedExpiration)
 		assertInsideSlice(t, keyServiceStub.CalledWith, scope)
 	})
+	t.Run("Should create encryption keys by default", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertInsideSlice(t, keyServiceStub.CalledWith, keys.UseEncryption)
+		assertInsideJSON(t, response.Body, "use", "enc")
+	})
+	t.Run("Should call the CreateKey with the requested use", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"scope":      "testing",
+			"expiration": time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+			"use":        "sig",
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertInsideSlice(t, keyServiceStub.CalledWith, keys.UseSigning)
+	})
+	t.Run("Should create RSA-2048 keys by default", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertInsideSlice(t, keyServiceStub.CalledWith, keys.TypeRSA2048)
+	})
+	t.Run("Should call the CreateKey with the requested key type", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"scope":      "testing",
+			"expiration": time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+			"use":        "sig",
+			"keyType":    "Ed25519",
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertInsideSlice(t, keyServiceStub.CalledWith, keys.TypeEd25519)
+	})
+	t.Run("Should return a BadRequest for an unknown key type", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"scope":      "testing",
+			"expiration": time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+			"keyType":    "RSA-1024",
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "keyType is invalid")
+	})
+	t.Run("Should return a BadRequest if the key type does not support the use", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"scope":      "testing",
+			"expiration": time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+			"use":        "enc",
+			"keyType":    "Ed25519",
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertInsideJSON(t, response.Body, "message", "Key type does not support the requested use")
+	})
+	t.Run("Should call the CreateKey with the requested policy", func(t *testing.T) {
+		requestBody, _ := json.Marshal(keyOpts{
+			Scope:      "testing",
+			Expiration: time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+			Policy: &keyPolicyOpts{
+				KeyAlgorithms:     []string{"RSA-OAEP"},
+				ContentAlgorithms: []string{"A256GCM", "A128GCM"},
+				Compression:       true,
+			},
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusCreated)
+		var got HTTPCreateKey
+		json.NewDecoder(response.Body).Decode(&got)
+		want := &HTTPPolicy{
+			KeyAlgorithms:     []string{"RSA-OAEP"},
+			ContentAlgorithms: []string{"A256GCM", "A128GCM"},
+			Compression:       true,
+		}
+		if !reflect.DeepEqual(got.Policy, want) {
+			t.Errorf("want %v, got %v", want, got.Policy)
+		}
+	})
+	t.Run("Should return a BadRequest if the policy is not valid for the key type", func(t *testing.T) {
+		requestBody, _ := json.Marshal(keyOpts{
+			Scope:      "testing",
+			Expiration: time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+			Policy: &keyPolicyOpts{
+				KeyAlgorithms: []string{"ECDH-ES"},
+			},
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertInsideJSON(t, response.Body, "message", "Policy is not valid for the key type")
+	})
+	t.Run("Should return a BadRequest for an unknown use", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"scope":      "testing",
+			"expiration": time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+			"use":        "both",
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "use is invalid")
+	})
 	t.Run("Should return a internal server error if there was an error creating keys", func(t *testing.T) {
 		scope := "ERROR"
 		expiration := time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339)
@@ -169,7 +391,7 @@ func TestPOSTKeys(t *testing.T) {
 			"scope":      scope,
 			"expiration": expiration,
 		})
-		request, _ := http.NewRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -177,8 +399,22 @@ func TestPOSTKeys(t *testing.T) {
 		assertStatus(t, response.Code, http.StatusInternalServerError)
 		assertInsideJSON(t, response.Body, "message", "There was an unexpected error")
 	})
+	t.Run("Should return a 503 with a retry hint if the key could not be generated", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"scope":      "GENERATION",
+			"expiration": time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339),
+		})
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+		assertString(t, response.Header().Get("Retry-After"), "1")
+		assertInsideJSON(t, response.Body, "message", "Key could not be generated, try again later")
+	})
 	t.Run("Should return a BadRequest if body is nil", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodPost, "/keys", nil)
+		request, _ := newRequest(http.MethodPost, "/keys", nil)
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -193,7 +429,7 @@ func TestPOSTKeys(t *testing.T) {
 			"scope":      scope,
 			"expiration": expiration,
 		})
-		request, _ := http.NewRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 
 		h.Post(response, request)
@@ -208,7 +444,7 @@ func TestGETKeys(t *testing.T) {
 	h := NewKeyHandler(&keyServiceStub)
 	m := make(map[string]string)
 	t.Run("Should return a 200 if it was a success", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+		request, _ := newRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
 		m["keyID"] = "f6a4633a-65f5-42f8-a984-38d87e3513ee"
 		response := httptest.NewRecorder()
 
@@ -219,11 +455,11 @@ func TestGETKeys(t *testing.T) {
 		assertStatus(t, response.Code, want)
 	})
 	t.Run("Should return a Key if it was a success", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+		request, _ := newRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
 		m["keyID"] = "f6a4633a-65f5-42f8-a984-38d87e3513ee"
 		response := httptest.NewRecorder()
 
-		wants := []string{"publicKey", "keyID", "expiration"}
+		wants := []string{"publicKey", "keyID", "version", "expiration", "use", "keyType"}
 
 		h.Get(response, mux.SetURLVars(request, m))
 		respMap := map[string]interface{}{}
@@ -243,22 +479,43 @@ func TestGETKeys(t *testing.T) {
 			"expiration": expiration,
 		})
 
-		request, _ := http.NewRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
+		request, _ := newRequest(http.MethodPost, "/keys", bytes.NewBuffer(requestBody))
 		response := httptest.NewRecorder()
 		h.Post(response, request)
 		respMap := map[string]interface{}{}
 		extractJSON(response.Body, respMap)
 
-		getRequest, _ := http.NewRequest(http.MethodGet, fmt.Sprintf("/keys/%v", respMap["keyID"]), nil)
+		getRequest, _ := newRequest(http.MethodGet, fmt.Sprintf("/keys/%v", respMap["keyID"]), nil)
 		m["keyID"] = fmt.Sprint(respMap["keyID"])
 		h.Get(response, mux.SetURLVars(getRequest, m))
 
 		assertInsideSlice(t, keyServiceStub.CalledWith, respMap["keyID"])
 	})
+	t.Run("Should call find Key version if a version was requested", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee?version=2", nil)
+		m["keyID"] = "f6a4633a-65f5-42f8-a984-38d87e3513ee"
+		response := httptest.NewRecorder()
+
+		h.Get(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideSlice(t, keyServiceStub.CalledWith, 2)
+		assertInsideJSON(t, response.Body, "version", float64(2))
+	})
+	t.Run("Should return a BadRequest if the version is not a positive integer", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee?version=0", nil)
+		m["keyID"] = "f6a4633a-65f5-42f8-a984-38d87e3513ee"
+		response := httptest.NewRecorder()
+
+		h.Get(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "version is invalid")
+	})
 	t.Run("If key was not found", func(t *testing.T) {
 		t.Run("Should return a 404", func(t *testing.T) {
 			want := http.StatusNotFound
-			getRequest, _ := http.NewRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+			getRequest, _ := newRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
 			m["keyID"] = "f6a4633a-65f5-42f8-a984-38d87e3513ee"
 			keyServiceStub.SetErrorFindKey(keys.ErrKeyNotFound)
 			response := httptest.NewRecorder()
@@ -272,7 +529,7 @@ func TestGETKeys(t *testing.T) {
 	t.Run("If there was any other error", func(t *testing.T) {
 		t.Run("Should return a 500", func(t *testing.T) {
 			want := http.StatusInternalServerError
-			getRequest, _ := http.NewRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+			getRequest, _ := newRequest(http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
 			m["keyID"] = "f6a4633a-65f5-42f8-a984-38d87e3513ee"
 			keyServiceStub.SetErrorFindKey(errors.New("another error"))
 			response := httptest.NewRecorder()
@@ -284,11 +541,129 @@ func TestGETKeys(t *testing.T) {
 	})
 }
 
+func TestRotateKeys(t *testing.T) {
+	keyServiceStub := KeyServiceStub{}
+	h := NewKeyHandler(&keyServiceStub)
+	m := map[string]string{"keyID": "f6a4633a-65f5-42f8-a984-38d87e3513ee"}
+	t.Run("Should return 201 with the new version", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusCreated)
+		assertInsideJSON(t, response.Body, "version", float64(2))
+	})
+	t.Run("Should call RotateKey with the keyID and expiration", func(t *testing.T) {
+		expiration := time.Now().UTC().AddDate(0, 0, 1).Format(time.RFC3339)
+		requestBody, _ := json.Marshal(map[string]string{
+			"expiration": expiration,
+		})
+		request, _ := newRequest(http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		wantedExpiration, _ := time.Parse(time.RFC3339, expiration)
+		assertInsideSlice(t, keyServiceStub.CalledWith, wantedExpiration)
+		assertInsideSlice(t, keyServiceStub.CalledWith, "f6a4633a-65f5-42f8-a984-38d87e3513ee")
+	})
+	t.Run("Should return a BadRequest if expiration is missing", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBufferString("{}"))
+		response := httptest.NewRecorder()
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "expiration is invalid")
+	})
+	t.Run("Should return a 409 if the key is not active", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+		keyServiceStub.nextChangeError = keys.ErrKeyDisabled
+		defer func() { keyServiceStub.nextChangeError = nil }()
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusConflict)
+		assertHTTPError(t, response.Body, "key_disabled", "Key is disabled")
+	})
+	t.Run("Should return a 404 if the key was not found", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+		keyServiceStub.nextError = keys.ErrKeyNotFound
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+		assertInsideJSON(t, response.Body, "message", "Key was not found")
+	})
+	t.Run("Should return a 503 with a retry hint if the key could not be generated", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+		keyServiceStub.nextError = nil
+		keyServiceStub.nextChangeError = keys.ErrKeyGeneration
+		defer func() { keyServiceStub.nextChangeError = nil }()
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusServiceUnavailable)
+		assertString(t, response.Header().Get("Retry-After"), "1")
+		assertInsideJSON(t, response.Body, "message", "Key could not be generated, try again later")
+	})
+}
+
+func TestChangeKeyState(t *testing.T) {
+	keyServiceStub := KeyServiceStub{}
+	h := NewKeyHandler(&keyServiceStub)
+	m := map[string]string{"keyID": "f6a4633a-65f5-42f8-a984-38d87e3513ee"}
+	t.Run("Should return 200 with the key in the new state", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPut, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/state", bytes.NewBufferString(`{"state":"disabled"}`))
+		response := httptest.NewRecorder()
+
+		h.ChangeState(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideSlice(t, keyServiceStub.CalledWith, keys.StateDisabled)
+		assertInsideJSON(t, response.Body, "state", "disabled")
+	})
+	t.Run("Should return a BadRequest for an unknown state", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPut, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/state", bytes.NewBufferString(`{"state":"destroyed"}`))
+		response := httptest.NewRecorder()
+
+		h.ChangeState(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "state is invalid")
+	})
+	t.Run("Should return a 409 for an invalid transition", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPut, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/state", bytes.NewBufferString(`{"state":"active"}`))
+		response := httptest.NewRecorder()
+		keyServiceStub.nextChangeError = keys.ErrInvalidStateTransition
+		defer func() { keyServiceStub.nextChangeError = nil }()
+
+		h.ChangeState(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusConflict)
+		assertInsideJSON(t, response.Body, "message", "Key can not be moved to the requested state")
+	})
+	t.Run("Should return a 404 if the key was not found", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPut, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/state", bytes.NewBufferString(`{"state":"disabled"}`))
+		response := httptest.NewRecorder()
+		keyServiceStub.nextError = keys.ErrKeyNotFound
+
+		h.ChangeState(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+		assertInsideJSON(t, response.Body, "message", "Key was not found")
+	})
+}
+
 func TestFindKeys(t *testing.T) {
 	keyServiceStub := KeyServiceStub{}
 	h := NewKeyHandler(&keyServiceStub)
 	t.Run("Should return a 200 if it was a success", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodGet, "/keys?scope=scope", nil)
+		request, _ := newRequest(http.MethodGet, "/keys?scope=scope", nil)
 		response := httptest.NewRecorder()
 
 		want := http.StatusOK
@@ -298,25 +673,100 @@ func TestFindKeys(t *testing.T) {
 		assertStatus(t, response.Code, want)
 	})
 	t.Run("Should return .a list of Key if it was a success", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodGet, "/keys?scope=scope", nil)
+		request, _ := newRequest(http.MethodGet, "/keys?scope=scope", nil)
 		response := httptest.NewRecorder()
 
-		wants := []string{"publicKey", "keyID", "expiration"}
+		wants := []string{"publicKey", "keyID", "version", "expiration", "use", "keyType"}
 
 		h.Find(response, request)
-		respArr := []map[string]interface{}{}
-		json.Unmarshal(response.Body.Bytes(), &respArr)
-
+		resp := struct {
+			Keys       []map[string]interface{} `json:"keys"`
+			NextCursor *string                  `json:"nextCursor"`
+		}{}
+		json.Unmarshal(response.Body.Bytes(), &resp)
+
+		if len(resp.Keys) != 1 {
+			t.Fatalf("got %d keys, want %d", len(resp.Keys), 1)
+		}
 		for _, want := range wants {
-			for _, e := range respArr {
+			for _, e := range resp.Keys {
 				if _, ok := e[want]; ok != true {
 					t.Errorf("does not have the %q prop", want)
 				}
 			}
 		}
+		if resp.NextCursor != nil {
+			t.Errorf("got %q, want no next cursor on the last page", *resp.NextCursor)
+		}
+	})
+	t.Run("Should return the cursor of the next page", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/keys?scope=scope&limit=1", nil)
+		response := httptest.NewRecorder()
+
+		h.Find(response, request)
+		var resp HTTPKeysPage
+		json.Unmarshal(response.Body.Bytes(), &resp)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		if resp.NextCursor == nil {
+			t.Fatalf("want the cursor of the next page")
+		}
+		c, err := keys.ParseCursor(*resp.NextCursor, keys.SortByCreation)
+		if err != nil {
+			t.Fatalf("got an invalid cursor: %v", err)
+		}
+		assertString(t, c.ID, resp.Keys[0].KeyID)
+	})
+	t.Run("Should translate the query parameters into the key query", func(t *testing.T) {
+		cursor := keys.Cursor{SortBy: keys.SortByExpiration, Value: time.Now().UTC(), ID: uuid.NewString()}
+		request, _ := newRequest(http.MethodGet, "/keys?scope=scope&limit=20&state=active,disabled&keyType=P-256&expiresAfter=2030-01-01T00:00:00Z&expiresBefore=2031-01-01T00:00:00Z&sort=expiration&order=desc&cursor="+cursor.Encode(), nil)
+		response := httptest.NewRecorder()
+
+		h.Find(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		q := keyServiceStub.CalledWith[1].(keys.KeyQuery)
+		if q.Limit != 20 || q.SortBy != keys.SortByExpiration || !q.Descending {
+			t.Errorf("got %+v, want the limit and sort of the request", q)
+		}
+		if !reflect.DeepEqual(q.States, []keys.State{keys.StateActive, keys.StateDisabled}) || !reflect.DeepEqual(q.Types, []keys.KeyType{keys.TypeP256}) {
+			t.Errorf("got %v %v, want the state and type filters", q.States, q.Types)
+		}
+		if q.ExpiresAfter.Year() != 2030 || q.ExpiresBefore.Year() != 2031 {
+			t.Errorf("got %v %v, want the expiration range", q.ExpiresAfter, q.ExpiresBefore)
+		}
+		if q.After == nil || q.After.ID != cursor.ID {
+			t.Errorf("got %v, want the cursor %v", q.After, cursor)
+		}
+	})
+	t.Run("Should return a BadRequest for invalid query parameters", func(t *testing.T) {
+		tests := []struct {
+			query   string
+			message string
+		}{
+			{"limit=0", "limit is invalid"},
+			{"limit=501", "limit is invalid"},
+			{"state=active,unknown", "state is invalid"},
+			{"keyType=DSA", "keyType is invalid"},
+			{"expiresAfter=tomorrow", "expiresAfter is invalid"},
+			{"expiresBefore=2030-01-01", "expiresBefore is invalid"},
+			{"sort=scope", "sort is invalid"},
+			{"order=up", "order is invalid"},
+			{"cursor=invalid", "Invalid: cursor does not belong to this listing"},
+			{"sort=expiration&cursor=" + keys.Cursor{SortBy: keys.SortByCreation, Value: time.Now(), ID: uuid.NewString()}.Encode(), "Invalid: cursor does not belong to this listing"},
+		}
+		for _, tt := range tests {
+			request, _ := newRequest(http.MethodGet, "/keys?scope=scope&"+tt.query, nil)
+			response := httptest.NewRecorder()
+
+			h.Find(response, request)
+
+			assertStatus(t, response.Code, http.StatusBadRequest)
+			assertErrorMessage(t, response.Body, "message", tt.message)
+		}
 	})
 	t.Run("Should call find Keys by scope with the right params", func(t *testing.T) {
-		request, _ := http.NewRequest(http.MethodGet, "/keys?scope=target", nil)
+		request, _ := newRequest(http.MethodGet, "/keys?scope=target", nil)
 		response := httptest.NewRecorder()
 
 		h.Find(response, request)
@@ -326,7 +776,7 @@ func TestFindKeys(t *testing.T) {
 	t.Run("If scope is not well formatted", func(t *testing.T) {
 		want := http.StatusBadRequest
 
-		request, _ := http.NewRequest(http.MethodGet, "/keys?scope=1231231313132313123213131231231313123131313123141414", nil)
+		request, _ := newRequest(http.MethodGet, "/keys?scope=1231231313132313123213131231231313123131313123141414", nil)
 		response := httptest.NewRecorder()
 
 		h.Find(response, request)
@@ -341,25 +791,25 @@ func TestFindKeys(t *testing.T) {
 	t.Run("If no key was found", func(t *testing.T) {
 		t.Run("Should return a 200 with no keys", func(t *testing.T) {
 			want := http.StatusOK
-			getRequest, _ := http.NewRequest(http.MethodGet, "/keys?scope=notFound", nil)
+			getRequest, _ := newRequest(http.MethodGet, "/keys?scope=notFound", nil)
 			response := httptest.NewRecorder()
 
 			keyServiceStub.nextFindResult = []keys.Key{}
 
 			h.Find(response, getRequest)
-			respArr := []map[string]interface{}{}
-			json.Unmarshal(response.Body.Bytes(), &respArr)
+			var resp HTTPKeysPage
+			json.Unmarshal(response.Body.Bytes(), &resp)
 
 			assertStatus(t, response.Code, want)
-			if len(respArr) != 0 {
-				t.Errorf("got %d, want %d", len(respArr), 0)
+			if resp.Keys == nil || len(resp.Keys) != 0 {
+				t.Errorf("got %v, want an empty list", resp.Keys)
 			}
 		})
 	})
 	t.Run("If there was any other error", func(t *testing.T) {
 		t.Run("Should return a 500", func(t *testing.T) {
 			want := http.StatusInternalServerError
-			getRequest, _ := http.NewRequest(http.MethodGet, "/keys?scope=scope", nil)
+			getRequest, _ := newRequest(http.MethodGet, "/keys?scope=scope", nil)
 			keyServiceStub.SetErrorFindKey(errors.New("another error"))
 			response := httptest.NewRecorder()
 
@@ -371,6 +821,225 @@ func TestFindKeys(t *testing.T) {
 	})
 }
 
+func TestJWKS(t *testing.T) {
+	keyServiceStub := KeyServiceStub{}
+	h := NewKeyHandler(&keyServiceStub)
+	t.Run("Should return a JSON Web Key Set with the scope keys", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+
+		h.JWKS(response, mux.SetURLVars(request, map[string]string{"scope": "scope"}))
+
+		assertStatus(t, response.Code, http.StatusOK)
+		set, err := jwk.Parse(response.Body.Bytes())
+		if err != nil {
+			t.Fatalf("got an invalid JWKS: %v", err)
+		}
+		if set.Len() != 1 {
+			t.Fatalf("got %d keys, want %d", set.Len(), 1)
+		}
+		key, _ := set.Get(0)
+		assertString(t, key.KeyID(), keyServiceStub.LastDeliveredKey.KID())
+		assertString(t, key.Algorithm(), "RSA-OAEP-256")
+		assertString(t, key.KeyUsage(), "enc")
+		if _, ok := key.Get("exp"); !ok {
+			t.Errorf("does not have the %q prop", "exp")
+		}
+	})
+	t.Run("Should not bind signing keys to an algorithm", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+		keyServiceStub.nextFindResult = []keys.Key{{
+			ID:         "signing",
+			Version:    1,
+			Expiration: time.Now().AddDate(0, 0, 1),
+			Use:        keys.UseSigning,
+			Pub:        &rsaKey.PublicKey,
+		}}
+
+		h.JWKS(response, mux.SetURLVars(request, map[string]string{"scope": "scope"}))
+		keyServiceStub.nextFindResult = nil
+
+		set, _ := jwk.Parse(response.Body.Bytes())
+		key, _ := set.Get(0)
+		assertString(t, key.KeyUsage(), "sig")
+		assertString(t, key.Algorithm(), "")
+	})
+	t.Run("Should publish every version of a rotated key", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+		_, previous, _ := ed25519.GenerateKey(rand.Reader)
+		newest, _, _ := ed25519.GenerateKey(rand.Reader)
+		keyServiceStub.nextFindResult = []keys.Key{
+			{ID: "signing", Version: 2, Use: keys.UseSigning, Pub: newest},
+			{ID: "signing", Version: 1, Use: keys.UseSigning, Pub: previous.Public()},
+		}
+
+		h.JWKS(response, mux.SetURLVars(request, map[string]string{"scope": "scope"}))
+		keyServiceStub.nextFindResult = nil
+
+		set, _ := jwk.Parse(response.Body.Bytes())
+		if set.Len() != 2 {
+			t.Fatalf("got %d keys, want %d", set.Len(), 2)
+		}
+		for i, kid := range []string{"signing:2", "signing:1"} {
+			key, _ := set.Get(i)
+			assertString(t, key.KeyID(), kid)
+		}
+	})
+	t.Run("Should bind curve keys to their algorithm", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+		ecPriv, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+		edPub, _, _ := ed25519.GenerateKey(rand.Reader)
+		keyServiceStub.nextFindResult = []keys.Key{
+			{ID: "ec", Version: 1, Use: keys.UseEncryption, Pub: &ecPriv.PublicKey},
+			{ID: "ed", Version: 1, Use: keys.UseSigning, Pub: edPub},
+		}
+
+		h.JWKS(response, mux.SetURLVars(request, map[string]string{"scope": "scope"}))
+		keyServiceStub.nextFindResult = nil
+
+		set, _ := jwk.Parse(response.Body.Bytes())
+		ec, _ := set.Get(0)
+		ed, _ := set.Get(1)
+		assertString(t, ec.Algorithm(), "ECDH-ES+A256KW")
+		assertString(t, ed.Algorithm(), "EdDSA")
+	})
+	t.Run("Should call find active keys by scope with the right params", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/scopes/target/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+
+		h.JWKS(response, mux.SetURLVars(request, map[string]string{"scope": "target"}))
+
+		assertInsideSlice(t, keyServiceStub.CalledWith, "target")
+	})
+	t.Run("Should return a 500 if there was any error", func(t *testing.T) {
+		request, _ := newRequest(http.MethodGet, "/scopes/scope/.well-known/jwks.json", nil)
+		response := httptest.NewRecorder()
+		keyServiceStub.nextError = errors.New("another error")
+
+		h.JWKS(response, mux.SetURLVars(request, map[string]string{"scope": "scope"}))
+
+		assertStatus(t, response.Code, http.StatusInternalServerError)
+	})
+}
+
+var (
+	allAccess, _ = auth.Disabled{}.Authenticate(nil)
+	readOnly     = auth.Credential{
+		ID:         "reader",
+		Scopes:     []string{"scope"},
+		Operations: []auth.Operation{auth.OpRead},
+	}
+)
+
+// newRequest builds a request carrying a credential allowed to run every
+// operation on every scope, as the auth middleware would
+func newRequest(method, url string, body io.Reader) (*http.Request, error) {
+	return newRequestAs(allAccess, method, url, body)
+}
+
+func newRequestAs(c auth.Credential, method, url string, body io.Reader) (*http.Request, error) {
+	r, err := http.NewRequest(method, url, body)
+	if err != nil {
+		return nil, err
+	}
+	return r.WithContext(auth.NewContext(r.Context(), c)), nil
+}
+
+func TestKeysAuthorization(t *testing.T) {
+	keyServiceStub := KeyServiceStub{}
+	h := NewKeyHandler(&keyServiceStub)
+	m := map[string]string{"keyID": "f6a4633a-65f5-42f8-a984-38d87e3513ee"}
+	forbidden := "Credential is not allowed to run this operation on the scope"
+
+	t.Run("Should return a forbidden when creating keys without the create operation", func(t *testing.T) {
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/keys", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", forbidden)
+	})
+	t.Run("Should return a forbidden when rotating keys of a scope without the create operation", func(t *testing.T) {
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", forbidden)
+		if keyServiceStub.CalledWith != nil {
+			t.Errorf("want the key not to be looked up, got %v", keyServiceStub.CalledWith)
+		}
+	})
+	t.Run("Should return a not found when rotating keys of other scopes", func(t *testing.T) {
+		other := auth.Credential{ID: "other", Scopes: []string{"other"}, Operations: []auth.Operation{auth.OpCreate}}
+		request, _ := newRequestAs(other, http.MethodPost, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/rotate", bytes.NewBuffer(validReqBody))
+		response := httptest.NewRecorder()
+
+		h.Rotate(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+		assertInsideJSON(t, response.Body, "code", "key_not_found")
+	})
+	t.Run("Should return a forbidden when changing the state of keys without the create operation", func(t *testing.T) {
+		request, _ := newRequestAs(readOnly, http.MethodPut, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee/state", bytes.NewBufferString(`{"state":"disabled"}`))
+		response := httptest.NewRecorder()
+
+		h.ChangeState(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", forbidden)
+	})
+	t.Run("Should read the keys of the bound scopes", func(t *testing.T) {
+		request, _ := newRequestAs(readOnly, http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+		response := httptest.NewRecorder()
+
+		h.Get(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusOK)
+	})
+	t.Run("Should return a not found when reading keys of other scopes", func(t *testing.T) {
+		other := auth.Credential{ID: "other", Scopes: []string{"other"}, Operations: []auth.Operation{auth.OpRead}}
+		request, _ := newRequestAs(other, http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+		response := httptest.NewRecorder()
+
+		h.Get(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusNotFound)
+		assertInsideJSON(t, response.Body, "code", "key_not_found")
+	})
+	t.Run("Should return a forbidden when reading keys without the read operation", func(t *testing.T) {
+		signer := auth.Credential{ID: "signer", Scopes: []string{"scope"}, Operations: []auth.Operation{auth.OpSign}}
+		request, _ := newRequestAs(signer, http.MethodGet, "/keys/f6a4633a-65f5-42f8-a984-38d87e3513ee", nil)
+		response := httptest.NewRecorder()
+
+		h.Get(response, mux.SetURLVars(request, m))
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", forbidden)
+	})
+	t.Run("Should return a forbidden when listing keys of other scopes", func(t *testing.T) {
+		request, _ := newRequestAs(readOnly, http.MethodGet, "/keys?scope=other", nil)
+		response := httptest.NewRecorder()
+
+		h.Find(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", forbidden)
+	})
+}
+
+func assertString(t *testing.T, got, want string) {
+	t.Helper()
+	if got != want {
+		t.Errorf("got %q want %q", got, want)
+	}
+}
+
 func assertStatus(t *testing.T, got, want int) {
 	t.Helper()
 	if got != want {
@@ -393,6 +1062,15 @@ func assertInsideJSON(t *testing.T, jBuff *bytes.Buffer, wantedKey string, wante
 	}
 }
 
+func assertHTTPError(t *testing.T, jBuff *bytes.Buffer, code, message string) {
+	t.Helper()
+	var got HTTPError
+	json.NewDecoder(jBuff).Decode(&got)
+	if got.Code != code || got.Message != message {
+		t.Errorf("got %v, want %v", got, HTTPError{Code: code, Message: message})
+	}
+}
+
 func assertInsideSlice(t *testing.T, a []interface{}, want interface{}) {
 	t.Helper()
 	has := false
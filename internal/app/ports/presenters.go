@@ -5,37 +5,78 @@ import (
 	"crypto/x509"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"mime"
 	"net/http"
+	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/signing"
+	"github.com/cesarFuhr/gocrypto/internal/pkg/keycodec"
+	"github.com/lestrrat-go/jwx/jwk"
 )
 
-// HTTPError Exception formatter to all http badRequests
+// HTTPError Exception formatter to all http errors, the code is meant for
+// machines and the message for people
 type HTTPError struct {
+	Code    string `json:"code"`
 	Message string `json:"message"`
 }
 
 // HTTPCreateKey Http representation of the create key response body
 type HTTPCreateKey struct {
-	KeyID      string `json:"keyID"`
-	Expiration string `json:"expiration"`
-	PublicKey  string `json:"publicKey"`
+	KeyID        string      `json:"keyID"`
+	Version      int         `json:"version"`
+	Expiration   string      `json:"expiration"`
+	Use          string      `json:"use"`
+	KeyType      string      `json:"keyType"`
+	Policy       *HTTPPolicy `json:"policy,omitempty"`
+	State        string      `json:"state"`
+	DeletionDate string      `json:"deletionDate,omitempty"`
+	PublicKey    string      `json:"publicKey"`
 }
 
 // HTTPCreateKey Http representation of the create key response body
 type HTTPListedKeys struct {
-	KeyID      string `json:"keyID"`
-	Expiration string `json:"expiration"`
-	PublicKey  string `json:"publicKey"`
+	KeyID        string      `json:"keyID"`
+	Version      int         `json:"version"`
+	Expiration   string      `json:"expiration"`
+	Use          string      `json:"use"`
+	KeyType      string      `json:"keyType"`
+	Policy       *HTTPPolicy `json:"policy,omitempty"`
+	State        string      `json:"state"`
+	DeletionDate string      `json:"deletionDate,omitempty"`
+	Creation     string      `json:"creation,omitempty"`
+	PublicKey    string      `json:"publicKey"`
+}
+
+// HTTPKeysPage Http representation of a page of the listed keys
+type HTTPKeysPage struct {
+	Keys       []HTTPListedKeys `json:"keys"`
+	NextCursor *string          `json:"nextCursor"`
+}
+
+// HTTPPolicy Http representation of the encryption algorithms a key allows
+type HTTPPolicy struct {
+	KeyAlgorithms     []string `json:"keyAlgorithms"`
+	ContentAlgorithms []string `json:"contentAlgorithms"`
+	Compression       bool     `json:"compression"`
 }
 
 // NewHTTPCreateKey Builder for the http CreateKey response
 func NewHTTPCreateKey(k keys.Key) HTTPCreateKey {
 	return HTTPCreateKey{
-		KeyID:      k.ID,
-		Expiration: k.Expiration.UTC().Format(time.RFC3339),
-		PublicKey:  formatPublicKey(k.Pub),
+		KeyID:        k.ID,
+		Version:      k.Version,
+		Expiration:   k.Expiration.UTC().Format(time.RFC3339),
+		Use:          string(k.Use),
+		KeyType:      string(k.Type()),
+		Policy:       newHTTPPolicy(k),
+		State:        string(k.State),
+		DeletionDate: formatOptionalDate(k.DeletionDate),
+		PublicKey:    formatPublicKey(k),
 	}
 }
 
@@ -44,18 +85,100 @@ func NewHTTPFindKeys(keys []keys.Key) []HTTPListedKeys {
 	listed := []HTTPListedKeys{}
 	for _, k := range keys {
 		listed = append(listed, HTTPListedKeys{
-			KeyID:      k.ID,
-			Expiration: k.Expiration.UTC().Format(time.RFC3339),
-			PublicKey:  formatPublicKey(k.Pub),
+			KeyID:        k.ID,
+			Version:      k.Version,
+			Expiration:   k.Expiration.UTC().Format(time.RFC3339),
+			Use:          string(k.Use),
+			KeyType:      string(k.Type()),
+			Policy:       newHTTPPolicy(k),
+			State:        string(k.State),
+			DeletionDate: formatOptionalDate(k.DeletionDate),
+			Creation:     formatOptionalDate(k.Creation),
+			PublicKey:    formatPublicKey(k),
 		})
 	}
 
 	return listed
 }
 
-func formatPublicKey(pubKey *rsa.PublicKey) string {
-	b := base64.RawStdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(pubKey))
-	return b
+// NewHTTPKeysPage Builder for the http FindKeys response, the cursor of the
+// next page is null on the last one
+func NewHTTPKeysPage(page keys.KeyPage) HTTPKeysPage {
+	p := HTTPKeysPage{Keys: NewHTTPFindKeys(page.Keys)}
+	if page.Next != nil {
+		next := page.Next.Encode()
+		p.NextCursor = &next
+	}
+	return p
+}
+
+// NewHTTPJWKS Builder for the http JSON Web Key Set response
+func NewHTTPJWKS(ks []keys.Key) (jwk.Set, error) {
+	set := jwk.NewSet()
+	for _, k := range ks {
+		key, err := jwk.New(k.Pub)
+		if err != nil {
+			return nil, err
+		}
+
+		fields := map[string]interface{}{
+			jwk.KeyIDKey:    k.KID(),
+			jwk.KeyUsageKey: string(k.Use),
+			"exp":           k.Expiration.Unix(),
+		}
+		// keys are only bound to an algorithm when they allow a single one,
+		// like RSA signing keys taking either RS256 or PS256
+		if k.Use == keys.UseEncryption {
+			if algs := k.EncryptionPolicy().KeyAlgorithms; len(algs) == 1 {
+				fields[jwk.AlgorithmKey] = algs[0]
+			}
+		} else if algs := signing.Algorithms(k.Type()); len(algs) == 1 {
+			fields[jwk.AlgorithmKey] = algs[0]
+		}
+		for name, value := range fields {
+			if err := key.Set(name, value); err != nil {
+				return nil, err
+			}
+		}
+
+		set.Add(key)
+	}
+
+	return set, nil
+}
+
+// newHTTPPolicy only encryption keys have a policy
+func newHTTPPolicy(k keys.Key) *HTTPPolicy {
+	if k.Use != keys.UseEncryption {
+		return nil
+	}
+	p := k.EncryptionPolicy()
+	return &HTTPPolicy{
+		KeyAlgorithms:     p.KeyAlgorithms,
+		ContentAlgorithms: p.ContentAlgorithms,
+		Compression:       p.Compression,
+	}
+}
+
+func formatOptionalDate(t time.Time) string {
+	if t.IsZero() {
+		return ""
+	}
+	return t.UTC().Format(time.RFC3339)
+}
+
+// formatPublicKey RSA keys keep the PKCS #1 format they always had, the
+// other key types are in the PKIX format
+func formatPublicKey(k keys.Key) string {
+	if rsaKey, ok := k.Pub.(*rsa.PublicKey); ok {
+		return base64.RawStdEncoding.EncodeToString(x509.MarshalPKCS1PublicKey(rsaKey))
+	}
+
+	der, err := keycodec.MarshalPublicKey(k.Pub)
+	if err != nil {
+		return ""
+	}
+	return base64.RawStdEncoding.EncodeToString(der)
 }
 
 // HTTPEncrypt representation of the encrypt response body
@@ -68,16 +191,162 @@ type HTTPDecrypt struct {
 	Data string `json:"data"`
 }
 
+// payload encodings of the data carried in the JSON bodies, utf8 by default
+const (
+	encodingUTF8      = "utf8"
+	encodingBase64    = "base64"
+	encodingBase64URL = "base64url"
+)
+
+// errInvalidPayload the data is not valid in the requested encoding
+var errInvalidPayload = errors.New("payload does not match its encoding")
+
+// decodePayload reads the data in its encoding, base64url is accepted padded
+// or not
+func decodePayload(encoding string, data string) ([]byte, error) {
+	var (
+		b   []byte
+		err error
+	)
+	switch encoding {
+	case encodingBase64:
+		b, err = base64.StdEncoding.DecodeString(data)
+	case encodingBase64URL:
+		b, err = base64.RawURLEncoding.DecodeString(strings.TrimRight(data, "="))
+	default:
+		return []byte(data), nil
+	}
+	if err != nil {
+		return nil, errInvalidPayload
+	}
+	return b, nil
+}
+
+// encodePayload renders the data in its encoding, binary data does not fit
+// in a JSON string unless encoded
+func encodePayload(encoding string, b []byte) (string, error) {
+	switch encoding {
+	case encodingBase64:
+		return base64.StdEncoding.EncodeToString(b), nil
+	case encodingBase64URL:
+		return base64.RawURLEncoding.EncodeToString(b), nil
+	}
+	if !utf8.Valid(b) {
+		return "", errInvalidPayload
+	}
+	return string(b), nil
+}
+
+// HTTPBatchError error of a single item of a batch, with the status the item
+// would get on its own
+type HTTPBatchError struct {
+	Status  int    `json:"status"`
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+// HTTPEncryptBatchItem result of an item of the encrypt batch, either the
+// encrypted data or its error
+type HTTPEncryptBatchItem struct {
+	EncryptedData string          `json:"encryptedData,omitempty"`
+	Error         *HTTPBatchError `json:"error,omitempty"`
+}
+
+// HTTPEncryptBatch representation of the encrypt batch response body, the
+// items are in the order of the request
+type HTTPEncryptBatch struct {
+	Items []HTTPEncryptBatchItem `json:"items"`
+}
+
+// HTTPDecryptBatchItem result of an item of the decrypt batch, either the
+// data or its error
+type HTTPDecryptBatchItem struct {
+	Data  string          `json:"data,omitempty"`
+	Error *HTTPBatchError `json:"error,omitempty"`
+}
+
+// HTTPDecryptBatch representation of the decrypt batch response body, the
+// items are in the order of the request
+type HTTPDecryptBatch struct {
+	Items []HTTPDecryptBatchItem `json:"items"`
+}
+
+// HTTPSign representation of the sign response body
+type HTTPSign struct {
+	Signature string `json:"signature"`
+}
+
+// HTTPVerify representation of the verify response body
+type HTTPVerify struct {
+	Payload string `json:"payload"`
+}
+
+// HTTPHealth representation of the liveness and readiness response bodies
+type HTTPHealth struct {
+	Status       string            `json:"status"`
+	Dependencies map[string]string `json:"dependencies,omitempty"`
+}
+
 func replyJSON(w http.ResponseWriter, code int, obj interface{}) {
 	w.Header().Set("Content-type", "application/json")
 	w.WriteHeader(code)
 	json.NewEncoder(w).Encode(obj)
 }
 
-func internalServerError(w http.ResponseWriter) {
-	w.Header().Set("Content-type", "application/json")
-	w.WriteHeader(http.StatusInternalServerError)
-	json.NewEncoder(w).Encode(HTTPError{
-		Message: "There was an unexpected error",
-	})
+func forbidden(w http.ResponseWriter) {
+	replyError(w, errForbidden)
+}
+
+// internalServerError requests running out of time are reported as such, the
+// error is then most likely the cancellation of their context
+func internalServerError(w http.ResponseWriter, r *http.Request) {
+	replyError(w, failure(r, nil))
+}
+
+// octetStream media type of the streamed payloads
+const octetStream = "application/octet-stream"
+
+func isOctetStream(r *http.Request) bool {
+	t, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	return err == nil && t == octetStream
+}
+
+func unsupportedMediaType(w http.ResponseWriter) {
+	replyError(w, errUnsupportedMediaType)
+}
+
+// streamWriter replies an octet stream on the first write, errors found
+// before it can still be replied as JSON
+type streamWriter struct {
+	w       http.ResponseWriter
+	started bool
+}
+
+// newStreamWriter the reply is written while the request body is still being
+// read, HTTP/1.1 servers would otherwise drop the rest of the body once the
+// reply starts. Writers not supporting it, like the recorders, stay as they are
+func newStreamWriter(w http.ResponseWriter) *streamWriter {
+	http.NewResponseController(w).EnableFullDuplex()
+	return &streamWriter{w: w}
+}
+
+func (s *streamWriter) Write(p []byte) (int, error) {
+	s.start()
+	return s.w.Write(p)
+}
+
+// start replies the octet stream headers, even if nothing was written
+func (s *streamWriter) start() {
+	if !s.started {
+		s.w.Header().Set("Content-type", octetStream)
+		s.w.WriteHeader(http.StatusOK)
+		s.started = true
+	}
+}
+
+// abortStream the status of a started stream can not change anymore, the
+// connection is closed without ending the response so the client sees it
+// incomplete
+func abortStream() {
+	panic(http.ErrAbortHandler)
 }
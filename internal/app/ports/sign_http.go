@@ -0,0 +1,60 @@
+package ports
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
+)
+
+type signReqBody struct {
+	KeyID     string `json:"keyID"`
+	Scope     string `json:"scope"`
+	Algorithm string `json:"algorithm"`
+	Payload   string `json:"payload"`
+}
+
+type SigningService interface {
+	Sign(context.Context, string, string, string, string) ([]byte, error)
+}
+
+type SignHandler struct {
+	service   SigningService
+	validator signValidator
+}
+
+// NewSignHandler creates a sign http handler
+func NewSignHandler(s SigningService) SignHandler {
+	return SignHandler{
+		service:   s,
+		validator: signValidator{},
+	}
+}
+
+func (h *SignHandler) Post(w http.ResponseWriter, r *http.Request) {
+	var o signReqBody
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
+
+	if err := h.validator.PostValidator(o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpSign) {
+		forbidden(w)
+		return
+	}
+
+	signed, err := h.service.Sign(r.Context(), o.KeyID, o.Scope, o.Algorithm, o.Payload)
+	if err != nil {
+		serviceError(w, r, err)
+		return
+	}
+
+	replyJSON(w, http.StatusOK, HTTPSign{
+		Signature: string(signed),
+	})
+}
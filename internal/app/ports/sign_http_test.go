@@ -0,0 +1,165 @@
+package ports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/signing"
+	"github.com/google/uuid"
+)
+
+type SigningServiceStub struct {
+	CalledWith []interface{}
+}
+
+func (s *SigningServiceStub) Sign(ctx context.Context, keyID string, scope string, alg string, payload string) ([]byte, error) {
+	s.CalledWith = []interface{}{keyID, scope, alg, payload}
+	switch payload {
+	case "error":
+		return []byte{}, errors.New("some error")
+	case "notFound":
+		return []byte{}, keys.ErrKeyNotFound
+	case "outOfScope":
+		return []byte{}, keys.ErrKeyOutOfScope
+	case "disabled":
+		return []byte{}, keys.ErrKeyDisabled
+	case "pendingDeletion":
+		return []byte{}, keys.ErrKeyPendingDeletion
+	case "destroyed":
+		return []byte{}, keys.ErrKeyDestroyed
+	case "wrongUse":
+		return []byte{}, keys.ErrKeyWrongUse
+	case "expired":
+		return []byte{}, keys.ErrKeyExpired
+	case "unsupported":
+		return []byte{}, signing.ErrUnsupportedAlgorithm
+	}
+	return []byte("header.payload.signature"), nil
+}
+
+func TestSign(t *testing.T) {
+	signingStub := SigningServiceStub{}
+	h := NewSignHandler(&signingStub)
+	t.Run("Should return a BadRequest if the body is not valid JSON", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/sign", bytes.NewBufferString(`{"scope": "scope",`))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertHTTPError(t, response.Body, "invalid_body", "Request body contains badly-formed JSON")
+	})
+	t.Run("Should return a 200 with the signature if it was a success", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":   uuid.New().String(),
+			"scope":   "scope",
+			"payload": "testing",
+		})
+		request, _ := newRequest(http.MethodPost, "/sign", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideJSON(t, response.Body, "signature", "header.payload.signature")
+	})
+	t.Run("Should call Sign with the right params", func(t *testing.T) {
+		keyID := uuid.New().String()
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":     keyID,
+			"scope":     "scope",
+			"algorithm": "PS256",
+			"payload":   "testing",
+		})
+		request, _ := newRequest(http.MethodPost, "/sign", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertInsideSlice(t, signingStub.CalledWith, keyID)
+		assertInsideSlice(t, signingStub.CalledWith, "PS256")
+		assertInsideSlice(t, signingStub.CalledWith, "testing")
+	})
+	t.Run("Should return a BadRequest for an unknown algorithm", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":     uuid.New().String(),
+			"scope":     "scope",
+			"algorithm": "HS256",
+			"payload":   "testing",
+		})
+		request, _ := newRequest(http.MethodPost, "/sign", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "algorithm")
+	})
+	t.Run("Should return a BadRequest if the payload is missing", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID": uuid.New().String(),
+			"scope": "scope",
+		})
+		request, _ := newRequest(http.MethodPost, "/sign", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "payload")
+	})
+	t.Run("Should return a specific error for each signing failure", func(t *testing.T) {
+		tests := []struct {
+			payload string
+			status  int
+			code    string
+			message string
+		}{
+			{"error", http.StatusInternalServerError, "internal_error", "There was an unexpected error"},
+			{"notFound", http.StatusNotFound, "key_not_found", "Key was not found"},
+			{"outOfScope", http.StatusForbidden, "key_out_of_scope", "Key is out of scope"},
+			{"disabled", http.StatusConflict, "key_disabled", "Key is disabled"},
+			{"pendingDeletion", http.StatusConflict, "key_pending_deletion", "Key is pending deletion"},
+			{"destroyed", http.StatusGone, "key_destroyed", "Key was destroyed"},
+			{"wrongUse", http.StatusConflict, "key_wrong_use", "Key is not meant for this operation"},
+			{"expired", http.StatusUnprocessableEntity, "key_expired", "Key is expired"},
+			{"unsupported", http.StatusBadRequest, "unsupported_algorithm", "Signature algorithm is not supported"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID":   uuid.New().String(),
+				"scope":   "scope",
+				"payload": tt.payload,
+			})
+			request, _ := newRequest(http.MethodPost, "/sign", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, tt.status)
+			assertHTTPError(t, response.Body, tt.code, tt.message)
+		}
+	})
+	t.Run("Should return a forbidden if the credential can not sign on the scope", func(t *testing.T) {
+		signingStub.CalledWith = nil
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":   uuid.New().String(),
+			"scope":   "scope",
+			"payload": "testing",
+		})
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/sign", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", "Credential is not allowed to run this operation on the scope")
+		if signingStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", signingStub.CalledWith)
+		}
+	})
+}
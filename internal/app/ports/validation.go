@@ -1,6 +1,8 @@
 package ports
 
 import (
+	"fmt"
+	"regexp"
 	"time"
 
 	"github.com/cesarFuhr/validator"
@@ -10,10 +12,38 @@ var (
 	scopeV         = validator.NewStringValidator("scope", true, validator.StrLength(1, 50))
 	expirationV    = validator.NewStringValidator("expiration", true, validator.StrDate(time.RFC3339))
 	keyIDV         = validator.NewStringValidator("keyID", true, validator.StrUUID())
+	stateV         = validator.NewStringValidator("state", true, validator.StrRegexp(regexp.MustCompile(`^(active|disabled|pending-deletion)$`)))
+	useV           = validator.NewStringValidator("use", false, validator.StrRegexp(regexp.MustCompile(`^(enc|sig)$`)))
+	keyTypeV       = validator.NewStringValidator("keyType", false, validator.StrRegexp(regexp.MustCompile(`^(RSA-2048|RSA-3072|RSA-4096|P-256|P-384|Ed25519|X25519)$`)))
+	versionV       = validator.NewStringValidator("version", false, validator.StrRegexp(regexp.MustCompile(`^[1-9][0-9]{0,8}$`)))
+	limitV         = validator.NewStringValidator("limit", false, validator.StrRegexp(regexp.MustCompile(`^([1-9][0-9]?|[1-4][0-9]{2}|500)$`)))
+	cursorV        = validator.NewStringValidator("cursor", false, validator.StrLength(1, 500))
+	stateFilterV   = validator.NewStringValidator("state", false, validator.StrRegexp(regexp.MustCompile(`^(active|disabled|pending-deletion|destroyed)(,(active|disabled|pending-deletion|destroyed))*$`)))
+	keyTypeFilterV = validator.NewStringValidator("keyType", false, validator.StrRegexp(regexp.MustCompile(`^(RSA-2048|RSA-3072|RSA-4096|P-256|P-384|Ed25519|X25519)(,(RSA-2048|RSA-3072|RSA-4096|P-256|P-384|Ed25519|X25519))*$`)))
+	expiresAfterV  = validator.NewStringValidator("expiresAfter", false, validator.StrDate(time.RFC3339))
+	expiresBeforeV = validator.NewStringValidator("expiresBefore", false, validator.StrDate(time.RFC3339))
+	sortV          = validator.NewStringValidator("sort", false, validator.StrRegexp(regexp.MustCompile(`^(creation|expiration)$`)))
+	orderV         = validator.NewStringValidator("order", false, validator.StrRegexp(regexp.MustCompile(`^(asc|desc)$`)))
 	dataV          = validator.NewStringValidator("data", true, validator.StrLength(1, 1000))
 	encryptedDataV = validator.NewStringValidator("encryptedData", true, validator.StrLength(1, 4000))
+	encodingV      = validator.NewStringValidator("encoding", false, validator.StrRegexp(regexp.MustCompile(`^(utf8|base64|base64url)$`)))
+	keyAlgV        = validator.NewStringValidator("alg", false, validator.StrRegexp(regexp.MustCompile(`^(RSA-OAEP-256|RSA-OAEP|ECDH-ES\+A256KW|ECDH-ES\+A192KW|ECDH-ES\+A128KW|ECDH-ES)$`)))
+	contentAlgV    = validator.NewStringValidator("enc", false, validator.StrRegexp(regexp.MustCompile(`^(A256CBC-HS512|A192CBC-HS384|A128CBC-HS256|A256GCM|A192GCM|A128GCM)$`)))
+	algorithmV     = validator.NewStringValidator("algorithm", false, validator.StrRegexp(regexp.MustCompile(`^(RS256|PS256|ES256|ES384|EdDSA)$`)))
+	payloadV       = validator.NewStringValidator("payload", true, validator.StrLength(1, 1000))
+	signatureV     = validator.NewStringValidator("signature", true, validator.StrLength(1, 4000))
 )
 
+// maxBatchItems most items of a batch request
+const maxBatchItems = 1000
+
+func validateBatchSize(n int) error {
+	if n < 1 || n > maxBatchItems {
+		return fmt.Errorf("items is invalid: should hold between 1 and %d items", maxBatchItems)
+	}
+	return nil
+}
+
 type keysValidator struct{}
 
 func (v keysValidator) PostValidator(ko keyOpts) error {
@@ -23,13 +53,42 @@ func (v keysValidator) PostValidator(ko keyOpts) error {
 	if err := expirationV.Validate(ko.Expiration); err != nil {
 		return err
 	}
+	if err := useV.Validate(ko.Use); err != nil {
+		return err
+	}
+	if err := keyTypeV.Validate(ko.KeyType); err != nil {
+		return err
+	}
 	return nil
 }
 
-func (v keysValidator) GetValidator(keyID string) error {
+func (v keysValidator) GetValidator(keyID string, version string) error {
 	if err := keyIDV.Validate(keyID); err != nil {
 		return err
 	}
+	if err := versionV.Validate(version); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v keysValidator) RotateValidator(keyID string, ro rotateKeyOpts) error {
+	if err := keyIDV.Validate(keyID); err != nil {
+		return err
+	}
+	if err := expirationV.Validate(ro.Expiration); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v keysValidator) StateValidator(keyID string, so keyStateOpts) error {
+	if err := keyIDV.Validate(keyID); err != nil {
+		return err
+	}
+	if err := stateV.Validate(so.State); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -40,15 +99,103 @@ func (v keysValidator) FindValidator(scope string) error {
 	return nil
 }
 
+func (v keysValidator) PageValidator(po keyPageOpts) error {
+	if err := scopeV.Validate(po.Scope); err != nil {
+		return err
+	}
+	if err := limitV.Validate(po.Limit); err != nil {
+		return err
+	}
+	if err := cursorV.Validate(po.Cursor); err != nil {
+		return err
+	}
+	if err := stateFilterV.Validate(po.State); err != nil {
+		return err
+	}
+	if err := keyTypeFilterV.Validate(po.KeyType); err != nil {
+		return err
+	}
+	if err := expiresAfterV.Validate(po.ExpiresAfter); err != nil {
+		return err
+	}
+	if err := expiresBeforeV.Validate(po.ExpiresBefore); err != nil {
+		return err
+	}
+	if err := sortV.Validate(po.Sort); err != nil {
+		return err
+	}
+	if err := orderV.Validate(po.Order); err != nil {
+		return err
+	}
+	return nil
+}
+
 type encryptValidator struct{}
 
 func (v encryptValidator) PostValidator(eo encryptReqBody) error {
 	if err := keyIDV.Validate(eo.KeyID); err != nil {
 		return err
 	}
+	if err := scopeV.Validate(eo.Scope); err != nil {
+		return err
+	}
 	if err := dataV.Validate(eo.Data); err != nil {
 		return err
 	}
+	if err := keyAlgV.Validate(eo.Algorithm); err != nil {
+		return err
+	}
+	if err := contentAlgV.Validate(eo.Encryption); err != nil {
+		return err
+	}
+	if err := encodingV.Validate(eo.Encoding); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v encryptValidator) BatchValidator(eo encryptBatchReqBody) error {
+	if err := scopeV.Validate(eo.Scope); err != nil {
+		return err
+	}
+	if err := keyAlgV.Validate(eo.Algorithm); err != nil {
+		return err
+	}
+	if err := contentAlgV.Validate(eo.Encryption); err != nil {
+		return err
+	}
+	if err := encodingV.Validate(eo.Encoding); err != nil {
+		return err
+	}
+	if err := validateBatchSize(len(eo.Items)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v encryptValidator) BatchItemValidator(item encryptBatchItem) error {
+	if err := keyIDV.Validate(item.KeyID); err != nil {
+		return err
+	}
+	if err := dataV.Validate(item.Data); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v encryptValidator) StreamValidator(eo encryptStreamOpts) error {
+	if err := keyIDV.Validate(eo.KeyID); err != nil {
+		return err
+	}
+	if err := scopeV.Validate(eo.Scope); err != nil {
+		return err
+	}
+	if err := keyAlgV.Validate(eo.Algorithm); err != nil {
+		return err
+	}
+	if err := contentAlgV.Validate(eo.Encryption); err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -58,8 +205,80 @@ func (v decryptValidator) PostValidator(do decryptReqBody) error {
 	if err := keyIDV.Validate(do.KeyID); err != nil {
 		return err
 	}
+	if err := scopeV.Validate(do.Scope); err != nil {
+		return err
+	}
 	if err := encryptedDataV.Validate(do.EncryptedData); err != nil {
 		return err
 	}
+	if err := encodingV.Validate(do.Encoding); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v decryptValidator) BatchValidator(do decryptBatchReqBody) error {
+	if err := scopeV.Validate(do.Scope); err != nil {
+		return err
+	}
+	if err := encodingV.Validate(do.Encoding); err != nil {
+		return err
+	}
+	if err := validateBatchSize(len(do.Items)); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v decryptValidator) BatchItemValidator(item decryptBatchItem) error {
+	if err := keyIDV.Validate(item.KeyID); err != nil {
+		return err
+	}
+	if err := encryptedDataV.Validate(item.EncryptedData); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (v decryptValidator) StreamValidator(do decryptStreamOpts) error {
+	if err := keyIDV.Validate(do.KeyID); err != nil {
+		return err
+	}
+	if err := scopeV.Validate(do.Scope); err != nil {
+		return err
+	}
+	return nil
+}
+
+type signValidator struct{}
+
+func (v signValidator) PostValidator(so signReqBody) error {
+	if err := keyIDV.Validate(so.KeyID); err != nil {
+		return err
+	}
+	if err := scopeV.Validate(so.Scope); err != nil {
+		return err
+	}
+	if err := algorithmV.Validate(so.Algorithm); err != nil {
+		return err
+	}
+	if err := payloadV.Validate(so.Payload); err != nil {
+		return err
+	}
+	return nil
+}
+
+type verifyValidator struct{}
+
+func (v verifyValidator) PostValidator(vo verifyReqBody) error {
+	if err := keyIDV.Validate(vo.KeyID); err != nil {
+		return err
+	}
+	if err := scopeV.Validate(vo.Scope); err != nil {
+		return err
+	}
+	if err := signatureV.Validate(vo.Signature); err != nil {
+		return err
+	}
 	return nil
 }
@@ -0,0 +1,59 @@
+package ports
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/cesarFuhr/gocrypto/internal/pkg/auth"
+)
+
+type verifyReqBody struct {
+	KeyID     string `json:"keyID"`
+	Scope     string `json:"scope"`
+	Signature string `json:"signature"`
+}
+
+type VerificationService interface {
+	Verify(context.Context, string, string, string) ([]byte, error)
+}
+
+type VerifyHandler struct {
+	service   VerificationService
+	validator verifyValidator
+}
+
+// NewVerifyHandler creates a verify http handler
+func NewVerifyHandler(s VerificationService) VerifyHandler {
+	return VerifyHandler{
+		service:   s,
+		validator: verifyValidator{},
+	}
+}
+
+func (h *VerifyHandler) Post(w http.ResponseWriter, r *http.Request) {
+	var o verifyReqBody
+	if err := decodeJSONBody(r, &o); err != nil {
+		bodyError(w, r, err)
+		return
+	}
+
+	if err := h.validator.PostValidator(o); err != nil {
+		invalidRequest(w, err)
+		return
+	}
+
+	if !auth.Allowed(r.Context(), o.Scope, auth.OpVerify) {
+		forbidden(w)
+		return
+	}
+
+	payload, err := h.service.Verify(r.Context(), o.KeyID, o.Scope, o.Signature)
+	if err != nil {
+		serviceError(w, r, err)
+		return
+	}
+
+	replyJSON(w, http.StatusOK, HTTPVerify{
+		Payload: string(payload),
+	})
+}
@@ -0,0 +1,152 @@
+package ports
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/keys"
+	"github.com/cesarFuhr/gocrypto/internal/app/domain/signing"
+	"github.com/google/uuid"
+)
+
+type VerificationServiceStub struct {
+	CalledWith []interface{}
+}
+
+func (s *VerificationServiceStub) Verify(ctx context.Context, keyID string, scope string, m string) ([]byte, error) {
+	s.CalledWith = []interface{}{keyID, scope, m}
+	switch m {
+	case "error":
+		return []byte{}, errors.New("some error")
+	case "notFound":
+		return []byte{}, keys.ErrKeyNotFound
+	case "outOfScope":
+		return []byte{}, keys.ErrKeyOutOfScope
+	case "disabled":
+		return []byte{}, keys.ErrKeyDisabled
+	case "pendingDeletion":
+		return []byte{}, keys.ErrKeyPendingDeletion
+	case "destroyed":
+		return []byte{}, keys.ErrKeyDestroyed
+	case "wrongUse":
+		return []byte{}, keys.ErrKeyWrongUse
+	case "kidMismatch":
+		return []byte{}, signing.ErrKIDMismatch
+	case "unsupported":
+		return []byte{}, signing.ErrUnsupportedAlgorithm
+	case "invalid":
+		return []byte{}, signing.ErrInvalidSignature
+	}
+	return []byte("payload"), nil
+}
+
+func TestVerify(t *testing.T) {
+	verificationStub := VerificationServiceStub{}
+	h := NewVerifyHandler(&verificationStub)
+	t.Run("Should return a BadRequest if the body is not valid JSON", func(t *testing.T) {
+		request, _ := newRequest(http.MethodPost, "/verify", bytes.NewBufferString(`{"scope": "scope",`))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertHTTPError(t, response.Body, "invalid_body", "Request body contains badly-formed JSON")
+	})
+	t.Run("Should return a 200 with the payload if it was a success", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":     uuid.New().String(),
+			"scope":     "scope",
+			"signature": "header.payload.signature",
+		})
+		request, _ := newRequest(http.MethodPost, "/verify", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusOK)
+		assertInsideJSON(t, response.Body, "payload", "payload")
+	})
+	t.Run("Should call Verify with the right params", func(t *testing.T) {
+		keyID := uuid.New().String()
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":     keyID,
+			"scope":     "scope",
+			"signature": "header.payload.signature",
+		})
+		request, _ := newRequest(http.MethodPost, "/verify", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertInsideSlice(t, verificationStub.CalledWith, keyID)
+		assertInsideSlice(t, verificationStub.CalledWith, "scope")
+		assertInsideSlice(t, verificationStub.CalledWith, "header.payload.signature")
+	})
+	t.Run("Should return a BadRequest if the signature is missing", func(t *testing.T) {
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID": uuid.New().String(),
+			"scope": "scope",
+		})
+		request, _ := newRequest(http.MethodPost, "/verify", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusBadRequest)
+		assertErrorMessage(t, response.Body, "message", "signature")
+	})
+	t.Run("Should return a specific error for each verification failure", func(t *testing.T) {
+		tests := []struct {
+			signature string
+			status    int
+			code      string
+			message   string
+		}{
+			{"error", http.StatusInternalServerError, "internal_error", "There was an unexpected error"},
+			{"notFound", http.StatusNotFound, "key_not_found", "Key was not found"},
+			{"outOfScope", http.StatusForbidden, "key_out_of_scope", "Key is out of scope"},
+			{"disabled", http.StatusConflict, "key_disabled", "Key is disabled"},
+			{"pendingDeletion", http.StatusConflict, "key_pending_deletion", "Key is pending deletion"},
+			{"destroyed", http.StatusGone, "key_destroyed", "Key was destroyed"},
+			{"wrongUse", http.StatusConflict, "key_wrong_use", "Key is not meant for this operation"},
+			{"kidMismatch", http.StatusBadRequest, "kid_mismatch", "Signature does not belong to the key"},
+			{"unsupported", http.StatusBadRequest, "unsupported_algorithm", "Signature algorithm is not supported"},
+			{"invalid", http.StatusUnprocessableEntity, "invalid_signature", "Signature is invalid"},
+		}
+		for _, tt := range tests {
+			requestBody, _ := json.Marshal(map[string]string{
+				"keyID":     uuid.New().String(),
+				"scope":     "scope",
+				"signature": tt.signature,
+			})
+			request, _ := newRequest(http.MethodPost, "/verify", bytes.NewBuffer(requestBody))
+			response := httptest.NewRecorder()
+			h.Post(response, request)
+
+			assertStatus(t, response.Code, tt.status)
+			assertHTTPError(t, response.Body, tt.code, tt.message)
+		}
+	})
+	t.Run("Should return a forbidden if the credential can not verify on the scope", func(t *testing.T) {
+		verificationStub.CalledWith = nil
+		requestBody, _ := json.Marshal(map[string]string{
+			"keyID":     uuid.New().String(),
+			"scope":     "scope",
+			"signature": "header.payload.signature",
+		})
+		request, _ := newRequestAs(readOnly, http.MethodPost, "/verify", bytes.NewBuffer(requestBody))
+		response := httptest.NewRecorder()
+		h.Post(response, request)
+
+		assertStatus(t, response.Code, http.StatusForbidden)
+		assertInsideJSON(t, response.Body, "message", "Credential is not allowed to run this operation on the scope")
+		if verificationStub.CalledWith != nil {
+			t.Errorf("the service should not be called, got %v", verificationStub.CalledWith)
+		}
+	})
+}
@@ -0,0 +1,25 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// newTimeoutMiddleware sets a deadline on the context of every request, the
+// handlers hand it down to the repositories so the queries of a request that
+// ran out of time, or whose client went away, are cancelled. Zero disables it
+func newTimeoutMiddleware(timeout time.Duration) func(http.Handler) http.Handler {
+	return func(h http.Handler) http.Handler {
+		if timeout <= 0 {
+			return h
+		}
+
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			ctx, cancel := context.WithTimeout(r.Context(), timeout)
+			defer cancel()
+
+			h.ServeHTTP(w, r.WithContext(ctx))
+		})
+	}
+}
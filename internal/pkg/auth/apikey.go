@@ -0,0 +1,37 @@
+package auth
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+)
+
+// APIKeyHeader header carrying the static API keys
+const APIKeyHeader = "X-API-Key"
+
+// APIKeys authenticates static API keys, only the SHA-256 of each key is
+// known so the key file never holds them in plain text
+type APIKeys struct {
+	byHash map[string]Credential
+}
+
+// NewAPIKeys creates an APIKeys authenticator from the credentials indexed
+// by the hex encoded SHA-256 of their keys
+func NewAPIKeys(byHash map[string]Credential) APIKeys {
+	return APIKeys{byHash: byHash}
+}
+
+// Authenticate checks the key in the APIKeyHeader
+func (a APIKeys) Authenticate(r *http.Request) (Credential, error) {
+	key := r.Header.Get(APIKeyHeader)
+	if key == "" {
+		return Credential{}, ErrNoCredentials
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	c, ok := a.byHash[hex.EncodeToString(sum[:])]
+	if !ok {
+		return Credential{}, ErrInvalidCredentials
+	}
+	return c, nil
+}
@@ -0,0 +1,150 @@
+package auth
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+var (
+	// ErrNoCredentials the request does not carry the credential an
+	// authenticator looks for
+	ErrNoCredentials = errors.New("no credentials in the request")
+	// ErrInvalidCredentials the request carries a credential that is unknown,
+	// expired or badly signed
+	ErrInvalidCredentials = errors.New("invalid credentials")
+	// ErrUnknownOperation the credential is bound to an operation that does not exist
+	ErrUnknownOperation = errors.New("unknown operation")
+)
+
+// Operation what a credential is allowed to do with the keys of its scopes
+type Operation string
+
+const (
+	// OpCreate creating, rotating and changing the state of keys
+	OpCreate Operation = "create"
+	// OpRead reading keys and listing them by scope
+	OpRead Operation = "read"
+	// OpEncrypt encrypting with keys
+	OpEncrypt Operation = "encrypt"
+	// OpDecrypt decrypting with keys
+	OpDecrypt Operation = "decrypt"
+	// OpSign signing with keys
+	OpSign Operation = "sign"
+	// OpVerify verifying signatures with keys
+	OpVerify Operation = "verify"
+)
+
+// Operations every operation a credential can be bound to
+var Operations = []Operation{OpCreate, OpRead, OpEncrypt, OpDecrypt, OpSign, OpVerify}
+
+// Valid checks if the operation is a known one
+func (o Operation) Valid() bool {
+	for _, op := range Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// AnyScope binds a credential to every scope
+const AnyScope = "*"
+
+// Credential who is calling and the scopes and operations it is bound to
+type Credential struct {
+	ID         string
+	Scopes     []string
+	Operations []Operation
+}
+
+// Allows checks if the credential can run the operation on the keys of the scope
+func (c Credential) Allows(scope string, op Operation) bool {
+	return c.hasScope(scope) && c.hasOperation(op)
+}
+
+func (c Credential) hasScope(scope string) bool {
+	for _, s := range c.Scopes {
+		if s == AnyScope || s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+func (c Credential) hasOperation(op Operation) bool {
+	for _, o := range c.Operations {
+		if o == op {
+			return true
+		}
+	}
+	return false
+}
+
+// Authenticator finds and checks the credential carried by a request,
+// returns ErrNoCredentials when there is none of its kind
+type Authenticator interface {
+	Authenticate(*http.Request) (Credential, error)
+}
+
+// Chain tries each authenticator in order, the first one finding a
+// credential in the request decides
+type Chain []Authenticator
+
+// Authenticate runs the chain
+func (c Chain) Authenticate(r *http.Request) (Credential, error) {
+	for _, a := range c {
+		cred, err := a.Authenticate(r)
+		if err == ErrNoCredentials {
+			continue
+		}
+		return cred, err
+	}
+	return Credential{}, ErrNoCredentials
+}
+
+// Disabled authenticates every request with a credential bound to every
+// scope and operation, meant for when no key file is configured
+type Disabled struct{}
+
+// Authenticate returns the all access credential
+func (Disabled) Authenticate(r *http.Request) (Credential, error) {
+	return Credential{
+		ID:         "anonymous",
+		Scopes:     []string{AnyScope},
+		Operations: Operations,
+	}, nil
+}
+
+type credentialKey struct{}
+
+// NewContext returns a copy of the context carrying the credential
+func NewContext(ctx context.Context, c Credential) context.Context {
+	return context.WithValue(ctx, credentialKey{}, c)
+}
+
+// FromContext returns the credential carried by the context
+func FromContext(ctx context.Context) (Credential, bool) {
+	c, ok := ctx.Value(credentialKey{}).(Credential)
+	return c, ok
+}
+
+// AllowedOperation checks if the credential in the context can run the
+// operation on the keys of any scope, for when the scope is not known yet
+func AllowedOperation(ctx context.Context, op Operation) bool {
+	c, ok := FromContext(ctx)
+	if !ok {
+		return false
+	}
+	return c.hasOperation(op)
+}
+
+// Allowed checks if the credential in the context can run the operation on
+// the keys of the scope, a context without a credential is never allowed
+func Allowed(ctx context.Context, scope string, op Operation) bool {
+	c, ok := FromContext(ctx)
+	if !ok {
+		return false
+	}
+	return c.Allows(scope, op)
+}
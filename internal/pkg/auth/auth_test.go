@@ -0,0 +1,234 @@
+package auth
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+var (
+	apiKey      = "a-very-secret-api-key"
+	hmacSecret  = bytes.Repeat([]byte{7}, 32)
+	otherSecret = bytes.Repeat([]byte{8}, 32)
+	billing     = Credential{
+		ID:         "billing",
+		Scopes:     []string{"billing"},
+		Operations: []Operation{OpEncrypt, OpDecrypt},
+	}
+)
+
+func hash(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+func keyFile() KeyFile {
+	return KeyFile{
+		APIKeys: []APIKeyEntry{
+			{ID: "billing", SHA256: hash(apiKey), Scopes: []string{"billing"}, Operations: []Operation{OpEncrypt, OpDecrypt}},
+		},
+		HMACKeys: []HMACKeyEntry{
+			{KID: "hmac", Alg: "HS256", Secret: base64.StdEncoding.EncodeToString(hmacSecret)},
+		},
+	}
+}
+
+func signToken(t *testing.T, kid string, secret []byte, claims map[string]interface{}) string {
+	t.Helper()
+	token := jwt.New()
+	for name, value := range claims {
+		token.Set(name, value)
+	}
+
+	key, _ := jwk.New(secret)
+	key.Set(jwk.KeyIDKey, kid)
+	signed, err := jwt.Sign(token, jwa.HS256, key)
+	if err != nil {
+		t.Fatalf("could not sign the token: %v", err)
+	}
+	return string(signed)
+}
+
+func validClaims() map[string]interface{} {
+	return map[string]interface{}{
+		jwt.SubjectKey:    "billing",
+		jwt.ExpirationKey: time.Now().Add(time.Hour),
+		ScopesClaim:       []string{"billing"},
+		OperationsClaim:   []string{"encrypt", "decrypt"},
+	}
+}
+
+func request(headers map[string]string) *http.Request {
+	r, _ := http.NewRequest(http.MethodPost, "/encrypt", nil)
+	for name, value := range headers {
+		r.Header.Set(name, value)
+	}
+	return r
+}
+
+func TestCredentialAllows(t *testing.T) {
+	t.Run("allows the bound operations on the bound scopes", func(t *testing.T) {
+		assertValue(t, billing.Allows("billing", OpEncrypt), true)
+		assertValue(t, billing.Allows("billing", OpDecrypt), true)
+	})
+	t.Run("refuses other scopes and operations", func(t *testing.T) {
+		assertValue(t, billing.Allows("payroll", OpEncrypt), false)
+		assertValue(t, billing.Allows("billing", OpCreate), false)
+	})
+	t.Run("allows every scope with the wildcard", func(t *testing.T) {
+		c := Credential{Scopes: []string{AnyScope}, Operations: []Operation{OpRead}}
+
+		assertValue(t, c.Allows("anything", OpRead), true)
+	})
+}
+
+func TestContext(t *testing.T) {
+	t.Run("never allows a context without a credential", func(t *testing.T) {
+		assertValue(t, Allowed(context.Background(), "billing", OpEncrypt), false)
+	})
+	t.Run("checks the credential in the context", func(t *testing.T) {
+		ctx := NewContext(context.Background(), billing)
+
+		assertValue(t, Allowed(ctx, "billing", OpEncrypt), true)
+		assertValue(t, Allowed(ctx, "billing", OpRead), false)
+	})
+	t.Run("checks the operation whatever the scope", func(t *testing.T) {
+		ctx := NewContext(context.Background(), billing)
+
+		assertValue(t, AllowedOperation(ctx, OpEncrypt), true)
+		assertValue(t, AllowedOperation(ctx, OpRead), false)
+		assertValue(t, AllowedOperation(context.Background(), OpEncrypt), false)
+	})
+	t.Run("allows everything when the authentication is disabled", func(t *testing.T) {
+		c, _ := Disabled{}.Authenticate(request(nil))
+
+		for _, op := range Operations {
+			assertValue(t, c.Allows("any", op), true)
+		}
+	})
+}
+
+func TestAPIKeys(t *testing.T) {
+	a := NewAPIKeys(map[string]Credential{hash(apiKey): billing})
+
+	t.Run("returns the credential bound to the key", func(t *testing.T) {
+		c, err := a.Authenticate(request(map[string]string{APIKeyHeader: apiKey}))
+
+		assertValue(t, err, nil)
+		if !reflect.DeepEqual(c, billing) {
+			t.Errorf("want %v, got %v", billing, c)
+		}
+	})
+	t.Run("refuses unknown keys", func(t *testing.T) {
+		_, err := a.Authenticate(request(map[string]string{APIKeyHeader: "unknown"}))
+
+		assertValue(t, err, ErrInvalidCredentials)
+	})
+	t.Run("returns ErrNoCredentials without the header", func(t *testing.T) {
+		_, err := a.Authenticate(request(nil))
+
+		assertValue(t, err, ErrNoCredentials)
+	})
+}
+
+func TestBearerTokens(t *testing.T) {
+	a, _ := keyFile().Authenticator()
+
+	t.Run("returns the credential described by the token", func(t *testing.T) {
+		token := signToken(t, "hmac", hmacSecret, validClaims())
+
+		c, err := a.Authenticate(request(map[string]string{"Authorization": "Bearer " + token}))
+
+		assertValue(t, err, nil)
+		if !reflect.DeepEqual(c, billing) {
+			t.Errorf("want %v, got %v", billing, c)
+		}
+	})
+	t.Run("refuses invalid tokens", func(t *testing.T) {
+		expired := validClaims()
+		expired[jwt.ExpirationKey] = time.Now().Add(-time.Hour)
+		unbounded := validClaims()
+		delete(unbounded, jwt.ExpirationKey)
+		unknownOp := validClaims()
+		unknownOp[OperationsClaim] = []string{"destroy"}
+
+		tests := map[string]string{
+			"expired":          signToken(t, "hmac", hmacSecret, expired),
+			"without exp":      signToken(t, "hmac", hmacSecret, unbounded),
+			"unknown op":       signToken(t, "hmac", hmacSecret, unknownOp),
+			"unknown kid":      signToken(t, "other", hmacSecret, validClaims()),
+			"wrong secret":     signToken(t, "hmac", otherSecret, validClaims()),
+			"not even a token": "garbage",
+		}
+		for name, token := range tests {
+			_, err := a.Authenticate(request(map[string]string{"Authorization": "Bearer " + token}))
+
+			if err != ErrInvalidCredentials {
+				t.Errorf("%s: want %v, got %v", name, ErrInvalidCredentials, err)
+			}
+		}
+	})
+	t.Run("returns ErrNoCredentials without a bearer token", func(t *testing.T) {
+		_, err := a.Authenticate(request(map[string]string{"Authorization": "Basic abc"}))
+
+		assertValue(t, err, ErrNoCredentials)
+	})
+}
+
+func TestKeyFile(t *testing.T) {
+	t.Run("authenticates both API keys and bearer tokens", func(t *testing.T) {
+		a, err := keyFile().Authenticator()
+		assertValue(t, err, nil)
+
+		_, err = a.Authenticate(request(map[string]string{APIKeyHeader: apiKey}))
+		assertValue(t, err, nil)
+
+		token := signToken(t, "hmac", hmacSecret, validClaims())
+		_, err = a.Authenticate(request(map[string]string{"Authorization": "Bearer " + token}))
+		assertValue(t, err, nil)
+	})
+	t.Run("refuses invalid entries", func(t *testing.T) {
+		badHash := keyFile()
+		badHash.APIKeys[0].SHA256 = "abc"
+		badOp := keyFile()
+		badOp.APIKeys[0].Operations = []Operation{"destroy"}
+		badAlg := keyFile()
+		badAlg.HMACKeys[0].Alg = "RS256"
+		shortSecret := keyFile()
+		shortSecret.HMACKeys[0].Secret = base64.StdEncoding.EncodeToString([]byte("short"))
+
+		tests := map[string]struct {
+			kf   KeyFile
+			want error
+		}{
+			"bad hash":     {badHash, ErrInvalidKeyFile},
+			"bad op":       {badOp, ErrUnknownOperation},
+			"bad alg":      {badAlg, ErrInvalidKeyFile},
+			"short secret": {shortSecret, ErrInvalidKeyFile},
+		}
+		for name, tt := range tests {
+			_, err := tt.kf.Authenticator()
+
+			if err != tt.want {
+				t.Errorf("%s: want %v, got %v", name, tt.want, err)
+			}
+		}
+	})
+}
+
+func assertValue(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,80 @@
+package auth
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/lestrrat-go/jwx/jwk"
+	"github.com/lestrrat-go/jwx/jwt"
+)
+
+const (
+	// ScopesClaim token claim listing the scopes of the credential
+	ScopesClaim = "scopes"
+	// OperationsClaim token claim listing the operations of the credential
+	OperationsClaim = "ops"
+)
+
+// BearerTokens authenticates HMAC signed JWT bearer tokens, the kid header
+// picks the secret and the algorithm is the one bound to that secret. Tokens
+// must expire, the subject is the credential ID and the scopes and ops claims
+// bind it
+type BearerTokens struct {
+	secrets jwk.Set
+}
+
+// NewBearerTokens creates a BearerTokens authenticator from a set of
+// symmetric keys, each one with its kid and alg
+func NewBearerTokens(secrets jwk.Set) BearerTokens {
+	return BearerTokens{secrets: secrets}
+}
+
+// Authenticate checks the token in the Authorization header
+func (b BearerTokens) Authenticate(r *http.Request) (Credential, error) {
+	h := r.Header.Get("Authorization")
+	if !strings.HasPrefix(h, "Bearer ") {
+		return Credential{}, ErrNoCredentials
+	}
+
+	token, err := jwt.ParseString(
+		strings.TrimPrefix(h, "Bearer "),
+		jwt.WithKeySet(b.secrets),
+		jwt.WithValidate(true),
+		jwt.WithRequiredClaim(jwt.ExpirationKey),
+	)
+	if err != nil || token.Subject() == "" {
+		return Credential{}, ErrInvalidCredentials
+	}
+
+	c := Credential{
+		ID:     token.Subject(),
+		Scopes: stringsClaim(token, ScopesClaim),
+	}
+	for _, o := range stringsClaim(token, OperationsClaim) {
+		op := Operation(o)
+		if !op.Valid() {
+			return Credential{}, ErrInvalidCredentials
+		}
+		c.Operations = append(c.Operations, op)
+	}
+	return c, nil
+}
+
+func stringsClaim(token jwt.Token, name string) []string {
+	v, ok := token.Get(name)
+	if !ok {
+		return nil
+	}
+	values, ok := v.([]interface{})
+	if !ok {
+		return nil
+	}
+
+	var strs []string
+	for _, value := range values {
+		if s, ok := value.(string); ok {
+			strs = append(strs, s)
+		}
+	}
+	return strs
+}
@@ -0,0 +1,122 @@
+package auth
+
+import (
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+
+	"github.com/lestrrat-go/jwx/jwa"
+	"github.com/lestrrat-go/jwx/jwk"
+)
+
+var (
+	// ErrInvalidKeyFile the key file has an entry that can not be used
+	ErrInvalidKeyFile = errors.New("invalid auth key file")
+)
+
+// KeyFile local file holding the known API keys and the secrets used to
+// sign the bearer tokens
+//
+//	{
+//	  "apiKeys": [
+//	    {"id": "billing", "sha256": "<hex>", "scopes": ["billing"], "operations": ["encrypt", "decrypt"]}
+//	  ],
+//	  "hmacKeys": [
+//	    {"kid": "2021-01", "alg": "HS256", "secret": "<base64>"}
+//	  ]
+//	}
+type KeyFile struct {
+	APIKeys  []APIKeyEntry  `json:"apiKeys"`
+	HMACKeys []HMACKeyEntry `json:"hmacKeys"`
+}
+
+// APIKeyEntry a static API key and what it is bound to
+type APIKeyEntry struct {
+	ID         string      `json:"id"`
+	SHA256     string      `json:"sha256"`
+	Scopes     []string    `json:"scopes"`
+	Operations []Operation `json:"operations"`
+}
+
+// HMACKeyEntry a secret signing bearer tokens
+type HMACKeyEntry struct {
+	KID    string `json:"kid"`
+	Alg    string `json:"alg"`
+	Secret string `json:"secret"`
+}
+
+var hmacAlgorithms = map[string]jwa.SignatureAlgorithm{
+	"HS256": jwa.HS256,
+	"HS384": jwa.HS384,
+	"HS512": jwa.HS512,
+}
+
+// LoadKeyFile reads the key file and builds an authenticator checking the
+// API keys first and then the bearer tokens
+func LoadKeyFile(path string) (Authenticator, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var kf KeyFile
+	if err := json.Unmarshal(content, &kf); err != nil {
+		return nil, err
+	}
+	return kf.Authenticator()
+}
+
+// Authenticator builds the authenticator described by the key file
+func (kf KeyFile) Authenticator() (Authenticator, error) {
+	byHash := make(map[string]Credential, len(kf.APIKeys))
+	for _, e := range kf.APIKeys {
+		if e.ID == "" || len(e.Scopes) == 0 {
+			return nil, ErrInvalidKeyFile
+		}
+		hash, err := hex.DecodeString(e.SHA256)
+		if err != nil || len(hash) != 32 {
+			return nil, ErrInvalidKeyFile
+		}
+		for _, op := range e.Operations {
+			if !op.Valid() {
+				return nil, ErrUnknownOperation
+			}
+		}
+		byHash[hex.EncodeToString(hash)] = Credential{
+			ID:         e.ID,
+			Scopes:     e.Scopes,
+			Operations: e.Operations,
+		}
+	}
+
+	secrets := jwk.NewSet()
+	for _, e := range kf.HMACKeys {
+		alg, ok := hmacAlgorithms[e.Alg]
+		if !ok || e.KID == "" {
+			return nil, ErrInvalidKeyFile
+		}
+		secret, err := base64.StdEncoding.DecodeString(e.Secret)
+		if err != nil || len(secret) < 32 {
+			return nil, ErrInvalidKeyFile
+		}
+
+		key, err := jwk.New(secret)
+		if err != nil {
+			return nil, err
+		}
+		key.Set(jwk.KeyIDKey, e.KID)
+		key.Set(jwk.AlgorithmKey, alg)
+		secrets.Add(key)
+	}
+
+	var chain Chain
+	if len(byHash) > 0 {
+		chain = append(chain, NewAPIKeys(byHash))
+	}
+	if secrets.Len() > 0 {
+		chain = append(chain, NewBearerTokens(secrets))
+	}
+	return chain, nil
+}
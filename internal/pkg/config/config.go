@@ -1,6 +1,8 @@
 package config
 
 import (
+	"time"
+
 	"github.com/kelseyhightower/envconfig"
 )
 
@@ -17,7 +19,11 @@ func LoadConfigs() (Config, error) {
 // Config set of configurations needed to run the app
 type Config struct {
 	Server struct {
-		Port string `envconfig:"SERVER_PORT"`
+		Port           string        `envconfig:"SERVER_PORT"`
+		MetricsPort    string        `envconfig:"SERVER_METRICS_PORT" default:"9090"`
+		RequestTimeout time.Duration `envconfig:"SERVER_REQUEST_TIMEOUT" default:"30s"`
+		StreamTimeout  time.Duration `envconfig:"SERVER_STREAM_TIMEOUT" default:"1h"`
+		DrainPeriod    time.Duration `envconfig:"SERVER_DRAIN_PERIOD" default:"5s"`
 	}
 	Db struct {
 		Host         string `envconfig:"DB_HOST"`
@@ -30,8 +36,32 @@ type Config struct {
 	}
 	App struct {
 		KeySource struct {
-			PoolSize   int `envconfig:"APP_KEYSOURCE_POOL_SIZE"`
-			RSAKeySize int `envconfig:"APP_KEYSOURCE_RSAKEY_SIZE"`
+			PoolSize         int      `envconfig:"APP_KEYSOURCE_POOL_SIZE"`
+			PoolLowWatermark int      `envconfig:"APP_KEYSOURCE_POOL_LOW_WATERMARK"`
+			PoolWorkers      int      `envconfig:"APP_KEYSOURCE_POOL_WORKERS" default:"2"`
+			PoolTypes        []string `envconfig:"APP_KEYSOURCE_POOL_TYPES" default:"RSA-2048,P-256,P-384,Ed25519,X25519"`
+			Fallback         string   `envconfig:"APP_KEYSOURCE_FALLBACK" default:"synchronous"`
+		}
+		Keys struct {
+			DeletionWaitingPeriod time.Duration `envconfig:"APP_KEYS_DELETION_WAITING_PERIOD" default:"720h"`
+			DestructionInterval   time.Duration `envconfig:"APP_KEYS_DESTRUCTION_INTERVAL" default:"1h"`
+		}
+		Crypto struct {
+			DecryptGracePeriod time.Duration `envconfig:"APP_CRYPTO_DECRYPT_GRACE_PERIOD"`
+		}
+		Storage struct {
+			Backend      string `envconfig:"APP_STORAGE_BACKEND" default:"postgres"`
+			SnapshotFile string `envconfig:"APP_STORAGE_SNAPSHOT_FILE"`
+			BoltFile     string `envconfig:"APP_STORAGE_BOLT_FILE" default:"gocrypto.db"`
+		}
+		Auth struct {
+			KeyFile  string `envconfig:"APP_AUTH_KEY_FILE"`
+			Disabled bool   `envconfig:"APP_AUTH_DISABLED"`
+		}
+		KEK struct {
+			ActiveID      string            `envconfig:"APP_KEK_ACTIVE_ID"`
+			Keys          map[string]string `envconfig:"APP_KEK_KEYS"`
+			RewrapOnStart bool              `envconfig:"APP_KEK_REWRAP_ON_START"`
 		}
 	}
 }
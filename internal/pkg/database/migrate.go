@@ -1,54 +1,295 @@
 package database
 
 import (
+	"context"
 	"database/sql"
 	"embed"
+	"errors"
+	"fmt"
 	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 //go:embed migrations
 var mFS embed.FS
 
-// MigrateUp runs the migrations to setup the db
+var (
+	// ErrInvalidMigrationName a migration file is not named <version>_<name>.(up|down).sql
+	ErrInvalidMigrationName = errors.New("invalid migration file name")
+	// ErrMissingMigration a migration lacks its up or down file
+	ErrMissingMigration = errors.New("migration is missing its up or down file")
+	// ErrUnknownVersion the target version is not one of the migrations
+	ErrUnknownVersion = errors.New("unknown migration version")
+)
+
+// migrationsLockID postgres advisory lock held while migrating, so replicas
+// booting at the same time run the migrations one after the other
+const migrationsLockID = 7453010365649810543
+
+var createMigrationsTableStatement = `
+	CREATE TABLE IF NOT EXISTS schema_migrations (
+		version BIGINT PRIMARY KEY,
+		name TEXT NOT NULL,
+		applied_at TIMESTAMPTZ NOT NULL
+	)`
+
+var findAppliedMigrationsStatement = `
+	SELECT version, applied_at
+		FROM schema_migrations`
+
+var insertMigrationStatement = `
+	INSERT INTO schema_migrations (version, name, applied_at)
+		VALUES ($1, $2, $3)`
+
+var deleteMigrationStatement = `
+	DELETE FROM schema_migrations
+		WHERE version = $1`
+
+// Migration a versioned schema change and the way back
+type Migration struct {
+	Version int
+	Name    string
+	Up      string
+	Down    string
+}
+
+// MigrationStatus a migration and when it was applied, zero if it was not
+type MigrationStatus struct {
+	Migration
+	AppliedAt time.Time
+}
+
+// Applied checks if the migration was applied
+func (s MigrationStatus) Applied() bool {
+	return !s.AppliedAt.IsZero()
+}
+
+// MigrateUp applies, in ascending order, every migration not applied yet
 func MigrateUp(db *sql.DB) error {
-	upFilePaths, err := fs.Glob(mFS, "migrations/*.up.sql")
+	ms, err := loadMigrations(mFS)
+	if err != nil {
+		return err
+	}
+	return withMigrationsLock(db, func(conn *sql.Conn) error {
+		return migrateUp(conn, ms)
+	})
+}
+
+// MigrateDown rolls back every applied migration
+func MigrateDown(db *sql.DB) error {
+	return MigrateDownTo(db, 0)
+}
+
+// MigrateDownTo rolls back, in descending order, every applied migration
+// newer than the target version, zero rolls back all of them
+func MigrateDownTo(db *sql.DB, target int) error {
+	ms, err := loadMigrations(mFS)
 	if err != nil {
 		return err
 	}
+	if target != 0 && !hasVersion(ms, target) {
+		return ErrUnknownVersion
+	}
+	return withMigrationsLock(db, func(conn *sql.Conn) error {
+		return migrateDown(conn, ms, target)
+	})
+}
 
-	for _, fp := range upFilePaths {
-		m, err := fs.ReadFile(mFS, fp)
+// MigrationsStatus lists every migration and when it was applied
+func MigrationsStatus(db *sql.DB) ([]MigrationStatus, error) {
+	ms, err := loadMigrations(mFS)
+	if err != nil {
+		return nil, err
+	}
+
+	var status []MigrationStatus
+	err = withMigrationsLock(db, func(conn *sql.Conn) error {
+		applied, err := appliedMigrations(conn)
 		if err != nil {
 			return err
 		}
+		for _, m := range ms {
+			status = append(status, MigrationStatus{Migration: m, AppliedAt: applied[m.Version]})
+		}
+		return nil
+	})
+	return status, err
+}
+
+// withMigrationsLock session advisory locks belong to a connection, so
+// everything runs on a single one taken from the pool
+func withMigrationsLock(db *sql.DB, fn func(*sql.Conn) error) error {
+	ctx := context.Background()
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if _, err := conn.ExecContext(ctx, "SELECT pg_advisory_lock($1)", migrationsLockID); err != nil {
+		return err
+	}
+	defer conn.ExecContext(ctx, "SELECT pg_advisory_unlock($1)", migrationsLockID)
 
-		_, err = db.Exec(string(m) + ";")
+	if _, err := conn.ExecContext(ctx, createMigrationsTableStatement); err != nil {
+		return err
+	}
+	return fn(conn)
+}
+
+func migrateUp(conn *sql.Conn, ms []Migration) error {
+	applied, err := appliedMigrations(conn)
+	if err != nil {
+		return err
+	}
+
+	for _, m := range ms {
+		if _, ok := applied[m.Version]; ok {
+			continue
+		}
+		err := inTransaction(conn, m.Up, insertMigrationStatement, m.Version, m.Name, time.Now())
 		if err != nil {
-			return err
+			return fmt.Errorf("migration %06d_%s: %w", m.Version, m.Name, err)
 		}
 	}
-
 	return nil
 }
 
-// MigrateDown runs the migrations to teardown the db
-func MigrateDown(db *sql.DB) error {
-	downFilePaths, err := fs.Glob(mFS, "migrations/*.down.sql")
+func migrateDown(conn *sql.Conn, ms []Migration, target int) error {
+	applied, err := appliedMigrations(conn)
 	if err != nil {
 		return err
 	}
 
-	for _, fp := range downFilePaths {
-		m, err := fs.ReadFile(mFS, fp)
+	for i := len(ms) - 1; i >= 0; i-- {
+		m := ms[i]
+		if m.Version <= target {
+			break
+		}
+		if _, ok := applied[m.Version]; !ok {
+			continue
+		}
+		err := inTransaction(conn, m.Down, deleteMigrationStatement, m.Version)
 		if err != nil {
-			return err
+			return fmt.Errorf("rollback %06d_%s: %w", m.Version, m.Name, err)
+		}
+	}
+	return nil
+}
+
+// inTransaction runs the migration script and records it in the tracking
+// table atomically
+func inTransaction(conn *sql.Conn, script string, record string, args ...interface{}) error {
+	ctx := context.Background()
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, script); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, record, args...); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+func appliedMigrations(conn *sql.Conn) (map[int]time.Time, error) {
+	rows, err := conn.QueryContext(context.Background(), findAppliedMigrationsStatement)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	applied := map[int]time.Time{}
+	for rows.Next() {
+		var (
+			version   int
+			appliedAt time.Time
+		)
+		if err := rows.Scan(&version, &appliedAt); err != nil {
+			return nil, err
 		}
+		applied[version] = appliedAt
+	}
+	return applied, rows.Err()
+}
 
-		_, err = db.Exec(string(m) + ";")
+// loadMigrations reads the migration files sorted by version
+func loadMigrations(fsys fs.FS) ([]Migration, error) {
+	paths, err := fs.Glob(fsys, "migrations/*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := map[int]*Migration{}
+	for _, p := range paths {
+		version, name, direction, err := parseMigrationName(path.Base(p))
 		if err != nil {
-			return err
+			return nil, err
+		}
+		content, err := fs.ReadFile(fsys, p)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &Migration{Version: version, Name: name}
+			byVersion[version] = m
+		}
+		if m.Name != name {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidMigrationName, p)
+		}
+		if direction == "up" {
+			m.Up = string(content)
+		} else {
+			m.Down = string(content)
 		}
 	}
 
-	return nil
+	ms := make([]Migration, 0, len(byVersion))
+	for _, m := range byVersion {
+		if m.Up == "" || m.Down == "" {
+			return nil, fmt.Errorf("%w: %06d_%s", ErrMissingMigration, m.Version, m.Name)
+		}
+		ms = append(ms, *m)
+	}
+	sort.Slice(ms, func(i, j int) bool { return ms[i].Version < ms[j].Version })
+	return ms, nil
+}
+
+func parseMigrationName(file string) (int, string, string, error) {
+	parts := strings.SplitN(strings.TrimSuffix(file, ".sql"), "_", 2)
+	if len(parts) != 2 {
+		return 0, "", "", fmt.Errorf("%w: %s", ErrInvalidMigrationName, file)
+	}
+
+	version, err := strconv.Atoi(parts[0])
+	if err != nil || version <= 0 {
+		return 0, "", "", fmt.Errorf("%w: %s", ErrInvalidMigrationName, file)
+	}
+
+	ext := path.Ext(parts[1])
+	direction := strings.TrimPrefix(ext, ".")
+	if direction != "up" && direction != "down" {
+		return 0, "", "", fmt.Errorf("%w: %s", ErrInvalidMigrationName, file)
+	}
+	return version, strings.TrimSuffix(parts[1], ext), direction, nil
+}
+
+func hasVersion(ms []Migration, version int) bool {
+	for _, m := range ms {
+		if m.Version == version {
+			return true
+		}
+	}
+	return false
 }
@@ -0,0 +1,217 @@
+package database
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	"github.com/DATA-DOG/go-sqlmock"
+)
+
+var testMigrations = fstest.MapFS{
+	"migrations/000002_second.up.sql":   {Data: []byte("CREATE TABLE second")},
+	"migrations/000002_second.down.sql": {Data: []byte("DROP TABLE second")},
+	"migrations/000001_first.up.sql":    {Data: []byte("CREATE TABLE first")},
+	"migrations/000001_first.down.sql":  {Data: []byte("DROP TABLE first")},
+	"migrations/000003_third.up.sql":    {Data: []byte("CREATE TABLE third")},
+	"migrations/000003_third.down.sql":  {Data: []byte("DROP TABLE third")},
+}
+
+type anyTime struct{}
+
+func (a anyTime) Match(v driver.Value) bool {
+	_, ok := v.(time.Time)
+	return ok
+}
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("sorts the migrations by version", func(t *testing.T) {
+		ms, err := loadMigrations(testMigrations)
+
+		assertValue(t, err, nil)
+		assertValue(t, len(ms), 3)
+		for i, name := range []string{"first", "second", "third"} {
+			assertValue(t, ms[i].Version, i+1)
+			assertValue(t, ms[i].Name, name)
+		}
+		assertValue(t, ms[1].Up, "CREATE TABLE second")
+		assertValue(t, ms[1].Down, "DROP TABLE second")
+	})
+	t.Run("refuses migrations without a down file", func(t *testing.T) {
+		fsys := fstest.MapFS{
+			"migrations/000001_first.up.sql": {Data: []byte("CREATE TABLE first")},
+		}
+
+		_, err := loadMigrations(fsys)
+
+		if !errors.Is(err, ErrMissingMigration) {
+			t.Errorf("want %v, got %v", ErrMissingMigration, err)
+		}
+	})
+	t.Run("refuses badly named files", func(t *testing.T) {
+		for _, name := range []string{"first.up.sql", "000001_first.sql", "abc_first.up.sql"} {
+			fsys := fstest.MapFS{"migrations/" + name: {Data: []byte("SELECT 1")}}
+
+			_, err := loadMigrations(fsys)
+
+			if !errors.Is(err, ErrInvalidMigrationName) {
+				t.Errorf("%s: want %v, got %v", name, ErrInvalidMigrationName, err)
+			}
+		}
+	})
+	t.Run("embeds a complete sequence of migrations", func(t *testing.T) {
+		ms, err := loadMigrations(mFS)
+
+		assertValue(t, err, nil)
+		for i, m := range ms {
+			assertValue(t, m.Version, i+1)
+		}
+	})
+}
+
+func TestKeyTypeBackfill(t *testing.T) {
+	ms, _ := loadMigrations(mFS)
+	backfill := ms[7].Up
+
+	for _, bits := range []int{2048, 3072, 4096} {
+		priv, _ := rsa.GenerateKey(rand.Reader, bits)
+		pkix, _ := x509.MarshalPKIXPublicKey(&priv.PublicKey)
+		pkcs1 := x509.MarshalPKCS1PublicKey(&priv.PublicKey)
+
+		for _, pub := range [][]byte{pkix, pkcs1} {
+			when := fmt.Sprintf("WHEN octet_length(pub) = %d THEN 'RSA-%d'", len(pub), bits)
+			if !strings.Contains(backfill, when) {
+				t.Errorf("want the backfill to have %q", when)
+			}
+		}
+	}
+}
+
+func expectLock(mock sqlmock.Sqlmock, applied ...int) {
+	mock.ExpectExec(`SELECT pg_advisory_lock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+	mock.ExpectExec("CREATE TABLE IF NOT EXISTS schema_migrations").
+		WillReturnResult(sqlmock.NewResult(0, 0))
+
+	rows := sqlmock.NewRows([]string{"version", "applied_at"})
+	for _, v := range applied {
+		rows.AddRow(v, time.Now())
+	}
+	mock.ExpectQuery("SELECT version, applied_at").WillReturnRows(rows)
+}
+
+func expectUnlock(mock sqlmock.Sqlmock) {
+	mock.ExpectExec(`SELECT pg_advisory_unlock\(\$1\)`).
+		WithArgs(migrationsLockID).
+		WillReturnResult(sqlmock.NewResult(0, 0))
+}
+
+func TestMigrateUp(t *testing.T) {
+	ms, _ := loadMigrations(testMigrations)
+
+	t.Run("applies the pending migrations in order, each in its own transaction", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+
+		expectLock(mock, 1)
+		for _, m := range ms[1:] {
+			mock.ExpectBegin()
+			mock.ExpectExec(m.Up).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("INSERT INTO schema_migrations").
+				WithArgs(m.Version, m.Name, anyTime{}).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+		expectUnlock(mock)
+
+		err := withMigrationsLock(db, func(conn *sql.Conn) error { return migrateUp(conn, ms) })
+
+		assertValue(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+	t.Run("rolls back the failing migration and stops", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+		want := errors.New("syntax error")
+
+		expectLock(mock, 1)
+		mock.ExpectBegin()
+		mock.ExpectExec(ms[1].Up).WillReturnError(want)
+		mock.ExpectRollback()
+		expectUnlock(mock)
+
+		err := withMigrationsLock(db, func(conn *sql.Conn) error { return migrateUp(conn, ms) })
+
+		if !errors.Is(err, want) {
+			t.Errorf("want %v, got %v", want, err)
+		}
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+}
+
+func TestMigrateDown(t *testing.T) {
+	ms, _ := loadMigrations(testMigrations)
+
+	t.Run("rolls back the migrations newer than the target in reverse order", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+
+		expectLock(mock, 1, 2, 3)
+		for _, m := range []Migration{ms[2], ms[1]} {
+			mock.ExpectBegin()
+			mock.ExpectExec(m.Down).WillReturnResult(sqlmock.NewResult(0, 0))
+			mock.ExpectExec("DELETE FROM schema_migrations").
+				WithArgs(m.Version).
+				WillReturnResult(sqlmock.NewResult(0, 1))
+			mock.ExpectCommit()
+		}
+		expectUnlock(mock)
+
+		err := withMigrationsLock(db, func(conn *sql.Conn) error { return migrateDown(conn, ms, 1) })
+
+		assertValue(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+	t.Run("skips the migrations that were not applied", func(t *testing.T) {
+		db, mock, _ := sqlmock.New()
+		defer db.Close()
+
+		expectLock(mock, 1)
+		mock.ExpectBegin()
+		mock.ExpectExec(ms[0].Down).WillReturnResult(sqlmock.NewResult(0, 0))
+		mock.ExpectExec("DELETE FROM schema_migrations").
+			WithArgs(1).
+			WillReturnResult(sqlmock.NewResult(0, 1))
+		mock.ExpectCommit()
+		expectUnlock(mock)
+
+		err := withMigrationsLock(db, func(conn *sql.Conn) error { return migrateDown(conn, ms, 0) })
+
+		assertValue(t, err, nil)
+		if err := mock.ExpectationsWereMet(); err != nil {
+			t.Errorf("SQL expectations failed: %s", err)
+		}
+	})
+}
+
+func assertValue(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
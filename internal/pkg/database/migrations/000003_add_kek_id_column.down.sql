@@ -0,0 +1 @@
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS kek_id
\ No newline at end of file
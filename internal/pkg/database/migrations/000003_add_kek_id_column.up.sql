@@ -0,0 +1 @@
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS kek_id VARCHAR(50)
\ No newline at end of file
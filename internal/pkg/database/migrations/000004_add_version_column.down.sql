@@ -0,0 +1,8 @@
+DO $$ BEGIN
+  IF to_regclass('keys') IS NOT NULL THEN
+    DELETE FROM keys WHERE version > 1;
+  END IF;
+END $$;
+ALTER TABLE IF EXISTS keys DROP CONSTRAINT IF EXISTS keys_pkey;
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS version;
+ALTER TABLE IF EXISTS keys ADD CONSTRAINT keys_pkey PRIMARY KEY (id)
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS version INTEGER NOT NULL DEFAULT 1;
+ALTER TABLE keys DROP CONSTRAINT IF EXISTS keys_pkey;
+ALTER TABLE keys ADD CONSTRAINT keys_pkey PRIMARY KEY (id, version)
\ No newline at end of file
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS state_deletion_idx;
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS deletion_date;
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS state
\ No newline at end of file
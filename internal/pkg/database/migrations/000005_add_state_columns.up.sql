@@ -0,0 +1,3 @@
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS state VARCHAR(20) NOT NULL DEFAULT 'active';
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS deletion_date TIMESTAMP;
+CREATE INDEX IF NOT EXISTS state_deletion_idx ON keys(state, deletion_date)
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS key_use
\ No newline at end of file
@@ -0,0 +1 @@
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS key_use VARCHAR(3) NOT NULL DEFAULT 'enc'
\ No newline at end of file
@@ -0,0 +1,3 @@
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS compression;
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS content_algorithms;
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS key_algorithms
\ No newline at end of file
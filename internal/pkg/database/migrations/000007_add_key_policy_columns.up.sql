@@ -0,0 +1,3 @@
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS key_algorithms TEXT;
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS content_algorithms TEXT;
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS compression BOOLEAN NOT NULL DEFAULT FALSE
\ No newline at end of file
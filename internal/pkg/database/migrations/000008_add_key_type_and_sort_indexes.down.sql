@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS scope_expiration_idx;
+DROP INDEX IF EXISTS scope_creation_idx;
+ALTER TABLE IF EXISTS keys DROP COLUMN IF EXISTS key_type
\ No newline at end of file
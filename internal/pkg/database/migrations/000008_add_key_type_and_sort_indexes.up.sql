@@ -0,0 +1,18 @@
+ALTER TABLE keys ADD COLUMN IF NOT EXISTS key_type VARCHAR(20);
+-- the type of the PKIX public keys follows from their length, Ed25519 and X25519 ones differ by the curve OID,
+-- the RSA keys stored before the key types are PKCS #1 ones, shorter than their PKIX counterparts
+UPDATE keys SET key_type = CASE
+    WHEN octet_length(pub) = 294 THEN 'RSA-2048'
+    WHEN octet_length(pub) = 422 THEN 'RSA-3072'
+    WHEN octet_length(pub) = 550 THEN 'RSA-4096'
+    WHEN octet_length(pub) = 270 THEN 'RSA-2048'
+    WHEN octet_length(pub) = 398 THEN 'RSA-3072'
+    WHEN octet_length(pub) = 526 THEN 'RSA-4096'
+    WHEN octet_length(pub) = 91 THEN 'P-256'
+    WHEN octet_length(pub) = 120 THEN 'P-384'
+    WHEN octet_length(pub) = 44 AND get_byte(pub, 8) = 112 THEN 'Ed25519'
+    WHEN octet_length(pub) = 44 AND get_byte(pub, 8) = 110 THEN 'X25519'
+  END
+  WHERE key_type IS NULL;
+CREATE INDEX IF NOT EXISTS scope_creation_idx ON keys(scope, creation, id);
+CREATE INDEX IF NOT EXISTS scope_expiration_idx ON keys(scope, expiration, id)
\ No newline at end of file
@@ -34,6 +34,5 @@ func NewPGDatabase(cfg PGConfigs) (*sql.DB, error) {
 
 	db.SetMaxOpenConns(cfg.MaxOpenConns)
 
-	fmt.Println("Connected to SQLKeyRepository")
 	return db, nil
 }
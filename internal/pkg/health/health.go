@@ -0,0 +1,122 @@
+// Package health keeps track of whether the service is ready to take traffic
+package health
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Status of a dependency in the readiness report
+const (
+	StatusOK       = "ok"
+	StatusPending  = "pending"
+	StatusFailing  = "failing"
+	StatusDraining = "draining"
+)
+
+// shutdown name of the dependency reported while draining
+const shutdown = "shutdown"
+
+// probeTimeout most time a probe is given before it is reported failing
+const probeTimeout = 2 * time.Second
+
+// Probe checks a dependency the service needs all along, like the database
+type Probe func(context.Context) error
+
+// Report readiness of the service and the status of each dependency
+type Report struct {
+	Ready        bool
+	Dependencies map[string]string
+}
+
+type namedProbe struct {
+	name  string
+	probe Probe
+}
+
+// Readiness the service is ready once every startup step is done, as long as
+// every probe passes and it is not draining for a shutdown
+type Readiness struct {
+	mu       sync.RWMutex
+	steps    map[string]bool
+	probes   []namedProbe
+	draining bool
+}
+
+// NewReadiness creates a Readiness without steps nor probes, ready until
+// they are added
+func NewReadiness() *Readiness {
+	return &Readiness{steps: map[string]bool{}}
+}
+
+// Await adds a startup step, the service is not ready until the returned
+// func is called
+func (r *Readiness) Await(name string) func() {
+	r.mu.Lock()
+	r.steps[name] = false
+	r.mu.Unlock()
+
+	return func() {
+		r.mu.Lock()
+		r.steps[name] = true
+		r.mu.Unlock()
+	}
+}
+
+// Probe adds a dependency checked on every readiness check
+func (r *Readiness) Probe(name string, p Probe) {
+	r.mu.Lock()
+	r.probes = append(r.probes, namedProbe{name, p})
+	r.mu.Unlock()
+}
+
+// Drain reports the service as not ready from now on, so the load balancers
+// stop sending traffic before the server is shut down
+func (r *Readiness) Drain() {
+	r.mu.Lock()
+	r.draining = true
+	r.mu.Unlock()
+}
+
+// Check reports the status of every step and probe, the probes are checked
+// concurrently within probeTimeout
+func (r *Readiness) Check(ctx context.Context) Report {
+	r.mu.RLock()
+	report := Report{Ready: !r.draining, Dependencies: make(map[string]string, len(r.steps)+len(r.probes)+1)}
+	for name, done := range r.steps {
+		report.Dependencies[name] = StatusOK
+		if !done {
+			report.Dependencies[name] = StatusPending
+			report.Ready = false
+		}
+	}
+	if r.draining {
+		report.Dependencies[shutdown] = StatusDraining
+	}
+	probes := r.probes
+	r.mu.RUnlock()
+
+	ctx, cancel := context.WithTimeout(ctx, probeTimeout)
+	defer cancel()
+
+	errs := make([]error, len(probes))
+	var wg sync.WaitGroup
+	for i, p := range probes {
+		wg.Add(1)
+		go func(i int, p Probe) {
+			defer wg.Done()
+			errs[i] = p(ctx)
+		}(i, p.probe)
+	}
+	wg.Wait()
+
+	for i, p := range probes {
+		report.Dependencies[p.name] = StatusOK
+		if errs[i] != nil {
+			report.Dependencies[p.name] = StatusFailing
+			report.Ready = false
+		}
+	}
+	return report
+}
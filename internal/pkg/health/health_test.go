@@ -0,0 +1,84 @@
+package health
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+var ctx = context.Background()
+
+func TestReadiness(t *testing.T) {
+	t.Run("is ready without steps nor probes", func(t *testing.T) {
+		r := NewReadiness()
+
+		report := r.Check(ctx)
+
+		assertValue(t, report.Ready, true)
+		assertValue(t, len(report.Dependencies), 0)
+	})
+	t.Run("is not ready until every step is done", func(t *testing.T) {
+		r := NewReadiness()
+		migrated := r.Await("migrations")
+		warmedUp := r.Await("keyPool")
+
+		migrated()
+		report := r.Check(ctx)
+
+		assertValue(t, report.Ready, false)
+		assertValue(t, report.Dependencies["migrations"], StatusOK)
+		assertValue(t, report.Dependencies["keyPool"], StatusPending)
+
+		warmedUp()
+		report = r.Check(ctx)
+
+		assertValue(t, report.Ready, true)
+		assertValue(t, report.Dependencies["keyPool"], StatusOK)
+	})
+	t.Run("is not ready while a probe fails", func(t *testing.T) {
+		r := NewReadiness()
+		var err error
+		r.Probe("database", func(context.Context) error { return err })
+
+		assertValue(t, r.Check(ctx).Ready, true)
+
+		err = errors.New("connection refused")
+		report := r.Check(ctx)
+
+		assertValue(t, report.Ready, false)
+		assertValue(t, report.Dependencies["database"], StatusFailing)
+	})
+	t.Run("gives up on the probes that do not answer in time", func(t *testing.T) {
+		r := NewReadiness()
+		r.Probe("database", func(ctx context.Context) error {
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		deadline, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+		defer cancel()
+
+		report := r.Check(deadline)
+
+		assertValue(t, report.Ready, false)
+		assertValue(t, report.Dependencies["database"], StatusFailing)
+	})
+	t.Run("is not ready once draining", func(t *testing.T) {
+		r := NewReadiness()
+		r.Await("migrations")()
+
+		r.Drain()
+		report := r.Check(ctx)
+
+		assertValue(t, report.Ready, false)
+		assertValue(t, report.Dependencies["migrations"], StatusOK)
+		assertValue(t, report.Dependencies["shutdown"], StatusDraining)
+	})
+}
+
+func assertValue(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
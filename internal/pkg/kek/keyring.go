@@ -0,0 +1,86 @@
+package kek
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"errors"
+	"io"
+)
+
+var (
+	// ErrUnknownKEK the requested key-encryption key is not in the keyring
+	ErrUnknownKEK = errors.New("unknown key-encryption key")
+	// ErrInvalidKEK the key-encryption key is not a valid AES-256 key
+	ErrInvalidKEK = errors.New("key-encryption keys must have 32 bytes")
+	// ErrMalformedWrappedKey the wrapped content is too short to be unwrapped
+	ErrMalformedWrappedKey = errors.New("malformed wrapped key")
+)
+
+// Keyring holds the key-encryption keys (KEK) by ID, new content is always
+// wrapped with the active one while any of them can unwrap
+type Keyring struct {
+	activeID string
+	aeads    map[string]cipher.AEAD
+}
+
+// NewKeyring creates a Keyring from raw AES-256 keys indexed by their IDs
+func NewKeyring(activeID string, keks map[string][]byte) (Keyring, error) {
+	aeads := make(map[string]cipher.AEAD, len(keks))
+	for id, k := range keks {
+		if len(k) != 32 {
+			return Keyring{}, ErrInvalidKEK
+		}
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return Keyring{}, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return Keyring{}, err
+		}
+		aeads[id] = aead
+	}
+
+	if _, ok := aeads[activeID]; !ok {
+		return Keyring{}, ErrUnknownKEK
+	}
+
+	return Keyring{
+		activeID: activeID,
+		aeads:    aeads,
+	}, nil
+}
+
+// ActiveID returns the ID of the KEK used to wrap new content
+func (k Keyring) ActiveID() string {
+	return k.activeID
+}
+
+// Wrap encrypts the content with the active KEK binding it to the additional
+// data, returns the ID of the KEK used and the nonce prefixed ciphertext
+func (k Keyring) Wrap(plain []byte, ad []byte) (string, []byte, error) {
+	aead := k.aeads[k.activeID]
+
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", nil, err
+	}
+
+	return k.activeID, aead.Seal(nonce, nonce, plain, ad), nil
+}
+
+// Unwrap decrypts content wrapped by the KEK with the given ID
+func (k Keyring) Unwrap(kekID string, wrapped []byte, ad []byte) ([]byte, error) {
+	aead, ok := k.aeads[kekID]
+	if !ok {
+		return nil, ErrUnknownKEK
+	}
+
+	if len(wrapped) < aead.NonceSize() {
+		return nil, ErrMalformedWrappedKey
+	}
+
+	nonce, ciphertext := wrapped[:aead.NonceSize()], wrapped[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, ad)
+}
@@ -0,0 +1,75 @@
+package kek
+
+import (
+	"bytes"
+	"testing"
+)
+
+var (
+	oldKEK = bytes.Repeat([]byte{1}, 32)
+	newKEK = bytes.Repeat([]byte{2}, 32)
+)
+
+func TestNewKeyring(t *testing.T) {
+	t.Run("returns an error if the active KEK is not in the keyring", func(t *testing.T) {
+		_, err := NewKeyring("missing", map[string][]byte{"old": oldKEK})
+
+		assertValue(t, err, ErrUnknownKEK)
+	})
+	t.Run("returns an error if a KEK is not 32 bytes long", func(t *testing.T) {
+		_, err := NewKeyring("old", map[string][]byte{"old": []byte("short")})
+
+		assertValue(t, err, ErrInvalidKEK)
+	})
+}
+
+func TestWrap(t *testing.T) {
+	kr, _ := NewKeyring("old", map[string][]byte{"old": oldKEK, "new": newKEK})
+
+	t.Run("wraps with the active KEK", func(t *testing.T) {
+		kekID, wrapped, _ := kr.Wrap([]byte("secret"), []byte("id"))
+
+		assertValue(t, kekID, "old")
+		if bytes.Contains(wrapped, []byte("secret")) {
+			t.Errorf("wrapped content should not contain the plain content")
+		}
+	})
+	t.Run("unwraps back to the plain content", func(t *testing.T) {
+		kekID, wrapped, _ := kr.Wrap([]byte("secret"), []byte("id"))
+
+		got, err := kr.Unwrap(kekID, wrapped, []byte("id"))
+
+		assertValue(t, err, nil)
+		assertValue(t, string(got), "secret")
+	})
+	t.Run("fails to unwrap with other additional data", func(t *testing.T) {
+		kekID, wrapped, _ := kr.Wrap([]byte("secret"), []byte("id"))
+
+		_, err := kr.Unwrap(kekID, wrapped, []byte("other id"))
+
+		if err == nil {
+			t.Errorf("was expecting an error and didn't received")
+		}
+	})
+	t.Run("unwraps content of a rotated KEK", func(t *testing.T) {
+		_, wrapped, _ := kr.Wrap([]byte("secret"), []byte("id"))
+		rotated, _ := NewKeyring("new", map[string][]byte{"old": oldKEK, "new": newKEK})
+
+		got, err := rotated.Unwrap("old", wrapped, []byte("id"))
+
+		assertValue(t, err, nil)
+		assertValue(t, string(got), "secret")
+	})
+	t.Run("returns an error for an unknown KEK", func(t *testing.T) {
+		_, err := kr.Unwrap("unknown", []byte{}, nil)
+
+		assertValue(t, err, ErrUnknownKEK)
+	})
+}
+
+func assertValue(t *testing.T, got, want interface{}) {
+	t.Helper()
+	if got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,100 @@
+package keycodec
+
+import (
+	"crypto"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"errors"
+
+	"github.com/lestrrat-go/jwx/x25519"
+)
+
+// ErrUnsupportedKey the key is not of a supported type or encoding
+var ErrUnsupportedKey = errors.New("unsupported key")
+
+// oidX25519 RFC 8410 algorithm identifier, the standard library only
+// handles its own X25519 types so these keys are encoded here
+var oidX25519 = asn1.ObjectIdentifier{1, 3, 101, 110}
+
+type pkcs8 struct {
+	Version    int
+	Algo       pkix.AlgorithmIdentifier
+	PrivateKey []byte
+}
+
+type publicKeyInfo struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+// MarshalPrivateKey encodes a private key in the PKCS #8 DER format
+func MarshalPrivateKey(priv crypto.PrivateKey) ([]byte, error) {
+	k, ok := priv.(x25519.PrivateKey)
+	if !ok {
+		return x509.MarshalPKCS8PrivateKey(priv)
+	}
+
+	seed, err := asn1.Marshal(k.Seed())
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(pkcs8{
+		Algo:       pkix.AlgorithmIdentifier{Algorithm: oidX25519},
+		PrivateKey: seed,
+	})
+}
+
+// ParsePrivateKey decodes a PKCS #8 DER private key, keys stored before the
+// key types were introduced are RSA keys in the PKCS #1 format
+func ParsePrivateKey(der []byte) (crypto.PrivateKey, error) {
+	var p pkcs8
+	if rest, err := asn1.Unmarshal(der, &p); err == nil && len(rest) == 0 && p.Algo.Algorithm.Equal(oidX25519) {
+		var seed []byte
+		if _, err := asn1.Unmarshal(p.PrivateKey, &seed); err != nil {
+			return nil, err
+		}
+		return x25519.NewKeyFromSeed(seed)
+	}
+
+	if k, err := x509.ParsePKCS8PrivateKey(der); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParsePKCS1PrivateKey(der); err == nil {
+		return k, nil
+	}
+	return nil, ErrUnsupportedKey
+}
+
+// MarshalPublicKey encodes a public key in the PKIX DER format
+func MarshalPublicKey(pub crypto.PublicKey) ([]byte, error) {
+	k, ok := pub.(x25519.PublicKey)
+	if !ok {
+		return x509.MarshalPKIXPublicKey(pub)
+	}
+
+	return asn1.Marshal(publicKeyInfo{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidX25519},
+		PublicKey: asn1.BitString{Bytes: k, BitLength: 8 * len(k)},
+	})
+}
+
+// ParsePublicKey decodes a PKIX DER public key, keys stored before the key
+// types were introduced are RSA keys in the PKCS #1 format
+func ParsePublicKey(der []byte) (crypto.PublicKey, error) {
+	var info publicKeyInfo
+	if rest, err := asn1.Unmarshal(der, &info); err == nil && len(rest) == 0 && info.Algorithm.Algorithm.Equal(oidX25519) {
+		if len(info.PublicKey.Bytes) != x25519.PublicKeySize {
+			return nil, ErrUnsupportedKey
+		}
+		return x25519.PublicKey(info.PublicKey.Bytes), nil
+	}
+
+	if k, err := x509.ParsePKIXPublicKey(der); err == nil {
+		return k, nil
+	}
+	if k, err := x509.ParsePKCS1PublicKey(der); err == nil {
+		return k, nil
+	}
+	return nil, ErrUnsupportedKey
+}
@@ -0,0 +1,101 @@
+package keycodec
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"reflect"
+	"testing"
+
+	"github.com/lestrrat-go/jwx/x25519"
+)
+
+type privateKey interface {
+	Public() crypto.PublicKey
+}
+
+func generateKeys(t *testing.T) map[string]privateKey {
+	t.Helper()
+	rsaKey, _ := rsa.GenerateKey(rand.Reader, 2048)
+	ecKey, _ := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	_, edKey, _ := ed25519.GenerateKey(rand.Reader)
+	_, xKey, _ := x25519.GenerateKey(rand.Reader)
+
+	return map[string]privateKey{
+		"rsa":     rsaKey,
+		"ecdsa":   ecKey,
+		"ed25519": edKey,
+		"x25519":  xKey,
+	}
+}
+
+func TestPrivateKey(t *testing.T) {
+	for name, priv := range generateKeys(t) {
+		t.Run("encodes and decodes back a "+name+" private key", func(t *testing.T) {
+			der, err := MarshalPrivateKey(priv)
+			if err != nil {
+				t.Fatalf("was expecting no error and received %v", err)
+			}
+
+			got, err := ParsePrivateKey(der)
+			if err != nil {
+				t.Fatalf("was expecting no error and received %v", err)
+			}
+			if !reflect.DeepEqual(got.(privateKey).Public(), priv.Public()) {
+				t.Errorf("got %v, want %v", got, priv)
+			}
+		})
+	}
+	t.Run("decodes legacy PKCS #1 private keys", func(t *testing.T) {
+		priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+		got, err := ParsePrivateKey(x509.MarshalPKCS1PrivateKey(priv))
+
+		if err != nil {
+			t.Fatalf("was expecting no error and received %v", err)
+		}
+		if !priv.Equal(got) {
+			t.Errorf("got %v, want %v", got, priv)
+		}
+	})
+	t.Run("refuses anything else", func(t *testing.T) {
+		if _, err := ParsePrivateKey([]byte("not a key")); err != ErrUnsupportedKey {
+			t.Errorf("was expecting %v and received %v", ErrUnsupportedKey, err)
+		}
+	})
+}
+
+func TestPublicKey(t *testing.T) {
+	for name, priv := range generateKeys(t) {
+		t.Run("encodes and decodes back a "+name+" public key", func(t *testing.T) {
+			der, err := MarshalPublicKey(priv.Public())
+			if err != nil {
+				t.Fatalf("was expecting no error and received %v", err)
+			}
+
+			got, err := ParsePublicKey(der)
+			if err != nil {
+				t.Fatalf("was expecting no error and received %v", err)
+			}
+			if !reflect.DeepEqual(got, priv.Public()) {
+				t.Errorf("got %v, want %v", got, priv.Public())
+			}
+		})
+	}
+	t.Run("decodes legacy PKCS #1 public keys", func(t *testing.T) {
+		priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+
+		got, err := ParsePublicKey(x509.MarshalPKCS1PublicKey(&priv.PublicKey))
+
+		if err != nil {
+			t.Fatalf("was expecting no error and received %v", err)
+		}
+		if !priv.PublicKey.Equal(got) {
+			t.Errorf("got %v, want %v", got, priv.PublicKey)
+		}
+	})
+}
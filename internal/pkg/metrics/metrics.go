@@ -0,0 +1,147 @@
+// Package metrics keeps the prometheus collectors of the service, exposed on
+// its own registry by Handler: the HTTP requests per route template, the
+// crypto operations per scope and outcome, the key pools, the postgres query
+// latency, and the go runtime and process metrics. A pool depth at zero, or a
+// growing miss count, means the key pool ran dry
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "gocrypto"
+
+// Outcomes of the crypto operations
+const (
+	OutcomeSuccess = "success"
+	OutcomeFailure = "failure"
+)
+
+// UnresolvedScope scope label of the crypto operations failing before the key
+// is found within the scope, the scopes sent by the clients are not labels
+// until they are known to exist
+const UnresolvedScope = "unresolved"
+
+var (
+	// Registry every collector of the service, the go runtime and process
+	// collectors included
+	Registry = prometheus.NewRegistry()
+
+	httpRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests served, per route, method and status.",
+	}, []string{"route", "method", "status"})
+	httpDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Latency of the HTTP requests, per route, method and status.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "status"})
+	cryptoOperations = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "crypto_operations_total",
+		Help:      "Encryption and decryption operations, per operation, scope and outcome.",
+	}, []string{"operation", "scope", "outcome"})
+	poolDepth = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Namespace: namespace,
+		Name:      "keysource_pool_depth",
+		Help:      "Pre-generated keys waiting in the pool, per key type.",
+	}, []string{"key_type"})
+	poolMisses = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keysource_pool_misses_total",
+		Help:      "Keys taken while the pool was empty and generated on the request, per key type.",
+	}, []string{"key_type"})
+	keyGenerationErrors = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "keysource_generation_errors_total",
+		Help:      "Key generations that failed, per key type.",
+	}, []string{"key_type"})
+	keyGeneration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "keysource_generation_duration_seconds",
+		Help:      "Time spent generating a key, per key type.",
+		Buckets:   prometheus.ExponentialBuckets(0.001, 2.5, 12),
+	}, []string{"key_type"})
+	dbQueries = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_query_duration_seconds",
+		Help:      "Latency of the SQL key repository queries, per query.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"query"})
+)
+
+func init() {
+	Registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		httpRequests,
+		httpDuration,
+		cryptoOperations,
+		poolDepth,
+		poolMisses,
+		keyGenerationErrors,
+		keyGeneration,
+		dbQueries,
+	)
+}
+
+// Handler serves the collectors of the Registry in the prometheus format, on
+// a listener kept reachable by the scrapers only since the metrics name the
+// scopes
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveRequest counts a served request and its latency, route is the
+// template of the route, not the path, so the key ids do not become labels
+func ObserveRequest(route string, method string, status int, d time.Duration) {
+	code := strconv.Itoa(status)
+	httpRequests.WithLabelValues(route, method, code).Inc()
+	httpDuration.WithLabelValues(route, method, code).Observe(d.Seconds())
+}
+
+// CountOperation counts a crypto operation on the scope of the key, any error
+// is a failure and an empty scope is counted as UnresolvedScope
+func CountOperation(operation string, scope string, err error) {
+	outcome := OutcomeSuccess
+	if err != nil {
+		outcome = OutcomeFailure
+	}
+	if scope == "" {
+		scope = UnresolvedScope
+	}
+	cryptoOperations.WithLabelValues(operation, scope, outcome).Inc()
+}
+
+// SetPoolDepth records how many keys of the type are waiting in the pool
+func SetPoolDepth(keyType string, depth int) {
+	poolDepth.WithLabelValues(keyType).Set(float64(depth))
+}
+
+// CountPoolMiss counts a key generated on the request as the pool was empty
+func CountPoolMiss(keyType string) {
+	poolMisses.WithLabelValues(keyType).Inc()
+}
+
+// CountKeyGenerationError counts a failed generation of a key of the type
+func CountKeyGenerationError(keyType string) {
+	keyGenerationErrors.WithLabelValues(keyType).Inc()
+}
+
+// ObserveKeyGeneration records the time spent generating a key of the type
+func ObserveKeyGeneration(keyType string, start time.Time) {
+	keyGeneration.WithLabelValues(keyType).Observe(time.Since(start).Seconds())
+}
+
+// ObserveQuery records the latency of a query started at start, meant to be
+// deferred
+func ObserveQuery(query string, start time.Time) {
+	dbQueries.WithLabelValues(query).Observe(time.Since(start).Seconds())
+}
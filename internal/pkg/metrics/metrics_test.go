@@ -0,0 +1,73 @@
+package metrics
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestObserveRequest(t *testing.T) {
+	ObserveRequest("/keys/{keyID}", http.MethodGet, http.StatusNotFound, time.Millisecond)
+	ObserveRequest("/keys/{keyID}", http.MethodGet, http.StatusNotFound, time.Millisecond)
+
+	assertCount(t, testutil.ToFloat64(httpRequests.WithLabelValues("/keys/{keyID}", http.MethodGet, "404")), 2)
+	if n := testutil.CollectAndCount(httpDuration); n != 1 {
+		t.Errorf("want a single latency series, got %d", n)
+	}
+}
+
+func TestCountOperation(t *testing.T) {
+	CountOperation("encrypt", "scope", nil)
+	CountOperation("encrypt", "scope", errors.New("some error"))
+	CountOperation("encrypt", "scope", errors.New("some error"))
+
+	assertCount(t, testutil.ToFloat64(cryptoOperations.WithLabelValues("encrypt", "scope", OutcomeSuccess)), 1)
+	assertCount(t, testutil.ToFloat64(cryptoOperations.WithLabelValues("encrypt", "scope", OutcomeFailure)), 2)
+
+	CountOperation("decrypt", "", errors.New("some error"))
+
+	assertCount(t, testutil.ToFloat64(cryptoOperations.WithLabelValues("decrypt", UnresolvedScope, OutcomeFailure)), 1)
+}
+
+func TestKeySource(t *testing.T) {
+	SetPoolDepth("RSA-2048", 3)
+	SetPoolDepth("RSA-2048", 2)
+	CountPoolMiss("P-256")
+	CountKeyGenerationError("X25519")
+
+	assertCount(t, testutil.ToFloat64(poolDepth.WithLabelValues("RSA-2048")), 2)
+	assertCount(t, testutil.ToFloat64(poolMisses.WithLabelValues("P-256")), 1)
+	assertCount(t, testutil.ToFloat64(keyGenerationErrors.WithLabelValues("X25519")), 1)
+}
+
+func TestHandler(t *testing.T) {
+	ObserveKeyGeneration("Ed25519", time.Now())
+	ObserveQuery("find_key", time.Now())
+	request := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	response := httptest.NewRecorder()
+
+	Handler().ServeHTTP(response, request)
+
+	body := response.Body.String()
+	for _, want := range []string{
+		`gocrypto_keysource_generation_duration_seconds_count{key_type="Ed25519"} 1`,
+		`gocrypto_db_query_duration_seconds_count{query="find_key"} 1`,
+		"go_goroutines",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("want %q in the metrics", want)
+		}
+	}
+}
+
+func assertCount(t *testing.T, got, want float64) {
+	t.Helper()
+	if got != want {
+		t.Errorf("want %v, got %v", want, got)
+	}
+}
@@ -0,0 +1,209 @@
+// Package stream encrypts payloads of any length as a sequence of AES-256-GCM
+// authenticated chunks, so neither side ever holds more than a chunk in memory
+package stream
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+	"io"
+)
+
+const (
+	// KeySize size of the data keys, AES-256
+	KeySize = 32
+	// ChunkSize most plaintext bytes sealed in a single chunk
+	ChunkSize = 64 * 1024
+)
+
+var (
+	// ErrInvalidKey the data key is not a valid AES-256 key
+	ErrInvalidKey = errors.New("stream: data keys must have 32 bytes")
+	// ErrCorrupted a chunk failed authentication, was reordered or is malformed
+	ErrCorrupted = errors.New("stream: corrupted ciphertext")
+	// ErrTruncated the ciphertext ended before its last chunk
+	ErrTruncated = errors.New("stream: truncated ciphertext")
+)
+
+// frameHeaderSize every chunk is framed by its last chunk flag and the
+// length of its ciphertext
+const frameHeaderSize = 1 + 4
+
+// nonce the nonce of a chunk is its big endian counter followed by the last
+// chunk flag, data keys are never reused so the nonces never repeat, and
+// chunks can not be reordered, dropped or presented as the last one
+func nonce(counter uint64, last bool) []byte {
+	n := make([]byte, 12)
+	binary.BigEndian.PutUint64(n[3:11], counter)
+	if last {
+		n[11] = 1
+	}
+	return n
+}
+
+func newAEAD(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, ErrInvalidKey
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// Writer seals what is written to it, Close must be called to seal the last
+// chunk
+type Writer struct {
+	w       io.Writer
+	aead    cipher.AEAD
+	buf     []byte
+	frame   []byte
+	counter uint64
+	closed  bool
+}
+
+// NewWriter returns a Writer sealing the plaintext with the data key into w
+func NewWriter(w io.Writer, key []byte) (*Writer, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Writer{
+		w:     w,
+		aead:  aead,
+		buf:   make([]byte, 0, ChunkSize),
+		frame: make([]byte, frameHeaderSize+ChunkSize+aead.Overhead()),
+	}, nil
+}
+
+// Write buffers the plaintext, full chunks are only sealed once more
+// plaintext arrives, as the last chunk has to be flagged as such
+func (s *Writer) Write(p []byte) (int, error) {
+	if s.closed {
+		return 0, errors.New("stream: write on a closed writer")
+	}
+
+	n := 0
+	for len(p) > 0 {
+		if len(s.buf) == ChunkSize {
+			if err := s.seal(false); err != nil {
+				return n, err
+			}
+		}
+		c := copy(s.buf[len(s.buf):ChunkSize], p)
+		s.buf = s.buf[:len(s.buf)+c]
+		p = p[c:]
+		n += c
+	}
+	return n, nil
+}
+
+// Close seals the last chunk, an empty one when nothing is buffered
+func (s *Writer) Close() error {
+	if s.closed {
+		return nil
+	}
+	s.closed = true
+	return s.seal(true)
+}
+
+func (s *Writer) seal(last bool) error {
+	frame := s.frame[:frameHeaderSize]
+	frame[0] = 0
+	if last {
+		frame[0] = 1
+	}
+	frame = s.aead.Seal(frame, nonce(s.counter, last), s.buf, nil)
+	binary.BigEndian.PutUint32(frame[1:frameHeaderSize], uint32(len(frame)-frameHeaderSize))
+
+	if _, err := s.w.Write(frame); err != nil {
+		return err
+	}
+	s.counter++
+	s.buf = s.buf[:0]
+	return nil
+}
+
+// Reader opens the chunks read from the ciphertext, a chunk is only released
+// once authenticated and the end of the plaintext is only reported after the
+// last chunk
+type Reader struct {
+	r       io.Reader
+	aead    cipher.AEAD
+	frame   []byte
+	plain   []byte
+	counter uint64
+	done    bool
+	err     error
+}
+
+// NewReader returns a Reader opening the ciphertext read from r with the
+// data key
+func NewReader(r io.Reader, key []byte) (*Reader, error) {
+	aead, err := newAEAD(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Reader{r: r, aead: aead, frame: make([]byte, ChunkSize+aead.Overhead())}, nil
+}
+
+// Read releases the plaintext of the authenticated chunks
+func (s *Reader) Read(p []byte) (int, error) {
+	for len(s.plain) == 0 {
+		if s.err != nil {
+			return 0, s.err
+		}
+		if s.done {
+			return 0, io.EOF
+		}
+		s.err = s.open()
+	}
+
+	n := copy(p, s.plain)
+	s.plain = s.plain[n:]
+	return n, nil
+}
+
+func (s *Reader) open() error {
+	var header [frameHeaderSize]byte
+	if _, err := io.ReadFull(s.r, header[:]); err != nil {
+		return truncated(err)
+	}
+
+	last := header[0] == 1
+	size := binary.BigEndian.Uint32(header[1:])
+	if header[0] > 1 || size < uint32(s.aead.Overhead()) || size > uint32(len(s.frame)) {
+		return ErrCorrupted
+	}
+
+	frame := s.frame[:size]
+	if _, err := io.ReadFull(s.r, frame); err != nil {
+		return truncated(err)
+	}
+
+	plain, err := s.aead.Open(frame[:0], nonce(s.counter, last), frame, nil)
+	if err != nil {
+		return ErrCorrupted
+	}
+	if last {
+		// anything after the last chunk was not produced by a Writer
+		var extra [1]byte
+		if n, _ := s.r.Read(extra[:]); n > 0 {
+			return ErrCorrupted
+		}
+		s.done = true
+	}
+
+	s.counter++
+	s.plain = plain
+	return nil
+}
+
+func truncated(err error) error {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return ErrTruncated
+	}
+	return err
+}
@@ -0,0 +1,132 @@
+package stream
+
+import (
+	"bytes"
+	"crypto/rand"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func newKey(t *testing.T) []byte {
+	t.Helper()
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		t.Fatal(err)
+	}
+	return key
+}
+
+func seal(t *testing.T, key, plain []byte) []byte {
+	t.Helper()
+	var sealed bytes.Buffer
+	w, err := NewWriter(&sealed, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// odd sized writes cross the chunk boundaries
+	for len(plain) > 0 {
+		n := 1000
+		if n > len(plain) {
+			n = len(plain)
+		}
+		if _, err := w.Write(plain[:n]); err != nil {
+			t.Fatal(err)
+		}
+		plain = plain[n:]
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return sealed.Bytes()
+}
+
+func open(key, sealed []byte) ([]byte, error) {
+	r, err := NewReader(bytes.NewReader(sealed), key)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(r)
+}
+
+func TestRoundTrip(t *testing.T) {
+	key := newKey(t)
+	for _, size := range []int{0, 1, ChunkSize - 1, ChunkSize, ChunkSize + 1, 3*ChunkSize + 17} {
+		plain := make([]byte, size)
+		rand.Read(plain)
+
+		got, err := open(key, seal(t, key, plain))
+
+		if err != nil {
+			t.Fatalf("%d bytes: %v", size, err)
+		}
+		if !bytes.Equal(got, plain) {
+			t.Errorf("%d bytes: the plaintext did not round trip", size)
+		}
+	}
+}
+
+func TestTampering(t *testing.T) {
+	key := newKey(t)
+	plain := make([]byte, 2*ChunkSize+10)
+	sealed := seal(t, key, plain)
+	chunk := frameHeaderSize + ChunkSize + 16
+
+	tests := []struct {
+		name   string
+		sealed []byte
+		want   error
+	}{
+		{"a flipped bit", flip(sealed, chunk+100), ErrCorrupted},
+		{"the last chunk dropped", sealed[:2*chunk], ErrTruncated},
+		{"a chunk cut short", sealed[:chunk+50], ErrTruncated},
+		{"the chunks reordered", append(append(append([]byte{}, sealed[chunk:2*chunk]...), sealed[:chunk]...), sealed[2*chunk:]...), ErrCorrupted},
+		{"a chunk flagged as the last one", flip(sealed[:chunk], 0), ErrCorrupted},
+		{"data after the last chunk", append(append([]byte{}, sealed...), 0), ErrCorrupted},
+		{"an oversized frame", []byte{0, 0xff, 0xff, 0xff, 0xff}, ErrCorrupted},
+	}
+	for _, tt := range tests {
+		t.Run("refuses "+tt.name, func(t *testing.T) {
+			_, err := open(key, tt.sealed)
+
+			if err != tt.want {
+				t.Errorf("want %v, got %v", tt.want, err)
+			}
+		})
+	}
+	t.Run("refuses another data key", func(t *testing.T) {
+		_, err := open(newKey(t), sealed)
+
+		if err != ErrCorrupted {
+			t.Errorf("want %v, got %v", ErrCorrupted, err)
+		}
+	})
+	t.Run("refuses invalid data keys", func(t *testing.T) {
+		if _, err := NewWriter(ioutil.Discard, key[:16]); err != ErrInvalidKey {
+			t.Errorf("want %v, got %v", ErrInvalidKey, err)
+		}
+		if _, err := NewReader(bytes.NewReader(sealed), nil); err != ErrInvalidKey {
+			t.Errorf("want %v, got %v", ErrInvalidKey, err)
+		}
+	})
+}
+
+func TestReaderReleasesAuthenticatedChunks(t *testing.T) {
+	key := newKey(t)
+	plain := make([]byte, 2*ChunkSize)
+	sealed := seal(t, key, plain)
+	chunk := frameHeaderSize + ChunkSize + 16
+
+	r, _ := NewReader(bytes.NewReader(flip(sealed, chunk+100)), key)
+	n, err := io.Copy(ioutil.Discard, r)
+
+	if n != ChunkSize || err != ErrCorrupted {
+		t.Errorf("want the first chunk and %v, got %d bytes and %v", ErrCorrupted, n, err)
+	}
+}
+
+func flip(b []byte, i int) []byte {
+	c := append([]byte{}, b...)
+	c[i] ^= 1
+	return c
+}